@@ -0,0 +1,59 @@
+package acl
+
+import (
+	"github.com/SeraphJACK/go-annil/storage"
+	"path"
+)
+
+// Policy decides which catalogs of which backends a user may access.
+type Policy struct {
+	restricted bool
+	rules      []storage.AccessRule
+}
+
+// ForUser builds the policy of username from the access rules of its groups.
+// Users who belong to no group are not restricted.
+func ForUser(s storage.Store, username string) (Policy, error) {
+	groups, err := s.UserGroups(username)
+	if err != nil {
+		return Policy{}, err
+	}
+	if len(groups) == 0 {
+		return Policy{}, nil
+	}
+	rules, err := s.UserAccessRules(username)
+	if err != nil {
+		return Policy{}, err
+	}
+	return Policy{restricted: true, rules: rules}, nil
+}
+
+func (p Policy) Allow(backend, catalog string) bool {
+	if !p.restricted {
+		return true
+	}
+	for _, r := range p.rules {
+		if Match(r, backend, catalog) {
+			return true
+		}
+	}
+	return false
+}
+
+// Match reports whether rule covers catalog served by backend.
+func Match(rule storage.AccessRule, backend, catalog string) bool {
+	if rule.Backend != "" && rule.Backend != "*" && rule.Backend != backend {
+		return false
+	}
+	if rule.Pattern == "" {
+		return true
+	}
+	ok, err := path.Match(rule.Pattern, catalog)
+	return err == nil && ok
+}
+
+// ValidPattern reports whether pattern is a well-formed catalog pattern.
+func ValidPattern(pattern string) bool {
+	_, err := path.Match(pattern, "")
+	return err == nil
+}
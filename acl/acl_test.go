@@ -0,0 +1,61 @@
+package acl
+
+import (
+	"errors"
+	"github.com/SeraphJACK/go-annil/storage"
+	"testing"
+)
+
+func TestPolicy(t *testing.T) {
+	p := Policy{
+		restricted: true,
+		rules: []storage.AccessRule{
+			{Group: "guests", Backend: "friend", Pattern: "LACA-*"},
+			{Group: "guests", Backend: "*", Pattern: "KICA-1234"},
+		},
+	}
+	cases := []struct {
+		backend, catalog string
+		allow            bool
+	}{
+		{"friend", "LACA-12345", true},
+		{"local", "LACA-12345", false},
+		{"local", "KICA-1234", true},
+		{"friend", "KICA-1235", false},
+	}
+	for _, c := range cases {
+		if p.Allow(c.backend, c.catalog) != c.allow {
+			t.Errorf("wrong result for %s/%s", c.backend, c.catalog)
+		}
+	}
+	if !(Policy{}).Allow("any", "thing") {
+		t.Errorf("unrestricted policy denied access")
+	}
+	if ValidPattern("[") {
+		t.Errorf("malformed pattern accepted")
+	}
+}
+
+// brokenStore fails to read group memberships.
+type brokenStore struct {
+	storage.Store
+}
+
+func (brokenStore) UserGroups(string) ([]string, error) {
+	return nil, errors.New("database is locked")
+}
+
+func TestForUser(t *testing.T) {
+	s := storage.NewMemoryStore()
+	if p, err := ForUser(s, "alice"); err != nil || !p.Allow("any", "thing") {
+		t.Errorf("user without groups is restricted: %v", err)
+	}
+	_ = s.NewGroup("guests")
+	_ = s.AddGroupMember("guests", "alice")
+	if p, err := ForUser(s, "alice"); err != nil || p.Allow("any", "thing") {
+		t.Errorf("group member without rules is allowed: %v", err)
+	}
+	if _, err := ForUser(brokenStore{s}, "alice"); err == nil {
+		t.Errorf("failed store produced a policy")
+	}
+}
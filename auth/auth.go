@@ -0,0 +1,154 @@
+// Package auth checks passwords against local accounts and external directories.
+package auth
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"github.com/SeraphJACK/go-annil/logging"
+	"github.com/SeraphJACK/go-annil/storage"
+)
+
+var (
+	ErrUnknownUser   = errors.New("unknown user")
+	ErrWrongPassword = errors.New("wrong password")
+	// ErrNotLinked is returned when a provider accepts a user whose name is taken by an account
+	// the provider does not own
+	ErrNotLinked = errors.New("account is not linked to the provider")
+)
+
+// User is a user whose password was accepted by a provider.
+type User struct {
+	Username string
+	// Identity of the user at an external provider, which owns the account linked to it.
+	// Empty for local accounts.
+	Subject string
+	// Role mapped from the groups of the user, applied at every login unless empty
+	Role string
+	// Role given when the user is created in the store
+	DefaultRole string
+}
+
+// Provider checks the password of a user.
+type Provider interface {
+	Name() string
+	// Authenticate returns ErrUnknownUser if the provider does not know username and
+	// ErrWrongPassword if it rejects password. Other errors mean it could not tell.
+	Authenticate(username, password string) (User, error)
+}
+
+// Local checks passwords of the accounts in a store.
+type Local struct {
+	store storage.Store
+}
+
+func NewLocal(store storage.Store) *Local {
+	return &Local{store: store}
+}
+
+func (l *Local) Name() string {
+	return "local"
+}
+
+func (l *Local) Authenticate(username, password string) (User, error) {
+	if !l.store.UserExists(username) {
+		return User{}, ErrUnknownUser
+	}
+	if !l.store.CheckPassword(username, password) {
+		return User{}, ErrWrongPassword
+	}
+	return User{Username: username}, nil
+}
+
+// Authenticator asks its providers in order until one knows the user.
+// Users of external providers are created in the store on their first login.
+type Authenticator struct {
+	store     storage.Store
+	providers []Provider
+	// Ask the next provider when one cannot be reached, instead of rejecting the login
+	skipUnavailable bool
+}
+
+func New(store storage.Store, skipUnavailable bool, providers ...Provider) *Authenticator {
+	return &Authenticator{store: store, providers: providers, skipUnavailable: skipUnavailable}
+}
+
+// Authenticate returns the name of the user in the store, which may differ from username in case.
+// A provider accepting a user whose account it does not own is skipped as if it did not know the user.
+func (a *Authenticator) Authenticate(username, password string) (string, error) {
+	for _, p := range a.providers {
+		u, err := p.Authenticate(username, password)
+		if err == nil {
+			var name string
+			name, err = a.sync(p, u)
+			if err == nil {
+				return name, nil
+			}
+			if errors.Is(err, ErrNotLinked) {
+				logging.Default().Warn("Refused login of an unlinked account", "provider", p.Name(), "subject", u.Subject, "err", err)
+				continue
+			}
+			return "", err
+		}
+		switch {
+		case errors.Is(err, ErrUnknownUser):
+			continue
+		case errors.Is(err, ErrWrongPassword):
+			return "", err
+		default:
+			logging.Default().Error("Failed to authenticate", "username", username, "provider", p.Name(), "err", err)
+			if !a.skipUnavailable {
+				return "", err
+			}
+		}
+	}
+	return "", ErrWrongPassword
+}
+
+// sync returns the account of u, which external providers own through an identity linked to it.
+// Accounts are created for users of external providers on their first login, unless the name is
+// taken by another account, and their role is updated.
+func (a *Authenticator) sync(p Provider, u User) (string, error) {
+	if u.Subject == "" {
+		return u.Username, nil
+	}
+	name, err := a.store.IdentityUser(p.Name(), u.Subject)
+	if err != nil {
+		if a.store.UserExists(u.Username) {
+			return "", ErrNotLinked
+		}
+		if !storage.NameExp.MatchString(u.Username) {
+			return "", fmt.Errorf("%w: %q is not a valid username", ErrNotLinked, u.Username)
+		}
+		if err = a.provision(p, u); err != nil {
+			return "", err
+		}
+		name = u.Username
+		if u.Role == "" {
+			u.Role = u.DefaultRole
+		}
+	}
+	if u.Role == "" || a.store.UserRole(name) == u.Role || a.store.UserRole(name) == storage.RoleOwner {
+		return name, nil
+	}
+	if !a.store.RoleExists(u.Role) {
+		logging.Default().Warn("Failed to apply role, it does not exist", "username", name, "role", u.Role)
+		return name, nil
+	}
+	return name, a.store.SetRole(name, u.Role)
+}
+
+// provision creates the account of u and links it to its identity at p.
+func (a *Authenticator) provision(p Provider, u User) error {
+	// The local password is never handed out, the user logs in through its provider
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return err
+	}
+	err := storage.ProvisionUser(a.store, u.Username, base64.RawURLEncoding.EncodeToString(b), "", p.Name(), u.Subject)
+	if err != nil {
+		return fmt.Errorf("failed to provision %s: %v", u.Username, err)
+	}
+	return nil
+}
@@ -0,0 +1,131 @@
+package auth
+
+import (
+	"github.com/SeraphJACK/go-annil/config"
+	"github.com/SeraphJACK/go-annil/ldap/ldaptest"
+	"github.com/SeraphJACK/go-annil/storage"
+	"testing"
+)
+
+func newDirectory(t *testing.T) (*ldaptest.Server, config.LDAPConfig) {
+	srv, err := ldaptest.NewServer()
+	if err != nil {
+		t.Fatalf("failed to start directory: %v", err)
+	}
+	srv.Add("cn=annil,dc=example", "service", nil)
+	srv.Add("uid=alice,ou=people,dc=example", "alice-pw", map[string][]string{
+		"objectClass": {"person"},
+		"uid":         {"alice"},
+		"memberOf":    {"cn=staff,ou=groups,dc=example"},
+	})
+	srv.Add("uid=bob,ou=people,dc=example", "bob-pw", map[string][]string{"objectClass": {"person"}, "uid": {"bob"}})
+	// Directory users named like local accounts
+	srv.Add("uid=Admin,ou=people,dc=example", "evil", map[string][]string{"objectClass": {"person"}, "uid": {"Admin"}})
+	srv.Add("uid=bad,ou=people,dc=example", "bad-pw", map[string][]string{"objectClass": {"person"}, "uid": {"bad name"}})
+	srv.Add("cn=admins,ou=groups,dc=example", "", map[string][]string{"member": {"uid=bob,ou=people,dc=example"}})
+	return srv, config.LDAPConfig{
+		Enabled:           true,
+		URL:               srv.URL(),
+		BindDN:            "cn=annil,dc=example",
+		BindPassword:      "service",
+		BaseDN:            "ou=people,dc=example",
+		UserFilter:        "(&(objectClass=person)(uid={username}))",
+		UsernameAttribute: "uid",
+		GroupAttribute:    "memberOf",
+		GroupBaseDN:       "ou=groups,dc=example",
+		GroupFilter:       "(member={dn})",
+		DefaultRole:       storage.RoleGuest,
+		GroupRoles: []config.GroupRole{
+			{Group: "admins", Role: storage.RoleAdmin},
+			{Group: "cn=staff,ou=groups,dc=example", Role: storage.RoleMember},
+		},
+		Timeout: 5,
+	}
+}
+
+func TestLDAP(t *testing.T) {
+	srv, cfg := newDirectory(t)
+	defer srv.Close()
+	store := storage.NewMemoryStore()
+	if err := storage.CreateOwner(store, "Admin", "12345", false); err != nil {
+		t.Fatalf("failed to create owner: %v", err)
+	}
+	a := New(store, false, NewLDAP(cfg), NewLocal(store))
+
+	if _, err := a.Authenticate("alice", "wrong"); err != ErrWrongPassword {
+		t.Errorf("wrong password accepted: %v", err)
+	}
+	if _, err := a.Authenticate("alice", ""); err != ErrWrongPassword {
+		t.Errorf("empty password accepted: %v", err)
+	}
+	name, err := a.Authenticate("ALICE", "alice-pw")
+	if err != nil || name != "alice" {
+		t.Fatalf("failed to authenticate: %s %v", name, err)
+	}
+	if store.UserRole("alice") != storage.RoleMember {
+		t.Errorf("memberOf group not mapped: %s", store.UserRole("alice"))
+	}
+	if _, err = a.Authenticate("bob", "bob-pw"); err != nil || store.UserRole("bob") != storage.RoleAdmin {
+		t.Errorf("searched group not mapped: %v %s", err, store.UserRole("bob"))
+	}
+	if ids := store.UserIdentities("alice"); len(ids) != 1 || ids[0].Issuer != LDAPIssuer || ids[0].Subject != "alice" {
+		t.Errorf("provisioned account not linked: %v", ids)
+	}
+	// Local accounts are checked for users unknown to the directory
+	_ = store.Register("dave", "dave-pw")
+	if name, err = a.Authenticate("dave", "dave-pw"); err != nil || name != "dave" {
+		t.Errorf("failed to fall back to local account: %v", err)
+	}
+	if _, err = a.Authenticate("carol", "x"); err != ErrWrongPassword {
+		t.Errorf("unknown user accepted: %v", err)
+	}
+
+	// The directory can't log in as accounts it does not own
+	if name, err = a.Authenticate("Admin", "evil"); err != ErrWrongPassword {
+		t.Errorf("directory user took over a local account: %s %v", name, err)
+	}
+	if _, err = a.Authenticate("bad", "bad-pw"); err != ErrWrongPassword || store.UserExists("bad name") {
+		t.Errorf("invalid username provisioned: %v", err)
+	}
+	if err = store.LinkIdentity(LDAPIssuer, "Admin", "Admin"); err != nil {
+		t.Fatalf("failed to link: %v", err)
+	}
+	if name, err = a.Authenticate("Admin", "evil"); err != nil || name != "Admin" || store.UserRole("Admin") != storage.RoleOwner {
+		t.Errorf("linked account failed to log in: %s %v", name, err)
+	}
+	_ = store.UnlinkIdentity(LDAPIssuer, "Admin")
+
+	// Without a fallback local passwords are never checked
+	a = New(store, false, NewLDAP(cfg))
+	if _, err = a.Authenticate("Admin", "12345"); err != ErrWrongPassword {
+		t.Errorf("local account accepted without fallback: %v", err)
+	}
+
+	srv.Close()
+	a = New(store, false, NewLDAP(cfg), NewLocal(store))
+	if _, err = a.Authenticate("Admin", "12345"); err == nil || err == ErrWrongPassword {
+		t.Errorf("unreachable directory not reported: %v", err)
+	}
+	a = New(store, true, NewLDAP(cfg), NewLocal(store))
+	if _, err = a.Authenticate("Admin", "12345"); err != nil {
+		t.Errorf("failed to fall back while directory is unreachable: %v", err)
+	}
+}
+
+func TestLDAPStartTLS(t *testing.T) {
+	srv, cfg := newDirectory(t)
+	defer srv.Close()
+	roots, err := srv.EnableStartTLS()
+	if err != nil {
+		t.Fatalf("failed to enable starttls: %v", err)
+	}
+	cfg.StartTLS = true
+	l := NewLDAP(cfg)
+	if _, err = l.Authenticate("alice", "alice-pw"); err == nil {
+		t.Errorf("directory with an unknown certificate trusted")
+	}
+	l.roots = roots
+	if u, err := l.Authenticate("alice", "alice-pw"); err != nil || u.Username != "alice" || !srv.Upgraded() {
+		t.Errorf("failed to authenticate over starttls: %v", err)
+	}
+}
@@ -0,0 +1,138 @@
+package auth
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"github.com/SeraphJACK/go-annil/config"
+	"github.com/SeraphJACK/go-annil/ldap"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// LDAP checks passwords by searching for the user with a service account and binding as it.
+type LDAP struct {
+	cfg config.LDAPConfig
+	// Certificates the directory is verified with, the system ones if nil
+	roots *x509.CertPool
+}
+
+func NewLDAP(cfg config.LDAPConfig) *LDAP {
+	return &LDAP{cfg: cfg}
+}
+
+// LDAPIssuer is the issuer of identities of directory users, which link them to their accounts.
+const LDAPIssuer = "ldap"
+
+func (l *LDAP) Name() string {
+	return LDAPIssuer
+}
+
+func (l *LDAP) Authenticate(username, password string) (User, error) {
+	// Directories accept an empty password as an unauthenticated bind
+	if password == "" {
+		return User{}, ErrWrongPassword
+	}
+	conn, err := l.dial()
+	if err != nil {
+		return User{}, err
+	}
+	defer conn.Close()
+	if err = l.bindService(conn); err != nil {
+		return User{}, err
+	}
+
+	filter := strings.ReplaceAll(l.cfg.UserFilter, "{username}", ldap.EscapeFilter(username))
+	entries, err := conn.Search(l.cfg.BaseDN, filter, []string{l.cfg.UsernameAttribute, l.cfg.GroupAttribute})
+	if err != nil {
+		return User{}, fmt.Errorf("failed to search for user: %v", err)
+	}
+	if len(entries) == 0 {
+		return User{}, ErrUnknownUser
+	}
+	if len(entries) > 1 {
+		return User{}, fmt.Errorf("%d entries match %s", len(entries), filter)
+	}
+	entry := entries[0]
+	err = conn.Bind(entry.DN, password)
+	if ldap.IsInvalidCredentials(err) {
+		return User{}, ErrWrongPassword
+	} else if err != nil {
+		return User{}, err
+	}
+
+	groups := entry.Values(l.cfg.GroupAttribute)
+	if l.cfg.GroupFilter != "" {
+		// Groups are searched as the service account, users may not be allowed to
+		if err = l.bindService(conn); err != nil {
+			return User{}, err
+		}
+		base := l.cfg.GroupBaseDN
+		if base == "" {
+			base = l.cfg.BaseDN
+		}
+		filter = strings.ReplaceAll(l.cfg.GroupFilter, "{dn}", ldap.EscapeFilter(entry.DN))
+		found, err := conn.Search(base, filter, []string{"cn"})
+		if err != nil {
+			return User{}, fmt.Errorf("failed to search for groups: %v", err)
+		}
+		for _, g := range found {
+			groups = append(groups, g.DN)
+		}
+	}
+
+	u := User{Username: entry.Value(l.cfg.UsernameAttribute), DefaultRole: l.cfg.DefaultRole}
+	if u.Username == "" {
+		u.Username = username
+	}
+	// Linked accounts are found by the name in the directory, whatever case it was typed in
+	u.Subject = u.Username
+	for _, gr := range l.cfg.GroupRoles {
+		if u.Role == "" && memberOf(groups, gr.Group) {
+			u.Role = gr.Role
+		}
+	}
+	return u, nil
+}
+
+// dial connects to the directory, upgrading plain connections with StartTLS if configured.
+func (l *LDAP) dial() (*ldap.Conn, error) {
+	conn, err := ldap.Dial(l.cfg.URL, time.Duration(l.cfg.Timeout)*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	if l.cfg.StartTLS && strings.HasPrefix(l.cfg.URL, "ldap://") {
+		u, _ := url.Parse(l.cfg.URL)
+		if err = conn.StartTLS(&tls.Config{ServerName: u.Hostname(), RootCAs: l.roots}); err != nil {
+			_ = conn.Close()
+			return nil, fmt.Errorf("failed to start tls: %v", err)
+		}
+	}
+	return conn, nil
+}
+
+func (l *LDAP) bindService(conn *ldap.Conn) error {
+	if l.cfg.BindDN == "" {
+		return nil
+	}
+	err := conn.Bind(l.cfg.BindDN, l.cfg.BindPassword)
+	if err != nil {
+		return fmt.Errorf("failed to bind as service account: %v", err)
+	}
+	return nil
+}
+
+// memberOf reports whether one of the group DNs is group, given as DN or by the value of its first RDN.
+func memberOf(groups []string, group string) bool {
+	for _, dn := range groups {
+		if strings.EqualFold(dn, group) {
+			return true
+		}
+		rdn := strings.SplitN(dn, ",", 2)[0]
+		if i := strings.IndexByte(rdn, '='); i >= 0 && strings.EqualFold(rdn[i+1:], group) {
+			return true
+		}
+	}
+	return false
+}
@@ -1,9 +1,14 @@
 package backend
 
 import (
+	"context"
+	"errors"
 	"io"
 )
 
+// ErrNotFound is returned by backends which do not have a cover or track.
+var ErrNotFound = errors.New("not found")
+
 type AudioType uint8
 
 const (
@@ -12,8 +17,9 @@ const (
 	UNKNOWN AudioType = 2
 )
 
+// Backend serves a library. The context carries the request being served, such as its request id.
 type Backend interface {
-	ListCatalogs() []string
-	GetCover(catalog string) (io.ReadCloser, error)
-	GetAudio(catalog string, track uint8) (AudioType, io.ReadCloser, error)
+	ListCatalogs(ctx context.Context) []string
+	GetCover(ctx context.Context, catalog string) (io.ReadCloser, error)
+	GetAudio(ctx context.Context, catalog string, track uint8) (AudioType, io.ReadCloser, error)
 }
@@ -0,0 +1,57 @@
+package backend
+
+import (
+	"container/list"
+	"sync"
+)
+
+// coverCache keeps recently used covers in memory, evicting the least recently used ones
+// once they take up more than max bytes.
+type coverCache struct {
+	mu    sync.Mutex
+	max   int64
+	size  int64
+	order *list.List
+	items map[string]*list.Element
+}
+
+type cachedCover struct {
+	catalog string
+	data    []byte
+}
+
+func newCoverCache(max int64) *coverCache {
+	return &coverCache{max: max, order: list.New(), items: make(map[string]*list.Element)}
+}
+
+func (c *coverCache) get(catalog string) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.items[catalog]
+	if !ok {
+		return nil, false
+	}
+	c.order.MoveToFront(el)
+	return el.Value.(*cachedCover).data, true
+}
+
+func (c *coverCache) put(catalog string, data []byte) {
+	if int64(len(data)) > c.max {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.items[catalog]; ok {
+		c.size -= int64(len(el.Value.(*cachedCover).data))
+		c.order.Remove(el)
+	}
+	c.items[catalog] = c.order.PushFront(&cachedCover{catalog: catalog, data: data})
+	c.size += int64(len(data))
+	for c.size > c.max {
+		el := c.order.Back()
+		cover := el.Value.(*cachedCover)
+		c.order.Remove(el)
+		delete(c.items, cover.catalog)
+		c.size -= int64(len(cover.data))
+	}
+}
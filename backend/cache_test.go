@@ -0,0 +1,24 @@
+package backend
+
+import "testing"
+
+func TestCoverCache(t *testing.T) {
+	c := newCoverCache(10)
+	c.put("A", []byte("aaaa"))
+	c.put("B", []byte("bbbb"))
+	if _, ok := c.get("A"); !ok {
+		t.Fatalf("cover not cached")
+	}
+	// B is the least recently used
+	c.put("C", []byte("cccc"))
+	if _, ok := c.get("B"); ok {
+		t.Errorf("least recently used cover kept")
+	}
+	if _, ok := c.get("A"); !ok {
+		t.Errorf("recently used cover evicted")
+	}
+	c.put("D", []byte("too large to cache"))
+	if _, ok := c.get("D"); ok || c.size > c.max {
+		t.Errorf("oversized cover cached: %d", c.size)
+	}
+}
@@ -2,7 +2,9 @@ package backend
 
 import (
 	"bytes"
+	"context"
 	"errors"
+	"github.com/SeraphJACK/go-annil/tracing"
 	"io"
 	"io/ioutil"
 	"os"
@@ -31,8 +33,8 @@ func NewFileBackend(pathIn string) (*FileBackend, error) {
 	return &FileBackend{rootDir: path.Clean(pathIn)}, nil
 }
 
-func (b *FileBackend) ListCatalogs() []string {
-	f, err := os.Open(b.rootDir)
+func (b *FileBackend) ListCatalogs(ctx context.Context) []string {
+	f, err := open(ctx, b.rootDir)
 	if err != nil {
 		return []string{}
 	}
@@ -41,16 +43,22 @@ func (b *FileBackend) ListCatalogs() []string {
 	return catalogs
 }
 
-func (b *FileBackend) GetCover(catalog string) (io.ReadCloser, error) {
-	f, err := os.Open(b.rootDir + "/" + catalog + "/cover.jpg")
+func (b *FileBackend) GetCover(ctx context.Context, catalog string) (io.ReadCloser, error) {
+	f, err := open(ctx, b.rootDir+"/"+catalog+"/cover.jpg")
+	if os.IsNotExist(err) {
+		err = ErrNotFound
+	}
 	if err != nil {
 		return ioutil.NopCloser(bytes.NewReader([]byte{})), err
 	}
 	return f, nil
 }
 
-func (b *FileBackend) GetAudio(catalog string, track uint8) (AudioType, io.ReadCloser, error) {
-	dir, err := os.Open(b.rootDir + "/" + catalog)
+func (b *FileBackend) GetAudio(ctx context.Context, catalog string, track uint8) (AudioType, io.ReadCloser, error) {
+	dir, err := open(ctx, b.rootDir+"/"+catalog)
+	if os.IsNotExist(err) {
+		err = ErrNotFound
+	}
 	if err != nil {
 		return UNKNOWN, ioutil.NopCloser(bytes.NewReader([]byte{})), err
 	}
@@ -84,7 +92,7 @@ func (b *FileBackend) GetAudio(catalog string, track uint8) (AudioType, io.ReadC
 	}
 
 	if name == "" {
-		return UNKNOWN, ioutil.NopCloser(bytes.NewReader([]byte{})), err
+		return UNKNOWN, ioutil.NopCloser(bytes.NewReader([]byte{})), ErrNotFound
 	}
 
 	audType := UNKNOWN
@@ -94,9 +102,18 @@ func (b *FileBackend) GetAudio(catalog string, track uint8) (AudioType, io.ReadC
 		audType = MP3
 	}
 
-	f, err := os.Open(b.rootDir + "/" + catalog + "/" + name)
+	f, err := open(ctx, b.rootDir+"/"+catalog+"/"+name)
 	if err != nil {
 		return UNKNOWN, ioutil.NopCloser(bytes.NewReader([]byte{})), err
 	}
 	return audType, f, nil
 }
+
+// open opens a file within a span, so slow file systems show up in traces.
+func open(ctx context.Context, name string) (*os.File, error) {
+	_, span := tracing.Start(ctx, "file.open", tracing.Internal, "path", name)
+	f, err := os.Open(name)
+	span.SetError(err)
+	span.End()
+	return f, err
+}
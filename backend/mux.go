@@ -1,24 +1,39 @@
 package backend
 
 import (
+	"context"
 	"errors"
+	"github.com/SeraphJACK/go-annil/tracing"
 	"io"
+	"strconv"
 )
 
 func NewMultiplexer(backends []Backend) *Multiplexer {
-	return &Multiplexer{Backends: backends}
+	names := make([]string, len(backends))
+	for i := range backends {
+		names[i] = strconv.Itoa(i)
+	}
+	return NewNamedMultiplexer(names, backends)
+}
+
+// NewNamedMultiplexer creates a multiplexer whose backends can be told apart by name in access rules.
+func NewNamedMultiplexer(names []string, backends []Backend) *Multiplexer {
+	return &Multiplexer{Backends: backends, Names: names}
 }
 
 type Multiplexer struct {
 	Backends []Backend
+	Names    []string
 }
 
-func (be *Multiplexer) ListCatalogs() []string {
+func (be *Multiplexer) ListCatalogs(ctx context.Context) []string {
 	m := make(map[string]bool)
-	for _, b := range be.Backends {
-		for _, cat := range b.ListCatalogs() {
+	for i, b := range be.Backends {
+		c, span := be.attempt(ctx, i, "list", "")
+		for _, cat := range b.ListCatalogs(c) {
 			m[cat] = true
 		}
+		endAttempt(span, nil)
 	}
 	keys := make([]string, 0, len(m))
 	for k := range m {
@@ -27,9 +42,11 @@ func (be *Multiplexer) ListCatalogs() []string {
 	return keys
 }
 
-func (be *Multiplexer) GetCover(catalog string) (io.ReadCloser, error) {
-	for _, b := range be.Backends {
-		c, err := b.GetCover(catalog)
+func (be *Multiplexer) GetCover(ctx context.Context, catalog string) (io.ReadCloser, error) {
+	for i, b := range be.Backends {
+		actx, span := be.attempt(ctx, i, "cover", catalog)
+		c, err := b.GetCover(actx, catalog)
+		endAttempt(span, err)
 		if err == nil {
 			return c, nil
 		}
@@ -37,9 +54,117 @@ func (be *Multiplexer) GetCover(catalog string) (io.ReadCloser, error) {
 	return nil, errors.New("no available")
 }
 
-func (be *Multiplexer) GetAudio(catalog string, track uint8) (AudioType, io.ReadCloser, error) {
+func (be *Multiplexer) GetAudio(ctx context.Context, catalog string, track uint8) (AudioType, io.ReadCloser, error) {
+	for i, b := range be.Backends {
+		actx, span := be.attempt(ctx, i, "audio", catalog)
+		span.SetAttr("track", int(track))
+		t, c, err := b.GetAudio(actx, catalog, track)
+		endAttempt(span, err)
+		if err == nil {
+			return t, c, nil
+		}
+	}
+	return UNKNOWN, nil, errors.New("no available")
+}
+
+// Close closes the backends which hold resources, such as connections to relays.
+func (be *Multiplexer) Close() error {
+	var ret error
 	for _, b := range be.Backends {
-		t, c, err := b.GetAudio(catalog, track)
+		if c, ok := b.(io.Closer); ok {
+			if err := c.Close(); err != nil && ret == nil {
+				ret = err
+			}
+		}
+	}
+	return ret
+}
+
+// attempt starts the span of a call to backend i. Spans of audio and covers end once
+// the backend responds, not when the stream is read.
+func (be *Multiplexer) attempt(ctx context.Context, i int, op, catalog string) (context.Context, *tracing.Span) {
+	ctx, span := tracing.Start(ctx, "backend."+op, tracing.Internal, "backend", be.Names[i])
+	if catalog != "" {
+		span.SetAttr("catalog", catalog)
+	}
+	return ctx, span
+}
+
+func endAttempt(span *tracing.Span, err error) {
+	switch {
+	case err == nil:
+		span.SetAttr("result", "ok")
+	case errors.Is(err, ErrNotFound):
+		span.SetAttr("result", "miss")
+	default:
+		span.SetAttr("result", "error")
+		span.SetError(err)
+	}
+	span.End()
+}
+
+// Restrict returns a view of the multiplexer which only serves a catalog from the backends allow accepts.
+func (be *Multiplexer) Restrict(allow func(backend, catalog string) bool) *Restricted {
+	return &Restricted{mux: be, allow: allow}
+}
+
+type Restricted struct {
+	mux   *Multiplexer
+	allow func(backend, catalog string) bool
+}
+
+// Allows reports whether catalog may be served by any of the backends.
+func (be *Restricted) Allows(catalog string) bool {
+	for _, n := range be.mux.Names {
+		if be.allow(n, catalog) {
+			return true
+		}
+	}
+	return false
+}
+
+func (be *Restricted) ListCatalogs(ctx context.Context) []string {
+	m := make(map[string]bool)
+	for i, b := range be.mux.Backends {
+		c, span := be.mux.attempt(ctx, i, "list", "")
+		for _, cat := range b.ListCatalogs(c) {
+			if be.allow(be.mux.Names[i], cat) {
+				m[cat] = true
+			}
+		}
+		endAttempt(span, nil)
+	}
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+func (be *Restricted) GetCover(ctx context.Context, catalog string) (io.ReadCloser, error) {
+	for i, b := range be.mux.Backends {
+		if !be.allow(be.mux.Names[i], catalog) {
+			continue
+		}
+		actx, span := be.mux.attempt(ctx, i, "cover", catalog)
+		c, err := b.GetCover(actx, catalog)
+		endAttempt(span, err)
+		if err == nil {
+			return c, nil
+		}
+	}
+	return nil, errors.New("no available")
+}
+
+func (be *Restricted) GetAudio(ctx context.Context, catalog string, track uint8) (AudioType, io.ReadCloser, error) {
+	for i, b := range be.mux.Backends {
+		if !be.allow(be.mux.Names[i], catalog) {
+			continue
+		}
+		actx, span := be.mux.attempt(ctx, i, "audio", catalog)
+		span.SetAttr("track", int(track))
+		t, c, err := b.GetAudio(actx, catalog, track)
+		endAttempt(span, err)
 		if err == nil {
 			return t, c, nil
 		}
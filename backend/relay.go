@@ -1,9 +1,14 @@
 package backend
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
+	"github.com/SeraphJACK/go-annil/logging"
+	"github.com/SeraphJACK/go-annil/tracing"
 	"io"
+	"io/ioutil"
 	"net/http"
 	"strconv"
 	"strings"
@@ -12,6 +17,12 @@ import (
 type RelayBackend struct {
 	Url   string
 	Token string
+	// Called with the result of every cover lookup in the cache, if there is one
+	OnCacheLookup func(hit bool)
+	// Connections to the relay, not shared with other relays so they can be closed
+	client *http.Client
+	// Covers fetched from the relay, nil if they are not cached
+	covers *coverCache
 }
 
 func NewRelay(url string, token string) *RelayBackend {
@@ -19,22 +30,34 @@ func NewRelay(url string, token string) *RelayBackend {
 		url += "/"
 	}
 	return &RelayBackend{
-		Url:   url,
-		Token: token,
+		Url:    url,
+		Token:  token,
+		client: &http.Client{Transport: http.DefaultTransport.(*http.Transport).Clone()},
 	}
 }
 
-func (e *RelayBackend) ListCatalogs() []string {
-	req, err := http.NewRequest(http.MethodGet, e.Url+"albums", nil)
-	ret := make([]string, 0)
-	if err != nil {
-		return ret
+// NewCachedRelay creates a relay which keeps up to cacheBytes of covers in memory.
+func NewCachedRelay(url string, token string, cacheBytes int64) *RelayBackend {
+	e := NewRelay(url, token)
+	if cacheBytes > 0 {
+		e.covers = newCoverCache(cacheBytes)
 	}
-	res, err := http.DefaultClient.Do(req)
-	if err != nil {
-		return ret
+	return e
+}
+
+// Close closes idle connections to the relay.
+func (e *RelayBackend) Close() error {
+	if e.client != nil {
+		e.client.CloseIdleConnections()
 	}
-	if res.StatusCode != http.StatusOK {
+	return nil
+}
+
+func (e *RelayBackend) ListCatalogs(ctx context.Context) []string {
+	ret := make([]string, 0)
+	res, err := e.get(ctx, "albums")
+	if err != nil {
+		logging.FromContext(ctx).Warn("Failed to list relay catalogs", "relay", e.Url, "err", err)
 		return ret
 	}
 	defer res.Body.Close()
@@ -42,35 +65,48 @@ func (e *RelayBackend) ListCatalogs() []string {
 	return ret
 }
 
-func (e *RelayBackend) GetCover(catalog string) (io.ReadCloser, error) {
-	req, err := http.NewRequest(http.MethodGet, e.Url+catalog+"/cover", nil)
+func (e *RelayBackend) GetCover(ctx context.Context, catalog string) (io.ReadCloser, error) {
+	if e.covers != nil {
+		data, ok := e.covers.get(catalog)
+		if e.OnCacheLookup != nil {
+			e.OnCacheLookup(ok)
+		}
+		if ok {
+			return ioutil.NopCloser(bytes.NewReader(data)), nil
+		}
+	}
+	res, err := e.get(ctx, catalog+"/cover")
 	if err != nil {
 		return nil, err
 	}
-	req.Header.Set("Authorization", e.Token)
-	res, err := http.DefaultClient.Do(req)
+	if e.covers == nil {
+		return res.Body, nil
+	}
+	// Covers larger than the cache are passed on without being kept
+	data, err := ioutil.ReadAll(io.LimitReader(res.Body, e.covers.max+1))
 	if err != nil {
+		res.Body.Close()
 		return nil, err
 	}
-	if res.StatusCode != http.StatusOK {
-		return nil, errors.New("invalid response code")
+	if int64(len(data)) <= e.covers.max {
+		res.Body.Close()
+		e.covers.put(catalog, data)
+		return ioutil.NopCloser(bytes.NewReader(data)), nil
 	}
-	return res.Body, nil
+	return &prefixedBody{Reader: io.MultiReader(bytes.NewReader(data), res.Body), Closer: res.Body}, nil
 }
 
-func (e *RelayBackend) GetAudio(catalog string, track uint8) (AudioType, io.ReadCloser, error) {
-	req, err := http.NewRequest(http.MethodGet, e.Url+catalog+"/"+strconv.Itoa(int(track)), nil)
-	if err != nil {
-		return UNKNOWN, nil, err
-	}
-	req.Header.Set("Authorization", e.Token)
-	res, err := http.DefaultClient.Do(req)
+// prefixedBody is a response body whose beginning was already read.
+type prefixedBody struct {
+	io.Reader
+	io.Closer
+}
+
+func (e *RelayBackend) GetAudio(ctx context.Context, catalog string, track uint8) (AudioType, io.ReadCloser, error) {
+	res, err := e.get(ctx, catalog+"/"+strconv.Itoa(int(track)))
 	if err != nil {
 		return UNKNOWN, nil, err
 	}
-	if res.StatusCode != http.StatusOK {
-		return UNKNOWN, nil, errors.New("invalid response code")
-	}
 	t := UNKNOWN
 	if res.Header.Get("Content-Type") == "audio/flac" {
 		t = FLAC
@@ -79,3 +115,40 @@ func (e *RelayBackend) GetAudio(catalog string, track uint8) (AudioType, io.Read
 	}
 	return t, res.Body, nil
 }
+
+// get requests path from the relay, passing on the request id and trace context of ctx.
+// Responses other than 200 are closed and returned as errors.
+func (e *RelayBackend) get(ctx context.Context, path string) (*http.Response, error) {
+	ctx, span := tracing.Start(ctx, "relay GET", tracing.Client, "http.method", http.MethodGet, "http.url", e.Url+path)
+	defer span.End()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, e.Url+path, nil)
+	if err != nil {
+		span.SetError(err)
+		return nil, err
+	}
+	req.Header.Set("Authorization", e.Token)
+	if id := logging.RequestID(ctx); id != "" {
+		req.Header.Set("X-Request-ID", id)
+	}
+	tracing.Inject(ctx, req.Header)
+	client := e.client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		span.SetError(err)
+		return nil, err
+	}
+	span.SetAttr("http.status_code", res.StatusCode)
+	if res.StatusCode != http.StatusOK {
+		res.Body.Close()
+		if res.StatusCode == http.StatusNotFound {
+			return nil, ErrNotFound
+		}
+		err = errors.New("invalid response code " + strconv.Itoa(res.StatusCode))
+		span.SetError(err)
+		return nil, err
+	}
+	return res, nil
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/SeraphJACK/go-annil/config"
+	"github.com/SeraphJACK/go-annil/storage"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+var commands = map[string]func(configPath string, args []string) int{
+	"serve":   serve,
+	"migrate": migrate,
+	"user": withStore("user", map[string]storeCommand{
+		"add":    userAdd,
+		"list":   userList,
+		"passwd": userPasswd,
+		"delete": userDelete,
+		"grant":  userGrant,
+		"link":   userLink,
+	}),
+	"invite": withStore("invite", map[string]storeCommand{
+		"create": inviteCreate,
+		"list":   inviteList,
+		"revoke": inviteRevoke,
+	}),
+	"token": withStore("token", map[string]storeCommand{
+		"issue":  tokenIssue,
+		"list":   tokenList,
+		"revoke": tokenRevoke,
+	}),
+	"library": library,
+	"config":  configCommand,
+}
+
+func usage() {
+	_, _ = fmt.Fprintf(os.Stderr, `Usage: %s [--config config.yml] <command>
+
+Commands:
+  serve                                  Run the server (default)
+  migrate [status|up]                    Show or apply database migrations
+  user add <name> [-password p] [-role r]
+  user list [-json]
+  user passwd <name> [-password p]       Set a password, a generated one has to be changed at login
+  user delete <name>
+  user grant <name> <role>
+  user link <name> <subject> [-issuer i] Let a directory user log in as an existing account
+  invite create [-limit n] [-expire-hours h] [-note s] [-role r] [-groups a,b]
+  invite list [-json]
+  invite revoke <code>
+  token issue <user> [-catalogs a,b] [-cover-only] [-expire-hours h] [-note s]
+  token list <user> [-json]
+  token revoke <id>
+  library scan [-json]                   List the catalogs of every backend
+  library verify                         Check that every catalog has a cover and a first track
+  config check                           Validate the config file
+`, os.Args[0])
+}
+
+func usageError(msg string) int {
+	_, _ = fmt.Fprintln(os.Stderr, msg)
+	return 2
+}
+
+// Actor of audit events recorded by commands, which is not a valid username
+const cliActor = "(cli)"
+
+// recordAudit adds a change made by a command to the audit log.
+func recordAudit(store storage.Store, action, target string) {
+	err := store.AppendAudit(storage.AuditEvent{
+		Time:      time.Now().Unix(),
+		Actor:     cliActor,
+		Action:    action,
+		Target:    target,
+		UserAgent: "go-annil cli",
+		Status:    200,
+	})
+	if err != nil {
+		_, _ = fmt.Fprintf(os.Stderr, "Failed to record %s in audit log: %v\n", action, err)
+	}
+}
+
+type storeCommand func(store storage.Store, args []string) int
+
+// withStore dispatches to the subcommands of group, which work on the migrated database.
+func withStore(group string, subs map[string]storeCommand) func(string, []string) int {
+	return func(_ string, args []string) int {
+		if len(args) == 0 || subs[args[0]] == nil {
+			return usageError("usage: " + group + " " + strings.Join(sortedKeys(subs), "|"))
+		}
+		store, err := openDatabase()
+		if err != nil {
+			_, _ = fmt.Fprintf(os.Stderr, "Failed to open database: %v\n", err)
+			return 1
+		}
+		defer store.Close()
+		return subs[args[0]](store, args[1:])
+	}
+}
+
+func sortedKeys(m map[string]storeCommand) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// openDatabase opens and migrates the configured database.
+func openDatabase() (storage.Store, error) {
+	store, err := storage.OpenSQLite(config.Cfg.Database)
+	if err != nil {
+		return nil, err
+	}
+	if err = store.Migrate(); err != nil {
+		_ = store.Close()
+		return nil, err
+	}
+	return store, nil
+}
+
+// parseArgs parses the flags of fs, which may come before or after the positional arguments,
+// and checks the number of positional arguments.
+func parseArgs(fs *flag.FlagSet, args []string, positional int) ([]string, bool) {
+	rest := make([]string, 0)
+	for {
+		if err := fs.Parse(args); err != nil {
+			return nil, false
+		}
+		args = fs.Args()
+		if len(args) == 0 {
+			break
+		}
+		rest = append(rest, args[0])
+		args = args[1:]
+	}
+	if len(rest) != positional {
+		_, _ = fmt.Fprintf(os.Stderr, "%s takes %d arguments\n", fs.Name(), positional)
+		return nil, false
+	}
+	return rest, true
+}
+
+func newFlags(name string) *flag.FlagSet {
+	return flag.NewFlagSet(name, flag.ContinueOnError)
+}
+
+// splitList splits a comma-separated flag value.
+func splitList(s string) []string {
+	ret := make([]string, 0)
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			ret = append(ret, item)
+		}
+	}
+	return ret
+}
+
+func printJSON(v interface{}) int {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(v); err != nil {
+		_, _ = fmt.Fprintf(os.Stderr, "Failed to write output: %v\n", err)
+		return 1
+	}
+	return 0
+}
+
+// printTable writes rows as aligned columns below header.
+func printTable(header string, rows [][]string) int {
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	_, _ = fmt.Fprintln(w, header)
+	for _, r := range rows {
+		_, _ = fmt.Fprintln(w, strings.Join(r, "\t"))
+	}
+	if err := w.Flush(); err != nil {
+		_, _ = fmt.Fprintf(os.Stderr, "Failed to write output: %v\n", err)
+		return 1
+	}
+	return 0
+}
+
+func formatTime(unix int64) string {
+	if unix == 0 {
+		return "never"
+	}
+	return time.Unix(unix, 0).Format("2006-01-02 15:04")
+}
+
+// configCommand implements `config check`, which reports every problem of the config file.
+func configCommand(configPath string, args []string) int {
+	if len(args) != 1 || args[0] != "check" {
+		return usageError("usage: config check")
+	}
+	c, err := config.ReadFile(configPath)
+	if err != nil {
+		_, _ = fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	fmt.Printf("%s is valid, %d backends, listening on %s\n", configPath, len(c.Backends), c.Listen)
+	return 0
+}
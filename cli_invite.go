@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"github.com/SeraphJACK/go-annil/storage"
+	"os"
+	"strconv"
+	"time"
+)
+
+func inviteCreate(store storage.Store, args []string) int {
+	fs := newFlags("invite create")
+	limit := fs.Int("limit", 1, "number of registrations, -1 for unlimited")
+	expire := fs.Int("expire-hours", 0, "hours until the code expires, 0 for never")
+	note := fs.String("note", "", "note shown in the code list")
+	role := fs.String("role", "", "role granted to registered users, guest if empty")
+	groups := fs.String("groups", "", "comma-separated groups joined by registered users")
+	if _, ok := parseArgs(fs, args, 0); !ok {
+		return 2
+	}
+	if *limit < -1 || *limit == 0 || *expire < 0 {
+		return usageError("-limit must be positive or -1 and -expire-hours must not be negative")
+	}
+	code := storage.InviteCode{
+		Limit:   *limit,
+		Creator: cliActor,
+		Note:    *note,
+		Role:    *role,
+		Groups:  splitList(*groups),
+	}
+	if *expire > 0 {
+		code.Expire = time.Now().Add(time.Hour * time.Duration(*expire)).Unix()
+	}
+	if code.Role != "" && !store.RoleExists(code.Role) {
+		_, _ = fmt.Fprintf(os.Stderr, "Role %s does not exist\n", code.Role)
+		return 1
+	}
+	for _, g := range code.Groups {
+		if !store.GroupExists(g) {
+			_, _ = fmt.Fprintf(os.Stderr, "Group %s does not exist\n", g)
+			return 1
+		}
+	}
+	code, err := store.NewInviteCode(code)
+	if err != nil {
+		_, _ = fmt.Fprintf(os.Stderr, "Failed to create invite code: %v\n", err)
+		return 1
+	}
+	recordAudit(store, "createInviteCode", code.Code)
+	fmt.Println(code.Code)
+	return 0
+}
+
+func inviteList(store storage.Store, args []string) int {
+	fs := newFlags("invite list")
+	asJSON := fs.Bool("json", false, "print JSON")
+	if _, ok := parseArgs(fs, args, 0); !ok {
+		return 2
+	}
+	codes := store.ListInviteCodes()
+	if *asJSON {
+		return printJSON(codes)
+	}
+	rows := make([][]string, 0, len(codes))
+	for _, c := range codes {
+		limit := "unlimited"
+		if c.Limit >= 0 {
+			limit = strconv.Itoa(c.Limit)
+		}
+		role := c.Role
+		if role == "" {
+			role = storage.RoleGuest
+		}
+		rows = append(rows, []string{c.Code, strconv.Itoa(c.Redeemed) + "/" + limit, role, c.Creator, formatTime(c.Expire), c.Note})
+	}
+	return printTable("CODE\tUSED\tROLE\tCREATOR\tEXPIRES\tNOTE", rows)
+}
+
+func inviteRevoke(store storage.Store, args []string) int {
+	rest, ok := parseArgs(newFlags("invite revoke"), args, 1)
+	if !ok {
+		return 2
+	}
+	if _, err := store.GetInviteCode(rest[0]); err != nil {
+		_, _ = fmt.Fprintf(os.Stderr, "Invite code %s does not exist\n", rest[0])
+		return 1
+	}
+	if err := store.RevokeInviteCode(rest[0]); err != nil {
+		_, _ = fmt.Fprintf(os.Stderr, "Failed to revoke invite code: %v\n", err)
+		return 1
+	}
+	recordAudit(store, "revokeInviteCode", rest[0])
+	fmt.Printf("Revoked %s\n", rest[0])
+	return 0
+}
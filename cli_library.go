@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/SeraphJACK/go-annil/backend"
+	"github.com/SeraphJACK/go-annil/config"
+	"github.com/SeraphJACK/go-annil/http"
+	"os"
+	"sort"
+	"strconv"
+)
+
+// library implements `library scan` and `library verify`, which read the configured backends
+// without starting the server.
+func library(_ string, args []string) int {
+	if len(args) == 0 || (args[0] != "scan" && args[0] != "verify") {
+		return usageError("usage: library scan|verify")
+	}
+	be, err := http.NewBackend(config.Cfg.Backends)
+	if err != nil {
+		_, _ = fmt.Fprintf(os.Stderr, "Failed to open backends: %v\n", err)
+		return 1
+	}
+	defer be.Close()
+	if args[0] == "scan" {
+		return libraryScan(be, args[1:])
+	}
+	return libraryVerify(be, args[1:])
+}
+
+func libraryScan(be *backend.Multiplexer, args []string) int {
+	fs := newFlags("library scan")
+	asJSON := fs.Bool("json", false, "print JSON")
+	if _, ok := parseArgs(fs, args, 0); !ok {
+		return 2
+	}
+	catalogs := make(map[string][]string)
+	rows := make([][]string, 0, len(be.Backends))
+	for i, b := range be.Backends {
+		c := b.ListCatalogs(context.Background())
+		sort.Strings(c)
+		catalogs[be.Names[i]] = c
+		rows = append(rows, []string{be.Names[i], strconv.Itoa(len(c))})
+	}
+	if *asJSON {
+		return printJSON(catalogs)
+	}
+	return printTable("BACKEND\tCATALOGS", rows)
+}
+
+// libraryVerify reports catalogs whose cover or first track cannot be read, and fails if there are any.
+func libraryVerify(be *backend.Multiplexer, args []string) int {
+	if _, ok := parseArgs(newFlags("library verify"), args, 0); !ok {
+		return 2
+	}
+	ctx := context.Background()
+	problems, checked := 0, 0
+	for i, b := range be.Backends {
+		for _, catalog := range b.ListCatalogs(ctx) {
+			checked++
+			if r, err := b.GetCover(ctx, catalog); err != nil {
+				problems++
+				fmt.Printf("%s: %s: cover: %v\n", be.Names[i], catalog, err)
+			} else {
+				_ = r.Close()
+			}
+			if _, r, err := b.GetAudio(ctx, catalog, 1); err != nil {
+				problems++
+				fmt.Printf("%s: %s: track 1: %v\n", be.Names[i], catalog, err)
+			} else {
+				_ = r.Close()
+			}
+		}
+	}
+	fmt.Printf("Checked %d catalogs, %d problems\n", checked, problems)
+	if problems > 0 {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"github.com/SeraphJACK/go-annil/config"
+	"github.com/SeraphJACK/go-annil/storage"
+	"github.com/SeraphJACK/go-annil/token"
+	"os"
+	"strings"
+	"time"
+)
+
+// tokenIssue implements `token issue <user>` and prints the token, which cannot be shown again.
+func tokenIssue(store storage.Store, args []string) int {
+	fs := newFlags("token issue")
+	catalogs := fs.String("catalogs", "", "comma-separated catalogs the token may read, all if empty")
+	coverOnly := fs.Bool("cover-only", false, "only allow covers and the album list")
+	expire := fs.Int("expire-hours", 0, "hours until the token expires, 0 for never")
+	note := fs.String("note", "", "note shown in the token list")
+	rest, ok := parseArgs(fs, args, 1)
+	if !ok {
+		return 2
+	}
+	if *expire < 0 {
+		return usageError("-expire-hours must not be negative")
+	}
+	name := rest[0]
+	if !store.UserExists(name) {
+		_, _ = fmt.Fprintf(os.Stderr, "User %s does not exist\n", name)
+		return 1
+	}
+	scope := token.Scope{Catalogs: splitList(*catalogs), CoverOnly: *coverOnly}
+	tok, err := token.NewManager(store, config.Cfg.Secret).GenerateScopedUserToken(name, scope, time.Hour*time.Duration(*expire), *note)
+	if err != nil {
+		_, _ = fmt.Fprintf(os.Stderr, "Failed to issue token: %v\n", err)
+		return 1
+	}
+	recordAudit(store, "generateToken", name)
+	fmt.Println(tok)
+	return 0
+}
+
+func tokenList(store storage.Store, args []string) int {
+	fs := newFlags("token list")
+	asJSON := fs.Bool("json", false, "print JSON")
+	rest, ok := parseArgs(fs, args, 1)
+	if !ok {
+		return 2
+	}
+	tokens := store.ListTokens(rest[0])
+	if *asJSON {
+		return printJSON(tokens)
+	}
+	rows := make([][]string, 0, len(tokens))
+	for _, t := range tokens {
+		scope := "all"
+		if len(t.Catalogs) > 0 {
+			scope = strings.Join(t.Catalogs, ",")
+		}
+		if t.CoverOnly {
+			scope += " (covers)"
+		}
+		rows = append(rows, []string{t.Id, formatTime(t.IssueTime), formatTime(t.Expire), scope, t.Note})
+	}
+	return printTable("ID\tISSUED\tEXPIRES\tCATALOGS\tNOTE", rows)
+}
+
+func tokenRevoke(store storage.Store, args []string) int {
+	rest, ok := parseArgs(newFlags("token revoke"), args, 1)
+	if !ok {
+		return 2
+	}
+	if !store.TokenExists(rest[0]) {
+		_, _ = fmt.Fprintf(os.Stderr, "Token %s does not exist\n", rest[0])
+		return 1
+	}
+	if err := store.RevokeToken(rest[0]); err != nil {
+		_, _ = fmt.Fprintf(os.Stderr, "Failed to revoke token: %v\n", err)
+		return 1
+	}
+	recordAudit(store, "revokeToken", rest[0])
+	fmt.Printf("Revoked %s\n", rest[0])
+	return 0
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"fmt"
+	"github.com/SeraphJACK/go-annil/auth"
+	"github.com/SeraphJACK/go-annil/storage"
+	"os"
+)
+
+// userAdd implements `user add <name>`. Without -password a one-time password is generated and printed.
+func userAdd(store storage.Store, args []string) int {
+	fs := newFlags("user add")
+	password := fs.String("password", "", "password, generated if empty")
+	role := fs.String("role", storage.RoleMember, "role of the user")
+	rest, ok := parseArgs(fs, args, 1)
+	if !ok {
+		return 2
+	}
+	name := rest[0]
+	if !storage.NameExp.MatchString(name) || store.UserExists(name) {
+		_, _ = fmt.Fprintf(os.Stderr, "Username %s is taken or invalid\n", name)
+		return 1
+	}
+	if !store.RoleExists(*role) {
+		_, _ = fmt.Fprintf(os.Stderr, "Role %s does not exist\n", *role)
+		return 1
+	}
+	pass, generated, code := passwordArg(*password)
+	if code != 0 {
+		return code
+	}
+	if err := store.Register(name, pass); err != nil {
+		_, _ = fmt.Fprintf(os.Stderr, "Failed to create user: %v\n", err)
+		return 1
+	}
+	if err := store.SetRole(name, *role); err != nil {
+		_, _ = fmt.Fprintf(os.Stderr, "Failed to set role: %v\n", err)
+		return 1
+	}
+	if err := store.SetMustChangePassword(name, generated); err != nil {
+		_, _ = fmt.Fprintf(os.Stderr, "Failed to require a password change: %v\n", err)
+		return 1
+	}
+	recordAudit(store, "register", name)
+	if generated {
+		fmt.Printf("Created %s with one-time password: %s\n", name, pass)
+	} else {
+		fmt.Printf("Created %s\n", name)
+	}
+	return 0
+}
+
+// passwordArg returns the password given in a flag, or a generated one if it is empty.
+func passwordArg(password string) (string, bool, int) {
+	if password == "" {
+		p, err := randomPassword()
+		if err != nil {
+			_, _ = fmt.Fprintf(os.Stderr, "Failed to generate password: %v\n", err)
+			return "", false, 1
+		}
+		return p, true, 0
+	}
+	if len(password) < 5 {
+		_, _ = fmt.Fprintln(os.Stderr, "The password must be at least 5 characters long")
+		return "", false, 1
+	}
+	return password, false, 0
+}
+
+func userList(store storage.Store, args []string) int {
+	fs := newFlags("user list")
+	asJSON := fs.Bool("json", false, "print JSON")
+	if _, ok := parseArgs(fs, args, 0); !ok {
+		return 2
+	}
+	users := store.ListUsers()
+	if *asJSON {
+		return printJSON(users)
+	}
+	rows := make([][]string, 0, len(users))
+	for _, u := range users {
+		email := u.Email
+		if email != "" && !u.EmailVerified {
+			email += " (unverified)"
+		}
+		rows = append(rows, []string{u.Username, u.Role, formatTime(u.RegisterDate), email})
+	}
+	return printTable("USERNAME\tROLE\tREGISTERED\tEMAIL", rows)
+}
+
+// userPasswd implements `user passwd <name>`, which also logs the user out everywhere.
+// A generated password has to be changed at the next login.
+func userPasswd(store storage.Store, args []string) int {
+	fs := newFlags("user passwd")
+	password := fs.String("password", "", "new password, generated if empty")
+	rest, ok := parseArgs(fs, args, 1)
+	if !ok {
+		return 2
+	}
+	name := rest[0]
+	if !store.UserExists(name) {
+		_, _ = fmt.Fprintf(os.Stderr, "User %s does not exist\n", name)
+		return 1
+	}
+	pass, generated, code := passwordArg(*password)
+	if code != 0 {
+		return code
+	}
+	if err := store.ChangePassword(name, pass); err != nil {
+		_, _ = fmt.Fprintf(os.Stderr, "Failed to change password: %v\n", err)
+		return 1
+	}
+	if err := store.SetMustChangePassword(name, generated); err != nil {
+		_, _ = fmt.Fprintf(os.Stderr, "Failed to require a password change: %v\n", err)
+		return 1
+	}
+	if err := store.DeleteUserSessions(name); err != nil {
+		_, _ = fmt.Fprintf(os.Stderr, "Failed to log out %s: %v\n", name, err)
+		return 1
+	}
+	recordAudit(store, "resetPassword", name)
+	if generated {
+		fmt.Printf("One-time password of %s: %s\n", name, pass)
+	} else {
+		fmt.Printf("Changed the password of %s\n", name)
+	}
+	return 0
+}
+
+func userDelete(store storage.Store, args []string) int {
+	rest, ok := parseArgs(newFlags("user delete"), args, 1)
+	if !ok {
+		return 2
+	}
+	name := rest[0]
+	if !store.UserExists(name) {
+		_, _ = fmt.Fprintf(os.Stderr, "User %s does not exist\n", name)
+		return 1
+	}
+	if isLastOwner(store, name) {
+		_, _ = fmt.Fprintf(os.Stderr, "%s is the last owner and cannot be deleted\n", name)
+		return 1
+	}
+	if err := store.RevokeUser(name); err != nil {
+		_, _ = fmt.Fprintf(os.Stderr, "Failed to delete user: %v\n", err)
+		return 1
+	}
+	recordAudit(store, "revoke", name)
+	fmt.Printf("Deleted %s\n", name)
+	return 0
+}
+
+func userGrant(store storage.Store, args []string) int {
+	rest, ok := parseArgs(newFlags("user grant"), args, 2)
+	if !ok {
+		return 2
+	}
+	name, role := rest[0], rest[1]
+	if !store.UserExists(name) {
+		_, _ = fmt.Fprintf(os.Stderr, "User %s does not exist\n", name)
+		return 1
+	}
+	if !store.RoleExists(role) {
+		_, _ = fmt.Fprintf(os.Stderr, "Role %s does not exist\n", role)
+		return 1
+	}
+	if role != storage.RoleOwner && isLastOwner(store, name) {
+		_, _ = fmt.Fprintf(os.Stderr, "%s is the last owner and must stay one\n", name)
+		return 1
+	}
+	if err := store.SetRole(name, role); err != nil {
+		_, _ = fmt.Fprintf(os.Stderr, "Failed to set role: %v\n", err)
+		return 1
+	}
+	recordAudit(store, "setRole", name)
+	fmt.Printf("%s is now %s\n", name, role)
+	return 0
+}
+
+// userLink implements `user link <name> <subject>`, which lets the directory user subject log in
+// as the existing account name.
+func userLink(store storage.Store, args []string) int {
+	fs := newFlags("user link")
+	issuer := fs.String("issuer", auth.LDAPIssuer, "issuer of the identity, ldap or the URL of an OpenID provider")
+	rest, ok := parseArgs(fs, args, 2)
+	if !ok {
+		return 2
+	}
+	name, subject := rest[0], rest[1]
+	if !store.UserExists(name) {
+		_, _ = fmt.Fprintf(os.Stderr, "User %s does not exist\n", name)
+		return 1
+	}
+	if linked, err := store.IdentityUser(*issuer, subject); err == nil {
+		_, _ = fmt.Fprintf(os.Stderr, "%s %s is already linked to %s\n", *issuer, subject, linked)
+		return 1
+	}
+	if err := store.LinkIdentity(*issuer, subject, name); err != nil {
+		_, _ = fmt.Fprintf(os.Stderr, "Failed to link identity: %v\n", err)
+		return 1
+	}
+	recordAudit(store, "linkIdentity", name)
+	fmt.Printf("%s %s now logs in as %s\n", *issuer, subject, name)
+	return 0
+}
+
+func isLastOwner(store storage.Store, username string) bool {
+	return store.UserRole(username) == storage.RoleOwner && len(store.RoleUsers(storage.RoleOwner)) <= 1
+}
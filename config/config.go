@@ -1,66 +1,318 @@
 package config
 
 import (
+	"fmt"
 	"github.com/go-yaml/yaml"
 	uuid "github.com/satori/go.uuid"
+	"io/ioutil"
 	"os"
 )
 
-const configPath = "config.yml"
+// Path of the config file read by Init
+var configPath = "config.yml"
 
 type BackendEntry struct {
+	// Name identifies the backend in access rules, defaults to Path
+	Name string `yaml:"name,omitempty"`
 	Type string `yaml:"type"`
 	Path string `yaml:"path"`
 	Auth string `yaml:"auth"`
+	// Megabytes of covers a relay keeps in memory, 0 disables the cache
+	CacheMB int `yaml:"cacheMB,omitempty"`
+}
+
+// LoginConfig throttles failed logins per username and per IP.
+// Failures are kept in memory and forgotten on restart.
+type LoginConfig struct {
+	// Failed logins of a username before further attempts are delayed
+	FreeAttempts int `yaml:"freeAttempts"`
+	// Delay in seconds after the first delayed failure, doubled for every further failure
+	Delay    int `yaml:"delay"`
+	MaxDelay int `yaml:"maxDelay"`
+	// Failed logins of a username before it is locked out, 0 disables lockout
+	LockoutAttempts int `yaml:"lockoutAttempts"`
+	LockoutMinutes  int `yaml:"lockoutMinutes"`
+	// Same as above, for failed logins from an IP
+	IPFreeAttempts    int `yaml:"ipFreeAttempts"`
+	IPLockoutAttempts int `yaml:"ipLockoutAttempts"`
+	// Failures are forgotten after this many minutes without another one
+	WindowMinutes int `yaml:"windowMinutes"`
+}
+
+// OIDCConfig enables logging in through an OpenID Connect provider, alongside local passwords.
+type OIDCConfig struct {
+	Enabled      bool   `yaml:"enabled"`
+	Issuer       string `yaml:"issuer"`
+	ClientID     string `yaml:"clientId"`
+	ClientSecret string `yaml:"clientSecret"`
+	// Has to point to /api/oidc/callback of this instance
+	RedirectURL string   `yaml:"redirectUrl"`
+	Scopes      []string `yaml:"scopes"`
+	// Claims holding the username of provisioned users and the groups of a user
+	UsernameClaim string `yaml:"usernameClaim"`
+	GroupsClaim   string `yaml:"groupsClaim"`
+	// Create users on their first login, otherwise existing users have to link their account
+	AutoRegister bool `yaml:"autoRegister"`
+	// Role of provisioned users who are in none of GroupRoles
+	DefaultRole string `yaml:"defaultRole"`
+	// Roles of members of provider groups, applied at every login. The first matching entry wins.
+	GroupRoles []GroupRole `yaml:"groupRoles"`
+}
+
+type GroupRole struct {
+	Group string `yaml:"group"`
+	Role  string `yaml:"role"`
+}
+
+// LDAPConfig checks passwords against an LDAP directory by searching for the user and binding as it.
+type LDAPConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// ldap:// or ldaps:// URL of the directory
+	URL string `yaml:"url"`
+	// Upgrade ldap:// connections with StartTLS. Passwords are only sent over plain ldap:// if
+	// Insecure is set.
+	StartTLS bool `yaml:"startTls"`
+	Insecure bool `yaml:"insecure"`
+	// Account used to search for users
+	BindDN       string `yaml:"bindDn"`
+	BindPassword string `yaml:"bindPassword"`
+	BaseDN       string `yaml:"baseDn"`
+	// {username} is replaced with the escaped username
+	UserFilter string `yaml:"userFilter"`
+	// Attribute holding the username of provisioned users
+	UsernameAttribute string `yaml:"usernameAttribute"`
+	// Attribute of users listing the DNs of their groups
+	GroupAttribute string `yaml:"groupAttribute"`
+	// Optional search for groups, {dn} is replaced with the escaped DN of the user
+	GroupBaseDN string `yaml:"groupBaseDn"`
+	GroupFilter string `yaml:"groupFilter"`
+	// Role of provisioned users who are in none of GroupRoles
+	DefaultRole string `yaml:"defaultRole"`
+	// Roles of members of directory groups, named by DN or cn, applied at every login. The first matching entry wins.
+	GroupRoles []GroupRole `yaml:"groupRoles"`
+	// When local accounts are checked: "unknown" for users the directory does not know,
+	// "unavailable" also when the directory cannot be reached, "never" disables local passwords.
+	Fallback string `yaml:"fallback"`
+	// Timeout in seconds
+	Timeout int `yaml:"timeout"`
+}
+
+// MailConfig enables email verification and password resets.
+type MailConfig struct {
+	Enabled  bool   `yaml:"enabled"`
+	Host     string `yaml:"host"`
+	Port     int    `yaml:"port"`
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+	From     string `yaml:"from"`
+	// Connect with TLS instead of STARTTLS, usually on port 465
+	TLS bool `yaml:"tls"`
+	// Directory with verify.txt and reset.txt overriding the built-in templates
+	TemplateDir string `yaml:"templateDir"`
+	// Public URL of the web interface, links in messages point to it
+	BaseURL string `yaml:"baseUrl"`
+	// Registration without an email address is rejected
+	RequireEmail bool `yaml:"requireEmail"`
+	// How long links in messages can be used
+	ResetMinutes int `yaml:"resetMinutes"`
+	VerifyHours  int `yaml:"verifyHours"`
+}
+
+// CookieConfig controls the attributes of the session and CSRF cookies.
+type CookieConfig struct {
+	// "auto" marks cookies Secure on requests made over TLS or forwarded as https, "always" or "never"
+	Secure string `yaml:"secure"`
+	// "strict" or "lax"
+	SameSite string `yaml:"sameSite"`
+}
+
+// MetricsConfig serves Prometheus metrics at /metrics. Scrapers either send Token as a
+// bearer token, or metrics are served on a separate Listen address only.
+type MetricsConfig struct {
+	Enabled bool   `yaml:"enabled"`
+	Token   string `yaml:"token"`
+	// Serves metrics on this address instead of the main listener, e.g. 127.0.0.1:9100
+	Listen string `yaml:"listen"`
+}
+
+// LogConfig controls the server log, which is written to standard error.
+type LogConfig struct {
+	// debug, info, warn or error
+	Level string `yaml:"level"`
+	// logfmt or json
+	Format string `yaml:"format"`
+}
+
+// TracingConfig records spans of requests, backend calls and relay requests.
+type TracingConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// "stdout" or "file" write spans as JSON lines, "otlp" sends them to an OpenTelemetry collector
+	Exporter string `yaml:"exporter"`
+	// Path of the file exporter
+	File string `yaml:"file"`
+	// OTLP/HTTP endpoint of the collector, e.g. http://localhost:4318
+	Endpoint string `yaml:"endpoint"`
+	// Fraction of traces started here which are recorded, traces of callers follow their decision
+	SampleRatio float64 `yaml:"sampleRatio"`
+}
+
+// ShutdownConfig controls how the server stops on SIGINT or SIGTERM.
+type ShutdownConfig struct {
+	// Seconds /readyz reports not ready before the listener closes, so load balancers stop sending requests
+	ReadyDelay int `yaml:"readyDelay"`
+	// Seconds in-flight requests, such as streams, get to finish before they are cut off
+	DrainTimeout int `yaml:"drainTimeout"`
+}
+
+// FrontendConfig selects the front-end served for paths which are not part of the API.
+type FrontendConfig struct {
+	// Directory of a built front-end served instead of the bundled one, e.g. while developing it
+	Dir string `yaml:"dir"`
 }
 
 type Config struct {
-	Secret   string         `yaml:"secret"`
-	Listen   string         `yaml:"listen"`
+	Secret string `yaml:"secret"`
+	Listen string `yaml:"listen"`
+	// Addresses or CIDR ranges of reverse proxies in front of the server. The client address of
+	// requests from them, used for login throttling and the audit log, is read from X-Forwarded-For.
+	TrustedProxies []string `yaml:"trustedProxies"`
+	// Path of the SQLite database
+	Database string         `yaml:"database"`
 	Backends []BackendEntry `yaml:"backends"`
+	Login    LoginConfig    `yaml:"login"`
+	// How the owner account is created when there are no users:
+	// "random" prints a generated password, "setup" waits for POST /api/setup.
+	// ANNIL_ADMIN_PASSWORD or ANNIL_ADMIN_PASSWORD_FILE take precedence over both.
+	Bootstrap string         `yaml:"bootstrap"`
+	OIDC      OIDCConfig     `yaml:"oidc"`
+	LDAP      LDAPConfig     `yaml:"ldap"`
+	Mail      MailConfig     `yaml:"mail"`
+	Cookies   CookieConfig   `yaml:"cookies"`
+	Metrics   MetricsConfig  `yaml:"metrics"`
+	Log       LogConfig      `yaml:"log"`
+	Tracing   TracingConfig  `yaml:"tracing"`
+	Shutdown  ShutdownConfig `yaml:"shutdown"`
+	Frontend  FrontendConfig `yaml:"frontend"`
 }
 
-var Cfg = Config{
-	Secret: uuid.NewV4().String(),
-	Listen: "0.0.0.0:8000",
-	Backends: []BackendEntry{
-		{
-			Type: "file",
-			Path: "./repo",
-			Auth: "",
+// Cfg is the configuration the process started with.
+var Cfg = Default()
+
+// Default returns the configuration used for settings missing from the config file.
+// It has no secret, which has to be set in the file.
+func Default() Config {
+	return Config{
+		Listen:    "0.0.0.0:8000",
+		Database:  "./data.db",
+		Bootstrap: "random",
+		Login: LoginConfig{
+			FreeAttempts:      3,
+			Delay:             1,
+			MaxDelay:          30,
+			LockoutAttempts:   10,
+			LockoutMinutes:    15,
+			IPFreeAttempts:    10,
+			IPLockoutAttempts: 50,
+			WindowMinutes:     60,
+		},
+		OIDC: OIDCConfig{
+			Scopes:        []string{"profile"},
+			UsernameClaim: "preferred_username",
+			GroupsClaim:   "groups",
+			DefaultRole:   "guest",
+		},
+		LDAP: LDAPConfig{
+			UserFilter:        "(uid={username})",
+			UsernameAttribute: "uid",
+			GroupAttribute:    "memberOf",
+			DefaultRole:       "guest",
+			Fallback:          "unknown",
+			Timeout:           5,
 		},
-		{
-			Type: "relay",
-			Path: "http://example.com/",
-			Auth: "a.b.c",
+		Mail: MailConfig{
+			Port:         587,
+			ResetMinutes: 60,
+			VerifyHours:  48,
 		},
-	},
+		Cookies: CookieConfig{
+			Secure:   "auto",
+			SameSite: "lax",
+		},
+		Log: LogConfig{
+			Level:  "info",
+			Format: "logfmt",
+		},
+		Tracing: TracingConfig{
+			Exporter:    "stdout",
+			SampleRatio: 1,
+		},
+		Shutdown: ShutdownConfig{
+			DrainTimeout: 30,
+		},
+		Backends:       []BackendEntry{},
+		TrustedProxies: []string{},
+	}
 }
 
-func Init() (err error) {
-	if err := Load(); err != nil {
-		err = Save()
+// Init reads the config file at path into Cfg. A missing file is created with the defaults
+// and a generated secret, an existing one is never written to.
+func Init(path string) error {
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		if err = create(path); err != nil {
+			return err
+		}
 	}
-	_ = Save()
-	return
+	return Load(path)
 }
 
-func Save() error {
-	f, err := os.Create(configPath)
+// Load reads the config file at path into Cfg like Init, but fails if it does not exist.
+func Load(path string) error {
+	configPath = path
+	c, err := Read()
 	if err != nil {
 		return err
 	}
-	defer f.Close()
-	encoder := yaml.NewEncoder(f)
-	return encoder.Encode(Cfg)
+	Cfg = c
+	return nil
 }
 
-func Load() error {
-	f, err := os.Open(configPath)
+// create writes the defaults to a new file at path.
+func create(path string) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
 	if err != nil {
 		return err
 	}
 	defer f.Close()
-	decoder := yaml.NewDecoder(f)
-	return decoder.Decode(&Cfg)
+	// The secret is only generated here: a file without one must not get a new one at every start
+	c := Default()
+	c.Secret = uuid.NewV4().String()
+	return yaml.NewEncoder(f).Encode(c)
+}
+
+// Read reads the config file Init was called with, without changing Cfg.
+func Read() (Config, error) {
+	return ReadFile(configPath)
+}
+
+// ReadFile reads the config file at path on top of the defaults, applies ANNIL_* environment
+// overrides and validates the result. Errors name the line of the setting.
+func ReadFile(path string) (Config, error) {
+	c := Default()
+	src, err := ioutil.ReadFile(path)
+	if err != nil {
+		return c, err
+	}
+	if err = yaml.UnmarshalStrict(src, &c); err != nil {
+		return c, fmt.Errorf("%s: %v", path, err)
+	}
+	if err = applyEnv(&c, os.LookupEnv); err != nil {
+		return c, err
+	}
+	if err = c.Validate(); err != nil {
+		if p, ok := err.(Problems); ok {
+			p.locate(path, src)
+		}
+		return c, err
+	}
+	return c, nil
 }
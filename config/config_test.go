@@ -0,0 +1,118 @@
+package config
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestInit(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yml")
+	if err := Init(path); err != nil {
+		t.Fatalf("failed to create config: %v", err)
+	}
+	created, _ := ioutil.ReadFile(path)
+	if Cfg.Secret == "" || len(Cfg.Backends) != 0 || strings.Contains(string(created), "example.com") {
+		t.Errorf("wrong defaults: %s", created)
+	}
+	// The generated secret is kept in the file
+	secret := Cfg.Secret
+	if c, err := ReadFile(path); err != nil || c.Secret != secret {
+		t.Errorf("secret changed on reread: %s %v", c.Secret, err)
+	}
+
+	src := "# Operator comment\nsecret: s3cret\nlisten: 127.0.0.1:8080\n"
+	_ = ioutil.WriteFile(path, []byte(src), 0600)
+	if err := Init(path); err != nil {
+		t.Fatalf("failed to read config: %v", err)
+	}
+	if Cfg.Secret != "s3cret" || Cfg.Listen != "127.0.0.1:8080" || Cfg.Login.FreeAttempts != 3 {
+		t.Errorf("wrong config: %+v", Cfg)
+	}
+	if b, _ := ioutil.ReadFile(path); string(b) != src {
+		t.Errorf("existing config rewritten: %s", b)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "config.yml")
+	_ = ioutil.WriteFile(path, []byte(`secret: s
+backends:
+  - name: local
+    type: file
+    path: `+dir+`
+  - type: ftp
+    path: ftp://example.com
+  -   type: file
+      # Missing
+      path: `+filepath.Join(dir, "missing")+`
+cookies:
+  sameSite: none
+trustedProxies:
+  - 10.0.0.0/8
+  - proxy.local
+ldap:
+  enabled: true
+  url: ldap://ldap.example.com
+  baseDn: dc=example
+`), 0600)
+	err := Init(path)
+	if err == nil {
+		t.Fatalf("invalid config accepted")
+	}
+	for _, want := range []string{
+		path + `:6: backends[1].type: unknown backend type "ftp"`,
+		path + `:10: backends[2].path:`,
+		path + `:12: cookies.sameSite: "none" is not one of strict, lax`,
+		path + `:15: trustedProxies[1]: "proxy.local" is not an IP address or CIDR range`,
+		path + `:18: ldap.url: sends passwords in clear, set startTls or insecure, or use ldaps://`,
+	} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("error lacks %s: %v", want, err)
+		}
+	}
+
+	// Files without a secret don't get a random one at every start
+	_ = ioutil.WriteFile(path, []byte("listen: :80\n"), 0600)
+	if err = Init(path); err == nil || !strings.Contains(err.Error(), "secret: must not be empty") {
+		t.Errorf("missing secret accepted: %v", err)
+	}
+
+	_ = ioutil.WriteFile(path, []byte("secret: s\nlistne: :80\n"), 0600)
+	if err = Init(path); err == nil || !strings.Contains(err.Error(), "line 2: field listne not found") {
+		t.Errorf("unknown setting accepted: %v", err)
+	}
+}
+
+func TestEnv(t *testing.T) {
+	secret := filepath.Join(t.TempDir(), "secret")
+	_ = ioutil.WriteFile(secret, []byte("from-file\n"), 0600)
+	env := map[string]string{
+		"ANNIL_LISTEN":               ":9000",
+		"ANNIL_SECRET_FILE":          secret,
+		"ANNIL_MAIL_ENABLED":         "true",
+		"ANNIL_MAIL_PORT":            "465",
+		"ANNIL_OIDC_CLIENT_SECRET":   "oidc",
+		"ANNIL_OIDC_SCOPES":          "profile, email",
+		"ANNIL_LDAP_BIND_DN":         "cn=admin",
+		"ANNIL_TRACING_SAMPLE_RATIO": "0.5",
+	}
+	lookup := func(name string) (string, bool) {
+		v, ok := env[name]
+		return v, ok
+	}
+	c := Default()
+	if err := applyEnv(&c, lookup); err != nil {
+		t.Fatalf("failed to apply env: %v", err)
+	}
+	if c.Listen != ":9000" || c.Secret != "from-file" || !c.Mail.Enabled || c.Mail.Port != 465 || c.OIDC.ClientSecret != "oidc" ||
+		len(c.OIDC.Scopes) != 2 || c.OIDC.Scopes[1] != "email" || c.LDAP.BindDN != "cn=admin" || c.Tracing.SampleRatio != 0.5 {
+		t.Errorf("wrong config: %+v", c)
+	}
+	env["ANNIL_MAIL_PORT"] = "smtp"
+	if err := applyEnv(&c, lookup); err == nil || !strings.Contains(err.Error(), "ANNIL_MAIL_PORT") {
+		t.Errorf("invalid value accepted: %v", err)
+	}
+}
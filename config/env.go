@@ -0,0 +1,108 @@
+package config
+
+import (
+	"fmt"
+	"io/ioutil"
+	"reflect"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+const envPrefix = "ANNIL_"
+
+// applyEnv overrides settings with environment variables named after their path in the config
+// file, e.g. ANNIL_LISTEN or ANNIL_MAIL_PASSWORD. String settings can also be read from a file
+// named by the variable with a _FILE suffix, e.g. ANNIL_SECRET_FILE. Lists of strings are
+// comma-separated, lists of other settings such as backends can only be set in the file.
+func applyEnv(c *Config, lookup func(string) (string, bool)) error {
+	return applyEnvTo(reflect.ValueOf(c).Elem(), envPrefix, lookup)
+}
+
+func applyEnvTo(v reflect.Value, prefix string, lookup func(string) (string, bool)) error {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		key := strings.Split(t.Field(i).Tag.Get("yaml"), ",")[0]
+		if key == "" || key == "-" {
+			continue
+		}
+		name := prefix + envName(key)
+		f := v.Field(i)
+		if f.Kind() == reflect.Struct {
+			if err := applyEnvTo(f, name+"_", lookup); err != nil {
+				return err
+			}
+			continue
+		}
+		value, ok := lookup(name)
+		if file, fromFile := lookup(name + "_FILE"); !ok && fromFile && f.Kind() == reflect.String {
+			b, err := ioutil.ReadFile(file)
+			if err != nil {
+				return fmt.Errorf("%s_FILE: %v", name, err)
+			}
+			value, ok = strings.TrimSpace(string(b)), true
+		}
+		if !ok {
+			continue
+		}
+		if err := setValue(f, value); err != nil {
+			return fmt.Errorf("%s: %v", name, err)
+		}
+	}
+	return nil
+}
+
+func setValue(f reflect.Value, value string) error {
+	switch f.Kind() {
+	case reflect.String:
+		f.SetString(value)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("%q is not a boolean", value)
+		}
+		f.SetBool(b)
+	case reflect.Int:
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("%q is not an integer", value)
+		}
+		f.SetInt(int64(n))
+	case reflect.Float64:
+		n, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return fmt.Errorf("%q is not a number", value)
+		}
+		f.SetFloat(n)
+	case reflect.Slice:
+		if f.Type().Elem().Kind() != reflect.String {
+			return fmt.Errorf("can only be set in the config file")
+		}
+		items := make([]string, 0)
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				items = append(items, item)
+			}
+		}
+		f.Set(reflect.ValueOf(items))
+	default:
+		return fmt.Errorf("can only be set in the config file")
+	}
+	return nil
+}
+
+// envName turns a camelCase key into upper snake case, e.g. clientSecret into CLIENT_SECRET.
+func envName(key string) string {
+	var b strings.Builder
+	runes := []rune(key)
+	for i, r := range runes {
+		// A new word starts at an upper case letter following a lower case one, or
+		// at the last letter of an abbreviation followed by a lower case one
+		if i > 0 && unicode.IsUpper(r) && (unicode.IsLower(runes[i-1]) ||
+			i+1 < len(runes) && unicode.IsLower(runes[i+1]) && unicode.IsUpper(runes[i-1])) {
+			b.WriteByte('_')
+		}
+		b.WriteRune(unicode.ToUpper(r))
+	}
+	return b.String()
+}
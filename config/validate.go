@@ -0,0 +1,240 @@
+package config
+
+import (
+	"fmt"
+	"github.com/SeraphJACK/go-annil/logging"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Problem is an invalid setting.
+type Problem struct {
+	// Keys, and indices of list items, leading to the setting
+	Path []string
+	Msg  string
+	// File and line of the setting, if known
+	File string
+	Line int
+}
+
+func (p Problem) Error() string {
+	name := ""
+	for _, el := range p.Path {
+		if _, err := strconv.Atoi(el); err == nil {
+			name += "[" + el + "]"
+		} else if name == "" {
+			name = el
+		} else {
+			name += "." + el
+		}
+	}
+	if p.Line > 0 {
+		return fmt.Sprintf("%s:%d: %s: %s", p.File, p.Line, name, p.Msg)
+	}
+	return name + ": " + p.Msg
+}
+
+// Problems lists every invalid setting of a config.
+type Problems []Problem
+
+func (p Problems) Error() string {
+	msgs := make([]string, len(p))
+	for i := range p {
+		msgs[i] = p[i].Error()
+	}
+	return strings.Join(msgs, "\n")
+}
+
+func (p Problems) locate(file string, src []byte) {
+	for i := range p {
+		p[i].File = file
+		p[i].Line = locate(src, p[i].Path...)
+	}
+}
+
+// Validate checks settings which would otherwise only fail once they are used.
+// It returns Problems if any setting is invalid.
+func (c *Config) Validate() error {
+	var ps Problems
+	add := func(msg string, path ...string) {
+		ps = append(ps, Problem{Path: path, Msg: msg})
+	}
+	oneOf := func(v string, allowed []string, path ...string) {
+		for _, a := range allowed {
+			if v == a {
+				return
+			}
+		}
+		add(fmt.Sprintf("%q is not one of %s", v, strings.Join(allowed, ", ")), path...)
+	}
+
+	if c.Secret == "" {
+		add("must not be empty", "secret")
+	}
+	if _, _, err := net.SplitHostPort(c.Listen); err != nil {
+		add("is not a host:port address", "listen")
+	}
+	for i, p := range c.TrustedProxies {
+		if _, _, err := net.ParseCIDR(p); err != nil && net.ParseIP(p) == nil {
+			add(fmt.Sprintf("%q is not an IP address or CIDR range", p), "trustedProxies", strconv.Itoa(i))
+		}
+	}
+	if c.Database == "" {
+		add("must not be empty", "database")
+	}
+	names := make(map[string]bool)
+	for i, b := range c.Backends {
+		item := strconv.Itoa(i)
+		switch b.Type {
+		case "file":
+			if info, err := os.Stat(b.Path); err != nil || !info.IsDir() {
+				add(fmt.Sprintf("%q is not a directory", b.Path), "backends", item, "path")
+			}
+		case "relay":
+			if u, err := url.Parse(b.Path); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+				add(fmt.Sprintf("%q is not an http or https URL", b.Path), "backends", item, "path")
+			}
+		default:
+			add(fmt.Sprintf("unknown backend type %q, expected file or relay", b.Type), "backends", item, "type")
+		}
+		if b.CacheMB < 0 {
+			add("must not be negative", "backends", item, "cacheMB")
+		} else if b.CacheMB > 0 && b.Type != "relay" {
+			add("is only supported by relays", "backends", item, "cacheMB")
+		}
+		name := b.Name
+		if name == "" {
+			name = b.Path
+		}
+		if names[name] {
+			add(fmt.Sprintf("backend name %s is used twice", name), "backends", item)
+		}
+		names[name] = true
+	}
+	oneOf(c.Bootstrap, []string{"random", "setup"}, "bootstrap")
+	if c.OIDC.Enabled {
+		if c.OIDC.Issuer == "" || c.OIDC.ClientID == "" || c.OIDC.RedirectURL == "" {
+			add("needs issuer, clientId and redirectUrl", "oidc")
+		}
+	}
+	if c.LDAP.Enabled {
+		if c.LDAP.URL == "" || c.LDAP.BaseDN == "" {
+			add("needs url and baseDn", "ldap")
+		}
+		oneOf(c.LDAP.Fallback, []string{"unknown", "unavailable", "never"}, "ldap", "fallback")
+		if strings.HasPrefix(c.LDAP.URL, "ldap://") && !c.LDAP.StartTLS && !c.LDAP.Insecure {
+			add("sends passwords in clear, set startTls or insecure, or use ldaps://", "ldap", "url")
+		}
+	}
+	if c.Mail.Enabled && (c.Mail.Host == "" || c.Mail.From == "") {
+		add("needs host and from", "mail")
+	}
+	oneOf(c.Cookies.Secure, []string{"auto", "always", "never"}, "cookies", "secure")
+	oneOf(c.Cookies.SameSite, []string{"strict", "lax"}, "cookies", "sameSite")
+	if _, err := logging.ParseLevel(c.Log.Level); err != nil {
+		add(err.Error(), "log", "level")
+	}
+	oneOf(c.Log.Format, []string{logging.FormatLogfmt, logging.FormatJSON}, "log", "format")
+	if c.Tracing.Enabled {
+		oneOf(c.Tracing.Exporter, []string{"stdout", "file", "otlp"}, "tracing", "exporter")
+		if c.Tracing.Exporter == "file" && c.Tracing.File == "" {
+			add("is needed by the file exporter", "tracing", "file")
+		}
+		if c.Tracing.Exporter == "otlp" && c.Tracing.Endpoint == "" {
+			add("is needed by the otlp exporter", "tracing", "endpoint")
+		}
+	}
+	if c.Tracing.SampleRatio < 0 || c.Tracing.SampleRatio > 1 {
+		add("must be between 0 and 1", "tracing", "sampleRatio")
+	}
+	if c.Shutdown.ReadyDelay < 0 || c.Shutdown.DrainTimeout < 0 {
+		add("must not be negative", "shutdown")
+	}
+	if c.Frontend.Dir != "" {
+		if info, err := os.Stat(c.Frontend.Dir); err != nil || !info.IsDir() {
+			add(fmt.Sprintf("%q is not a directory", c.Frontend.Dir), "frontend", "dir")
+		}
+	}
+	if len(ps) > 0 {
+		return ps
+	}
+	return nil
+}
+
+type yamlLine struct {
+	no     int
+	indent int
+	text   string
+}
+
+// locate returns the line of the setting at path in block-style YAML, or 0 if it is not found,
+// e.g. because the setting was left out or written in flow style.
+func locate(src []byte, path ...string) int {
+	var lines []yamlLine
+	for i, l := range strings.Split(string(src), "\n") {
+		text := strings.TrimLeft(l, " ")
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		lines = append(lines, yamlLine{no: i + 1, indent: len(l) - len(text), text: text})
+	}
+	// Lines of the block being searched, the whole document at first
+	block := lines
+	line := 0
+	for _, el := range path {
+		if len(block) == 0 {
+			return line
+		}
+		indent := block[0].indent
+		for _, l := range block {
+			if l.indent < indent {
+				indent = l.indent
+			}
+		}
+		found := -1
+		if idx, err := strconv.Atoi(el); err == nil {
+			n := 0
+			for i, l := range block {
+				if l.indent == indent && strings.HasPrefix(l.text, "-") {
+					if n == idx {
+						found = i
+						break
+					}
+					n++
+				}
+			}
+		} else {
+			for i, l := range block {
+				if l.indent == indent && (strings.HasPrefix(l.text, el+":") || strings.HasPrefix(l.text, `"`+el+`":`)) {
+					found = i
+					break
+				}
+			}
+		}
+		if found < 0 {
+			return line
+		}
+		line = block[found].no
+		item := block[found]
+		end := found + 1
+		for end < len(block) && (block[end].indent > indent ||
+			// Lists may be indented as far as their key
+			block[end].indent == indent && !strings.HasPrefix(item.text, "-") && strings.HasPrefix(block[end].text, "-")) {
+			end++
+		}
+		block = append([]yamlLine(nil), block[found+1:end]...)
+		if strings.HasPrefix(item.text, "-") {
+			// The first key of a list item shares the line of its dash
+			rest := strings.TrimLeft(item.text[1:], " ")
+			if rest != "" {
+				item.indent += len(item.text) - len(rest)
+				item.text = rest
+				block = append([]yamlLine{item}, block...)
+			}
+		}
+	}
+	return line
+}
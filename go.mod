@@ -6,7 +6,6 @@ require (
 	github.com/dgrijalva/jwt-go v3.2.0+incompatible
 	github.com/gin-gonic/gin v1.7.1
 	github.com/go-yaml/yaml v2.1.0+incompatible
-	github.com/markbates/pkger v0.17.1
 	github.com/mattn/go-sqlite3 v1.14.6
 	github.com/satori/go.uuid v1.2.0
 	golang.org/x/crypto v0.0.0-20210322153248-0c34fe9e7dc2
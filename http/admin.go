@@ -0,0 +1,240 @@
+package http
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"github.com/SeraphJACK/go-annil/storage"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// UserDetails is everything the admin console shows about a user.
+type UserDetails struct {
+	storage.User
+	Groups      []string           `json:"groups"`
+	TotpEnabled bool               `json:"totpEnabled"`
+	Identities  []storage.Identity `json:"identities"`
+	Tokens      []storage.Token    `json:"tokens"`
+	Sessions    []SessionInfo      `json:"sessions"`
+	// Invite code the user registered with, empty if none
+	InviteCode string `json:"inviteCode"`
+	// Unix time of the latest successful login in the audit log, 0 if there is none
+	LastLogin int64 `json:"lastLogin"`
+}
+
+// SessionInfo describes a session without revealing its cookie.
+type SessionInfo struct {
+	// Derived from the session id, used to revoke the session
+	Id       string `json:"id"`
+	Username string `json:"username"`
+	Expire   int64  `json:"expire"`
+	// Set for the session of the request
+	Current bool `json:"current"`
+}
+
+// BackendHealth is the result of listing the catalogs of a backend, along with the
+// calls made to it since the backends were loaded.
+type BackendHealth struct {
+	Name          string `json:"name"`
+	Catalogs      int    `json:"catalogs"`
+	LatencyMs     int64  `json:"latencyMs"`
+	Calls         int    `json:"calls"`
+	Errors        int    `json:"errors"`
+	LastError     string `json:"lastError"`
+	LastErrorTime int64  `json:"lastErrorTime"`
+}
+
+// DownloadStats sums the tracks streamed in the last Days days, by day, user and catalog.
+type DownloadStats struct {
+	Days  int `json:"days"`
+	Total int `json:"total"`
+	// Every day, oldest first, keyed by date
+	Daily []DownloadTotal `json:"daily"`
+	// The users and catalogs with the most downloads, at most downloadTop of each
+	Users    []DownloadTotal `json:"users"`
+	Catalogs []DownloadTotal `json:"catalogs"`
+}
+
+type DownloadTotal struct {
+	Key   string `json:"key"`
+	Count int    `json:"count"`
+}
+
+const (
+	downloadTop = 20
+	// Backends slower than this are reported with no catalogs
+	healthTimeout = 10 * time.Second
+)
+
+// regAdminEndpoints registers the read endpoints of the admin console, which are missing
+// from the rest of the API.
+func (s *Server) regAdminEndpoints(r *gin.Engine) {
+	g := r.Group("/api/v2")
+
+	g.GET("/users/:name/details", s.requirePermission(storage.PermManageUsers), func(ctx *gin.Context) {
+		name := ctx.Param("name")
+		u, ok := s.findUser(name)
+		if !ok {
+			fail(ctx, &apiError{Status: http.StatusNotFound})
+			return
+		}
+		groups, _ := s.store.UserGroups(name)
+		d := UserDetails{
+			User:       u,
+			Groups:     groups,
+			Identities: s.store.UserIdentities(name),
+			Tokens:     s.store.ListTokens(name),
+			Sessions:   s.sessionInfos(ctx, name),
+		}
+		if st, err := s.store.GetTotp(name); err == nil {
+			d.TotpEnabled = st.Enabled
+		}
+		for _, r := range s.store.ListRedemptions("") {
+			if r.Username == name {
+				d.InviteCode = r.Code
+			}
+		}
+		for _, e := range s.store.QueryAudit(storage.AuditFilter{User: name, Action: "login"}) {
+			if e.Actor == name && e.Status == http.StatusOK {
+				d.LastLogin = e.Time
+			}
+		}
+		ctx.JSON(http.StatusOK, d)
+	})
+
+	g.GET("/sessions", s.requirePermission(storage.PermManageUsers), func(ctx *gin.Context) {
+		ctx.JSON(http.StatusOK, s.sessionInfos(ctx, ctx.Query("username")))
+	})
+	g.DELETE("/sessions/:id", s.audit("revokeSession", ""), s.requirePermission(storage.PermManageUsers), func(ctx *gin.Context) {
+		for _, ses := range s.store.ListSessions("") {
+			if sessionKey(ses.Id) != ctx.Param("id") {
+				continue
+			}
+			ctx.Set("auditTarget", ses.Username)
+			if !s.canManage(ctx.GetString("username"), ses.Username) {
+				fail(ctx, &apiError{Status: http.StatusForbidden})
+				return
+			}
+			if err := s.store.DeleteSession(ses.Id); err != nil {
+				logger(ctx).Errorf("Failed to revoke session of %s: %v\n", ses.Username, err)
+				fail(ctx, &apiError{Status: http.StatusInternalServerError})
+				return
+			}
+			ctx.Status(http.StatusNoContent)
+			return
+		}
+		fail(ctx, &apiError{Status: http.StatusNotFound})
+	})
+
+	g.GET("/backends", s.requirePermission(storage.PermManageSettings), func(ctx *gin.Context) {
+		ctx.JSON(http.StatusOK, s.backendHealth(ctx.Request.Context()))
+	})
+
+	g.GET("/downloads", s.requirePermission(storage.PermViewAudit), func(ctx *gin.Context) {
+		days := 30
+		if d := ctx.Query("days"); d != "" {
+			var err error
+			days, err = strconv.Atoi(d)
+			if err != nil || days < 1 || days > 366 {
+				fail(ctx, &apiError{Status: http.StatusBadRequest})
+				return
+			}
+		}
+		ctx.JSON(http.StatusOK, s.downloadStats(days, time.Now()))
+	})
+}
+
+// sessionKey identifies a session in the API. The session id itself is a credential.
+func sessionKey(id string) string {
+	sum := sha256.Sum256([]byte("session:" + id))
+	return hex.EncodeToString(sum[:12])
+}
+
+// sessionInfos lists the sessions of username, or of everyone if it is empty,
+// leaving out those of users the current user may not manage.
+func (s *Server) sessionInfos(ctx *gin.Context, username string) []SessionInfo {
+	current, _ := ctx.Cookie(sessionCookie)
+	actor := ctx.GetString("username")
+	ret := []SessionInfo{}
+	for _, ses := range s.store.ListSessions(username) {
+		if !s.canManage(actor, ses.Username) {
+			continue
+		}
+		ret = append(ret, SessionInfo{
+			Id:       sessionKey(ses.Id),
+			Username: ses.Username,
+			Expire:   ses.Expire.Unix(),
+			Current:  ses.Id == current,
+		})
+	}
+	return ret
+}
+
+// backendHealth lists the catalogs of every backend at once.
+func (s *Server) backendHealth(ctx context.Context) []BackendHealth {
+	ctx, cancel := context.WithTimeout(ctx, healthTimeout)
+	defer cancel()
+	be := s.backends()
+	ret := make([]BackendHealth, len(be.Backends))
+	var wg sync.WaitGroup
+	for i := range be.Backends {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			h := BackendHealth{Name: be.Names[i]}
+			start := time.Now()
+			h.Catalogs = len(be.Backends[i].ListCatalogs(ctx))
+			h.LatencyMs = time.Since(start).Milliseconds()
+			if m, ok := be.Backends[i].(*measuredBackend); ok {
+				h.Calls, h.Errors, h.LastError, h.LastErrorTime = m.stats()
+			}
+			ret[i] = h
+		}(i)
+	}
+	wg.Wait()
+	return ret
+}
+
+func (s *Server) downloadStats(days int, now time.Time) DownloadStats {
+	today := now.Unix() - now.Unix()%86400
+	first := today - int64(days-1)*86400
+	ret := DownloadStats{Days: days, Daily: make([]DownloadTotal, days)}
+	for i := range ret.Daily {
+		ret.Daily[i].Key = time.Unix(first+int64(i)*86400, 0).UTC().Format("2006-01-02")
+	}
+	users := make(map[string]int)
+	catalogs := make(map[string]int)
+	for _, d := range s.store.ListDownloads(first) {
+		if i := (d.Day - first) / 86400; i >= 0 && i < int64(days) {
+			ret.Daily[i].Count += d.Count
+		}
+		ret.Total += d.Count
+		users[d.Username] += d.Count
+		catalogs[d.Catalog] += d.Count
+	}
+	ret.Users = topDownloads(users)
+	ret.Catalogs = topDownloads(catalogs)
+	return ret
+}
+
+func topDownloads(m map[string]int) []DownloadTotal {
+	ret := make([]DownloadTotal, 0, len(m))
+	for k, n := range m {
+		ret = append(ret, DownloadTotal{Key: k, Count: n})
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		if ret[i].Count != ret[j].Count {
+			return ret[i].Count > ret[j].Count
+		}
+		return ret[i].Key < ret[j].Key
+	})
+	if len(ret) > downloadTop {
+		ret = ret[:downloadTop]
+	}
+	return ret
+}
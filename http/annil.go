@@ -2,13 +2,12 @@ package http
 
 import (
 	"encoding/json"
+	"fmt"
 	"github.com/SeraphJACK/go-annil/backend"
 	"github.com/SeraphJACK/go-annil/storage"
-	"github.com/SeraphJACK/go-annil/token"
 	"github.com/gin-gonic/gin"
-	"io"
-	"log"
 	"net/http"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -19,15 +18,16 @@ type CreateSharePayload struct {
 	Expire uint             `json:"expire"`
 }
 
-func regAnniEndpoints(r *gin.Engine) {
-	r.POST("/share", func(ctx *gin.Context) {
+func (s *Server) regAnniEndpoints(r *gin.Engine) {
+	r.POST("/share", s.audit("share", ""), func(ctx *gin.Context) {
 		tok := ctx.GetHeader("Authorization")
-		username, err := token.ValidateUserToken(tok)
+		username, scope, err := s.tokens.ValidateScopedUserToken(tok)
 		if err != nil {
 			ctx.Status(http.StatusUnauthorized)
 			return
 		}
-		if !storage.AllowShare(username) {
+		ctx.Set("username", username)
+		if !storage.HasPermission(s.store, username, storage.PermShare) || scope.CoverOnly {
 			ctx.Status(http.StatusForbidden)
 			return
 		}
@@ -38,10 +38,24 @@ func regAnniEndpoints(r *gin.Engine) {
 			ctx.Status(http.StatusBadRequest)
 			return
 		}
-		sTok, err := token.GenerateShareToken(username, payload.Audios, time.Hour*time.Duration(payload.Expire))
+		catalogs := make([]string, 0, len(payload.Audios))
+		for catalog := range payload.Audios {
+			catalogs = append(catalogs, catalog)
+		}
+		sort.Strings(catalogs)
+		ctx.Set("auditDetail", fmt.Sprintf("catalogs=%s expire=%d", strings.Join(catalogs, ","), payload.Expire))
+		// A token can only share what it can access
+		lib := s.library(ctx, username)
+		for _, catalog := range catalogs {
+			if !scope.AllowCatalog(catalog) || !lib.Allows(catalog) {
+				ctx.Status(http.StatusForbidden)
+				return
+			}
+		}
+		sTok, err := s.tokens.GenerateShareToken(username, payload.Audios, time.Hour*time.Duration(payload.Expire))
 		if err != nil {
 			ctx.Status(http.StatusInternalServerError)
-			log.Printf("Failed to generate share token for %s: %v\n", username, err)
+			logger(ctx).Errorf("Failed to generate share token for %s: %v\n", username, err)
 		} else {
 			ctx.Header("Content-Type", "text/plain")
 			ctx.String(http.StatusOK, sTok)
@@ -49,14 +63,35 @@ func regAnniEndpoints(r *gin.Engine) {
 	})
 
 	r.GET("/albums", func(ctx *gin.Context) {
+		tok := ctx.GetHeader("Authorization")
+		username, scope, err := s.tokens.ValidateScopedUserToken(tok)
+		allow := scope.AllowCatalog
+		if err != nil {
+			audios, err := s.tokens.ValidateShareToken(tok)
+			if err != nil {
+				ctx.Status(http.StatusUnauthorized)
+				return
+			}
+			username, _ = s.tokens.Owner(tok)
+			allow = func(catalog string) bool {
+				_, ok := audios[catalog]
+				return ok
+			}
+		}
+		catalogs := make([]string, 0)
+		for _, c := range s.library(ctx, username).ListCatalogs(ctx.Request.Context()) {
+			if allow(c) {
+				catalogs = append(catalogs, c)
+			}
+		}
 		ctx.Header("Access-Control-Allow-Origin", "*")
-		ctx.JSON(http.StatusOK, be.ListCatalogs())
+		ctx.JSON(http.StatusOK, catalogs)
 	})
 
 	r.GET("/:catalog/cover", func(ctx *gin.Context) {
 		catalog := ctx.Param("catalog")
 		tok := ctx.GetHeader("Authorization")
-		check := token.CheckCoverPerms(tok, catalog)
+		check := s.tokens.CheckCoverPerms(tok, catalog)
 		if check != 0 {
 			if check == 1 {
 				ctx.Status(http.StatusForbidden)
@@ -65,19 +100,20 @@ func regAnniEndpoints(r *gin.Engine) {
 			}
 			return
 		}
-		cov, err := be.GetCover(catalog)
+		owner, _ := s.tokens.Owner(tok)
+		lib := s.library(ctx, owner)
+		if !lib.Allows(catalog) {
+			ctx.Status(http.StatusForbidden)
+			return
+		}
+		cov, err := lib.GetCover(ctx.Request.Context(), catalog)
 		if err != nil {
 			ctx.Status(http.StatusNotFound)
 			return
 		}
 
 		ctx.Header("Access-Control-Allow-Origin", "*")
-
-		ctx.Stream(func(w io.Writer) bool {
-			defer cov.Close()
-			_, err := io.Copy(w, cov)
-			return err != nil
-		})
+		s.stream(ctx, "cover", cov)
 	})
 
 	r.GET("/:catalog/:track", func(ctx *gin.Context) {
@@ -89,7 +125,7 @@ func regAnniEndpoints(r *gin.Engine) {
 			return
 		}
 		tok := ctx.GetHeader("Authorization")
-		check := token.CheckAudioPerms(tok, catalog, track)
+		check := s.tokens.CheckAudioPerms(tok, catalog, track)
 		if check != 0 {
 			if check == 1 {
 				ctx.Status(http.StatusForbidden)
@@ -98,7 +134,13 @@ func regAnniEndpoints(r *gin.Engine) {
 			}
 			return
 		}
-		typ, aud, err := be.GetAudio(catalog, uint8(track))
+		owner, _ := s.tokens.Owner(tok)
+		lib := s.library(ctx, owner)
+		if !lib.Allows(catalog) {
+			ctx.Status(http.StatusForbidden)
+			return
+		}
+		typ, aud, err := lib.GetAudio(ctx.Request.Context(), catalog, uint8(track))
 		if err != nil {
 			ctx.Status(http.StatusNotFound)
 			return
@@ -109,13 +151,11 @@ func regAnniEndpoints(r *gin.Engine) {
 			ctx.Header("Content-Type", "audio/mp3")
 		}
 
+		if err = s.store.RecordDownload(owner, catalog, time.Now()); err != nil {
+			logger(ctx).Errorf("Failed to record download of %s: %v\n", catalog, err)
+		}
 		ctx.Header("Access-Control-Allow-Origin", "*")
-
-		ctx.Stream(func(w io.Writer) bool {
-			defer aud.Close()
-			_, err := io.Copy(w, aud)
-			return err != nil
-		})
+		s.stream(ctx, "audio", aud)
 	})
 
 	r.OPTIONS("/share", func(ctx *gin.Context) {
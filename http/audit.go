@@ -0,0 +1,103 @@
+package http
+
+import (
+	"encoding/json"
+	"github.com/SeraphJACK/go-annil/storage"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+func (s *Server) regAuditEndpoints(r *gin.Engine) {
+	r.POST("/api/queryAuditLog", s.requirePermission(storage.PermViewAudit), func(ctx *gin.Context) {
+		f, ok := auditFilter(ctx)
+		if !ok {
+			return
+		}
+		ctx.JSON(http.StatusOK, s.store.QueryAudit(f))
+	})
+	r.POST("/api/exportAuditLog", s.requirePermission(storage.PermViewAudit), func(ctx *gin.Context) {
+		f, ok := auditFilter(ctx)
+		if !ok {
+			return
+		}
+		ctx.Header("Content-Type", "application/x-ndjson")
+		ctx.Header("Content-Disposition", "attachment; filename=audit.jsonl")
+		ctx.Status(http.StatusOK)
+		enc := json.NewEncoder(ctx.Writer)
+		for _, e := range s.store.QueryAudit(f) {
+			if err := enc.Encode(e); err != nil {
+				logger(ctx).Errorf("Failed to export audit log: %v\n", err)
+				return
+			}
+		}
+	})
+}
+
+// auditFilter reads the user, action, since, until and limit form fields.
+// Times are unix seconds.
+func auditFilter(ctx *gin.Context) (storage.AuditFilter, bool) {
+	f := storage.AuditFilter{
+		User:   ctx.PostForm("user"),
+		Action: ctx.PostForm("action"),
+	}
+	for field, v := range map[string]*int64{"since": &f.Since, "until": &f.Until} {
+		if str := ctx.PostForm(field); str != "" {
+			n, err := strconv.ParseInt(str, 10, 64)
+			if err != nil || n < 0 {
+				ctx.Status(http.StatusBadRequest)
+				return f, false
+			}
+			*v = n
+		}
+	}
+	if str := ctx.PostForm("limit"); str != "" {
+		n, err := strconv.Atoi(str)
+		if err != nil || n < 0 {
+			ctx.Status(http.StatusBadRequest)
+			return f, false
+		}
+		f.Limit = n
+	}
+	return f, true
+}
+
+// audit records action in the audit log once the request has been handled.
+// The actor is the authorized user, empty for anonymous requests, and the target is read
+// from targetField. Handlers may override the target and add details by setting
+// "auditTarget" and "auditDetail" in the context.
+func (s *Server) audit(action, targetField string) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		ctx.Next()
+		e := storage.AuditEvent{
+			Time:      time.Now().Unix(),
+			Actor:     ctx.GetString("username"),
+			Action:    action,
+			Detail:    ctx.GetString("auditDetail"),
+			IP:        s.clientIP(ctx),
+			UserAgent: ctx.Request.UserAgent(),
+			Status:    ctx.Writer.Status(),
+			Reason:    ctx.Writer.Header().Get("X-Status-Reason"),
+		}
+		if t, ok := ctx.Get("auditTarget"); ok {
+			e.Target = t.(string)
+		} else if targetField != "" {
+			e.Target = ctx.PostForm(targetField)
+		}
+		err := s.store.AppendAudit(e)
+		if err != nil {
+			logger(ctx).Errorf("Failed to record %s by %s in audit log: %v\n", action, e.Actor, err)
+		}
+	}
+}
+
+// auditRead records a call of the read-only endpoint name under the read action, so that
+// reads can be told apart from changes.
+func (s *Server) auditRead(name, targetField string) gin.HandlerFunc {
+	record := s.audit("read", targetField)
+	return func(ctx *gin.Context) {
+		ctx.Set("auditDetail", name)
+		record(ctx)
+	}
+}
@@ -0,0 +1,80 @@
+package http
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	sessionCookie = "sessionId"
+	// Readable by the web interface, which sends the value back in csrfHeader
+	csrfCookie = "csrfToken"
+	csrfHeader = "X-CSRF-Token"
+)
+
+// csrf rejects state-changing /api requests authorized by a session cookie unless they carry
+// the CSRF token of the session. The token is derived from the session id, so it cannot be
+// planted with a cookie of its own. /api routes are only authorized by the session cookie,
+// so any other header such as Authorization does not exempt a request.
+func (s *Server) csrf() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		if !strings.HasPrefix(ctx.Request.URL.Path, "/api/") {
+			return
+		}
+		sid, err := ctx.Cookie(sessionCookie)
+		if err != nil {
+			return
+		}
+		ses, err := s.store.GetSession(sid)
+		if err != nil || time.Now().After(ses.Expire) {
+			return
+		}
+		token := s.csrfToken(sid)
+		// Sessions created before the token cookie existed get it with their next request
+		if c, err := ctx.Cookie(csrfCookie); err != nil || c != token {
+			s.setCookie(ctx, &http.Cookie{Name: csrfCookie, Value: token, Path: "/"})
+		}
+		switch ctx.Request.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions:
+			return
+		}
+		got := ctx.GetHeader(csrfHeader)
+		if got == "" {
+			got = ctx.PostForm("csrfToken")
+		}
+		if subtle.ConstantTimeCompare([]byte(got), []byte(token)) != 1 {
+			fail(ctx, &apiError{http.StatusForbidden, "CSRF_TOKEN_INVALID"})
+		}
+	}
+}
+
+func (s *Server) csrfToken(sid string) string {
+	mac := hmac.New(sha256.New, []byte(s.secret))
+	mac.Write([]byte("csrf:" + sid))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// setCookie sets c with the configured Secure and SameSite attributes, unless c sets SameSite itself.
+func (s *Server) setCookie(ctx *gin.Context, c *http.Cookie) {
+	switch s.cookieCfg.Secure {
+	case "always":
+		c.Secure = true
+	case "never":
+	default:
+		_, trusted := s.peer(ctx)
+		c.Secure = ctx.Request.TLS != nil || trusted && strings.EqualFold(ctx.GetHeader("X-Forwarded-Proto"), "https")
+	}
+	if c.SameSite == 0 {
+		c.SameSite = http.SameSiteLaxMode
+		if strings.EqualFold(s.cookieCfg.SameSite, "strict") {
+			c.SameSite = http.SameSiteStrictMode
+		}
+	}
+	http.SetCookie(ctx.Writer, c)
+}
@@ -0,0 +1,246 @@
+package http
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"github.com/SeraphJACK/go-annil/config"
+	"github.com/SeraphJACK/go-annil/logging"
+	"github.com/SeraphJACK/go-annil/mail"
+	"github.com/SeraphJACK/go-annil/storage"
+	"github.com/SeraphJACK/go-annil/throttle"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	netmail "net/mail"
+	"net/url"
+	"strings"
+	"time"
+)
+
+type AccountEmail struct {
+	Email    string `json:"email"`
+	Verified bool   `json:"verified"`
+}
+
+// mailData is passed to the message templates.
+type mailData struct {
+	Username string
+	URL      string
+	// How long the link can be used
+	Valid string
+}
+
+func (s *Server) regEmailEndpoints(r *gin.Engine) {
+	r.POST("/api/accountEmail", s.requireSession(), func(ctx *gin.Context) {
+		email, verified := s.store.UserEmail(ctx.GetString("username"))
+		ctx.JSON(http.StatusOK, AccountEmail{Email: email, Verified: verified})
+	})
+	// Changes the email address and sends a verification link to it, an empty address removes it
+	r.POST("/api/setEmail", s.audit("setEmail", "email"), s.requireSession(), func(ctx *gin.Context) {
+		if e := s.setEmail(ctx, ctx.GetString("username"), ctx.PostForm("email")); e != nil {
+			fail(ctx, e)
+			return
+		}
+		ctx.Status(http.StatusOK)
+	})
+	r.POST("/api/verifyEmail", s.audit("verifyEmail", ""), func(ctx *gin.Context) {
+		t, err := s.store.UseMailToken(ctx.PostForm("token"), storage.MailTokenVerify)
+		if err != nil {
+			ctx.Header("X-Status-Reason", "INVALID_TOKEN")
+			ctx.Status(http.StatusForbidden)
+			return
+		}
+		ctx.Set("auditTarget", t.Username)
+		if s.emailInUse(t.Email, t.Username) {
+			ctx.Header("X-Status-Reason", "EMAIL_IN_USE")
+			ctx.Status(http.StatusConflict)
+			return
+		}
+		if err = s.store.VerifyEmail(t.Username, t.Email); err != nil {
+			// The address was changed after the link was sent
+			ctx.Header("X-Status-Reason", "INVALID_TOKEN")
+			ctx.Status(http.StatusForbidden)
+			return
+		}
+		ctx.Status(http.StatusOK)
+	})
+
+	// Sends a reset link to the verified address of the user named by username or email.
+	// The response is the same whether or not a link was sent, so it does not reveal users.
+	r.POST("/api/requestPasswordReset", s.audit("requestPasswordReset", "username"), s.requireMail(), func(ctx *gin.Context) {
+		username := ctx.PostForm("username")
+		email, verified := s.store.UserEmail(username)
+		if e, ok := parseEmail(ctx.PostForm("email")); ok && e != "" {
+			username, _ = s.store.EmailUser(e)
+			email, verified = e, username != ""
+		}
+		if verified {
+			ctx.Set("auditTarget", username)
+			if wait, _ := s.resetMails.Attempt(username); wait > 0 {
+				ctx.Set("auditDetail", "throttled")
+			} else {
+				s.sendMailToken(ctx, username, email, storage.MailTokenReset, "reset", "/reset-password", time.Duration(s.mailCfg.ResetMinutes)*time.Minute)
+			}
+		}
+		ctx.Status(http.StatusOK)
+	})
+	r.POST("/api/resetPassword", s.audit("resetPassword", ""), func(ctx *gin.Context) {
+		password := ctx.PostForm("password")
+		if len(password) < 5 {
+			ctx.Header("X-Status-Reason", "PASSWORD_TOO_SHORT")
+			ctx.Status(http.StatusForbidden)
+			return
+		}
+		t, err := s.store.UseMailToken(ctx.PostForm("token"), storage.MailTokenReset)
+		if err == nil {
+			// Links sent to an address the user has since removed are void
+			if email, verified := s.store.UserEmail(t.Username); !verified || email != t.Email {
+				err = storage.ErrInvalidMailToken
+			}
+		}
+		if err != nil {
+			ctx.Header("X-Status-Reason", "INVALID_TOKEN")
+			ctx.Status(http.StatusForbidden)
+			return
+		}
+		ctx.Set("auditTarget", t.Username)
+		err = s.store.ChangePassword(t.Username, password)
+		if err == nil {
+			err = s.store.DeleteUserSessions(t.Username)
+		}
+		if err != nil {
+			ctx.Status(http.StatusInternalServerError)
+			logger(ctx).Errorf("Failed to reset password of %s: %v\n", t.Username, err)
+			return
+		}
+		s.userLogins.Reset(t.Username)
+		s.resetMails.Reset(t.Username)
+		ctx.Status(http.StatusOK)
+	})
+}
+
+func (s *Server) requireMail() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		if s.mailer == nil {
+			ctx.Header("X-Status-Reason", "MAIL_DISABLED")
+			ctx.AbortWithStatus(http.StatusNotFound)
+		}
+	}
+}
+
+// setEmail changes the address of username and sends a verification link to it.
+func (s *Server) setEmail(ctx *gin.Context, username, rawEmail string) *apiError {
+	email, ok := parseEmail(rawEmail)
+	if !ok {
+		return &apiError{http.StatusBadRequest, "INVALID_EMAIL"}
+	}
+	if email != "" && s.emailInUse(email, username) {
+		return &apiError{http.StatusConflict, "EMAIL_IN_USE"}
+	}
+	if err := s.store.SetEmail(username, email); err != nil {
+		logger(ctx).Errorf("Failed to set email of %s: %v\n", username, err)
+		return &apiError{Status: http.StatusInternalServerError}
+	}
+	if email != "" {
+		s.sendVerification(ctx, username, email)
+	}
+	return nil
+}
+
+// parseEmail normalizes a bare email address, an empty one is valid.
+func parseEmail(s string) (string, bool) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return "", true
+	}
+	a, err := netmail.ParseAddress(s)
+	if err != nil || a.Name != "" || a.Address != s {
+		return "", false
+	}
+	return strings.ToLower(s), true
+}
+
+// emailInUse reports whether another user than username verified email.
+func (s *Server) emailInUse(email, username string) bool {
+	u, err := s.store.EmailUser(email)
+	return err == nil && u != username
+}
+
+func (s *Server) sendVerification(ctx *gin.Context, username, email string) {
+	if s.mailer == nil {
+		return
+	}
+	s.sendMailToken(ctx, username, email, storage.MailTokenVerify, "verify", "/verify-email", time.Duration(s.mailCfg.VerifyHours)*time.Hour)
+}
+
+// sendMailToken sends a link with a new token of purpose in the background,
+// so the time a request takes does not tell whether a message was sent.
+func (s *Server) sendMailToken(ctx *gin.Context, username, email, purpose, template, path string, valid time.Duration) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		logger(ctx).Errorf("Failed to generate %s token for %s: %v\n", purpose, username, err)
+		return
+	}
+	token := base64.RawURLEncoding.EncodeToString(b)
+	err := s.store.NewMailToken(token, storage.MailToken{
+		Username: username,
+		Purpose:  purpose,
+		Email:    email,
+		Expire:   time.Now().Add(valid).Unix(),
+	})
+	if err != nil {
+		logger(ctx).Errorf("Failed to save %s token for %s: %v\n", purpose, username, err)
+		return
+	}
+	data := mailData{
+		Username: username,
+		URL:      strings.TrimSuffix(s.mailCfg.BaseURL, "/") + path + "?token=" + url.QueryEscape(token),
+		Valid:    formatDuration(valid),
+	}
+	l := logger(ctx)
+	go func() {
+		if err := s.mailer.Send(email, template, data); err != nil {
+			l.Errorf("Failed to send %s mail to %s: %v\n", template, username, err)
+		}
+	}()
+}
+
+func formatDuration(d time.Duration) string {
+	if d%time.Hour == 0 {
+		if d == time.Hour {
+			return "1 hour"
+		}
+		return fmt.Sprintf("%d hours", d/time.Hour)
+	}
+	return fmt.Sprintf("%d minutes", d/time.Minute)
+}
+
+func newMailer(cfg config.MailConfig) *mail.Mailer {
+	if !cfg.Enabled {
+		return nil
+	}
+	m, err := mail.New(mail.Config{
+		Host:        cfg.Host,
+		Port:        cfg.Port,
+		Username:    cfg.Username,
+		Password:    cfg.Password,
+		From:        cfg.From,
+		TLS:         cfg.TLS,
+		TemplateDir: cfg.TemplateDir,
+	})
+	if err != nil {
+		logging.Default().Error("Failed to load mail templates, mail is disabled", "err", err)
+		return nil
+	}
+	return m
+}
+
+// resetMailLimiter allows a few reset messages per user and hour, so nobody can flood a mailbox.
+func resetMailLimiter() *throttle.Limiter {
+	return throttle.New(throttle.Policy{
+		Free:     3,
+		Delay:    time.Minute,
+		MaxDelay: time.Hour,
+		Window:   time.Hour,
+	})
+}
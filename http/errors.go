@@ -0,0 +1,76 @@
+package http
+
+import (
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"strings"
+)
+
+// apiError rejects a request. Reason is a machine-readable code, which v1 endpoints send
+// in the X-Status-Reason header and v2 endpoints in the error body.
+type apiError struct {
+	Status int
+	Reason string
+}
+
+// ErrorBody is the body of failed /api/v2 requests.
+type ErrorBody struct {
+	Error ErrorDetail `json:"error"`
+}
+
+type ErrorDetail struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// Codes of errors which have no reason of their own
+var statusCodes = map[int]string{
+	http.StatusBadRequest:          "INVALID_REQUEST",
+	http.StatusUnauthorized:        "UNAUTHORIZED",
+	http.StatusForbidden:           "FORBIDDEN",
+	http.StatusNotFound:            "NOT_FOUND",
+	http.StatusConflict:            "CONFLICT",
+	http.StatusTooManyRequests:     "TOO_MANY_REQUESTS",
+	http.StatusInternalServerError: "INTERNAL_ERROR",
+	http.StatusServiceUnavailable:  "UNAVAILABLE",
+}
+
+var reasonMessages = map[string]string{
+	"USERNAME_UNAVAILABLE":     "The username is taken or invalid.",
+	"PASSWORD_TOO_SHORT":       "The password must be at least 5 characters long.",
+	"WRONG_OLD_PASSWORD":       "The current password is wrong.",
+	"INVALID_INVITE_CODE":      "The invite code is invalid, used up or expired.",
+	"INVALID_EMAIL":            "The email address is invalid.",
+	"EMAIL_REQUIRED":           "An email address is required.",
+	"EMAIL_IN_USE":             "The email address belongs to another user.",
+	"UNKNOWN_ROLE":             "The role does not exist.",
+	"UNKNOWN_GROUP":            "The group does not exist.",
+	"LAST_OWNER":               "The last owner cannot be removed.",
+	"PASSWORD_CHANGE_REQUIRED": "The password has to be changed first.",
+	"TOTP_ENROLLMENT_REQUIRED": "Two-factor authentication has to be set up first.",
+	"CSRF_TOKEN_INVALID":       "The CSRF token is missing or wrong.",
+}
+
+// fail aborts the request with e, in the format of the API version the request was made to.
+func fail(ctx *gin.Context, e *apiError) {
+	if !strings.HasPrefix(ctx.Request.URL.Path, "/api/v2/") {
+		if e.Reason != "" {
+			ctx.Header("X-Status-Reason", e.Reason)
+		}
+		ctx.AbortWithStatus(e.Status)
+		return
+	}
+	d := ErrorDetail{Code: e.Reason, Message: reasonMessages[e.Reason]}
+	if d.Code == "" {
+		d.Code = statusCodes[e.Status]
+	}
+	if d.Code == "" {
+		d.Code = "ERROR"
+	}
+	if d.Message == "" {
+		d.Message = http.StatusText(e.Status)
+	}
+	// The reason header is kept, so the audit log records the code for both versions
+	ctx.Header("X-Status-Reason", d.Code)
+	ctx.AbortWithStatusJSON(e.Status, ErrorBody{Error: d})
+}
@@ -1,22 +1,164 @@
 package http
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"github.com/SeraphJACK/go-annil/config"
+	"github.com/SeraphJACK/go-annil/web"
 	"github.com/gin-gonic/gin"
-	"github.com/markbates/pkger"
+	"io"
+	"io/fs"
+	"mime"
 	"net/http"
+	"os"
+	"path"
+	"regexp"
+	"strconv"
 	"strings"
+	"sync"
 )
 
-func serveFrontend(ctx *gin.Context) {
-	f, err := pkger.Open("/front-end")
-	if err != nil {
-		ctx.String(http.StatusNotFound, "front-end files not found")
+// frontend serves a built single-page front-end.
+type frontend struct {
+	files fs.FS
+	// ETags of files without a modification time, which are embedded and never change
+	etags sync.Map
+}
+
+// newFrontend serves the directory of cfg, or the bundled front-end if it is not set.
+func newFrontend(cfg config.FrontendConfig) *frontend {
+	if cfg.Dir != "" {
+		return &frontend{files: os.DirFS(cfg.Dir)}
+	}
+	return &frontend{files: web.FS()}
+}
+
+// adminConsole is the bundled admin console, which is served below /admin/ whichever front-end is configured.
+func adminConsole() *frontend {
+	return &frontend{files: web.Admin()}
+}
+
+// File names with a content hash, such as app.3f2a9c1b.js or index-B7x2kQ9a.css
+var hashedExp = regexp.MustCompile(`[.-]([0-9a-zA-Z_]{8,})\.[0-9a-z]+$`)
+
+// Precompressed variants, in order of preference
+var encodings = []struct{ name, ext string }{{"br", ".br"}, {"gzip", ".gz"}}
+
+// serve serves the file at p, the path of the request below the root of the front-end.
+func (f *frontend) serve(ctx *gin.Context, p string) {
+	if ctx.Request.Method != http.MethodGet && ctx.Request.Method != http.MethodHead {
+		ctx.String(http.StatusMethodNotAllowed, "405 method not allowed")
 		return
 	}
-	defer f.Close()
-	if strings.HasPrefix(ctx.Request.URL.Path, "/.") {
+	p = path.Clean("/" + p)
+	if strings.Contains(p, "/.") {
 		ctx.String(http.StatusNotFound, "404 not found")
 		return
 	}
-	http.FileServer(f).ServeHTTP(ctx.Writer, ctx.Request)
+	name := strings.TrimPrefix(p, "/")
+	if name == "" {
+		name = "index.html"
+	}
+	info, err := fs.Stat(f.files, name)
+	if err == nil && info.IsDir() {
+		name = path.Join(name, "index.html")
+		_, err = fs.Stat(f.files, name)
+	}
+	if err != nil {
+		// Routes of the app have no extension and fall back to index.html, missing assets do not
+		if path.Ext(name) != "" {
+			ctx.String(http.StatusNotFound, "404 not found")
+			return
+		}
+		name = "index.html"
+	}
+	f.serveFile(ctx, name)
+}
+
+// serveFile serves name, or a precompressed variant of it accepted by the client.
+func (f *frontend) serveFile(ctx *gin.Context, name string) {
+	h := ctx.Writer.Header()
+	if m := hashedExp.FindStringSubmatch(path.Base(name)); m != nil && strings.ContainsAny(m[1], "0123456789") {
+		h.Set("Cache-Control", "public, max-age=31536000, immutable")
+	} else {
+		h.Set("Cache-Control", "no-cache")
+	}
+	h.Set("Vary", "Accept-Encoding")
+	served := name
+	for _, enc := range encodings {
+		if !acceptsEncoding(ctx.GetHeader("Accept-Encoding"), enc.name) {
+			continue
+		}
+		if _, err := fs.Stat(f.files, name+enc.ext); err == nil {
+			served = name + enc.ext
+			h.Set("Content-Encoding", enc.name)
+			break
+		}
+	}
+
+	file, err := f.files.Open(served)
+	if err != nil {
+		logger(ctx).Errorf("Failed to open front-end file %s: %v\n", served, err)
+		ctx.String(http.StatusInternalServerError, "500 internal server error")
+		return
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		logger(ctx).Errorf("Failed to open front-end file %s: %v\n", served, err)
+		ctx.String(http.StatusInternalServerError, "500 internal server error")
+		return
+	}
+	content, ok := file.(io.ReadSeeker)
+	if !ok {
+		b, err := io.ReadAll(file)
+		if err != nil {
+			logger(ctx).Errorf("Failed to read front-end file %s: %v\n", served, err)
+			ctx.String(http.StatusInternalServerError, "500 internal server error")
+			return
+		}
+		content = bytes.NewReader(b)
+	}
+	if t := mime.TypeByExtension(path.Ext(name)); t != "" {
+		h.Set("Content-Type", t)
+	} else if served != name {
+		h.Set("Content-Type", "application/octet-stream")
+	}
+	if info.ModTime().IsZero() {
+		h.Set("ETag", f.etag(served, content))
+	}
+	http.ServeContent(ctx.Writer, ctx.Request, name, info.ModTime(), content)
+}
+
+func (f *frontend) etag(name string, content io.ReadSeeker) string {
+	if tag, ok := f.etags.Load(name); ok {
+		return tag.(string)
+	}
+	sum := sha256.New()
+	_, _ = io.Copy(sum, content)
+	_, _ = content.Seek(0, io.SeekStart)
+	tag := fmt.Sprintf(`"%x"`, sum.Sum(nil)[:12])
+	f.etags.Store(name, tag)
+	return tag
+}
+
+// acceptsEncoding reports whether an Accept-Encoding header allows encoding.
+func acceptsEncoding(header, encoding string) bool {
+	for _, part := range strings.Split(header, ",") {
+		params := strings.Split(part, ";")
+		if strings.TrimSpace(params[0]) != encoding {
+			continue
+		}
+		for _, p := range params[1:] {
+			p = strings.TrimSpace(p)
+			if strings.HasPrefix(p, "q=") {
+				if q, err := strconv.ParseFloat(p[2:], 64); err == nil && q == 0 {
+					return false
+				}
+			}
+		}
+		return true
+	}
+	return false
 }
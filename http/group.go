@@ -0,0 +1,113 @@
+package http
+
+import (
+	"fmt"
+	"github.com/SeraphJACK/go-annil/acl"
+	"github.com/SeraphJACK/go-annil/storage"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"strconv"
+)
+
+func (s *Server) regGroupEndpoints(r *gin.Engine) {
+	r.POST("/api/listBackends", s.requirePermission(storage.PermManageGroups), func(ctx *gin.Context) {
+		ctx.JSON(http.StatusOK, s.backends().Names)
+	})
+	r.POST("/api/createGroup", s.audit("createGroup", "name"), s.requirePermission(storage.PermManageGroups), func(ctx *gin.Context) {
+		name := ctx.PostForm("name")
+		if s.store.GroupExists(name) || !usernameExp.MatchString(name) {
+			ctx.Header("X-Status-Reason", "GROUP_NAME_UNAVAILABLE")
+			ctx.Status(http.StatusConflict)
+			return
+		}
+		err := s.store.NewGroup(name)
+		if err != nil {
+			ctx.Status(http.StatusInternalServerError)
+			logger(ctx).Errorf("Failed to create group %s: %v\n", name, err)
+		} else {
+			ctx.Status(http.StatusOK)
+		}
+	})
+	r.POST("/api/deleteGroup", s.audit("deleteGroup", "name"), s.requirePermission(storage.PermManageGroups), func(ctx *gin.Context) {
+		name := ctx.PostForm("name")
+		if !s.store.GroupExists(name) {
+			ctx.Status(http.StatusNotFound)
+			return
+		}
+		err := s.store.DeleteGroup(name)
+		if err != nil {
+			ctx.Status(http.StatusInternalServerError)
+			logger(ctx).Errorf("Failed to delete group %s: %v\n", name, err)
+		} else {
+			ctx.Status(http.StatusOK)
+		}
+	})
+	r.POST("/api/listGroups", s.requirePermission(storage.PermManageGroups), func(ctx *gin.Context) {
+		ctx.JSON(http.StatusOK, s.store.ListGroups())
+	})
+	r.POST("/api/addGroupMember", s.audit("addGroupMember", "username"), s.requirePermission(storage.PermManageGroups), func(ctx *gin.Context) {
+		group := ctx.PostForm("group")
+		member := ctx.PostForm("username")
+		ctx.Set("auditDetail", "group="+group)
+		if !s.store.GroupExists(group) || !s.store.UserExists(member) {
+			ctx.Status(http.StatusNotFound)
+			return
+		}
+		err := s.store.AddGroupMember(group, member)
+		if err != nil {
+			ctx.Status(http.StatusInternalServerError)
+			logger(ctx).Errorf("Failed to add %s to group %s: %v\n", member, group, err)
+		} else {
+			ctx.Status(http.StatusOK)
+		}
+	})
+	r.POST("/api/removeGroupMember", s.audit("removeGroupMember", "username"), s.requirePermission(storage.PermManageGroups), func(ctx *gin.Context) {
+		group := ctx.PostForm("group")
+		member := ctx.PostForm("username")
+		ctx.Set("auditDetail", "group="+group)
+		err := s.store.RemoveGroupMember(group, member)
+		if err != nil {
+			ctx.Status(http.StatusInternalServerError)
+			logger(ctx).Errorf("Failed to remove %s from group %s: %v\n", member, group, err)
+		} else {
+			ctx.Status(http.StatusOK)
+		}
+	})
+	r.POST("/api/listAccessRules", s.requirePermission(storage.PermManageGroups), func(ctx *gin.Context) {
+		ctx.JSON(http.StatusOK, s.store.ListAccessRules(ctx.PostForm("group")))
+	})
+	r.POST("/api/addAccessRule", s.audit("addAccessRule", "group"), s.requirePermission(storage.PermManageGroups), func(ctx *gin.Context) {
+		group := ctx.PostForm("group")
+		pattern := ctx.PostForm("pattern")
+		if !s.store.GroupExists(group) {
+			ctx.Status(http.StatusNotFound)
+			return
+		}
+		if !acl.ValidPattern(pattern) {
+			ctx.Header("X-Status-Reason", "INVALID_PATTERN")
+			ctx.Status(http.StatusBadRequest)
+			return
+		}
+		ctx.Set("auditDetail", fmt.Sprintf("backend=%s pattern=%s", ctx.PostForm("backend"), pattern))
+		id, err := s.store.AddAccessRule(group, ctx.PostForm("backend"), pattern)
+		if err != nil {
+			ctx.Status(http.StatusInternalServerError)
+			logger(ctx).Errorf("Failed to add access rule for group %s: %v\n", group, err)
+		} else {
+			ctx.String(http.StatusOK, strconv.FormatInt(id, 10))
+		}
+	})
+	r.POST("/api/removeAccessRule", s.audit("removeAccessRule", "id"), s.requirePermission(storage.PermManageGroups), func(ctx *gin.Context) {
+		id, err := strconv.ParseInt(ctx.PostForm("id"), 10, 64)
+		if err != nil {
+			ctx.Status(http.StatusBadRequest)
+			return
+		}
+		err = s.store.RemoveAccessRule(id)
+		if err != nil {
+			ctx.Status(http.StatusInternalServerError)
+		} else {
+			ctx.Status(http.StatusOK)
+		}
+	})
+}
@@ -2,44 +2,220 @@ package http
 
 import (
 	"fmt"
+	"github.com/SeraphJACK/go-annil/acl"
+	"github.com/SeraphJACK/go-annil/auth"
 	"github.com/SeraphJACK/go-annil/backend"
 	"github.com/SeraphJACK/go-annil/config"
+	"github.com/SeraphJACK/go-annil/logging"
+	"github.com/SeraphJACK/go-annil/mail"
+	"github.com/SeraphJACK/go-annil/oidc"
+	"github.com/SeraphJACK/go-annil/storage"
+	"github.com/SeraphJACK/go-annil/throttle"
+	"github.com/SeraphJACK/go-annil/token"
 	"github.com/gin-gonic/gin"
+	"net"
+	"net/http"
+	"sync"
+	"time"
 )
 
-var r = gin.Default()
+// Server serves the Anni library and the user API from a store and a set of backends.
+type Server struct {
+	store  storage.Store
+	secret string
+	tokens *token.Manager
+	auth   *auth.Authenticator
+	// Swapped on reload, read through backends()
+	be     *backend.Multiplexer
+	beMu   sync.RWMutex
+	engine *gin.Engine
+	// Proxies whose X-Forwarded-For is believed by clientIP
+	trustedProxies []*net.IPNet
+	// Failed logins per username and per IP
+	userLogins *throttle.Limiter
+	ipLogins   *throttle.Limiter
+	setupMu    sync.Mutex
+	// Logins waiting for a second factor
+	tickets loginTickets
+	// OpenID provider, nil if OIDC login is disabled
+	oidc       *oidc.Provider
+	oidcCfg    config.OIDCConfig
+	oidcStates oidcStates
+	// Mailer, nil if mail is disabled
+	mailer     *mail.Mailer
+	mailCfg    config.MailConfig
+	resetMails *throttle.Limiter
+	cookieCfg  config.CookieConfig
+	metrics    *serverMetrics
+	metricsCfg config.MetricsConfig
+	front      *frontend
+	admin      *frontend
+	// Separate metrics listener, nil if metrics are served on the main listener
+	metricsSrv  *http.Server
+	shutdownCfg config.ShutdownConfig
+	srvMu       sync.Mutex
+	srv         *http.Server
+	stopping    bool
+	// 1 while the server listens and is not shutting down
+	ready    int32
+	done     chan struct{}
+	stopOnce sync.Once
+	// Configuration in effect, which reloads are compared against
+	running  config.Config
+	reloadMu sync.Mutex
+}
+
+func NewServer(store storage.Store, secret string, be *backend.Multiplexer) *Server {
+	s := &Server{
+		store:  store,
+		secret: secret,
+		tokens: token.NewManager(store, secret),
+		auth:   newAuthenticator(store, config.Cfg.LDAP),
+		engine: gin.New(),
+		done:   make(chan struct{}),
+	}
+	s.metrics = newServerMetrics(store)
+	s.metricsCfg = config.Cfg.Metrics
+	s.be = instrument(be, s.metrics)
+	s.trustedProxies = parseProxies(config.Cfg.TrustedProxies)
+	s.userLogins, s.ipLogins = loginLimiters(config.Cfg.Login)
+	s.oidcCfg = config.Cfg.OIDC
+	s.oidc = newOIDCProvider(s.oidcCfg)
+	s.mailCfg = config.Cfg.Mail
+	s.mailer = newMailer(s.mailCfg)
+	s.resetMails = resetMailLimiter()
+	s.cookieCfg = config.Cfg.Cookies
+	s.shutdownCfg = config.Cfg.Shutdown
+	s.front = newFrontend(config.Cfg.Frontend)
+	s.admin = adminConsole()
+	s.running = config.Cfg
+	s.running.Secret = secret
+
+	s.engine.Use(s.logRequests(), s.trace(), gin.RecoveryWithWriter(logging.Writer(logging.Default(), logging.Error)), s.measure(), s.csrf())
+
+	s.regAnniEndpoints(s.engine)
+	s.regUserEndpoints(s.engine)
+	s.regGroupEndpoints(s.engine)
+	s.regRoleEndpoints(s.engine)
+	s.regAuditEndpoints(s.engine)
+	s.regTotpEndpoints(s.engine)
+	s.regOIDCEndpoints(s.engine)
+	s.regEmailEndpoints(s.engine)
+	s.regV2Endpoints(s.engine)
+	s.regOpenAPIEndpoints(s.engine)
+	s.regMetricsEndpoints(s.engine)
+	s.regHealthEndpoints(s.engine)
+	s.regReloadEndpoints(s.engine)
+	s.regAdminEndpoints(s.engine)
+
+	// Static files
+	s.engine.NoRoute(s.noRoute)
+	return s
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	s.engine.ServeHTTP(w, req)
+}
+
+func loginLimiters(cfg config.LoginConfig) (user, ip *throttle.Limiter) {
+	p := throttle.Policy{
+		Free:       cfg.FreeAttempts,
+		Delay:      time.Duration(cfg.Delay) * time.Second,
+		MaxDelay:   time.Duration(cfg.MaxDelay) * time.Second,
+		Lockout:    cfg.LockoutAttempts,
+		LockoutFor: time.Duration(cfg.LockoutMinutes) * time.Minute,
+		Window:     time.Duration(cfg.WindowMinutes) * time.Minute,
+	}
+	user = throttle.New(p)
+	p.Free = cfg.IPFreeAttempts
+	p.Lockout = cfg.IPLockoutAttempts
+	ip = throttle.New(p)
+	return
+}
 
-var be backend.Backend
+// newAuthenticator checks passwords of local accounts, and of directory users if LDAP is enabled.
+func newAuthenticator(store storage.Store, cfg config.LDAPConfig) *auth.Authenticator {
+	local := auth.NewLocal(store)
+	if !cfg.Enabled {
+		return auth.New(store, false, local)
+	}
+	directory := auth.NewLDAP(cfg)
+	switch cfg.Fallback {
+	case "never":
+		return auth.New(store, false, directory)
+	case "unavailable":
+		return auth.New(store, true, directory, local)
+	case "unknown", "":
+	default:
+		logging.Default().Warn("Unknown ldap fallback, only checking local accounts of unknown users", "fallback", cfg.Fallback)
+	}
+	return auth.New(store, false, directory, local)
+}
 
-func Init() error {
+// NewBackend builds the multiplexer of the configured backends.
+func NewBackend(entries []config.BackendEntry) (*backend.Multiplexer, error) {
 	backends := make([]backend.Backend, 0)
-	for _, entry := range config.Cfg.Backends {
+	names := make([]string, 0)
+	for _, entry := range entries {
+		if entry.Name != "" {
+			names = append(names, entry.Name)
+		} else {
+			names = append(names, entry.Path)
+		}
 		switch entry.Type {
 		case "file":
 			{
 				be, err := backend.NewFileBackend(entry.Path)
 				if err != nil {
-					return fmt.Errorf("failed to initialize backend: %v", err)
+					return nil, fmt.Errorf("failed to initialize backend: %v", err)
 				}
 				backends = append(backends, be)
 			}
 		case "relay":
 			{
-				be := backend.NewRelay(entry.Path, entry.Auth)
+				be := backend.NewCachedRelay(entry.Path, entry.Auth, int64(entry.CacheMB)<<20)
 				backends = append(backends, be)
 			}
 		default:
-			return fmt.Errorf("unknwon backend type: %s", entry.Type)
+			return nil, fmt.Errorf("unknwon backend type: %s", entry.Type)
 		}
 	}
+	return backend.NewNamedMultiplexer(names, backends), nil
+}
 
-	be = backend.NewMultiplexer(backends)
-
-	regAnniEndpoints(r)
-	regUserEndpoints(r)
+// Init creates the server of the configured backends and starts its background jobs.
+// It is served with ListenAndServe and stopped with Shutdown.
+func Init(store storage.Store) (*Server, error) {
+	if !logging.Default().Enabled(logging.Debug) {
+		gin.SetMode(gin.ReleaseMode)
+	}
+	be, err := NewBackend(config.Cfg.Backends)
+	if err != nil {
+		return nil, err
+	}
+	s := NewServer(store, config.Cfg.Secret, be)
+	go s.cleanup()
 
-	// Static files
-	r.NoRoute(serveFrontend)
+	if m := s.metricsCfg; m.Enabled && m.Listen != "" {
+		s.metricsSrv = &http.Server{Addr: m.Listen, Handler: http.HandlerFunc(s.serveMetrics)}
+		go func() {
+			if err := s.metricsSrv.ListenAndServe(); err != http.ErrServerClosed {
+				logging.Default().Error("Failed to serve metrics", "err", err)
+			}
+		}()
+	} else if m.Enabled && m.Token == "" {
+		logging.Default().Warn("Metrics need a token or a listen address of their own, not serving them")
+	}
+	return s, nil
+}
 
-	return r.Run(config.Cfg.Listen)
+// library returns the part of the library username may access.
+// Nothing is accessible if the access rules of username cannot be read.
+func (s *Server) library(ctx *gin.Context, username string) *backend.Restricted {
+	p, err := acl.ForUser(s.store, username)
+	if err != nil {
+		logger(ctx).Errorf("Failed to read access rules of %s: %v\n", username, err)
+		return s.backends().Restrict(func(string, string) bool { return false })
+	}
+	return s.backends().Restrict(p.Allow)
 }
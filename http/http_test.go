@@ -0,0 +1,1404 @@
+package http
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/SeraphJACK/go-annil/backend"
+	"github.com/SeraphJACK/go-annil/config"
+	"github.com/SeraphJACK/go-annil/logging"
+	"github.com/SeraphJACK/go-annil/mail/mailtest"
+	"github.com/SeraphJACK/go-annil/oidc/oidctest"
+	"github.com/SeraphJACK/go-annil/storage"
+	"github.com/SeraphJACK/go-annil/throttle"
+	"github.com/SeraphJACK/go-annil/totp"
+	"github.com/SeraphJACK/go-annil/tracing"
+	"github.com/gin-gonic/gin"
+	"io"
+	"io/ioutil"
+	"mime/quotedprintable"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+)
+
+func init() {
+	gin.SetMode(gin.TestMode)
+	logging.SetDefault(logging.New(ioutil.Discard, logging.Error, logging.FormatLogfmt))
+}
+
+// newTestServer serves two catalogs from a temporary directory with an in-memory store.
+func newTestServer(t *testing.T) (*Server, storage.Store) {
+	dir := t.TempDir()
+	for _, c := range []string{"LACA-12345", "KICA-1234"} {
+		err := os.MkdirAll(filepath.Join(dir, c), 0755)
+		if err != nil {
+			t.Fatalf("failed to create catalog: %v", err)
+		}
+		err = ioutil.WriteFile(filepath.Join(dir, c, "cover.jpg"), []byte("cover"), 0644)
+		if err != nil {
+			t.Fatalf("failed to create cover: %v", err)
+		}
+		err = ioutil.WriteFile(filepath.Join(dir, c, "01. Track.flac"), []byte("audio"), 0644)
+		if err != nil {
+			t.Fatalf("failed to create track: %v", err)
+		}
+	}
+	fb, err := backend.NewFileBackend(dir)
+	if err != nil {
+		t.Fatalf("failed to create backend: %v", err)
+	}
+	store := storage.NewMemoryStore()
+	if err = storage.CreateOwner(store, "Admin", "12345", false); err != nil {
+		t.Fatalf("failed to bootstrap store: %v", err)
+	}
+	be := backend.NewNamedMultiplexer([]string{"local"}, []backend.Backend{fb})
+	return NewServer(store, "secret", be), store
+}
+
+// recorder supports streamed responses, which need to be notified when the client is gone.
+type recorder struct {
+	*httptest.ResponseRecorder
+}
+
+func (recorder) CloseNotify() <-chan bool {
+	return make(chan bool)
+}
+
+func do(s *Server, method, path string, form url.Values, header http.Header) *httptest.ResponseRecorder {
+	var req *http.Request
+	if form != nil {
+		req = httptest.NewRequest(method, path, strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	} else {
+		req = httptest.NewRequest(method, path, nil)
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	w := httptest.NewRecorder()
+	s.ServeHTTP(recorder{w}, req)
+	return w
+}
+
+// login returns the session cookie of username.
+func login(t *testing.T, s *Server, username, password string) http.Header {
+	w := do(s, http.MethodPost, "/api/login", url.Values{"username": {username}, "password": {password}}, nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("failed to login as %s: %d", username, w.Code)
+	}
+	return sessionHeader(w)
+}
+
+// sessionHeader sends back the cookies set by w, along with the CSRF token like the web interface does.
+func sessionHeader(w *httptest.ResponseRecorder) http.Header {
+	h := http.Header{}
+	for _, c := range w.Result().Cookies() {
+		h.Add("Cookie", c.Name+"="+c.Value)
+		if c.Name == csrfCookie {
+			h.Set(csrfHeader, c.Value)
+		}
+	}
+	return h
+}
+
+func TestUserAPI(t *testing.T) {
+	s, store := newTestServer(t)
+	if w := do(s, http.MethodPost, "/api/login", url.Values{"username": {"Admin"}, "password": {"wrong"}}, nil); w.Code != http.StatusUnauthorized {
+		t.Errorf("wrong password accepted: %d", w.Code)
+	}
+	admin := login(t, s, "Admin", "12345")
+	if w := do(s, http.MethodPost, "/api/current", url.Values{}, admin); w.Body.String() != "Admin" {
+		t.Errorf("wrong current user: %s", w.Body.String())
+	}
+
+	w := do(s, http.MethodPost, "/api/createInviteCode", url.Values{"limit": {"1"}}, admin)
+	if w.Code != http.StatusOK {
+		t.Fatalf("failed to create invite code: %d", w.Code)
+	}
+	code := w.Body.String()
+	reg := url.Values{"username": {"alice"}, "password": {"123456"}, "inviteCode": {code}}
+	if w = do(s, http.MethodPost, "/api/register", reg, nil); w.Code != http.StatusOK {
+		t.Fatalf("failed to register: %d", w.Code)
+	}
+	reg.Set("username", "bob")
+	if w = do(s, http.MethodPost, "/api/register", reg, nil); w.Header().Get("X-Status-Reason") != "INVALID_INVITE_CODE" {
+		t.Errorf("invite code used twice: %d", w.Code)
+	}
+
+	if r := store.ListRedemptions(code); len(r) != 1 || r[0].Username != "alice" {
+		t.Errorf("wrong redemptions: %v", r)
+	}
+	_ = store.NewGroup("friends")
+	invite := url.Values{"limit": {"-1"}, "expire": {"24"}, "role": {"member"}, "groups": {"friends"}, "note": {"for friends"}}
+	if w = do(s, http.MethodPost, "/api/createInviteCode", invite, admin); w.Code != http.StatusOK {
+		t.Fatalf("failed to create invite code: %d", w.Code)
+	}
+	reg = url.Values{"username": {"carol"}, "password": {"123456"}, "inviteCode": {w.Body.String()}}
+	if w = do(s, http.MethodPost, "/api/register", reg, nil); w.Code != http.StatusOK {
+		t.Fatalf("failed to register: %d", w.Code)
+	}
+	if g, _ := store.UserGroups("carol"); store.UserRole("carol") != storage.RoleMember || len(g) != 1 {
+		t.Errorf("invite code grants not applied")
+	}
+
+	alice := login(t, s, "alice", "123456")
+	if w = do(s, http.MethodPost, "/api/createInviteCode", url.Values{"limit": {"1"}, "role": {"owner"}}, admin); w.Code != http.StatusOK {
+		t.Errorf("owner failed to create an owner invite code: %d", w.Code)
+	}
+	if w = do(s, http.MethodPost, "/api/listUsers", url.Values{}, alice); w.Code != http.StatusForbidden {
+		t.Errorf("guest listed users: %d", w.Code)
+	}
+	if w = do(s, http.MethodPost, "/api/listUsers", url.Values{}, nil); w.Code != http.StatusUnauthorized {
+		t.Errorf("anonymous listed users: %d", w.Code)
+	}
+	if w = do(s, http.MethodPost, "/api/allowShare", url.Values{"username": {"alice"}}, admin); w.Code != http.StatusOK {
+		t.Errorf("failed to allow share: %d", w.Code)
+	}
+	if store.UserRole("alice") != storage.RoleMember {
+		t.Errorf("wrong role after allowing share: %s", store.UserRole("alice"))
+	}
+	if w = do(s, http.MethodPost, "/api/revoke", url.Values{"username": {"Admin"}}, admin); w.Code != http.StatusForbidden {
+		t.Errorf("revoked the last owner: %d", w.Code)
+	}
+}
+
+func TestSetup(t *testing.T) {
+	store := storage.NewMemoryStore()
+	s := NewServer(store, "secret", backend.NewMultiplexer(nil))
+	form := url.Values{"username": {"owner"}, "password": {"123456"}}
+	// Setup is refused unless the store can tell there are no users
+	s.store = brokenCount{store}
+	if w := do(s, http.MethodPost, "/api/setup", form, nil); w.Code != http.StatusInternalServerError || store.UserExists("owner") {
+		t.Errorf("set up without counting users: %d", w.Code)
+	}
+	s.store = store
+	if w := do(s, http.MethodPost, "/api/setup", form, nil); w.Code != http.StatusOK {
+		t.Fatalf("failed to set up: %d", w.Code)
+	}
+	if store.UserRole("owner") != storage.RoleOwner {
+		t.Errorf("wrong role after setup: %s", store.UserRole("owner"))
+	}
+	form.Set("username", "another")
+	if w := do(s, http.MethodPost, "/api/setup", form, nil); w.Header().Get("X-Status-Reason") != "ALREADY_SET_UP" {
+		t.Errorf("set up twice: %d", w.Code)
+	}
+
+	// Generated passwords have to be changed first
+	_ = storage.CreateOwner(store, "Admin", "generated", true)
+	w := do(s, http.MethodPost, "/api/login", url.Values{"username": {"Admin"}, "password": {"generated"}}, nil)
+	if w.Header().Get("X-Status-Reason") != "PASSWORD_CHANGE_REQUIRED" {
+		t.Errorf("password change not required at login")
+	}
+	admin := login(t, s, "Admin", "generated")
+	if w = do(s, http.MethodPost, "/api/listUsers", url.Values{}, admin); w.Code != http.StatusForbidden {
+		t.Errorf("listed users before changing password: %d", w.Code)
+	}
+	change := url.Values{"oldPassword": {"generated"}, "newPassword": {"chosen"}}
+	if w = do(s, http.MethodPost, "/api/changePassword", change, admin); w.Code != http.StatusOK {
+		t.Fatalf("failed to change password: %d", w.Code)
+	}
+	if w = do(s, http.MethodPost, "/api/listUsers", url.Values{}, admin); w.Code != http.StatusOK {
+		t.Errorf("failed to list users after changing password: %d", w.Code)
+	}
+}
+
+func TestTotp(t *testing.T) {
+	s, store := newTestServer(t)
+	_ = store.Register("alice", "123456")
+	alice := login(t, s, "alice", "123456")
+
+	w := do(s, http.MethodPost, "/api/enrollTotp", url.Values{}, alice)
+	var enrollment TotpEnrollment
+	if err := json.Unmarshal(w.Body.Bytes(), &enrollment); err != nil {
+		t.Fatalf("failed to enroll: %v", err)
+	}
+	code, _ := totp.Code(enrollment.Secret, totp.Step(time.Now()))
+	if w = do(s, http.MethodPost, "/api/confirmTotp", url.Values{"code": {"000000"}}, alice); w.Code != http.StatusForbidden && code != "000000" {
+		t.Errorf("confirmed with a wrong code: %d", w.Code)
+	}
+	w = do(s, http.MethodPost, "/api/confirmTotp", url.Values{"code": {code}}, alice)
+	var codes []string
+	if err := json.Unmarshal(w.Body.Bytes(), &codes); err != nil || len(codes) != 10 {
+		t.Fatalf("failed to confirm: %d %v", w.Code, err)
+	}
+
+	w = do(s, http.MethodPost, "/api/login", url.Values{"username": {"alice"}, "password": {"123456"}}, nil)
+	if w.Code != http.StatusAccepted || w.Header().Get("X-Status-Reason") != "TOTP_REQUIRED" || len(w.Result().Cookies()) != 0 {
+		t.Fatalf("second factor not required: %d", w.Code)
+	}
+	ticket := w.Body.String()
+	// Codes can't be replayed
+	if w = do(s, http.MethodPost, "/api/loginTotp", url.Values{"ticket": {ticket}, "code": {code}}, nil); w.Code != http.StatusUnauthorized {
+		t.Errorf("replayed code accepted: %d", w.Code)
+	}
+	if w = do(s, http.MethodPost, "/api/loginTotp", url.Values{"ticket": {ticket}, "recoveryCode": {codes[0]}}, nil); w.Code != http.StatusOK {
+		t.Fatalf("failed to login with recovery code: %d", w.Code)
+	}
+	if w = do(s, http.MethodPost, "/api/loginTotp", url.Values{"ticket": {ticket}, "recoveryCode": {codes[1]}}, nil); w.Code != http.StatusUnauthorized {
+		t.Errorf("ticket used twice: %d", w.Code)
+	}
+	if store.RecoveryCodesLeft("alice") != 9 {
+		t.Errorf("recovery code not consumed")
+	}
+
+	// Required for admins
+	admin := login(t, s, "Admin", "12345")
+	if w = do(s, http.MethodPost, "/api/setTotpRequiredRoles", url.Values{"roles": {"owner,admin"}}, admin); w.Code != http.StatusOK {
+		t.Fatalf("failed to require totp: %d", w.Code)
+	}
+	if w = do(s, http.MethodPost, "/api/listUsers", url.Values{}, admin); w.Header().Get("X-Status-Reason") != "TOTP_ENROLLMENT_REQUIRED" {
+		t.Errorf("admin without totp listed users: %d", w.Code)
+	}
+	if w = do(s, http.MethodPost, "/api/enrollTotp", url.Values{}, admin); w.Code != http.StatusOK {
+		t.Errorf("failed to enroll while required: %d", w.Code)
+	}
+
+	// The requirement holds when it can't be read
+	_ = store.SetSetting(storage.SettingTotpRequiredRoles, "")
+	s.store = brokenSettings{store}
+	if w = do(s, http.MethodPost, "/api/listUsers", url.Values{}, admin); w.Header().Get("X-Status-Reason") != "TOTP_ENROLLMENT_REQUIRED" {
+		t.Errorf("admin without totp listed users with unreadable settings: %d", w.Code)
+	}
+	s.store = store
+}
+
+// brokenSettings fails to read settings.
+type brokenSettings struct {
+	storage.Store
+}
+
+func (brokenSettings) GetSetting(string) (string, error) {
+	return "", errors.New("database is locked")
+}
+
+func TestLoginThrottle(t *testing.T) {
+	s, _ := newTestServer(t)
+	s.userLogins = throttle.New(throttle.Policy{Free: 1, Delay: time.Minute, Lockout: 3, LockoutFor: time.Hour})
+	wrong := url.Values{"username": {"Admin"}, "password": {"wrong"}}
+	for _, c := range []struct {
+		status int
+		reason string
+	}{
+		{http.StatusUnauthorized, ""},
+		{http.StatusUnauthorized, ""},
+		{http.StatusTooManyRequests, "TOO_MANY_ATTEMPTS"},
+	} {
+		w := do(s, http.MethodPost, "/api/login", wrong, nil)
+		if w.Code != c.status || w.Header().Get("X-Status-Reason") != c.reason {
+			t.Errorf("wrong login response: %d %s, want %d %s", w.Code, w.Header().Get("X-Status-Reason"), c.status, c.reason)
+		}
+	}
+	if w := do(s, http.MethodPost, "/api/login", wrong, nil); w.Header().Get("Retry-After") != "60" {
+		t.Errorf("wrong retry after: %s", w.Header().Get("Retry-After"))
+	}
+
+	// Lock out another account, without delays
+	s.userLogins = throttle.New(throttle.Policy{Lockout: 2, LockoutFor: time.Hour})
+	_ = s.store.Register("alice", "123456")
+	for i := 0; i < 2; i++ {
+		do(s, http.MethodPost, "/api/login", url.Values{"username": {"alice"}, "password": {"wrong"}}, nil)
+	}
+	w := do(s, http.MethodPost, "/api/login", url.Values{"username": {"alice"}, "password": {"123456"}}, nil)
+	if w.Code != http.StatusForbidden || w.Header().Get("X-Status-Reason") != "ACCOUNT_LOCKED" {
+		t.Errorf("locked account logged in: %d", w.Code)
+	}
+	admin := login(t, s, "Admin", "12345")
+	if w = do(s, http.MethodPost, "/api/listLockedUsers", url.Values{}, admin); !strings.Contains(w.Body.String(), `"alice"`) {
+		t.Errorf("wrong locked users: %s", w.Body.String())
+	}
+	if w = do(s, http.MethodPost, "/api/unlockUser", url.Values{"username": {"alice"}}, admin); w.Code != http.StatusOK {
+		t.Errorf("failed to unlock user: %d", w.Code)
+	}
+	login(t, s, "alice", "123456")
+
+	// Parallel attempts are counted before any of them is checked
+	s.userLogins = throttle.New(throttle.Policy{Lockout: 3, LockoutFor: time.Hour})
+	codes := make(chan int, 10)
+	for i := 0; i < cap(codes); i++ {
+		go func() {
+			codes <- do(s, http.MethodPost, "/api/login", url.Values{"username": {"alice"}, "password": {"wrong"}}, nil).Code
+		}()
+	}
+	checked := 0
+	for i := 0; i < cap(codes); i++ {
+		if <-codes == http.StatusUnauthorized {
+			checked++
+		}
+	}
+	if checked != 3 {
+		t.Errorf("%d parallel attempts checked, want 3", checked)
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	s, _ := newTestServer(t)
+	s.trustedProxies = parseProxies([]string{"10.0.0.0/8", "192.0.2.1"})
+	for _, c := range []struct {
+		remote, forwarded, want string
+	}{
+		{"198.51.100.7:1234", "203.0.113.1", "198.51.100.7"},
+		{"192.0.2.1:1234", "", "192.0.2.1"},
+		{"192.0.2.1:1234", "203.0.113.1", "203.0.113.1"},
+		{"192.0.2.1:1234", "1.2.3.4, 203.0.113.1, 10.0.0.2", "203.0.113.1"},
+		{"192.0.2.1:1234", "10.0.0.3, 10.0.0.2", "10.0.0.3"},
+		{"192.0.2.1:1234", "bogus", "192.0.2.1"},
+	} {
+		ctx, _ := gin.CreateTestContext(httptest.NewRecorder())
+		ctx.Request = httptest.NewRequest(http.MethodGet, "/", nil)
+		ctx.Request.RemoteAddr = c.remote
+		ctx.Request.Header.Set("X-Forwarded-For", c.forwarded)
+		if got := s.clientIP(ctx); got != c.want {
+			t.Errorf("wrong client of %s forwarding %q: %s, want %s", c.remote, c.forwarded, got, c.want)
+		}
+	}
+
+	// Clients behind the proxy are locked out separately
+	s.ipLogins = throttle.New(throttle.Policy{Lockout: 2, LockoutFor: time.Hour})
+	wrong := url.Values{"username": {"nobody"}, "password": {"wrong"}}
+	for i := 0; i < 2; i++ {
+		do(s, http.MethodPost, "/api/login", wrong, http.Header{"X-Forwarded-For": {"203.0.113.1"}})
+	}
+	if locks := s.ipLogins.Locks(); len(locks) != 1 || locks[0].Key != "203.0.113.1" {
+		t.Errorf("wrong locked addresses: %v", locks)
+	}
+	req := url.Values{"username": {"Admin"}, "password": {"12345"}}
+	if w := do(s, http.MethodPost, "/api/login", req, http.Header{"X-Forwarded-For": {"203.0.113.2"}}); w.Code != http.StatusOK {
+		t.Errorf("client sharing the proxy was locked out: %d", w.Code)
+	}
+	admin := login(t, s, "Admin", "12345")
+	if w := do(s, http.MethodPost, "/api/unlockUser", url.Values{"ip": {"203.0.113.1"}}, admin); w.Code != http.StatusOK {
+		t.Errorf("failed to unlock address: %d", w.Code)
+	}
+	if w := do(s, http.MethodPost, "/api/login", req, http.Header{"X-Forwarded-For": {"203.0.113.1"}}); w.Code != http.StatusOK {
+		t.Errorf("unlocked address still locked out: %d", w.Code)
+	}
+}
+
+func TestAuditLog(t *testing.T) {
+	s, _ := newTestServer(t)
+	do(s, http.MethodPost, "/api/login", url.Values{"username": {"Admin"}, "password": {"wrong"}}, nil)
+	admin := login(t, s, "Admin", "12345")
+	do(s, http.MethodPost, "/api/createInviteCode", url.Values{"limit": {"1"}}, admin)
+	do(s, http.MethodPost, "/api/createRole", url.Values{"name": {"editor"}, "permissions": {storage.PermManageGroups}}, admin)
+	do(s, http.MethodPost, "/api/createGroup", url.Values{"name": {"staff"}}, admin)
+	// Reads are recorded apart from changes
+	do(s, http.MethodPost, "/api/current", url.Values{}, admin)
+	do(s, http.MethodPost, "/api/listUsers", url.Values{}, admin)
+
+	w := do(s, http.MethodPost, "/api/queryAuditLog", url.Values{"action": {"login"}}, admin)
+	var events []storage.AuditEvent
+	if err := json.Unmarshal(w.Body.Bytes(), &events); err != nil {
+		t.Fatalf("failed to decode audit log: %v", err)
+	}
+	if len(events) != 2 || events[0].Status != http.StatusUnauthorized || events[0].Actor != "" || events[0].Target != "Admin" || events[1].Actor != "Admin" {
+		t.Errorf("wrong login events: %+v", events)
+	}
+	w = do(s, http.MethodPost, "/api/queryAuditLog", url.Values{"action": {"read"}}, admin)
+	events = nil
+	_ = json.Unmarshal(w.Body.Bytes(), &events)
+	if len(events) != 2 || events[0].Detail != "current" || events[1].Detail != "listUsers" {
+		t.Errorf("wrong read events: %+v", events)
+	}
+	w = do(s, http.MethodPost, "/api/exportAuditLog", url.Values{"user": {"Admin"}}, admin)
+	lines := strings.Split(strings.TrimSpace(w.Body.String()), "\n")
+	// Both logins, the invite code, the role, the group and both reads
+	if len(lines) != 7 || !strings.Contains(lines[2], `"action":"createInviteCode"`) ||
+		!strings.Contains(lines[3], `"action":"createRole","target":"editor","detail":"permissions=groups.manage"`) ||
+		!strings.Contains(lines[4], `"action":"createGroup","target":"staff"`) {
+		t.Errorf("wrong exported audit log: %v", lines)
+	}
+
+	_ = s.store.Register("alice", "123456")
+	alice := login(t, s, "alice", "123456")
+	if w = do(s, http.MethodPost, "/api/queryAuditLog", url.Values{}, alice); w.Code != http.StatusForbidden {
+		t.Errorf("guest queried audit log: %d", w.Code)
+	}
+}
+
+func TestLibraryAccess(t *testing.T) {
+	s, store := newTestServer(t)
+	_ = store.Register("alice", "123456")
+	alice := login(t, s, "alice", "123456")
+
+	w := do(s, http.MethodPost, "/api/generateToken", url.Values{}, alice)
+	if w.Code != http.StatusOK {
+		t.Fatalf("failed to generate token: %d", w.Code)
+	}
+	auth := http.Header{"Authorization": {w.Body.String()}}
+	if w = do(s, http.MethodGet, "/albums", nil, nil); w.Code != http.StatusUnauthorized {
+		t.Errorf("anonymous listed albums: %d", w.Code)
+	}
+	if got := albums(t, s, auth); len(got) != 2 {
+		t.Errorf("wrong albums: %v", got)
+	}
+	if w = do(s, http.MethodGet, "/KICA-1234/1", nil, auth); w.Code != http.StatusOK || w.Body.String() != "audio" {
+		t.Errorf("failed to get audio: %d", w.Code)
+	}
+
+	// Restricted to a catalog pattern through a group
+	_ = store.NewGroup("guests")
+	_ = store.AddGroupMember("guests", "alice")
+	_, _ = store.AddAccessRule("guests", "local", "LACA-*")
+	if got := albums(t, s, auth); len(got) != 1 || got[0] != "LACA-12345" {
+		t.Errorf("wrong albums: %v", got)
+	}
+	if w = do(s, http.MethodGet, "/KICA-1234/1", nil, auth); w.Code != http.StatusForbidden {
+		t.Errorf("accessed a catalog outside access rules: %d", w.Code)
+	}
+
+	// Unreadable access rules deny everything
+	var logs strings.Builder
+	defer logging.SetDefault(logging.Default())
+	logging.SetDefault(logging.New(&logs, logging.Error, logging.FormatLogfmt))
+	s.store = brokenRules{store}
+	if got := albums(t, s, auth); len(got) != 0 {
+		t.Errorf("listed albums without access rules: %v", got)
+	}
+	if !strings.Contains(logs.String(), "Failed to read access rules of alice") || !strings.Contains(logs.String(), "request_id=") {
+		t.Errorf("failure not logged with the request: %s", logs.String())
+	}
+	if w = do(s, http.MethodGet, "/LACA-12345/1", nil, auth); w.Code != http.StatusForbidden {
+		t.Errorf("accessed a catalog without access rules: %d", w.Code)
+	}
+	s.store = store
+
+	// Scoped token
+	w = do(s, http.MethodPost, "/api/generateToken", url.Values{"catalogs": {"LACA-12345"}, "coverOnly": {"true"}}, alice)
+	scoped := http.Header{"Authorization": {w.Body.String()}}
+	if w = do(s, http.MethodGet, "/LACA-12345/cover", nil, scoped); w.Code != http.StatusOK {
+		t.Errorf("failed to get cover with scoped token: %d", w.Code)
+	}
+	if w = do(s, http.MethodGet, "/LACA-12345/1", nil, scoped); w.Code != http.StatusForbidden {
+		t.Errorf("cover-only token accessed audio: %d", w.Code)
+	}
+	tokens := store.ListTokens("alice")
+	if len(tokens) != 2 {
+		t.Fatalf("wrong token registry: %v", tokens)
+	}
+	for _, tok := range tokens {
+		_ = store.RevokeToken(tok.Id)
+	}
+	if w = do(s, http.MethodGet, "/LACA-12345/cover", nil, scoped); w.Code != http.StatusUnauthorized {
+		t.Errorf("revoked token accepted: %d", w.Code)
+	}
+}
+
+// brokenCount fails to count users.
+type brokenCount struct {
+	storage.Store
+}
+
+func (brokenCount) CountUsers() (int, error) {
+	return 0, errors.New("database is locked")
+}
+
+// brokenRules fails to read access rules.
+type brokenRules struct {
+	storage.Store
+}
+
+func (brokenRules) UserAccessRules(string) ([]storage.AccessRule, error) {
+	return nil, errors.New("database is locked")
+}
+
+func albums(t *testing.T, s *Server, header http.Header) []string {
+	w := do(s, http.MethodGet, "/albums", nil, header)
+	if w.Code != http.StatusOK {
+		t.Fatalf("failed to list albums: %d", w.Code)
+	}
+	ret := make([]string, 0)
+	if err := json.Unmarshal(w.Body.Bytes(), &ret); err != nil {
+		t.Fatalf("failed to decode albums: %v", err)
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+func TestOIDCLogin(t *testing.T) {
+	s, store := newTestServer(t)
+	op, err := oidctest.NewProvider("annil", "secret")
+	if err != nil {
+		t.Fatalf("failed to start provider: %v", err)
+	}
+	defer op.Close()
+	s.oidcCfg = config.OIDCConfig{
+		Enabled:       true,
+		Issuer:        op.Issuer(),
+		ClientID:      "annil",
+		ClientSecret:  "secret",
+		RedirectURL:   "http://annil.example/api/oidc/callback",
+		UsernameClaim: "preferred_username",
+		GroupsClaim:   "groups",
+		DefaultRole:   storage.RoleGuest,
+		GroupRoles:    []config.GroupRole{{Group: "staff", Role: storage.RoleMember}},
+	}
+	if w := do(s, http.MethodGet, "/api/oidc/login", nil, nil); w.Code != http.StatusNotFound {
+		t.Errorf("oidc login available while disabled: %d", w.Code)
+	}
+	s.oidc = newOIDCProvider(s.oidcCfg)
+
+	alice := map[string]interface{}{"sub": "1", "preferred_username": "alice", "groups": []string{"users"}}
+	if w := oidcLogin(t, s, op, "/api/oidc/login", alice, nil); w.Header().Get("X-Status-Reason") != "NOT_REGISTERED" {
+		t.Errorf("unknown subject logged in without provisioning: %d", w.Code)
+	}
+
+	s.oidcCfg.AutoRegister = true
+	w := oidcLogin(t, s, op, "/api/oidc/login", alice, nil)
+	if w.Code != http.StatusFound {
+		t.Fatalf("failed to provision user: %d %s", w.Code, w.Header().Get("X-Status-Reason"))
+	}
+	if !store.UserExists("alice") || store.UserRole("alice") != storage.RoleGuest {
+		t.Errorf("user provisioned with role %s", store.UserRole("alice"))
+	}
+	h := sessionHeader(w)
+	if w = do(s, http.MethodPost, "/api/current", url.Values{}, h); w.Body.String() != "alice" {
+		t.Errorf("no session after oidc login: %s", w.Body.String())
+	}
+
+	// Group roles are applied at every login
+	alice["groups"] = []string{"staff"}
+	if w = oidcLogin(t, s, op, "/api/oidc/login", alice, nil); w.Code != http.StatusFound || store.UserRole("alice") != storage.RoleMember {
+		t.Errorf("group role not applied: %d %s", w.Code, store.UserRole("alice"))
+	}
+
+	// A second factor is asked for like with passwords
+	secret, _ := totp.NewSecret()
+	_ = store.SetTotpSecret("alice", secret)
+	_ = store.EnableTotp("alice")
+	w = oidcLogin(t, s, op, "/api/oidc/login", alice, nil)
+	loc := w.Header().Get("Location")
+	if w.Code != http.StatusFound || !strings.HasPrefix(loc, "/#totpTicket=") || len(w.Result().Cookies()) > 1 {
+		t.Fatalf("second factor not required: %d %s", w.Code, loc)
+	}
+	code, _ := totp.Code(secret, totp.Step(time.Now()))
+	w = do(s, http.MethodPost, "/api/loginTotp", url.Values{"ticket": {strings.TrimPrefix(loc, "/#totpTicket=")}, "code": {code}}, nil)
+	if w.Code != http.StatusOK {
+		t.Errorf("failed to complete oidc login with a code: %d", w.Code)
+	}
+	_ = store.DeleteTotp("alice")
+
+	taken := map[string]interface{}{"sub": "2", "preferred_username": "Admin"}
+	if w = oidcLogin(t, s, op, "/api/oidc/login", taken, nil); w.Header().Get("X-Status-Reason") != "USERNAME_UNAVAILABLE" {
+		t.Errorf("provisioned an existing username: %d", w.Code)
+	}
+
+	// Linking lets an existing user log in through the provider
+	admin := login(t, s, "Admin", "12345")
+	forged := http.Header{"Cookie": admin["Cookie"]}
+	if w = do(s, http.MethodPost, "/api/oidc/link", url.Values{}, forged); w.Code != http.StatusForbidden {
+		t.Errorf("linked without a CSRF token: %d", w.Code)
+	}
+	taken["groups"] = []string{"staff"}
+	if w = oidcLogin(t, s, op, "/api/oidc/link", taken, admin); w.Code != http.StatusFound {
+		t.Fatalf("failed to link identity: %d", w.Code)
+	}
+	if w = oidcLogin(t, s, op, "/api/oidc/login", taken, nil); w.Code != http.StatusFound || store.UserRole("Admin") != storage.RoleOwner {
+		t.Errorf("linked login failed or demoted the owner: %d %s", w.Code, store.UserRole("Admin"))
+	}
+	if w = oidcLogin(t, s, op, "/api/oidc/link", alice, admin); w.Header().Get("X-Status-Reason") != "IDENTITY_IN_USE" {
+		t.Errorf("linked an identity of another user: %d", w.Code)
+	}
+	if e := store.QueryAudit(storage.AuditFilter{Action: "oidcLink"}); len(e) != 2 || e[0].Actor != "Admin" {
+		t.Errorf("links not audited when started: %+v", e)
+	}
+	w = do(s, http.MethodPost, "/api/listIdentities", url.Values{}, admin)
+	var ids []storage.Identity
+	_ = json.Unmarshal(w.Body.Bytes(), &ids)
+	if len(ids) != 1 || ids[0].Subject != "2" {
+		t.Fatalf("wrong identities: %s", w.Body.String())
+	}
+	link := url.Values{"username": {"alice"}, "issuer": {"ldap"}, "subject": {"alice"}}
+	if w = do(s, http.MethodPost, "/api/linkIdentity", link, sessionHeader(oidcLogin(t, s, op, "/api/oidc/login", alice, nil))); w.Code != http.StatusForbidden {
+		t.Errorf("member linked an identity: %d", w.Code)
+	}
+	if w = do(s, http.MethodPost, "/api/linkIdentity", link, admin); w.Code != http.StatusOK {
+		t.Errorf("failed to link identity as admin: %d", w.Code)
+	}
+	if name, err := store.IdentityUser("ldap", "alice"); err != nil || name != "alice" {
+		t.Errorf("identity not linked: %s %v", name, err)
+	}
+	if w = do(s, http.MethodPost, "/api/linkIdentity", link, admin); w.Header().Get("X-Status-Reason") != "IDENTITY_IN_USE" {
+		t.Errorf("linked an identity twice: %d", w.Code)
+	}
+	unlink := url.Values{"issuer": {op.Issuer()}, "subject": {"1"}}
+	if w = do(s, http.MethodPost, "/api/unlinkIdentity", unlink, admin); w.Code != http.StatusNotFound {
+		t.Errorf("unlinked an identity of another user: %d", w.Code)
+	}
+	unlink.Set("subject", "2")
+	if w = do(s, http.MethodPost, "/api/unlinkIdentity", unlink, admin); w.Code != http.StatusOK {
+		t.Errorf("failed to unlink identity: %d", w.Code)
+	}
+
+	// States are bound to the browser and only usable once
+	w = do(s, http.MethodGet, "/api/oidc/login", nil, nil)
+	callback, _ := op.Authorize(w.Header().Get("Location"), alice)
+	u, _ := url.Parse(callback)
+	if w = do(s, http.MethodGet, u.RequestURI(), nil, nil); w.Header().Get("X-Status-Reason") != "INVALID_STATE" {
+		t.Errorf("callback accepted without state cookie: %d", w.Code)
+	}
+}
+
+// oidcLogin starts a login or link at path and completes it at the provider as the user with claims.
+func oidcLogin(t *testing.T, s *Server, op *oidctest.Provider, path string, claims map[string]interface{}, header http.Header) *httptest.ResponseRecorder {
+	method, form := http.MethodGet, url.Values(nil)
+	if path == "/api/oidc/link" {
+		method, form = http.MethodPost, url.Values{}
+	}
+	w := do(s, method, path, form, header)
+	if w.Code != http.StatusFound && w.Code != http.StatusSeeOther {
+		t.Fatalf("failed to start oidc login: %d", w.Code)
+	}
+	callback, err := op.Authorize(w.Header().Get("Location"), claims)
+	if err != nil {
+		t.Fatalf("failed to authorize: %v", err)
+	}
+	h := http.Header{}
+	for _, v := range header["Cookie"] {
+		h.Add("Cookie", v)
+	}
+	for _, c := range w.Result().Cookies() {
+		h.Add("Cookie", c.Name+"="+c.Value)
+	}
+	u, _ := url.Parse(callback)
+	return do(s, http.MethodGet, u.RequestURI(), nil, h)
+}
+
+func TestPasswordReset(t *testing.T) {
+	s, store := newTestServer(t)
+	sink, err := mailtest.NewSink()
+	if err != nil {
+		t.Fatalf("failed to start sink: %v", err)
+	}
+	defer sink.Close()
+	if w := do(s, http.MethodPost, "/api/requestPasswordReset", url.Values{"username": {"Admin"}}, nil); w.Code != http.StatusNotFound {
+		t.Errorf("password reset available without mail: %d", w.Code)
+	}
+	s.mailCfg = config.MailConfig{Enabled: true, Host: sink.Host(), Port: sink.Port(), From: "annil@example.com", BaseURL: "https://annil.example/", ResetMinutes: 60, VerifyHours: 48}
+	s.mailer = newMailer(s.mailCfg)
+
+	admin := login(t, s, "Admin", "12345")
+	code := do(s, http.MethodPost, "/api/createInviteCode", url.Values{"limit": {"2"}}, admin).Body.String()
+	reg := url.Values{"username": {"alice"}, "password": {"123456"}, "inviteCode": {code}, "email": {"Alice <alice@example.com>"}}
+	if w := do(s, http.MethodPost, "/api/register", reg, nil); w.Header().Get("X-Status-Reason") != "INVALID_EMAIL" {
+		t.Errorf("invalid email accepted: %d", w.Code)
+	}
+	reg.Set("email", "Alice@Example.com")
+	if w := do(s, http.MethodPost, "/api/register", reg, nil); w.Code != http.StatusOK {
+		t.Fatalf("failed to register: %d", w.Code)
+	}
+	token := mailToken(t, sink, "alice@example.com", "https://annil.example/verify-email?token=")
+	if email, verified := store.UserEmail("alice"); email != "alice@example.com" || verified {
+		t.Errorf("wrong email before verification: %s %v", email, verified)
+	}
+
+	// Unverified addresses do not receive reset links
+	do(s, http.MethodPost, "/api/requestPasswordReset", url.Values{"username": {"alice"}}, nil)
+	if w := do(s, http.MethodPost, "/api/verifyEmail", url.Values{"token": {token}}, nil); w.Code != http.StatusOK {
+		t.Fatalf("failed to verify email: %d", w.Code)
+	}
+	if w := do(s, http.MethodPost, "/api/verifyEmail", url.Values{"token": {token}}, nil); w.Code != http.StatusForbidden {
+		t.Errorf("verification token used twice: %d", w.Code)
+	}
+	reg = url.Values{"username": {"bob"}, "password": {"123456"}, "inviteCode": {code}, "email": {"alice@example.com"}}
+	if w := do(s, http.MethodPost, "/api/register", reg, nil); w.Header().Get("X-Status-Reason") != "EMAIL_IN_USE" {
+		t.Errorf("registered with an address in use: %d", w.Code)
+	}
+
+	alice := login(t, s, "alice", "123456")
+	if w := do(s, http.MethodPost, "/api/requestPasswordReset", url.Values{"email": {"nobody@example.com"}}, nil); w.Code != http.StatusOK {
+		t.Errorf("reset request revealed an unknown address: %d", w.Code)
+	}
+	if w := do(s, http.MethodPost, "/api/requestPasswordReset", url.Values{"email": {"ALICE@example.com"}}, nil); w.Code != http.StatusOK {
+		t.Fatalf("failed to request password reset: %d", w.Code)
+	}
+	token = mailToken(t, sink, "alice@example.com", "https://annil.example/reset-password?token=")
+	if w := do(s, http.MethodPost, "/api/resetPassword", url.Values{"token": {token}, "password": {"abc"}}, nil); w.Header().Get("X-Status-Reason") != "PASSWORD_TOO_SHORT" {
+		t.Errorf("short password accepted: %d", w.Code)
+	}
+	if w := do(s, http.MethodPost, "/api/resetPassword", url.Values{"token": {token}, "password": {"new-password"}}, nil); w.Code != http.StatusOK {
+		t.Fatalf("failed to reset password: %d", w.Code)
+	}
+	if w := do(s, http.MethodPost, "/api/resetPassword", url.Values{"token": {token}, "password": {"other-password"}}, nil); w.Code != http.StatusForbidden {
+		t.Errorf("reset token used twice: %d", w.Code)
+	}
+	if w := do(s, http.MethodPost, "/api/current", url.Values{}, alice); w.Code != http.StatusUnauthorized {
+		t.Errorf("session survived password reset: %d", w.Code)
+	}
+	login(t, s, "alice", "new-password")
+	if len(store.QueryAudit(storage.AuditFilter{Action: "resetPassword", User: "alice"})) != 1 {
+		t.Errorf("password reset not audited")
+	}
+}
+
+// mailToken waits for a message to to and returns the token of the link starting with prefix.
+func mailToken(t *testing.T, sink *mailtest.Sink, to, prefix string) string {
+	msg, err := sink.Next(5 * time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msg.To) != 1 || msg.To[0] != to {
+		t.Fatalf("message sent to %v", msg.To)
+	}
+	body, _ := ioutil.ReadAll(quotedprintable.NewReader(strings.NewReader(msg.Data)))
+	i := strings.Index(string(body), prefix)
+	if i < 0 {
+		t.Fatalf("no link in message: %s", body)
+	}
+	return strings.Fields(string(body[i+len(prefix):]))[0]
+}
+
+func TestCSRF(t *testing.T) {
+	s, _ := newTestServer(t)
+	// Only trusted proxies tell whether the client used TLS
+	w := do(s, http.MethodPost, "/api/login", url.Values{"username": {"Admin"}, "password": {"12345"}}, http.Header{"X-Forwarded-Proto": {"https"}})
+	for _, c := range w.Result().Cookies() {
+		if c.Secure {
+			t.Errorf("cookie %s secure on a forged forwarded protocol", c.Name)
+		}
+	}
+	s.trustedProxies = parseProxies([]string{"192.0.2.1"})
+	w = do(s, http.MethodPost, "/api/login", url.Values{"username": {"Admin"}, "password": {"12345"}}, http.Header{"X-Forwarded-Proto": {"https"}})
+	cookies := make(map[string]*http.Cookie)
+	for _, c := range w.Result().Cookies() {
+		cookies[c.Name] = c
+	}
+	if c := cookies[sessionCookie]; c == nil || !c.HttpOnly || !c.Secure || c.SameSite != http.SameSiteLaxMode {
+		t.Errorf("session cookie not hardened: %v", c)
+	}
+	if c := cookies[csrfCookie]; c == nil || c.HttpOnly || c.Value == "" {
+		t.Fatalf("no csrf cookie readable by scripts: %v", c)
+	}
+	admin := sessionHeader(w)
+	token := admin.Get(csrfHeader)
+
+	admin.Del(csrfHeader)
+	if w = do(s, http.MethodPost, "/api/createInviteCode", url.Values{"limit": {"1"}}, admin); w.Header().Get("X-Status-Reason") != "CSRF_TOKEN_INVALID" {
+		t.Errorf("request without csrf token accepted: %d", w.Code)
+	}
+	admin.Set(csrfHeader, "forged")
+	if w = do(s, http.MethodPost, "/api/createInviteCode", url.Values{"limit": {"1"}}, admin); w.Code != http.StatusForbidden {
+		t.Errorf("request with wrong csrf token accepted: %d", w.Code)
+	}
+	admin.Del(csrfHeader)
+	admin.Set("Authorization", "anything")
+	if w = do(s, http.MethodPost, "/api/createInviteCode", url.Values{"limit": {"1"}}, admin); w.Code != http.StatusForbidden {
+		t.Errorf("authorization header exempted a session request: %d", w.Code)
+	}
+	admin.Del("Authorization")
+	if w = do(s, http.MethodPost, "/api/createInviteCode", url.Values{"limit": {"1"}, "csrfToken": {token}}, admin); w.Code != http.StatusOK {
+		t.Errorf("csrf token in form rejected: %d", w.Code)
+	}
+	// A planted cookie does not help, the token is bound to the session
+	admin = http.Header{"Cookie": {sessionCookie + "=" + cookies[sessionCookie].Value, csrfCookie + "=forged"}, csrfHeader: {"forged"}}
+	if w = do(s, http.MethodPost, "/api/createInviteCode", url.Values{"limit": {"1"}}, admin); w.Code != http.StatusForbidden {
+		t.Errorf("planted csrf token accepted: %d", w.Code)
+	}
+	// Stale sessions do not stand in the way of logging in again
+	stale := http.Header{"Cookie": {sessionCookie + "=expired"}}
+	if w = do(s, http.MethodPost, "/api/login", url.Values{"username": {"Admin"}, "password": {"12345"}}, stale); w.Code != http.StatusOK {
+		t.Errorf("login with stale session rejected: %d", w.Code)
+	}
+
+	s.cookieCfg = config.CookieConfig{Secure: "never", SameSite: "strict"}
+	w = do(s, http.MethodPost, "/api/login", url.Values{"username": {"Admin"}, "password": {"12345"}}, http.Header{"X-Forwarded-Proto": {"https"}})
+	for _, c := range w.Result().Cookies() {
+		if c.Secure || c.SameSite != http.SameSiteStrictMode {
+			t.Errorf("cookie %s ignores config: %v", c.Name, c)
+		}
+	}
+}
+
+// doJSON sends v as a JSON body.
+func doJSON(s *Server, method, path string, v interface{}, header http.Header) *httptest.ResponseRecorder {
+	b, _ := json.Marshal(v)
+	req := httptest.NewRequest(method, path, strings.NewReader(string(b)))
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, req)
+	return w
+}
+
+// errorCode returns the code of an error envelope.
+func errorCode(t *testing.T, w *httptest.ResponseRecorder) string {
+	var body ErrorBody
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Fatalf("no error body: %d %s", w.Code, w.Body.String())
+	}
+	return body.Error.Code
+}
+
+func TestAPIv2(t *testing.T) {
+	s, store := newTestServer(t)
+	if w := do(s, http.MethodGet, "/api/v2/users", nil, nil); w.Code != http.StatusUnauthorized || errorCode(t, w) != "UNAUTHORIZED" {
+		t.Errorf("anonymous listed users: %d", w.Code)
+	}
+	admin := login(t, s, "Admin", "12345")
+	var me Me
+	w := do(s, http.MethodGet, "/api/v2/me", nil, admin)
+	if err := json.Unmarshal(w.Body.Bytes(), &me); err != nil || me.Username != "Admin" || me.Role != storage.RoleOwner || len(me.Permissions) == 0 {
+		t.Errorf("wrong current user: %s", w.Body.String())
+	}
+
+	w = doJSON(s, http.MethodPost, "/api/v2/invite-codes", NewInviteCode{Limit: 1, Role: "member"}, admin)
+	var code storage.InviteCode
+	if err := json.Unmarshal(w.Body.Bytes(), &code); w.Code != http.StatusCreated || err != nil {
+		t.Fatalf("failed to create invite code: %d %s", w.Code, w.Body.String())
+	}
+	if w = doJSON(s, http.MethodPost, "/api/v2/invite-codes", NewInviteCode{Limit: 1, Role: "nobody"}, admin); errorCode(t, w) != "UNKNOWN_ROLE" {
+		t.Errorf("invite code with unknown role created: %d", w.Code)
+	}
+	if w = doJSON(s, http.MethodPost, "/api/v2/users", NewUser{Username: "alice", Password: "123"}, nil); errorCode(t, w) != "PASSWORD_TOO_SHORT" {
+		t.Errorf("short password accepted: %d", w.Code)
+	}
+	if w = doJSON(s, http.MethodPost, "/api/v2/users", NewUser{Username: "alice", Password: "123456", InviteCode: code.Code}, nil); w.Code != http.StatusCreated {
+		t.Fatalf("failed to register: %d %s", w.Code, w.Body.String())
+	}
+	if w = doJSON(s, http.MethodPost, "/api/v2/users", NewUser{Username: "bob", Password: "123456", InviteCode: code.Code}, nil); errorCode(t, w) != "INVALID_INVITE_CODE" {
+		t.Errorf("invite code used twice: %d", w.Code)
+	}
+	if w = do(s, http.MethodGet, "/api/v2/invite-codes/"+code.Code+"/redemptions", nil, admin); !strings.Contains(w.Body.String(), "alice") {
+		t.Errorf("redemption missing: %s", w.Body.String())
+	}
+
+	alice := login(t, s, "alice", "123456")
+	if w = do(s, http.MethodGet, "/api/v2/users/Admin", nil, alice); w.Code != http.StatusForbidden || errorCode(t, w) != "FORBIDDEN" {
+		t.Errorf("member read another user: %d", w.Code)
+	}
+	role := storage.RoleAdmin
+	if w = doJSON(s, http.MethodPatch, "/api/v2/users/alice", UserPatch{Role: &role}, alice); w.Code != http.StatusForbidden {
+		t.Errorf("member changed own role: %d", w.Code)
+	}
+	password := "654321"
+	if w = doJSON(s, http.MethodPatch, "/api/v2/users/alice", UserPatch{Password: &password, OldPassword: "wrong"}, alice); errorCode(t, w) != "WRONG_OLD_PASSWORD" {
+		t.Errorf("password changed with wrong old password: %d", w.Code)
+	}
+	if w = doJSON(s, http.MethodPatch, "/api/v2/users/alice", UserPatch{Password: &password, OldPassword: "123456"}, alice); w.Code != http.StatusOK {
+		t.Errorf("failed to change password: %d %s", w.Code, w.Body.String())
+	}
+	if w = doJSON(s, http.MethodPatch, "/api/v2/users/alice", UserPatch{Role: &role}, admin); w.Code != http.StatusOK || store.UserRole("alice") != storage.RoleAdmin {
+		t.Errorf("failed to change role: %d %s", w.Code, w.Body.String())
+	}
+	if w = doJSON(s, http.MethodPatch, "/api/v2/users/alice", "not an object", admin); errorCode(t, w) != "INVALID_REQUEST" {
+		t.Errorf("malformed body accepted: %d", w.Code)
+	}
+
+	if w = do(s, http.MethodDelete, "/api/v2/users/Admin", nil, admin); errorCode(t, w) != "LAST_OWNER" {
+		t.Errorf("revoked the last owner: %d", w.Code)
+	}
+	if w = do(s, http.MethodDelete, "/api/v2/users/alice", nil, admin); w.Code != http.StatusNoContent || store.UserExists("alice") {
+		t.Errorf("failed to revoke user: %d", w.Code)
+	}
+	if w = do(s, http.MethodDelete, "/api/v2/users/alice", nil, admin); errorCode(t, w) != "NOT_FOUND" {
+		t.Errorf("revoked a missing user: %d", w.Code)
+	}
+	if w = do(s, http.MethodGet, "/api/v2/nothing", nil, admin); errorCode(t, w) != "NOT_FOUND" {
+		t.Errorf("unknown endpoint served: %d", w.Code)
+	}
+	admin.Del(csrfHeader)
+	if w = do(s, http.MethodDelete, "/api/v2/invite-codes/"+code.Code, nil, admin); errorCode(t, w) != "CSRF_TOKEN_INVALID" {
+		t.Errorf("request without csrf token accepted: %d", w.Code)
+	}
+}
+
+// TestOpenAPI fails when the router and the OpenAPI document disagree.
+func TestOpenAPI(t *testing.T) {
+	s, _ := newTestServer(t)
+	documented := make(map[string]bool)
+	for _, ep := range endpoints {
+		route := ep.Method + " " + ep.Path
+		if documented[route] {
+			t.Errorf("%s documented twice", route)
+		}
+		documented[route] = true
+	}
+	for _, r := range s.engine.Routes() {
+		route := r.Method + " " + r.Path
+		if !documented[route] {
+			t.Errorf("%s is missing from the OpenAPI document", route)
+		}
+		delete(documented, route)
+	}
+	for route := range documented {
+		t.Errorf("%s is documented but not registered", route)
+	}
+
+	w := do(s, http.MethodGet, "/openapi.json", nil, nil)
+	var doc struct {
+		OpenAPI    string                            `json:"openapi"`
+		Paths      map[string]map[string]interface{} `json:"paths"`
+		Components struct {
+			Schemas map[string]interface{} `json:"schemas"`
+		} `json:"components"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &doc); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("failed to get document: %d %v", w.Code, err)
+	}
+	operations := 0
+	for _, item := range doc.Paths {
+		operations += len(item)
+	}
+	if operations != len(endpoints) {
+		t.Errorf("document has %d operations, want %d", operations, len(endpoints))
+	}
+	if _, ok := doc.Paths["/api/v2/users/{name}"]["patch"]; !ok {
+		t.Errorf("path parameters not converted")
+	}
+	// Every reference has to resolve
+	for _, ref := range regexp.MustCompile(`#/components/schemas/(\w+)`).FindAllStringSubmatch(w.Body.String(), -1) {
+		if doc.Components.Schemas[ref[1]] == nil {
+			t.Errorf("schema %s is missing", ref[1])
+		}
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	s, _ := newTestServer(t)
+	if w := do(s, http.MethodGet, "/metrics", nil, nil); w.Code != http.StatusNotFound {
+		t.Errorf("metrics served while disabled: %d", w.Code)
+	}
+	s.metricsCfg = config.MetricsConfig{Enabled: true, Token: "scrape"}
+	do(s, http.MethodPost, "/api/login", url.Values{"username": {"Admin"}, "password": {"wrong"}}, nil)
+	admin := login(t, s, "Admin", "12345")
+	w := do(s, http.MethodPost, "/api/generateToken", url.Values{}, admin)
+	auth := http.Header{"Authorization": {w.Body.String()}}
+	if w = do(s, http.MethodGet, "/KICA-1234/1", nil, auth); w.Code != http.StatusOK {
+		t.Fatalf("failed to get audio: %d", w.Code)
+	}
+
+	if w = do(s, http.MethodGet, "/metrics", nil, http.Header{"Authorization": {"Bearer wrong"}}); w.Code != http.StatusUnauthorized {
+		t.Errorf("metrics served with wrong token: %d", w.Code)
+	}
+	w = do(s, http.MethodGet, "/metrics", nil, http.Header{"Authorization": {"Bearer scrape"}})
+	if w.Code != http.StatusOK {
+		t.Fatalf("failed to scrape metrics: %d", w.Code)
+	}
+	for _, line := range []string{
+		`annil_http_requests_total{method="GET",route="/:catalog/:track",status="200"} 1`,
+		`annil_http_request_duration_seconds_count{method="POST",route="/api/login"} 2`,
+		`annil_backend_streamed_bytes_total{backend="local"} 5`,
+		`annil_backend_requests_total{backend="local",op="audio",result="ok"} 1`,
+		`annil_active_streams{kind="audio"} 0`,
+		`annil_login_failures_total{reason="password"} 1`,
+		`annil_sessions 1`,
+	} {
+		if !strings.Contains(w.Body.String(), line+"\n") {
+			t.Errorf("metrics lack %s", line)
+		}
+	}
+
+	s.metricsCfg.Listen = "127.0.0.1:0"
+	if w = do(s, http.MethodGet, "/metrics", nil, http.Header{"Authorization": {"Bearer scrape"}}); w.Code != http.StatusNotFound {
+		t.Errorf("metrics served on the main listener: %d", w.Code)
+	}
+}
+
+func TestRelayCache(t *testing.T) {
+	covers := 0
+	relay := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		covers++
+		_, _ = w.Write([]byte("cover"))
+	}))
+	defer relay.Close()
+	s, _ := newTestServer(t)
+	s.metricsCfg = config.MetricsConfig{Enabled: true, Token: "scrape"}
+	s.be = instrument(backend.NewNamedMultiplexer([]string{"relay"}, []backend.Backend{backend.NewCachedRelay(relay.URL, "a.b.c", 1<<20)}), s.metrics)
+	tok, _ := s.tokens.GenerateUserToken("Admin")
+	for i := 0; i < 2; i++ {
+		if w := do(s, http.MethodGet, "/RELAY-1/cover", nil, http.Header{"Authorization": {tok}}); w.Code != http.StatusOK || w.Body.String() != "cover" {
+			t.Fatalf("failed to get cover: %d %s", w.Code, w.Body.String())
+		}
+	}
+	if covers != 1 {
+		t.Errorf("cached cover fetched again: %d", covers)
+	}
+	w := do(s, http.MethodGet, "/metrics", nil, http.Header{"Authorization": {"Bearer scrape"}})
+	for _, line := range []string{
+		`annil_relay_cache_lookups_total{backend="relay",result="hit"} 1`,
+		`annil_relay_cache_lookups_total{backend="relay",result="miss"} 1`,
+	} {
+		if !strings.Contains(w.Body.String(), line+"\n") {
+			t.Errorf("metrics lack %s", line)
+		}
+	}
+}
+
+func TestRequestID(t *testing.T) {
+	var upstream string
+	relay := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstream = r.Header.Get("X-Request-ID")
+		_, _ = w.Write([]byte(`["RELAY-1"]`))
+	}))
+	defer relay.Close()
+	var logs strings.Builder
+	defer logging.SetDefault(logging.Default())
+	logging.SetDefault(logging.New(&logs, logging.Info, logging.FormatLogfmt))
+
+	s, _ := newTestServer(t)
+	s.be = instrument(backend.NewNamedMultiplexer([]string{"relay"}, []backend.Backend{backend.NewRelay(relay.URL, "a.b.c")}), s.metrics)
+	tok, _ := s.tokens.GenerateUserToken("Admin")
+
+	w := do(s, http.MethodGet, "/albums", nil, http.Header{"Authorization": {tok}, "X-Request-Id": {"edge-42"}})
+	if w.Code != http.StatusOK || w.Header().Get("X-Request-ID") != "edge-42" {
+		t.Fatalf("request id not kept: %d %q", w.Code, w.Header().Get("X-Request-ID"))
+	}
+	if upstream != "edge-42" {
+		t.Errorf("request id not passed to the relay: %q", upstream)
+	}
+	if !strings.Contains(logs.String(), "request_id=edge-42") || strings.Contains(logs.String(), tok) {
+		t.Errorf("wrong access log: %s", logs.String())
+	}
+
+	w = do(s, http.MethodGet, "/albums?token=secret", nil, http.Header{"X-Request-Id": {"bad id\n"}})
+	id := w.Header().Get("X-Request-ID")
+	if !regexp.MustCompile(`^[0-9a-f]{24}$`).MatchString(id) {
+		t.Errorf("unsafe request id not replaced: %q", id)
+	}
+	if strings.Contains(logs.String(), "secret") {
+		t.Errorf("query secret logged: %s", logs.String())
+	}
+}
+
+func TestTracing(t *testing.T) {
+	var upstream string
+	relay := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstream = r.Header.Get("traceparent")
+		_, _ = w.Write([]byte(`["RELAY-1"]`))
+	}))
+	defer relay.Close()
+	var spans bytes.Buffer
+	defer tracing.SetDefault(tracing.Default())
+	tracing.SetDefault(tracing.New(tracing.NewWriterExporter(&spans), 1))
+
+	s, _ := newTestServer(t)
+	s.be = instrument(backend.NewNamedMultiplexer([]string{"relay"}, []backend.Backend{backend.NewRelay(relay.URL, "a.b.c")}), s.metrics)
+	tok, _ := s.tokens.GenerateUserToken("Admin")
+	caller := "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	if w := do(s, http.MethodGet, "/albums", nil, http.Header{"Authorization": {tok}, "Traceparent": {caller}}); w.Code != http.StatusOK {
+		t.Fatalf("failed to list albums: %d", w.Code)
+	}
+
+	byName := make(map[string]tracing.Record)
+	for _, line := range strings.Split(strings.TrimSpace(spans.String()), "\n") {
+		var r tracing.Record
+		if err := json.Unmarshal([]byte(line), &r); err != nil {
+			t.Fatalf("invalid span %s: %v", line, err)
+		}
+		byName[r.Name] = r
+	}
+	handler, attempt, call := byName["GET /albums"], byName["backend.list"], byName["relay GET"]
+	if handler.TraceID != "4bf92f3577b34da6a3ce929d0e0e4736" || handler.ParentID != "00f067aa0ba902b7" {
+		t.Errorf("trace of the caller not continued: %+v", handler)
+	}
+	if attempt.ParentID != handler.SpanID || call.ParentID != attempt.SpanID || attempt.Attributes["backend"] != "relay" {
+		t.Errorf("wrong span tree: %v", byName)
+	}
+	if upstream != "00-4bf92f3577b34da6a3ce929d0e0e4736-"+call.SpanID+"-01" {
+		t.Errorf("wrong traceparent sent to the relay: %q", upstream)
+	}
+}
+
+// pipeBackend streams a track written by the test, so requests stay in flight until it is done.
+type pipeBackend struct {
+	r      *io.PipeReader
+	closed bool
+}
+
+func (b *pipeBackend) ListCatalogs(ctx context.Context) []string { return []string{"PIPE-1"} }
+func (b *pipeBackend) GetCover(ctx context.Context, catalog string) (io.ReadCloser, error) {
+	return nil, backend.ErrNotFound
+}
+func (b *pipeBackend) GetAudio(ctx context.Context, catalog string, track uint8) (backend.AudioType, io.ReadCloser, error) {
+	return backend.FLAC, b.r, nil
+}
+func (b *pipeBackend) Close() error {
+	b.closed = true
+	return nil
+}
+
+func TestShutdown(t *testing.T) {
+	s, _ := newTestServer(t)
+	r, w := io.Pipe()
+	pb := &pipeBackend{r: r}
+	s.be = instrument(backend.NewNamedMultiplexer([]string{"pipe"}, []backend.Backend{pb}), s.metrics)
+	s.shutdownCfg = config.ShutdownConfig{DrainTimeout: 10}
+	tok, _ := s.tokens.GenerateUserToken("Admin")
+
+	if w := do(s, http.MethodGet, "/readyz", nil, nil); w.Code != http.StatusServiceUnavailable {
+		t.Errorf("ready before listening: %d", w.Code)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	served := make(chan error, 1)
+	go func() { served <- s.Serve(ln) }()
+	base := "http://" + ln.Addr().String()
+	waitFor(t, func() bool { return do(s, http.MethodGet, "/readyz", nil, nil).Code == http.StatusOK })
+
+	body := make(chan string, 1)
+	go func() {
+		req, _ := http.NewRequest(http.MethodGet, base+"/PIPE-1/1", nil)
+		req.Header.Set("Authorization", tok)
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			body <- err.Error()
+			return
+		}
+		defer res.Body.Close()
+		b, _ := ioutil.ReadAll(res.Body)
+		body <- string(b)
+	}()
+	// Returns once the stream is in flight
+	_, _ = w.Write([]byte("au"))
+
+	stopped := make(chan error, 1)
+	go func() { stopped <- s.Shutdown(context.Background()) }()
+	waitFor(t, func() bool { return do(s, http.MethodGet, "/readyz", nil, nil).Code == http.StatusServiceUnavailable })
+	waitFor(t, func() bool {
+		c, err := net.Dial("tcp", ln.Addr().String())
+		if err == nil {
+			_ = c.Close()
+		}
+		return err != nil
+	})
+	select {
+	case err := <-stopped:
+		t.Fatalf("shutdown did not wait for the stream: %v", err)
+	default:
+	}
+
+	_, _ = w.Write([]byte("dio"))
+	_ = w.Close()
+	if got := <-body; got != "audio" {
+		t.Errorf("stream cut off: %q", got)
+	}
+	if err := <-stopped; err != nil {
+		t.Errorf("failed to shut down: %v", err)
+	}
+	if err := <-served; err != nil {
+		t.Errorf("serve failed: %v", err)
+	}
+	if !pb.closed {
+		t.Errorf("backend not closed")
+	}
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	for i := 0; i < 200; i++ {
+		if cond() {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("condition not met in time")
+}
+
+func TestReload(t *testing.T) {
+	s, store := newTestServer(t)
+	r, w := io.Pipe()
+	s.be = instrument(backend.NewNamedMultiplexer([]string{"pipe"}, []backend.Backend{&pipeBackend{r: r}}), s.metrics)
+	tok, _ := s.tokens.GenerateUserToken("Admin")
+	auth := http.Header{"Authorization": {tok}}
+
+	streamed := make(chan string, 1)
+	go func() { streamed <- do(s, http.MethodGet, "/PIPE-1/1", nil, auth).Body.String() }()
+	_, _ = w.Write([]byte("au"))
+
+	dir := t.TempDir()
+	_ = os.MkdirAll(filepath.Join(dir, "NEW-1"), 0755)
+	cfg := s.running
+	cfg.Backends = []config.BackendEntry{{Name: "new", Type: "file", Path: dir}}
+	cfg.Listen = "127.0.0.1:9000"
+	res, err := s.Reload(cfg)
+	if err != nil {
+		t.Fatalf("failed to reload: %v", err)
+	}
+	if len(res.Backends) != 1 || res.Backends[0] != "new" || len(res.RestartRequired) != 1 || res.RestartRequired[0] != "listen" {
+		t.Errorf("wrong result: %+v", res)
+	}
+	if got := albums(t, s, auth); len(got) != 1 || got[0] != "NEW-1" {
+		t.Errorf("backends not swapped: %v", got)
+	}
+	_, _ = w.Write([]byte("dio"))
+	_ = w.Close()
+	if got := <-streamed; got != "audio" {
+		t.Errorf("stream in flight cut off: %q", got)
+	}
+
+	cfg.Backends = append(cfg.Backends, config.BackendEntry{Type: "ftp", Path: "ftp://example.com"})
+	if _, err = s.Reload(cfg); err == nil {
+		t.Errorf("invalid config reloaded")
+	}
+	if got := albums(t, s, auth); len(got) != 1 {
+		t.Errorf("backends changed by a failed reload: %v", got)
+	}
+
+	_ = store.Register("alice", "123456")
+	if w := do(s, http.MethodPost, "/api/reloadConfig", url.Values{}, login(t, s, "alice", "123456")); w.Code != http.StatusForbidden {
+		t.Errorf("member reloaded config: %d", w.Code)
+	}
+	if e := store.QueryAudit(storage.AuditFilter{Action: "reloadConfig"}); len(e) != 1 || e[0].Actor != "alice" || e[0].Status != http.StatusForbidden {
+		t.Errorf("denied reload not audited: %+v", e)
+	}
+}
+
+func TestFrontend(t *testing.T) {
+	s, _ := newTestServer(t)
+	if w := do(s, http.MethodGet, "/", nil, nil); w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "does not bundle a front-end") {
+		t.Errorf("bundled placeholder not served: %d %s", w.Code, w.Body.String())
+	}
+
+	s.front = &frontend{files: fstest.MapFS{
+		"index.html":                {Data: []byte("<html>app</html>")},
+		"assets/app.3f2a9c1b.js":    {Data: []byte("js")},
+		"assets/app.3f2a9c1b.js.br": {Data: []byte("br")},
+		"assets/app.3f2a9c1b.js.gz": {Data: []byte("gz")},
+		".env":                      {Data: []byte("secret")},
+		"assets/vendor.min.js":      {Data: []byte("vendor")},
+		"assets/vendor.min.js.gz":   {Data: []byte("vendor gz")},
+	}}
+	w := do(s, http.MethodGet, "/albums/LACA-1234", nil, nil)
+	if w.Code != http.StatusOK || w.Body.String() != "<html>app</html>" || w.Header().Get("Cache-Control") != "no-cache" {
+		t.Errorf("route of the app not served index.html: %d %v %s", w.Code, w.Header(), w.Body.String())
+	}
+	etag := w.Header().Get("ETag")
+	if w = do(s, http.MethodGet, "/", nil, http.Header{"If-None-Match": {etag}}); etag == "" || w.Code != http.StatusNotModified {
+		t.Errorf("unchanged index.html sent again: %d", w.Code)
+	}
+	for _, path := range []string{"/assets/missing.js", "/.env", "/assets/../.env"} {
+		if w = do(s, http.MethodGet, path, nil, nil); w.Code != http.StatusNotFound {
+			t.Errorf("%s: expected 404, got %d", path, w.Code)
+		}
+	}
+
+	for _, c := range []struct{ accept, body, encoding string }{
+		{"", "js", ""},
+		{"gzip, deflate", "gz", "gzip"},
+		{"gzip, br", "br", "br"},
+		{"gzip, br;q=0", "gz", "gzip"},
+	} {
+		w = do(s, http.MethodGet, "/assets/app.3f2a9c1b.js", nil, http.Header{"Accept-Encoding": {c.accept}})
+		if w.Body.String() != c.body || w.Header().Get("Content-Encoding") != c.encoding ||
+			!strings.HasPrefix(w.Header().Get("Content-Type"), "text/javascript") && !strings.HasPrefix(w.Header().Get("Content-Type"), "application/javascript") {
+			t.Errorf("Accept-Encoding %q: got %q, %v", c.accept, w.Body.String(), w.Header())
+		}
+		if !strings.Contains(w.Header().Get("Cache-Control"), "immutable") || w.Header().Get("Vary") != "Accept-Encoding" {
+			t.Errorf("wrong cache headers of hashed asset: %v", w.Header())
+		}
+	}
+	if w = do(s, http.MethodGet, "/assets/vendor.min.js", nil, nil); w.Header().Get("Cache-Control") != "no-cache" {
+		t.Errorf("unhashed asset cached: %v", w.Header())
+	}
+
+	if w = do(s, http.MethodGet, "/api/v2/missing", nil, nil); w.Code != http.StatusNotFound || errorCode(t, w) == "" {
+		t.Errorf("unknown API path served by the front-end: %d %s", w.Code, w.Body.String())
+	}
+}
+
+func TestAdminConsole(t *testing.T) {
+	s, store := newTestServer(t)
+	if w := do(s, http.MethodGet, "/admin", nil, nil); w.Code != http.StatusMovedPermanently || w.Header().Get("Location") != "/admin/" {
+		t.Errorf("/admin not redirected: %d", w.Code)
+	}
+	for _, path := range []string{"/admin/", "/admin/admin.js"} {
+		if w := do(s, http.MethodGet, path, nil, nil); w.Code != http.StatusOK || w.Body.Len() == 0 {
+			t.Errorf("%s not served: %d", path, w.Code)
+		}
+	}
+
+	_ = store.Register("alice", "123456")
+	alice := login(t, s, "alice", "123456")
+	admin := login(t, s, "Admin", "12345")
+	w := do(s, http.MethodPost, "/api/generateToken", url.Values{}, alice)
+	auth := http.Header{"Authorization": {w.Body.String()}}
+	for _, path := range []string{"/KICA-1234/1", "/KICA-1234/1", "/LACA-12345/1", "/LACA-12345/cover"} {
+		if w = do(s, http.MethodGet, path, nil, auth); w.Code != http.StatusOK {
+			t.Fatalf("failed to get %s: %d", path, w.Code)
+		}
+	}
+
+	var stats DownloadStats
+	w = do(s, http.MethodGet, "/api/v2/downloads?days=7", nil, admin)
+	if err := json.Unmarshal(w.Body.Bytes(), &stats); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("failed to get downloads: %d %v", w.Code, err)
+	}
+	if stats.Total != 3 || len(stats.Daily) != 7 || stats.Daily[6].Count != 3 || stats.Users[0] != (DownloadTotal{"alice", 3}) ||
+		stats.Catalogs[0] != (DownloadTotal{"KICA-1234", 2}) {
+		t.Errorf("wrong downloads: %+v", stats)
+	}
+	if w = do(s, http.MethodGet, "/api/v2/downloads", nil, alice); w.Code != http.StatusForbidden {
+		t.Errorf("member read downloads: %d", w.Code)
+	}
+
+	var d UserDetails
+	w = do(s, http.MethodGet, "/api/v2/users/alice/details", nil, admin)
+	if err := json.Unmarshal(w.Body.Bytes(), &d); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("failed to get user details: %d %v", w.Code, err)
+	}
+	if d.Role != storage.RoleGuest || len(d.Tokens) != 1 || len(d.Sessions) != 1 || d.Sessions[0].Current || d.LastLogin == 0 {
+		t.Errorf("wrong user details: %+v", d)
+	}
+
+	var sessions []SessionInfo
+	w = do(s, http.MethodGet, "/api/v2/sessions", nil, admin)
+	_ = json.Unmarshal(w.Body.Bytes(), &sessions)
+	if len(sessions) != 2 {
+		t.Fatalf("wrong sessions: %s", w.Body.String())
+	}
+	for _, ses := range sessions {
+		if ses.Username == "alice" {
+			if w = do(s, http.MethodDelete, "/api/v2/sessions/"+ses.Id, nil, admin); w.Code != http.StatusNoContent {
+				t.Errorf("failed to revoke session: %d", w.Code)
+			}
+		} else if !ses.Current {
+			t.Errorf("own session not marked current: %+v", ses)
+		}
+	}
+	if w = do(s, http.MethodGet, "/api/v2/me", nil, alice); w.Code != http.StatusUnauthorized {
+		t.Errorf("revoked session accepted: %d", w.Code)
+	}
+
+	_ = store.Register("bob", "123456")
+	_ = store.SetRole("bob", storage.RoleAdmin)
+	bob := login(t, s, "bob", "123456")
+	sessions = nil
+	w = do(s, http.MethodGet, "/api/v2/sessions", nil, bob)
+	_ = json.Unmarshal(w.Body.Bytes(), &sessions)
+	if len(sessions) != 1 || sessions[0].Username != "bob" {
+		t.Errorf("admin listed sessions of the owner: %s", w.Body.String())
+	}
+	d = UserDetails{}
+	w = do(s, http.MethodGet, "/api/v2/users/Admin/details", nil, bob)
+	if err := json.Unmarshal(w.Body.Bytes(), &d); err != nil || len(d.Sessions) != 0 {
+		t.Errorf("admin read sessions of the owner: %s", w.Body.String())
+	}
+	for _, ses := range s.store.ListSessions("Admin") {
+		if w = do(s, http.MethodDelete, "/api/v2/sessions/"+sessionKey(ses.Id), nil, bob); w.Code != http.StatusForbidden {
+			t.Errorf("admin revoked a session of the owner: %d", w.Code)
+		}
+	}
+	if len(s.store.ListSessions("Admin")) != 1 {
+		t.Errorf("owner session revoked by admin")
+	}
+
+	var health []BackendHealth
+	w = do(s, http.MethodGet, "/api/v2/backends", nil, admin)
+	_ = json.Unmarshal(w.Body.Bytes(), &health)
+	if len(health) != 1 || health[0].Name != "local" || health[0].Catalogs != 2 || health[0].Calls == 0 || health[0].Errors != 0 {
+		t.Errorf("wrong backend health: %s", w.Body.String())
+	}
+}
@@ -0,0 +1,105 @@
+package http
+
+import (
+	"context"
+	"github.com/SeraphJACK/go-annil/logging"
+	"github.com/gin-gonic/gin"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+func (s *Server) regHealthEndpoints(r *gin.Engine) {
+	r.GET("/healthz", func(ctx *gin.Context) {
+		ctx.String(http.StatusOK, "ok")
+	})
+	// Not ready before the server listens and once it is shutting down
+	r.GET("/readyz", func(ctx *gin.Context) {
+		if atomic.LoadInt32(&s.ready) == 0 {
+			ctx.String(http.StatusServiceUnavailable, "shutting down")
+			return
+		}
+		ctx.String(http.StatusOK, "ready")
+	})
+}
+
+// ListenAndServe serves on addr until Shutdown is called.
+func (s *Server) ListenAndServe(addr string) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(ln)
+}
+
+// Serve serves connections accepted by ln until Shutdown is called, which makes it return nil.
+func (s *Server) Serve(ln net.Listener) error {
+	s.srvMu.Lock()
+	if s.stopping {
+		s.srvMu.Unlock()
+		_ = ln.Close()
+		return nil
+	}
+	s.srv = &http.Server{Handler: s}
+	s.srvMu.Unlock()
+	atomic.StoreInt32(&s.ready, 1)
+	err := s.srv.Serve(ln)
+	if err == http.ErrServerClosed {
+		return nil
+	}
+	return err
+}
+
+// Shutdown stops the server in order. /readyz reports not ready first, and the listener closes
+// after the configured delay. In-flight requests then get the drain timeout to finish before
+// their connections are closed. Backends and background jobs are stopped last.
+// Cancelling ctx cuts the delay and the drain short.
+func (s *Server) Shutdown(ctx context.Context) error {
+	atomic.StoreInt32(&s.ready, 0)
+	select {
+	case <-time.After(time.Duration(s.shutdownCfg.ReadyDelay) * time.Second):
+	case <-ctx.Done():
+	}
+
+	s.srvMu.Lock()
+	s.stopping = true
+	srv := s.srv
+	s.srvMu.Unlock()
+	var err error
+	if srv != nil {
+		drain, cancel := context.WithTimeout(ctx, time.Duration(s.shutdownCfg.DrainTimeout)*time.Second)
+		defer cancel()
+		if err = srv.Shutdown(drain); err != nil {
+			// Streams still running are cut off
+			_ = srv.Close()
+		}
+	}
+	if s.metricsSrv != nil {
+		_ = s.metricsSrv.Close()
+	}
+	s.stopOnce.Do(func() { close(s.done) })
+	if cerr := s.backends().Close(); cerr != nil && err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// cleanup deletes expired sessions and mail tokens every hour until the server shuts down.
+func (s *Server) cleanup() {
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-s.done:
+			return
+		}
+		if err := s.store.DeleteExpiredSessions(); err != nil {
+			logging.Default().Error("Failed to clean up expired sessions", "err", err)
+		}
+		if err := s.store.DeleteExpiredMailTokens(); err != nil {
+			logging.Default().Error("Failed to clean up expired mail tokens", "err", err)
+		}
+	}
+}
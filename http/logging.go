@@ -0,0 +1,65 @@
+package http
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"github.com/SeraphJACK/go-annil/logging"
+	"github.com/gin-gonic/gin"
+	"regexp"
+	"time"
+)
+
+const requestIDHeader = "X-Request-ID"
+
+// Request ids of proxies in front are kept if they are safe to log and pass on
+var requestIDExp = regexp.MustCompile(`^[0-9A-Za-z._-]{1,64}$`)
+
+// logRequests names every request with an id, which handlers log with and relays receive,
+// and logs the request once it has been handled. Query values which may be secrets are redacted.
+func (s *Server) logRequests() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		start := time.Now()
+		id := ctx.GetHeader(requestIDHeader)
+		if !requestIDExp.MatchString(id) {
+			id = newRequestID()
+		}
+		ctx.Header(requestIDHeader, id)
+		ctx.Request = ctx.Request.WithContext(logging.WithRequestID(ctx.Request.Context(), id))
+		ctx.Next()
+
+		status := ctx.Writer.Status()
+		kv := []interface{}{
+			"method", ctx.Request.Method,
+			"path", ctx.Request.URL.Path,
+			"status", status,
+			"latency", time.Since(start),
+			"ip", s.clientIP(ctx),
+			"bytes", ctx.Writer.Size(),
+		}
+		if q := ctx.Request.URL.Query(); len(q) > 0 {
+			kv = append(kv, "query", logging.Query(q))
+		}
+		if u := ctx.GetString("username"); u != "" {
+			kv = append(kv, "user", u)
+		}
+		if r := ctx.Writer.Header().Get("X-Status-Reason"); r != "" {
+			kv = append(kv, "reason", r)
+		}
+		level := logging.Info
+		if status >= 500 {
+			level = logging.Error
+		}
+		logger(ctx).Log(level, "Request handled", kv...)
+	}
+}
+
+// logger returns the logger of the request, which adds its id to records.
+func logger(ctx *gin.Context) *logging.Logger {
+	return logging.FromContext(ctx.Request.Context())
+}
+
+func newRequestID() string {
+	b := make([]byte, 12)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
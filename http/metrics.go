@@ -0,0 +1,214 @@
+package http
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"github.com/SeraphJACK/go-annil/backend"
+	"github.com/SeraphJACK/go-annil/logging"
+	"github.com/SeraphJACK/go-annil/metrics"
+	"github.com/SeraphJACK/go-annil/storage"
+	"github.com/gin-gonic/gin"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// serverMetrics are collected by a Server and served at /metrics.
+type serverMetrics struct {
+	registry *metrics.Registry
+	requests *metrics.CounterVec
+	latency  *metrics.HistogramVec
+	// Library requests streaming a cover or track right now
+	streams  *metrics.GaugeVec
+	streamed *metrics.CounterVec
+	// Backend calls, for relays this is the upstream request until its response headers arrive
+	backendCalls   *metrics.CounterVec
+	backendLatency *metrics.HistogramVec
+	loginFailures  *metrics.CounterVec
+	// Cover lookups in the caches of relays
+	relayCache *metrics.CounterVec
+}
+
+func newServerMetrics(store storage.Store) *serverMetrics {
+	r := metrics.NewRegistry()
+	m := &serverMetrics{
+		registry:       r,
+		requests:       r.Counter("annil_http_requests_total", "HTTP requests by route and status.", "method", "route", "status"),
+		latency:        r.Histogram("annil_http_request_duration_seconds", "Time until HTTP requests were handled, including streaming.", metrics.DefBuckets, "method", "route"),
+		streams:        r.Gauge("annil_active_streams", "Covers and tracks being streamed.", "kind"),
+		streamed:       r.Counter("annil_backend_streamed_bytes_total", "Bytes of covers and tracks read from backends.", "backend"),
+		backendCalls:   r.Counter("annil_backend_requests_total", "Backend calls by operation and result.", "backend", "op", "result"),
+		backendLatency: r.Histogram("annil_backend_request_duration_seconds", "Time backends took to list catalogs or open a cover or track.", metrics.DefBuckets, "backend", "op"),
+		loginFailures:  r.Counter("annil_login_failures_total", "Rejected logins by reason.", "reason"),
+		relayCache:     r.Counter("annil_relay_cache_lookups_total", "Cover lookups in relay caches by result, hit or miss.", "backend", "result"),
+	}
+	r.GaugeFunc("annil_sessions", "Unexpired sessions.", func() float64 {
+		n, err := store.CountSessions()
+		if err != nil {
+			logging.Default().Error("Failed to count sessions", "err", err)
+		}
+		return float64(n)
+	})
+	return m
+}
+
+func (s *Server) regMetricsEndpoints(r *gin.Engine) {
+	r.GET("/metrics", func(ctx *gin.Context) {
+		// Without a token, metrics are only served on their own listener
+		if !s.metricsCfg.Enabled || s.metricsCfg.Listen != "" || s.metricsCfg.Token == "" {
+			ctx.Status(http.StatusNotFound)
+			return
+		}
+		s.serveMetrics(ctx.Writer, ctx.Request)
+	})
+}
+
+// serveMetrics writes the metrics if the request carries the configured token.
+func (s *Server) serveMetrics(w http.ResponseWriter, req *http.Request) {
+	if t := s.metricsCfg.Token; t != "" {
+		got := req.Header.Get("Authorization")
+		if subtle.ConstantTimeCompare([]byte(got), []byte("Bearer "+t)) != 1 {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+	}
+	w.Header().Set("Content-Type", metrics.ContentType)
+	if err := s.metrics.registry.Write(w); err != nil {
+		logging.FromContext(req.Context()).Errorf("Failed to write metrics: %v\n", err)
+	}
+}
+
+// measure counts requests by the route they matched.
+func (s *Server) measure() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		start := time.Now()
+		ctx.Next()
+		route := ctx.FullPath()
+		if route == "" {
+			route = "unmatched"
+		}
+		method := ctx.Request.Method
+		s.metrics.requests.Inc(method, route, strconv.Itoa(ctx.Writer.Status()))
+		s.metrics.latency.Observe(time.Since(start).Seconds(), method, route)
+	}
+}
+
+// stream copies r to the response and counts it as an active stream of kind.
+func (s *Server) stream(ctx *gin.Context, kind string, r io.ReadCloser) {
+	s.metrics.streams.Add(1, kind)
+	defer s.metrics.streams.Add(-1, kind)
+	ctx.Stream(func(w io.Writer) bool {
+		defer r.Close()
+		_, err := io.Copy(w, r)
+		return err != nil
+	})
+}
+
+// instrument wraps the backends of be, so their calls and the bytes read from them are measured.
+func instrument(be *backend.Multiplexer, m *serverMetrics) *backend.Multiplexer {
+	backends := make([]backend.Backend, len(be.Backends))
+	for i, b := range be.Backends {
+		name := be.Names[i]
+		if r, ok := b.(*backend.RelayBackend); ok {
+			r.OnCacheLookup = func(hit bool) {
+				result := "miss"
+				if hit {
+					result = "hit"
+				}
+				m.relayCache.Inc(name, result)
+			}
+		}
+		backends[i] = &measuredBackend{name: name, be: b, m: m}
+	}
+	return backend.NewNamedMultiplexer(be.Names, backends)
+}
+
+type measuredBackend struct {
+	name string
+	be   backend.Backend
+	m    *serverMetrics
+	// Calls and failures since the backend was loaded, shown by the admin console
+	mu            sync.Mutex
+	calls         int
+	failures      int
+	lastError     string
+	lastErrorTime int64
+}
+
+func (b *measuredBackend) observe(op string, start time.Time, err error) {
+	result := "ok"
+	if errors.Is(err, backend.ErrNotFound) {
+		// Backends are tried in turn, so misses are expected
+		result = "miss"
+	} else if err != nil {
+		result = "error"
+	}
+	b.m.backendCalls.Inc(b.name, op, result)
+	b.m.backendLatency.Observe(time.Since(start).Seconds(), b.name, op)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.calls++
+	if result == "error" {
+		b.failures++
+		b.lastError = err.Error()
+		b.lastErrorTime = time.Now().Unix()
+	}
+}
+
+func (b *measuredBackend) stats() (calls, failures int, lastError string, lastErrorTime int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.calls, b.failures, b.lastError, b.lastErrorTime
+}
+
+func (b *measuredBackend) Close() error {
+	if c, ok := b.be.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+func (b *measuredBackend) ListCatalogs(ctx context.Context) []string {
+	start := time.Now()
+	c := b.be.ListCatalogs(ctx)
+	b.observe("list", start, nil)
+	return c
+}
+
+func (b *measuredBackend) GetCover(ctx context.Context, catalog string) (io.ReadCloser, error) {
+	start := time.Now()
+	r, err := b.be.GetCover(ctx, catalog)
+	b.observe("cover", start, err)
+	if err != nil {
+		return nil, err
+	}
+	return &countingReader{ReadCloser: r, b: b}, nil
+}
+
+func (b *measuredBackend) GetAudio(ctx context.Context, catalog string, track uint8) (backend.AudioType, io.ReadCloser, error) {
+	start := time.Now()
+	t, r, err := b.be.GetAudio(ctx, catalog, track)
+	b.observe("audio", start, err)
+	if err != nil {
+		return t, nil, err
+	}
+	return t, &countingReader{ReadCloser: r, b: b}, nil
+}
+
+// countingReader counts the bytes read from a backend.
+type countingReader struct {
+	io.ReadCloser
+	b *measuredBackend
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	if n > 0 {
+		r.b.m.streamed.Add(float64(n), r.b.name)
+	}
+	return n, err
+}
@@ -0,0 +1,296 @@
+package http
+
+import (
+	"github.com/SeraphJACK/go-annil/config"
+	"github.com/SeraphJACK/go-annil/oidc"
+	"github.com/SeraphJACK/go-annil/storage"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// How long a redirect to the provider may take to come back
+	oidcStateLifetime = 10 * time.Minute
+	oidcStateCookie   = "oidcState"
+)
+
+type LoginMethods struct {
+	Local bool `json:"local"`
+	OIDC  bool `json:"oidc"`
+}
+
+func (s *Server) regOIDCEndpoints(r *gin.Engine) {
+	r.POST("/api/loginMethods", func(ctx *gin.Context) {
+		ctx.JSON(http.StatusOK, LoginMethods{Local: true, OIDC: s.oidc != nil})
+	})
+
+	r.GET("/api/oidc/login", s.requireOIDC(), func(ctx *gin.Context) {
+		s.redirectToProvider(ctx, "", http.StatusFound)
+	})
+	// Links the provider account to the logged in user, which changes how it can log in and
+	// is therefore a POST subject to the CSRF check
+	r.POST("/api/oidc/link", s.audit("oidcLink", ""), s.requireOIDC(), s.requireSession(), func(ctx *gin.Context) {
+		s.redirectToProvider(ctx, ctx.GetString("username"), http.StatusSeeOther)
+	})
+	r.GET("/api/oidc/callback", s.audit("oidcLogin", ""), s.requireOIDC(), func(ctx *gin.Context) {
+		state := ctx.Query("state")
+		cookie, _ := ctx.Cookie(oidcStateCookie)
+		st, ok := s.oidcStates.take(state)
+		if !ok || cookie != state {
+			ctx.Header("X-Status-Reason", "INVALID_STATE")
+			ctx.Status(http.StatusBadRequest)
+			return
+		}
+		s.setCookie(ctx, &http.Cookie{Name: oidcStateCookie, Path: "/api/oidc", MaxAge: -1, HttpOnly: true})
+		if e := ctx.Query("error"); e != "" {
+			ctx.Set("auditDetail", e)
+			ctx.Header("X-Status-Reason", "PROVIDER_ERROR")
+			ctx.Status(http.StatusUnauthorized)
+			return
+		}
+		claims, err := s.oidc.Exchange(ctx.Query("code"), st.verifier, st.nonce)
+		if err != nil {
+			logger(ctx).Errorf("Failed to complete oidc login: %v\n", err)
+			ctx.Header("X-Status-Reason", "INVALID_TOKEN")
+			ctx.Status(http.StatusUnauthorized)
+			return
+		}
+		issuer, subject := s.oidc.Issuer(), claims.Subject()
+		ctx.Set("auditDetail", subject)
+
+		if st.link != "" {
+			s.linkIdentity(ctx, st.link, issuer, subject)
+			return
+		}
+		username, err := s.store.IdentityUser(issuer, subject)
+		if err != nil {
+			username, ok = s.provision(ctx, claims)
+			if !ok {
+				return
+			}
+		} else if role, ok := s.oidcRole(claims); ok && s.store.UserRole(username) != storage.RoleOwner {
+			err = s.store.SetRole(username, role)
+			if err != nil {
+				logger(ctx).Errorf("Failed to apply oidc role of %s: %v\n", username, err)
+			}
+		}
+		// Like password logins, users with a second factor get a ticket for /api/loginTotp,
+		// which is passed to the web interface in the fragment so that it is never sent to a server.
+		// Users who still have to enroll get a session limited to enrolling.
+		if st, err := s.store.GetTotp(username); err == nil && st.Enabled {
+			ctx.Set("auditTarget", username)
+			ctx.Header("X-Status-Reason", "TOTP_REQUIRED")
+			ctx.Redirect(http.StatusFound, "/#totpTicket="+s.tickets.issue(username))
+			return
+		}
+		if !s.newSession(ctx, username) {
+			return
+		}
+		ctx.Redirect(http.StatusFound, "/")
+	})
+
+	r.POST("/api/listIdentities", s.requireSession(), func(ctx *gin.Context) {
+		ctx.JSON(http.StatusOK, s.store.UserIdentities(ctx.GetString("username")))
+	})
+	// Lets an external provider log in as an existing account, which it does not own otherwise
+	r.POST("/api/linkIdentity", s.audit("linkIdentity", "username"), s.requirePermission(storage.PermManageUsers), func(ctx *gin.Context) {
+		target, issuer, subject := ctx.PostForm("username"), ctx.PostForm("issuer"), ctx.PostForm("subject")
+		if issuer == "" || subject == "" {
+			ctx.Status(http.StatusBadRequest)
+			return
+		}
+		if !s.store.UserExists(target) {
+			ctx.Status(http.StatusNotFound)
+			return
+		}
+		if !s.canManage(ctx.GetString("username"), target) {
+			ctx.Status(http.StatusForbidden)
+			return
+		}
+		ctx.Set("auditDetail", issuer+" "+subject)
+		if _, err := s.store.IdentityUser(issuer, subject); err == nil {
+			ctx.Header("X-Status-Reason", "IDENTITY_IN_USE")
+			ctx.Status(http.StatusConflict)
+			return
+		}
+		if err := s.store.LinkIdentity(issuer, subject, target); err != nil {
+			ctx.Status(http.StatusInternalServerError)
+			logger(ctx).Errorf("Failed to link identity of %s: %v\n", target, err)
+		} else {
+			ctx.Status(http.StatusOK)
+		}
+	})
+	r.POST("/api/unlinkIdentity", s.audit("unlinkIdentity", "subject"), s.requireSession(), func(ctx *gin.Context) {
+		issuer, subject := ctx.PostForm("issuer"), ctx.PostForm("subject")
+		username, err := s.store.IdentityUser(issuer, subject)
+		if err != nil || username != ctx.GetString("username") {
+			ctx.Status(http.StatusNotFound)
+			return
+		}
+		err = s.store.UnlinkIdentity(issuer, subject)
+		if err != nil {
+			ctx.Status(http.StatusInternalServerError)
+			logger(ctx).Errorf("Failed to unlink identity of %s: %v\n", username, err)
+		} else {
+			ctx.Status(http.StatusOK)
+		}
+	})
+}
+
+func (s *Server) requireOIDC() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		if s.oidc == nil {
+			ctx.Header("X-Status-Reason", "OIDC_DISABLED")
+			ctx.AbortWithStatus(http.StatusNotFound)
+		}
+	}
+}
+
+func (s *Server) redirectToProvider(ctx *gin.Context, link string, status int) {
+	state, err := oidc.NewState()
+	var st oidcState
+	if err == nil {
+		st.nonce, err = oidc.NewState()
+	}
+	if err == nil {
+		st.verifier, err = oidc.NewState()
+	}
+	var u string
+	if err == nil {
+		u, err = s.oidc.AuthCodeURL(state, st.nonce, st.verifier)
+	}
+	if err != nil {
+		ctx.Status(http.StatusInternalServerError)
+		logger(ctx).Errorf("Failed to start oidc login: %v\n", err)
+		return
+	}
+	st.link = link
+	s.oidcStates.add(state, st)
+	// The provider redirects back from another site, which strict cookies are not sent with
+	s.setCookie(ctx, &http.Cookie{
+		Name:     oidcStateCookie,
+		Value:    state,
+		Path:     "/api/oidc",
+		MaxAge:   int(oidcStateLifetime.Seconds()),
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	ctx.Redirect(status, u)
+}
+
+func (s *Server) linkIdentity(ctx *gin.Context, username, issuer, subject string) {
+	ctx.Set("username", username)
+	if linked, err := s.store.IdentityUser(issuer, subject); err == nil {
+		if linked != username {
+			ctx.Header("X-Status-Reason", "IDENTITY_IN_USE")
+			ctx.Status(http.StatusConflict)
+			return
+		}
+	} else if err = s.store.LinkIdentity(issuer, subject, username); err != nil {
+		ctx.Status(http.StatusInternalServerError)
+		logger(ctx).Errorf("Failed to link identity of %s: %v\n", username, err)
+		return
+	}
+	ctx.Redirect(http.StatusFound, "/")
+}
+
+// provision registers the user of an unknown subject if just-in-time provisioning is enabled.
+func (s *Server) provision(ctx *gin.Context, claims oidc.Claims) (string, bool) {
+	if !s.oidcCfg.AutoRegister {
+		ctx.Header("X-Status-Reason", "NOT_REGISTERED")
+		ctx.Status(http.StatusForbidden)
+		return "", false
+	}
+	username := claims.String(s.oidcCfg.UsernameClaim)
+	if !usernameExp.MatchString(username) || s.store.UserExists(username) {
+		ctx.Header("X-Status-Reason", "USERNAME_UNAVAILABLE")
+		ctx.Status(http.StatusConflict)
+		return "", false
+	}
+	role, ok := s.oidcRole(claims)
+	if !ok {
+		role = s.oidcCfg.DefaultRole
+	}
+	// Provisioned users log in through the provider, until they set a password of their own
+	password, err := oidc.NewState()
+	if err == nil {
+		err = storage.ProvisionUser(s.store, username, password, role, s.oidc.Issuer(), claims.Subject())
+	}
+	if err != nil {
+		ctx.Status(http.StatusInternalServerError)
+		logger(ctx).Errorf("Failed to provision oidc user %s: %v\n", username, err)
+		return "", false
+	}
+	ctx.Set("auditTarget", username)
+	return username, true
+}
+
+// oidcRole returns the role of the first configured group the user is a member of.
+func (s *Server) oidcRole(claims oidc.Claims) (string, bool) {
+	groups := claims.Strings(s.oidcCfg.GroupsClaim)
+	for _, gr := range s.oidcCfg.GroupRoles {
+		for _, g := range groups {
+			if g == gr.Group && s.store.RoleExists(gr.Role) {
+				return gr.Role, true
+			}
+		}
+	}
+	return "", false
+}
+
+func newOIDCProvider(cfg config.OIDCConfig) *oidc.Provider {
+	if !cfg.Enabled {
+		return nil
+	}
+	return oidc.NewProvider(oidc.Config{
+		Issuer:       cfg.Issuer,
+		ClientID:     cfg.ClientID,
+		ClientSecret: cfg.ClientSecret,
+		RedirectURL:  cfg.RedirectURL,
+		Scopes:       cfg.Scopes,
+	})
+}
+
+// oidcStates holds logins which were redirected to the provider.
+type oidcStates struct {
+	mu sync.Mutex
+	m  map[string]oidcState
+}
+
+type oidcState struct {
+	nonce    string
+	verifier string
+	// User linking the identity, empty for logins
+	link   string
+	expire time.Time
+}
+
+func (o *oidcStates) add(state string, st oidcState) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.m == nil {
+		o.m = make(map[string]oidcState)
+	}
+	now := time.Now()
+	for k, v := range o.m {
+		if now.After(v.expire) {
+			delete(o.m, k)
+		}
+	}
+	st.expire = now.Add(oidcStateLifetime)
+	o.m[state] = st
+}
+
+// take removes and returns a state, every state can only be used once.
+func (o *oidcStates) take(state string) (oidcState, bool) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	st, ok := o.m[state]
+	delete(o.m, state)
+	if !ok || time.Now().After(st.expire) {
+		return oidcState{}, false
+	}
+	return st, true
+}
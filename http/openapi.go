@@ -0,0 +1,363 @@
+package http
+
+import (
+	"github.com/SeraphJACK/go-annil/storage"
+	"github.com/SeraphJACK/go-annil/throttle"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// endpoint documents a route in the OpenAPI document.
+type endpoint struct {
+	Method  string
+	Path    string
+	Summary string
+	// authSession, authToken or empty for anonymous requests
+	Auth string
+	// Permission the user needs besides a session
+	Perm  string
+	Query []string
+	// Form fields of v1 requests
+	Form []string
+	// JSON request body
+	Body interface{}
+	// Status of successful requests, 200 if zero
+	Status int
+	// JSON response body, or textBody or fileBody
+	Result interface{}
+	// Codes the endpoint reports in X-Status-Reason or the error body
+	Reasons []string
+}
+
+const (
+	authSession = "session"
+	authToken   = "token"
+	authMetrics = "metrics"
+)
+
+// Response bodies which are not JSON
+type textBody struct{}
+type fileBody struct{ types []string }
+
+var endpoints = []endpoint{
+	{Method: "GET", Path: "/openapi.json", Summary: "This document"},
+	{Method: "GET", Path: "/metrics", Summary: "Prometheus metrics, if enabled with a token", Auth: authMetrics, Result: fileBody{[]string{"text/plain"}}},
+	{Method: "GET", Path: "/healthz", Summary: "Liveness probe", Result: textBody{}},
+	{Method: "GET", Path: "/readyz", Summary: "Readiness probe, 503 while shutting down", Result: textBody{}},
+	{Method: "POST", Path: "/api/reloadConfig", Summary: "Reload backends from the config file", Auth: authSession, Perm: storage.PermManageSettings,
+		Result: ReloadResult{}, Reasons: []string{"INVALID_CONFIG"}},
+
+	// Library
+	{Method: "GET", Path: "/albums", Summary: "List the catalogs the token can access", Auth: authToken, Result: []string{}},
+	{Method: "GET", Path: "/:catalog/cover", Summary: "Get the cover of an album", Auth: authToken, Result: fileBody{[]string{"image/jpeg"}}},
+	{Method: "GET", Path: "/:catalog/:track", Summary: "Stream a track", Auth: authToken, Result: fileBody{[]string{"audio/flac", "audio/mp3"}}},
+	{Method: "POST", Path: "/share", Summary: "Create a share token for tracks", Auth: authToken, Perm: storage.PermShare, Body: CreateSharePayload{}, Result: textBody{}},
+	{Method: "OPTIONS", Path: "/share", Summary: "CORS preflight of share"},
+
+	// Users
+	{Method: "POST", Path: "/api/login", Summary: "Log in with username and password", Form: []string{"username", "password"}, Result: textBody{},
+		Reasons: []string{"TOTP_REQUIRED", "PASSWORD_CHANGE_REQUIRED", "TOTP_ENROLLMENT_REQUIRED", "ACCOUNT_LOCKED", "IP_LOCKED", "TOO_MANY_ATTEMPTS", "AUTH_UNAVAILABLE"}},
+	{Method: "POST", Path: "/api/loginMethods", Summary: "List the enabled login methods", Result: LoginMethods{}},
+	{Method: "POST", Path: "/api/setup", Summary: "Create the owner of a fresh instance", Form: []string{"username", "password"},
+		Reasons: []string{"ALREADY_SET_UP", "USERNAME_UNAVAILABLE", "PASSWORD_TOO_SHORT"}},
+	{Method: "POST", Path: "/api/register", Summary: "Register with an invite code", Form: []string{"username", "password", "inviteCode", "email"},
+		Reasons: []string{"USERNAME_UNAVAILABLE", "INVALID_EMAIL", "EMAIL_REQUIRED", "EMAIL_IN_USE", "PASSWORD_TOO_SHORT", "INVALID_INVITE_CODE"}},
+	{Method: "POST", Path: "/api/current", Summary: "Get the name of the logged in user", Auth: authSession, Result: textBody{}},
+	{Method: "POST", Path: "/api/changePassword", Summary: "Change the own password", Auth: authSession, Form: []string{"oldPassword", "newPassword"},
+		Reasons: []string{"WRONG_OLD_PASSWORD", "PASSWORD_TOO_SHORT"}},
+	{Method: "POST", Path: "/api/revoke", Summary: "Revoke a user", Auth: authSession, Form: []string{"username"}, Reasons: []string{"LAST_OWNER"}},
+	{Method: "POST", Path: "/api/listUsers", Summary: "List users", Auth: authSession, Perm: storage.PermManageUsers, Result: []storage.User{}},
+	{Method: "POST", Path: "/api/setRole", Summary: "Set the role of a user", Auth: authSession, Perm: storage.PermManageUsers, Form: []string{"username", "role"},
+		Reasons: []string{"UNKNOWN_ROLE", "LAST_OWNER"}},
+	{Method: "POST", Path: "/api/grantAdmin", Summary: "Give a user the admin role", Auth: authSession, Perm: storage.PermManageUsers, Form: []string{"username"}, Reasons: []string{"LAST_OWNER"}},
+	{Method: "POST", Path: "/api/revokeAdmin", Summary: "Give an admin the member role", Auth: authSession, Perm: storage.PermManageUsers, Form: []string{"username"}, Reasons: []string{"LAST_OWNER"}},
+	{Method: "POST", Path: "/api/allowShare", Summary: "Give a guest the member role", Auth: authSession, Perm: storage.PermManageUsers, Form: []string{"username"}, Reasons: []string{"CUSTOM_ROLE"}},
+	{Method: "POST", Path: "/api/disallowShare", Summary: "Give a member the guest role", Auth: authSession, Perm: storage.PermManageUsers, Form: []string{"username"}, Reasons: []string{"CUSTOM_ROLE"}},
+	{Method: "POST", Path: "/api/listLockedUsers", Summary: "List users locked out after failed logins", Auth: authSession, Perm: storage.PermManageUsers, Result: []throttle.Lock{}},
+	{Method: "POST", Path: "/api/unlockUser", Summary: "Lift the login lockout of a user or an address", Auth: authSession, Perm: storage.PermManageUsers, Form: []string{"username", "ip"}},
+
+	// Tokens
+	{Method: "POST", Path: "/api/generateToken", Summary: "Generate a user token, expire is in hours", Auth: authSession, Form: []string{"catalogs", "coverOnly", "expire", "note"}, Result: textBody{}},
+	{Method: "POST", Path: "/api/listTokens", Summary: "List the own tokens, or those of username", Auth: authSession, Form: []string{"username"}, Result: []storage.Token{}},
+	{Method: "POST", Path: "/api/revokeToken", Summary: "Revoke a token", Auth: authSession, Form: []string{"id"}},
+
+	// Invite codes
+	{Method: "POST", Path: "/api/createInviteCode", Summary: "Create an invite code, expire is in hours", Auth: authSession, Perm: storage.PermManageInvites,
+		Form: []string{"limit", "expire", "note", "role", "groups"}, Result: textBody{}, Reasons: []string{"UNKNOWN_ROLE", "UNKNOWN_GROUP"}},
+	{Method: "POST", Path: "/api/listInviteCodes", Summary: "List invite codes", Auth: authSession, Perm: storage.PermManageInvites, Result: []storage.InviteCode{}},
+	{Method: "POST", Path: "/api/listRedemptions", Summary: "List the users registered with a code", Auth: authSession, Perm: storage.PermManageInvites, Form: []string{"code"}, Result: []storage.Redemption{}},
+	{Method: "POST", Path: "/api/revokeInviteCode", Summary: "Revoke an invite code", Auth: authSession, Perm: storage.PermManageInvites, Form: []string{"code"}},
+
+	// Groups and access rules
+	{Method: "POST", Path: "/api/listBackends", Summary: "List backend names", Auth: authSession, Perm: storage.PermManageGroups, Result: []string{}},
+	{Method: "POST", Path: "/api/createGroup", Summary: "Create a group", Auth: authSession, Perm: storage.PermManageGroups, Form: []string{"name"}, Reasons: []string{"GROUP_NAME_UNAVAILABLE"}},
+	{Method: "POST", Path: "/api/deleteGroup", Summary: "Delete a group", Auth: authSession, Perm: storage.PermManageGroups, Form: []string{"name"}},
+	{Method: "POST", Path: "/api/listGroups", Summary: "List groups", Auth: authSession, Perm: storage.PermManageGroups, Result: []storage.Group{}},
+	{Method: "POST", Path: "/api/addGroupMember", Summary: "Add a user to a group", Auth: authSession, Perm: storage.PermManageGroups, Form: []string{"group", "username"}},
+	{Method: "POST", Path: "/api/removeGroupMember", Summary: "Remove a user from a group", Auth: authSession, Perm: storage.PermManageGroups, Form: []string{"group", "username"}},
+	{Method: "POST", Path: "/api/listAccessRules", Summary: "List the access rules of a group", Auth: authSession, Perm: storage.PermManageGroups, Form: []string{"group"}, Result: []storage.AccessRule{}},
+	{Method: "POST", Path: "/api/addAccessRule", Summary: "Allow a group catalogs matching pattern, returns the rule id", Auth: authSession, Perm: storage.PermManageGroups,
+		Form: []string{"group", "backend", "pattern"}, Result: textBody{}, Reasons: []string{"INVALID_PATTERN"}},
+	{Method: "POST", Path: "/api/removeAccessRule", Summary: "Remove an access rule", Auth: authSession, Perm: storage.PermManageGroups, Form: []string{"id"}},
+
+	// Roles
+	{Method: "POST", Path: "/api/listRoles", Summary: "List roles", Auth: authSession, Result: []storage.Role{}},
+	{Method: "POST", Path: "/api/listPermissions", Summary: "List permissions", Auth: authSession, Result: []string{}},
+	{Method: "POST", Path: "/api/createRole", Summary: "Create a role with comma separated permissions", Auth: authSession, Perm: storage.PermManageRoles,
+		Form: []string{"name", "permissions"}, Reasons: []string{"ROLE_NAME_UNAVAILABLE", "UNKNOWN_PERMISSION"}},
+	{Method: "POST", Path: "/api/setRolePermissions", Summary: "Set the permissions of a role", Auth: authSession, Perm: storage.PermManageRoles,
+		Form: []string{"name", "permissions"}, Reasons: []string{"BUILTIN_ROLE", "UNKNOWN_PERMISSION"}},
+	{Method: "POST", Path: "/api/deleteRole", Summary: "Delete an unused role", Auth: authSession, Perm: storage.PermManageRoles, Form: []string{"name"}, Reasons: []string{"BUILTIN_ROLE", "ROLE_IN_USE"}},
+
+	// Audit log
+	{Method: "POST", Path: "/api/queryAuditLog", Summary: "Query the audit log", Auth: authSession, Perm: storage.PermViewAudit,
+		Form: []string{"user", "action", "since", "until", "limit"}, Result: []storage.AuditEvent{}},
+	{Method: "POST", Path: "/api/exportAuditLog", Summary: "Export the audit log as JSON lines", Auth: authSession, Perm: storage.PermViewAudit,
+		Form: []string{"user", "action", "since", "until", "limit"}, Result: fileBody{[]string{"application/x-ndjson"}}},
+
+	// Two-factor authentication
+	{Method: "POST", Path: "/api/loginTotp", Summary: "Complete a login with a TOTP or recovery code", Form: []string{"ticket", "code", "recoveryCode"},
+		Reasons: []string{"INVALID_TICKET", "WRONG_CODE", "ACCOUNT_LOCKED", "IP_LOCKED", "TOO_MANY_ATTEMPTS"}},
+	{Method: "POST", Path: "/api/totpStatus", Summary: "Get the TOTP status of the logged in user", Auth: authSession, Result: TotpStatus{}},
+	{Method: "POST", Path: "/api/enrollTotp", Summary: "Start a TOTP enrollment", Auth: authSession, Result: TotpEnrollment{}, Reasons: []string{"TOTP_ALREADY_ENABLED"}},
+	{Method: "POST", Path: "/api/confirmTotp", Summary: "Enable TOTP, returns the recovery codes", Auth: authSession, Form: []string{"code"}, Result: []string{},
+		Reasons: []string{"NO_PENDING_ENROLLMENT", "WRONG_CODE"}},
+	{Method: "POST", Path: "/api/disableTotp", Summary: "Disable TOTP", Auth: authSession, Form: []string{"password"}, Reasons: []string{"WRONG_PASSWORD", "TOTP_REQUIRED"}},
+	{Method: "POST", Path: "/api/regenerateRecoveryCodes", Summary: "Replace the recovery codes", Auth: authSession, Form: []string{"password"}, Result: []string{}, Reasons: []string{"WRONG_PASSWORD"}},
+	{Method: "POST", Path: "/api/resetTotp", Summary: "Remove the TOTP of a user", Auth: authSession, Perm: storage.PermManageUsers, Form: []string{"username"}},
+	{Method: "POST", Path: "/api/listTotpRequiredRoles", Summary: "List the roles which require TOTP", Auth: authSession, Result: []string{}},
+	{Method: "POST", Path: "/api/setTotpRequiredRoles", Summary: "Set the comma separated roles which require TOTP", Auth: authSession, Perm: storage.PermManageRoles,
+		Form: []string{"roles"}, Reasons: []string{"UNKNOWN_ROLE"}},
+
+	// OpenID Connect
+	{Method: "GET", Path: "/api/oidc/login", Summary: "Redirect to the OpenID provider to log in", Status: http.StatusFound, Reasons: []string{"OIDC_DISABLED"}},
+	{Method: "POST", Path: "/api/oidc/link", Summary: "Redirect to the OpenID provider to link an identity", Auth: authSession, Status: http.StatusSeeOther, Reasons: []string{"OIDC_DISABLED"}},
+	{Method: "GET", Path: "/api/oidc/callback", Summary: "Complete a redirect from the OpenID provider", Query: []string{"state", "code", "error"}, Status: http.StatusFound,
+		Reasons: []string{"OIDC_DISABLED", "INVALID_STATE", "PROVIDER_ERROR", "INVALID_TOKEN", "NOT_REGISTERED", "USERNAME_UNAVAILABLE", "IDENTITY_IN_USE", "TOTP_REQUIRED"}},
+	{Method: "POST", Path: "/api/listIdentities", Summary: "List the linked identities", Auth: authSession, Result: []storage.Identity{}},
+	{Method: "POST", Path: "/api/unlinkIdentity", Summary: "Unlink an identity", Auth: authSession, Form: []string{"issuer", "subject"}},
+	{Method: "POST", Path: "/api/linkIdentity", Summary: "Link an identity, such as a directory user with issuer ldap, to a user", Auth: authSession, Perm: storage.PermManageUsers,
+		Form: []string{"username", "issuer", "subject"}, Reasons: []string{"IDENTITY_IN_USE"}},
+
+	// Email
+	{Method: "POST", Path: "/api/accountEmail", Summary: "Get the own email address", Auth: authSession, Result: AccountEmail{}},
+	{Method: "POST", Path: "/api/setEmail", Summary: "Change the own email address and send a verification link", Auth: authSession, Form: []string{"email"},
+		Reasons: []string{"INVALID_EMAIL", "EMAIL_IN_USE"}},
+	{Method: "POST", Path: "/api/verifyEmail", Summary: "Verify an email address", Form: []string{"token"}, Reasons: []string{"INVALID_TOKEN", "EMAIL_IN_USE"}},
+	{Method: "POST", Path: "/api/requestPasswordReset", Summary: "Send a password reset link", Form: []string{"username", "email"}, Reasons: []string{"MAIL_DISABLED"}},
+	{Method: "POST", Path: "/api/resetPassword", Summary: "Set a new password with a reset link", Form: []string{"token", "password"}, Reasons: []string{"PASSWORD_TOO_SHORT", "INVALID_TOKEN"}},
+
+	// JSON API
+	{Method: "GET", Path: "/api/v2/me", Summary: "Get the logged in user", Auth: authSession, Result: Me{}},
+	{Method: "GET", Path: "/api/v2/users", Summary: "List users", Auth: authSession, Perm: storage.PermManageUsers, Result: []storage.User{}},
+	{Method: "POST", Path: "/api/v2/users", Summary: "Register with an invite code", Body: NewUser{}, Status: http.StatusCreated, Result: storage.User{},
+		Reasons: []string{"USERNAME_UNAVAILABLE", "INVALID_EMAIL", "EMAIL_REQUIRED", "EMAIL_IN_USE", "PASSWORD_TOO_SHORT", "INVALID_INVITE_CODE"}},
+	{Method: "GET", Path: "/api/v2/users/:name", Summary: "Get a user", Auth: authSession, Result: storage.User{}},
+	{Method: "PATCH", Path: "/api/v2/users/:name", Summary: "Change the role, email or password of a user", Auth: authSession, Body: UserPatch{}, Result: storage.User{},
+		Reasons: []string{"UNKNOWN_ROLE", "LAST_OWNER", "INVALID_EMAIL", "EMAIL_IN_USE", "WRONG_OLD_PASSWORD", "PASSWORD_TOO_SHORT"}},
+	{Method: "DELETE", Path: "/api/v2/users/:name", Summary: "Revoke a user", Auth: authSession, Status: http.StatusNoContent, Reasons: []string{"LAST_OWNER"}},
+	{Method: "GET", Path: "/api/v2/invite-codes", Summary: "List invite codes", Auth: authSession, Perm: storage.PermManageInvites, Result: []storage.InviteCode{}},
+	{Method: "POST", Path: "/api/v2/invite-codes", Summary: "Create an invite code", Auth: authSession, Perm: storage.PermManageInvites, Body: NewInviteCode{},
+		Status: http.StatusCreated, Result: storage.InviteCode{}, Reasons: []string{"UNKNOWN_ROLE", "UNKNOWN_GROUP"}},
+	{Method: "DELETE", Path: "/api/v2/invite-codes/:code", Summary: "Revoke an invite code", Auth: authSession, Perm: storage.PermManageInvites, Status: http.StatusNoContent},
+	{Method: "GET", Path: "/api/v2/invite-codes/:code/redemptions", Summary: "List the users registered with a code", Auth: authSession, Perm: storage.PermManageInvites,
+		Result: []storage.Redemption{}},
+
+	// Admin console
+	{Method: "GET", Path: "/api/v2/users/:name/details", Summary: "Get a user with groups, tokens, sessions and second factors", Auth: authSession, Perm: storage.PermManageUsers,
+		Result: UserDetails{}},
+	{Method: "GET", Path: "/api/v2/sessions", Summary: "List unexpired sessions, of username if set", Auth: authSession, Perm: storage.PermManageUsers, Query: []string{"username"},
+		Result: []SessionInfo{}},
+	{Method: "DELETE", Path: "/api/v2/sessions/:id", Summary: "Log a session out", Auth: authSession, Perm: storage.PermManageUsers, Status: http.StatusNoContent},
+	{Method: "GET", Path: "/api/v2/backends", Summary: "List the catalogs of every backend and report failed calls", Auth: authSession, Perm: storage.PermManageSettings,
+		Result: []BackendHealth{}},
+	{Method: "GET", Path: "/api/v2/downloads", Summary: "Sum the tracks streamed in the last days, 30 by default", Auth: authSession, Perm: storage.PermViewAudit,
+		Query: []string{"days"}, Result: DownloadStats{}},
+}
+
+var (
+	openAPIOnce sync.Once
+	openAPIDoc  map[string]interface{}
+)
+
+func (s *Server) regOpenAPIEndpoints(r *gin.Engine) {
+	r.GET("/openapi.json", func(ctx *gin.Context) {
+		openAPIOnce.Do(func() {
+			openAPIDoc = openAPI(endpoints)
+		})
+		ctx.Header("Access-Control-Allow-Origin", "*")
+		ctx.JSON(http.StatusOK, openAPIDoc)
+	})
+}
+
+var pathParamExp = regexp.MustCompile(`:([^/]+)`)
+
+// openAPI builds an OpenAPI 3 document of eps. Schemas are derived from the Go types.
+func openAPI(eps []endpoint) map[string]interface{} {
+	schemas := make(map[string]interface{})
+	paths := make(map[string]interface{})
+	for _, ep := range eps {
+		path := pathParamExp.ReplaceAllString(ep.Path, "{$1}")
+		item, ok := paths[path].(map[string]interface{})
+		if !ok {
+			item = make(map[string]interface{})
+			paths[path] = item
+		}
+		item[strings.ToLower(ep.Method)] = operation(ep, schemas)
+	}
+	return map[string]interface{}{
+		"openapi": "3.0.3",
+		"info": map[string]interface{}{
+			"title":   "go-annil",
+			"version": "2",
+			"description": "Endpoints under /api take form fields and report errors with a status code and an X-Status-Reason header. " +
+				"Endpoints under /api/v2 take and return JSON and report errors with an ErrorBody. " +
+				"State-changing requests authorized by the session cookie have to send the csrfToken cookie in the X-CSRF-Token header.",
+		},
+		"paths": paths,
+		"components": map[string]interface{}{
+			"schemas": schemas,
+			"securitySchemes": map[string]interface{}{
+				authSession: map[string]interface{}{"type": "apiKey", "in": "cookie", "name": sessionCookie},
+				authToken: map[string]interface{}{"type": "apiKey", "in": "header", "name": "Authorization",
+					"description": "A user token from /api/generateToken, or a share token where the endpoint allows it"},
+				authMetrics: map[string]interface{}{"type": "http", "scheme": "bearer", "description": "The token of the metrics config"},
+			},
+		},
+	}
+}
+
+func operation(ep endpoint, schemas map[string]interface{}) map[string]interface{} {
+	op := map[string]interface{}{
+		"summary":     ep.Summary,
+		"operationId": operationID(ep),
+	}
+	params := make([]interface{}, 0)
+	for _, m := range pathParamExp.FindAllStringSubmatch(ep.Path, -1) {
+		params = append(params, map[string]interface{}{"name": m[1], "in": "path", "required": true, "schema": map[string]interface{}{"type": "string"}})
+	}
+	for _, q := range ep.Query {
+		params = append(params, map[string]interface{}{"name": q, "in": "query", "schema": map[string]interface{}{"type": "string"}})
+	}
+	if len(params) > 0 {
+		op["parameters"] = params
+	}
+	if ep.Auth != "" {
+		op["security"] = []interface{}{map[string]interface{}{ep.Auth: []string{}}}
+	}
+	if ep.Perm != "" {
+		op["description"] = "Requires the " + ep.Perm + " permission."
+	}
+	if len(ep.Form) > 0 {
+		props := make(map[string]interface{})
+		for _, f := range ep.Form {
+			props[f] = map[string]interface{}{"type": "string"}
+		}
+		op["requestBody"] = map[string]interface{}{"content": map[string]interface{}{
+			"application/x-www-form-urlencoded": map[string]interface{}{"schema": map[string]interface{}{"type": "object", "properties": props}},
+		}}
+	} else if ep.Body != nil {
+		op["requestBody"] = map[string]interface{}{"required": true, "content": map[string]interface{}{
+			"application/json": map[string]interface{}{"schema": schemaOf(reflect.TypeOf(ep.Body), schemas)},
+		}}
+	}
+
+	status := ep.Status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	ok := map[string]interface{}{"description": http.StatusText(status)}
+	switch r := ep.Result.(type) {
+	case nil:
+	case textBody:
+		ok["content"] = map[string]interface{}{"text/plain": map[string]interface{}{"schema": map[string]interface{}{"type": "string"}}}
+	case fileBody:
+		content := make(map[string]interface{})
+		for _, t := range r.types {
+			content[t] = map[string]interface{}{"schema": map[string]interface{}{"type": "string", "format": "binary"}}
+		}
+		ok["content"] = content
+	default:
+		ok["content"] = map[string]interface{}{"application/json": map[string]interface{}{"schema": schemaOf(reflect.TypeOf(r), schemas)}}
+	}
+	failed := map[string]interface{}{"description": "The request failed"}
+	if len(ep.Reasons) > 0 {
+		failed["description"] = "The request failed, with one of the reasons " + strings.Join(ep.Reasons, ", ")
+	}
+	if strings.HasPrefix(ep.Path, "/api/v2/") {
+		failed["content"] = map[string]interface{}{"application/json": map[string]interface{}{"schema": schemaOf(reflect.TypeOf(ErrorBody{}), schemas)}}
+	} else {
+		failed["headers"] = map[string]interface{}{"X-Status-Reason": map[string]interface{}{"schema": map[string]interface{}{"type": "string"}}}
+	}
+	op["responses"] = map[string]interface{}{strconv.Itoa(status): ok, "default": failed}
+	return op
+}
+
+// schemaOf describes t, adding named structs to schemas and referring to them.
+func schemaOf(t reflect.Type, schemas map[string]interface{}) map[string]interface{} {
+	switch t.Kind() {
+	case reflect.Ptr:
+		return schemaOf(t.Elem(), schemas)
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.Slice, reflect.Array:
+		return map[string]interface{}{"type": "array", "items": schemaOf(t.Elem(), schemas)}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": schemaOf(t.Elem(), schemas)}
+	case reflect.Struct:
+		if _, ok := schemas[t.Name()]; !ok {
+			// Placeholder for recursive types
+			schemas[t.Name()] = nil
+			props := make(map[string]interface{})
+			structFields(t, props, schemas)
+			schemas[t.Name()] = map[string]interface{}{"type": "object", "properties": props}
+		}
+		return map[string]interface{}{"$ref": "#/components/schemas/" + t.Name()}
+	}
+	return map[string]interface{}{}
+}
+
+// structFields adds the JSON fields of t to props, including those of embedded structs.
+func structFields(t reflect.Type, props, schemas map[string]interface{}) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.Anonymous && f.Type.Kind() == reflect.Struct {
+			structFields(f.Type, props, schemas)
+			continue
+		}
+		if f.PkgPath != "" {
+			continue
+		}
+		name := strings.Split(f.Tag.Get("json"), ",")[0]
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		props[name] = schemaOf(f.Type, schemas)
+	}
+}
+
+// operationID names ep by its method and path, like getApiV2UsersName.
+func operationID(ep endpoint) string {
+	id := strings.ToLower(ep.Method)
+	for _, seg := range strings.FieldsFunc(ep.Path, func(r rune) bool {
+		return !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9')
+	}) {
+		id += strings.ToUpper(seg[:1]) + seg[1:]
+	}
+	return id
+}
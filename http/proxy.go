@@ -0,0 +1,68 @@
+package http
+
+import (
+	"github.com/gin-gonic/gin"
+	"net"
+	"strings"
+)
+
+// parseProxies parses the addresses and CIDR ranges of trusted proxies, skipping invalid ones.
+func parseProxies(entries []string) []*net.IPNet {
+	ret := make([]*net.IPNet, 0, len(entries))
+	for _, e := range entries {
+		if _, n, err := net.ParseCIDR(e); err == nil {
+			ret = append(ret, n)
+		} else if ip := net.ParseIP(e); ip != nil {
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			ret = append(ret, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+		}
+	}
+	return ret
+}
+
+func (s *Server) trusted(ip net.IP) bool {
+	for _, n := range s.trustedProxies {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// peer returns the address the request came from, and whether it is a trusted proxy whose
+// forwarding headers can be relied on.
+func (s *Server) peer(ctx *gin.Context) (string, bool) {
+	host, _, err := net.SplitHostPort(strings.TrimSpace(ctx.Request.RemoteAddr))
+	if err != nil {
+		return "", false
+	}
+	ip := net.ParseIP(host)
+	return host, ip != nil && s.trusted(ip)
+}
+
+// clientIP returns the address of the client of the request. Requests from trusted proxies are
+// attributed to the last address in X-Forwarded-For which is not a trusted proxy itself, other
+// requests to their peer address, whatever headers they carry.
+func (s *Server) clientIP(ctx *gin.Context) string {
+	host, trusted := s.peer(ctx)
+	if !trusted {
+		return host
+	}
+	peer := net.ParseIP(host)
+	hops := strings.Split(ctx.GetHeader("X-Forwarded-For"), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		ip := net.ParseIP(strings.TrimSpace(hops[i]))
+		if ip == nil {
+			// Whatever the proxy was given by its client can't be relied on
+			break
+		}
+		if !s.trusted(ip) {
+			return ip.String()
+		}
+		peer = ip
+	}
+	return peer.String()
+}
@@ -0,0 +1,91 @@
+package http
+
+import (
+	"github.com/SeraphJACK/go-annil/backend"
+	"github.com/SeraphJACK/go-annil/config"
+	"github.com/SeraphJACK/go-annil/storage"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"reflect"
+	"strings"
+)
+
+// ReloadResult reports a configuration reload.
+type ReloadResult struct {
+	// Names of the backends now serving the library
+	Backends []string `json:"backends"`
+	// Changed settings which are not applied until a restart
+	RestartRequired []string `json:"restartRequired"`
+}
+
+func (s *Server) regReloadEndpoints(r *gin.Engine) {
+	r.POST("/api/reloadConfig", s.audit("reloadConfig", ""), s.requirePermission(storage.PermManageSettings), func(ctx *gin.Context) {
+		res, err := s.ReloadFile()
+		if err != nil {
+			ctx.Set("auditDetail", err.Error())
+			ctx.Header("X-Status-Reason", "INVALID_CONFIG")
+			ctx.String(http.StatusBadRequest, err.Error())
+			return
+		}
+		if len(res.RestartRequired) > 0 {
+			ctx.Set("auditDetail", "restart required: "+strings.Join(res.RestartRequired, ", "))
+		}
+		ctx.JSON(http.StatusOK, res)
+	})
+}
+
+// backends returns the multiplexer serving the library.
+func (s *Server) backends() *backend.Multiplexer {
+	s.beMu.RLock()
+	defer s.beMu.RUnlock()
+	return s.be
+}
+
+// ReloadFile reads the config file and reloads it.
+func (s *Server) ReloadFile() (ReloadResult, error) {
+	cfg, err := config.Read()
+	if err != nil {
+		return ReloadResult{}, err
+	}
+	return s.Reload(cfg)
+}
+
+// Reload swaps in the backends of cfg. Requests in flight keep streaming from the backends
+// they started with. Other changed settings are only reported, as they need a restart.
+func (s *Server) Reload(cfg config.Config) (ReloadResult, error) {
+	s.reloadMu.Lock()
+	defer s.reloadMu.Unlock()
+	if err := cfg.Validate(); err != nil {
+		return ReloadResult{}, err
+	}
+	be, err := NewBackend(cfg.Backends)
+	if err != nil {
+		return ReloadResult{}, err
+	}
+	s.beMu.Lock()
+	old := s.be
+	s.be = instrument(be, s.metrics)
+	s.beMu.Unlock()
+	// Only idle connections are closed, so streams from old relays go on
+	_ = old.Close()
+
+	ret := ReloadResult{Backends: be.Names, RestartRequired: changedSettings(s.running, cfg)}
+	s.running.Backends = cfg.Backends
+	return ret, nil
+}
+
+// changedSettings lists the sections of the config which differ between a and b, except backends.
+func changedSettings(a, b config.Config) []string {
+	ret := make([]string, 0)
+	va, vb := reflect.ValueOf(a), reflect.ValueOf(b)
+	for i := 0; i < va.NumField(); i++ {
+		name := strings.Split(va.Type().Field(i).Tag.Get("yaml"), ",")[0]
+		if name == "backends" {
+			continue
+		}
+		if !reflect.DeepEqual(va.Field(i).Interface(), vb.Field(i).Interface()) {
+			ret = append(ret, name)
+		}
+	}
+	return ret
+}
@@ -0,0 +1,104 @@
+package http
+
+import (
+	"github.com/SeraphJACK/go-annil/storage"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"strings"
+)
+
+func (s *Server) regRoleEndpoints(r *gin.Engine) {
+	r.POST("/api/listRoles", s.requirePermission(""), func(ctx *gin.Context) {
+		ctx.JSON(http.StatusOK, s.store.ListRoles())
+	})
+	r.POST("/api/listPermissions", s.requirePermission(""), func(ctx *gin.Context) {
+		ctx.JSON(http.StatusOK, storage.Permissions)
+	})
+	r.POST("/api/createRole", s.audit("createRole", "name"), s.requirePermission(storage.PermManageRoles), func(ctx *gin.Context) {
+		name := ctx.PostForm("name")
+		if s.store.RoleExists(name) || !usernameExp.MatchString(name) {
+			ctx.Header("X-Status-Reason", "ROLE_NAME_UNAVAILABLE")
+			ctx.Status(http.StatusConflict)
+			return
+		}
+		perms, ok := s.parsePermissions(ctx)
+		if !ok {
+			return
+		}
+		ctx.Set("auditDetail", "permissions="+strings.Join(perms, ","))
+		err := s.store.NewRole(name, perms)
+		if err != nil {
+			ctx.Status(http.StatusInternalServerError)
+			logger(ctx).Errorf("Failed to create role %s: %v\n", name, err)
+		} else {
+			ctx.Status(http.StatusOK)
+		}
+	})
+	r.POST("/api/setRolePermissions", s.audit("setRolePermissions", "name"), s.requirePermission(storage.PermManageRoles), func(ctx *gin.Context) {
+		name := ctx.PostForm("name")
+		if !s.store.RoleExists(name) {
+			ctx.Status(http.StatusNotFound)
+			return
+		}
+		if storage.IsBuiltinRole(name) {
+			ctx.Header("X-Status-Reason", "BUILTIN_ROLE")
+			ctx.Status(http.StatusForbidden)
+			return
+		}
+		if !s.canAssign(ctx.GetString("username"), name) {
+			ctx.Status(http.StatusForbidden)
+			return
+		}
+		perms, ok := s.parsePermissions(ctx)
+		if !ok {
+			return
+		}
+		ctx.Set("auditDetail", "permissions="+strings.Join(perms, ","))
+		err := s.store.SetRolePermissions(name, perms)
+		if err != nil {
+			ctx.Status(http.StatusInternalServerError)
+			logger(ctx).Errorf("Failed to set permissions of role %s: %v\n", name, err)
+		} else {
+			ctx.Status(http.StatusOK)
+		}
+	})
+	r.POST("/api/deleteRole", s.audit("deleteRole", "name"), s.requirePermission(storage.PermManageRoles), func(ctx *gin.Context) {
+		name := ctx.PostForm("name")
+		if !s.store.RoleExists(name) {
+			ctx.Status(http.StatusNotFound)
+			return
+		}
+		if storage.IsBuiltinRole(name) {
+			ctx.Header("X-Status-Reason", "BUILTIN_ROLE")
+			ctx.Status(http.StatusForbidden)
+			return
+		}
+		if len(s.store.RoleUsers(name)) > 0 {
+			ctx.Header("X-Status-Reason", "ROLE_IN_USE")
+			ctx.Status(http.StatusConflict)
+			return
+		}
+		err := s.store.DeleteRole(name)
+		if err != nil {
+			ctx.Status(http.StatusInternalServerError)
+			logger(ctx).Errorf("Failed to delete role %s: %v\n", name, err)
+		} else {
+			ctx.Status(http.StatusOK)
+		}
+	})
+}
+
+// parsePermissions reads the permissions form field and checks the current user holds all of them.
+func (s *Server) parsePermissions(ctx *gin.Context) ([]string, bool) {
+	perms, err := storage.ParsePermissions(ctx.PostForm("permissions"))
+	if err != nil {
+		ctx.Header("X-Status-Reason", "UNKNOWN_PERMISSION")
+		ctx.Status(http.StatusBadRequest)
+		return nil, false
+	}
+	if !subset(perms, s.store.RolePermissions(s.store.UserRole(ctx.GetString("username")))) {
+		ctx.Status(http.StatusForbidden)
+		return nil, false
+	}
+	return perms, true
+}
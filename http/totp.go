@@ -0,0 +1,307 @@
+package http
+
+import (
+	"github.com/SeraphJACK/go-annil/storage"
+	"github.com/SeraphJACK/go-annil/totp"
+	"github.com/gin-gonic/gin"
+	uuid "github.com/satori/go.uuid"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	totpIssuer = "go-annil"
+	// Number of recovery codes issued at once
+	recoveryCodes = 10
+	// How long a login may wait for its second factor
+	ticketLifetime = 5 * time.Minute
+)
+
+type TotpStatus struct {
+	Enabled       bool `json:"enabled"`
+	Required      bool `json:"required"`
+	RecoveryCodes int  `json:"recoveryCodes"`
+}
+
+type TotpEnrollment struct {
+	Secret string `json:"secret"`
+	URI    string `json:"uri"`
+}
+
+func (s *Server) regTotpEndpoints(r *gin.Engine) {
+	r.POST("/api/loginTotp", s.audit("loginTotp", ""), func(ctx *gin.Context) {
+		ticket := ctx.PostForm("ticket")
+		username, ok := s.tickets.get(ticket)
+		if !ok {
+			ctx.Header("X-Status-Reason", "INVALID_TICKET")
+			ctx.Status(http.StatusUnauthorized)
+			return
+		}
+		ctx.Set("auditTarget", username)
+		ip := s.clientIP(ctx)
+		if !s.loginAllowed(ctx, username, ip) {
+			return
+		}
+		if code := ctx.PostForm("recoveryCode"); code != "" {
+			ok = s.store.UseRecoveryCode(username, code)
+			ctx.Set("auditDetail", "recoveryCode")
+		} else {
+			ok = s.checkTotp(username, ctx.PostForm("code"))
+		}
+		if !ok {
+			s.metrics.loginFailures.Inc("totp")
+			ctx.Header("X-Status-Reason", "WRONG_CODE")
+			ctx.Status(http.StatusUnauthorized)
+			return
+		}
+		s.refundLogin(username, ip)
+		s.tickets.remove(ticket)
+		s.startSession(ctx, username)
+	})
+
+	r.POST("/api/totpStatus", s.requireSession(), func(ctx *gin.Context) {
+		username := ctx.GetString("username")
+		required, err := storage.TotpRequired(s.store, username)
+		if err != nil {
+			ctx.Status(http.StatusInternalServerError)
+			logger(ctx).Errorf("Failed to check whether %s requires totp: %v\n", username, err)
+			return
+		}
+		st, err := s.store.GetTotp(username)
+		ctx.JSON(http.StatusOK, TotpStatus{
+			Enabled:       err == nil && st.Enabled,
+			Required:      required,
+			RecoveryCodes: s.store.RecoveryCodesLeft(username),
+		})
+	})
+	// Starts an enrollment, which is enabled once confirmed with a code
+	r.POST("/api/enrollTotp", s.audit("enrollTotp", ""), s.requireSession(), func(ctx *gin.Context) {
+		username := ctx.GetString("username")
+		if st, err := s.store.GetTotp(username); err == nil && st.Enabled {
+			ctx.Header("X-Status-Reason", "TOTP_ALREADY_ENABLED")
+			ctx.Status(http.StatusConflict)
+			return
+		}
+		secret, err := totp.NewSecret()
+		if err == nil {
+			err = s.store.SetTotpSecret(username, secret)
+		}
+		if err != nil {
+			ctx.Status(http.StatusInternalServerError)
+			logger(ctx).Errorf("Failed to enroll totp for %s: %v\n", username, err)
+			return
+		}
+		ctx.JSON(http.StatusOK, TotpEnrollment{
+			Secret: secret,
+			URI:    totp.URI(totpIssuer, username, secret),
+		})
+	})
+	// Enables the pending enrollment and returns the recovery codes, which are only shown once
+	r.POST("/api/confirmTotp", s.audit("confirmTotp", ""), s.requireSession(), func(ctx *gin.Context) {
+		username := ctx.GetString("username")
+		st, err := s.store.GetTotp(username)
+		if err != nil || st.Enabled {
+			ctx.Header("X-Status-Reason", "NO_PENDING_ENROLLMENT")
+			ctx.Status(http.StatusConflict)
+			return
+		}
+		if !s.checkTotp(username, ctx.PostForm("code")) {
+			ctx.Header("X-Status-Reason", "WRONG_CODE")
+			ctx.Status(http.StatusForbidden)
+			return
+		}
+		codes, err := s.newRecoveryCodes(username)
+		if err == nil {
+			err = s.store.EnableTotp(username)
+		}
+		if err != nil {
+			ctx.Status(http.StatusInternalServerError)
+			logger(ctx).Errorf("Failed to enable totp for %s: %v\n", username, err)
+			return
+		}
+		ctx.JSON(http.StatusOK, codes)
+	})
+	r.POST("/api/disableTotp", s.audit("disableTotp", ""), s.requireSession(), func(ctx *gin.Context) {
+		username := ctx.GetString("username")
+		if !s.checkPassword(username, ctx.PostForm("password")) {
+			ctx.Header("X-Status-Reason", "WRONG_PASSWORD")
+			ctx.Status(http.StatusForbidden)
+			return
+		}
+		if required, err := storage.TotpRequired(s.store, username); err != nil || required {
+			if err != nil {
+				logger(ctx).Errorf("Failed to check whether %s requires totp: %v\n", username, err)
+			}
+			ctx.Header("X-Status-Reason", "TOTP_REQUIRED")
+			ctx.Status(http.StatusForbidden)
+			return
+		}
+		err := s.store.DeleteTotp(username)
+		if err != nil {
+			ctx.Status(http.StatusInternalServerError)
+			logger(ctx).Errorf("Failed to disable totp for %s: %v\n", username, err)
+		} else {
+			ctx.Status(http.StatusOK)
+		}
+	})
+	r.POST("/api/regenerateRecoveryCodes", s.audit("regenerateRecoveryCodes", ""), s.requireSession(), func(ctx *gin.Context) {
+		username := ctx.GetString("username")
+		if !s.checkPassword(username, ctx.PostForm("password")) {
+			ctx.Header("X-Status-Reason", "WRONG_PASSWORD")
+			ctx.Status(http.StatusForbidden)
+			return
+		}
+		if st, err := s.store.GetTotp(username); err != nil || !st.Enabled {
+			ctx.Status(http.StatusNotFound)
+			return
+		}
+		codes, err := s.newRecoveryCodes(username)
+		if err != nil {
+			ctx.Status(http.StatusInternalServerError)
+			logger(ctx).Errorf("Failed to regenerate recovery codes for %s: %v\n", username, err)
+			return
+		}
+		ctx.JSON(http.StatusOK, codes)
+	})
+
+	// Removes the second factor of a user who lost it
+	r.POST("/api/resetTotp", s.audit("resetTotp", "username"), s.requirePermission(storage.PermManageUsers), func(ctx *gin.Context) {
+		target := ctx.PostForm("username")
+		if !s.store.UserExists(target) {
+			ctx.Status(http.StatusNotFound)
+			return
+		}
+		if !s.canManage(ctx.GetString("username"), target) {
+			ctx.Status(http.StatusForbidden)
+			return
+		}
+		err := s.store.DeleteTotp(target)
+		if err != nil {
+			ctx.Status(http.StatusInternalServerError)
+			logger(ctx).Errorf("Failed to reset totp for %s: %v\n", target, err)
+		} else {
+			ctx.Status(http.StatusOK)
+		}
+	})
+	r.POST("/api/listTotpRequiredRoles", s.requirePermission(""), func(ctx *gin.Context) {
+		roles, err := s.totpRequiredRoles()
+		if err != nil {
+			ctx.Status(http.StatusInternalServerError)
+			logger(ctx).Errorf("Failed to read roles requiring totp: %v\n", err)
+			return
+		}
+		ctx.JSON(http.StatusOK, roles)
+	})
+	r.POST("/api/setTotpRequiredRoles", s.audit("setTotpRequiredRoles", "roles"), s.requirePermission(storage.PermManageRoles), func(ctx *gin.Context) {
+		roles := make([]string, 0)
+		for _, r := range strings.Split(ctx.PostForm("roles"), ",") {
+			if r = strings.TrimSpace(r); r == "" {
+				continue
+			}
+			if !s.store.RoleExists(r) {
+				ctx.Header("X-Status-Reason", "UNKNOWN_ROLE")
+				ctx.Status(http.StatusBadRequest)
+				return
+			}
+			roles = append(roles, r)
+		}
+		err := s.store.SetSetting(storage.SettingTotpRequiredRoles, strings.Join(roles, ","))
+		if err != nil {
+			ctx.Status(http.StatusInternalServerError)
+			logger(ctx).Errorf("Failed to set roles requiring totp: %v\n", err)
+		} else {
+			ctx.Status(http.StatusOK)
+		}
+	})
+}
+
+// checkTotp validates a code of username and rejects codes which were already used.
+func (s *Server) checkTotp(username, code string) bool {
+	st, err := s.store.GetTotp(username)
+	if err != nil {
+		return false
+	}
+	step, ok := totp.Validate(st.Secret, code, time.Now())
+	return ok && s.store.UseTotpStep(username, step)
+}
+
+func (s *Server) newRecoveryCodes(username string) ([]string, error) {
+	codes, err := totp.NewRecoveryCodes(recoveryCodes)
+	if err != nil {
+		return nil, err
+	}
+	return codes, s.store.SetRecoveryCodes(username, codes)
+}
+
+// totpEnrollmentRequired reports whether username has to enroll TOTP before doing anything else.
+// It is required if the requirement can't be checked.
+func (s *Server) totpEnrollmentRequired(ctx *gin.Context, username string) bool {
+	required, err := storage.TotpRequired(s.store, username)
+	if err != nil {
+		logger(ctx).Errorf("Failed to check whether %s requires totp: %v\n", username, err)
+	} else if !required {
+		return false
+	}
+	st, err := s.store.GetTotp(username)
+	return err != nil || !st.Enabled
+}
+
+func (s *Server) totpRequiredRoles() ([]string, error) {
+	roles, err := s.store.GetSetting(storage.SettingTotpRequiredRoles)
+	if err != nil {
+		return nil, err
+	}
+	ret := make([]string, 0)
+	for _, r := range strings.Split(roles, ",") {
+		if r != "" {
+			ret = append(ret, r)
+		}
+	}
+	return ret, nil
+}
+
+// loginTickets holds logins which passed the password check and wait for a second factor.
+type loginTickets struct {
+	mu sync.Mutex
+	m  map[string]loginTicket
+}
+
+type loginTicket struct {
+	username string
+	expire   time.Time
+}
+
+func (t *loginTickets) issue(username string) string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.m == nil {
+		t.m = make(map[string]loginTicket)
+	}
+	now := time.Now()
+	for id, tk := range t.m {
+		if now.After(tk.expire) {
+			delete(t.m, id)
+		}
+	}
+	id := uuid.NewV4().String()
+	t.m[id] = loginTicket{username: username, expire: now.Add(ticketLifetime)}
+	return id
+}
+
+func (t *loginTickets) get(id string) (string, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	tk, ok := t.m[id]
+	if !ok || time.Now().After(tk.expire) {
+		return "", false
+	}
+	return tk.username, true
+}
+
+func (t *loginTickets) remove(id string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.m, id)
+}
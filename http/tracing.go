@@ -0,0 +1,43 @@
+package http
+
+import (
+	"errors"
+	"github.com/SeraphJACK/go-annil/logging"
+	"github.com/SeraphJACK/go-annil/tracing"
+	"github.com/gin-gonic/gin"
+	"net/http"
+)
+
+// trace records a span for every request, continuing the trace of callers which send a
+// traceparent header. Records logged while handling the request carry its trace id.
+func (s *Server) trace() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		c := ctx.Request.Context()
+		if remote, ok := tracing.Extract(ctx.Request.Header); ok {
+			c = tracing.ContextWithRemote(c, remote)
+		}
+		c, span := tracing.Start(c, ctx.Request.Method, tracing.Server,
+			"http.method", ctx.Request.Method, "http.target", ctx.Request.URL.Path)
+		if span == nil {
+			ctx.Next()
+			return
+		}
+		c = logging.NewContext(c, logging.FromContext(c).With("trace_id", span.Context.TraceID.String()))
+		ctx.Request = ctx.Request.WithContext(c)
+		ctx.Next()
+
+		if route := ctx.FullPath(); route != "" {
+			span.SetName(ctx.Request.Method + " " + route)
+			span.SetAttr("http.route", route)
+		}
+		status := ctx.Writer.Status()
+		span.SetAttr("http.status_code", status)
+		if u := ctx.GetString("username"); u != "" {
+			span.SetAttr("user", u)
+		}
+		if status >= 500 {
+			span.SetError(errors.New(http.StatusText(status)))
+		}
+		span.End()
+	}
+}
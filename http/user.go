@@ -1,309 +1,579 @@
 package http
 
 import (
+	"errors"
+	"fmt"
+	"github.com/SeraphJACK/go-annil/auth"
 	"github.com/SeraphJACK/go-annil/storage"
 	"github.com/SeraphJACK/go-annil/token"
 	"github.com/gin-gonic/gin"
-	uuid "github.com/satori/go.uuid"
-	"log"
 	"net/http"
-	"regexp"
 	"strconv"
+	"strings"
 	"time"
 )
 
-type session struct {
-	username string
-	expire   time.Time
-}
-
-var sessions = make(map[string]session)
+var usernameExp = storage.NameExp
 
-var usernameExp = regexp.MustCompile("^[0-9a-zA-Z_]{2,15}$")
-
-func regUserEndpoints(r *gin.Engine) {
-	// Cleanup expired sessions
-	go func() {
-		for {
-			<-time.Tick(time.Hour)
-			for k, v := range sessions {
-				if time.Now().After(v.expire) {
-					delete(sessions, k)
-				}
-			}
-		}
-	}()
-
-	r.POST("/api/login", func(ctx *gin.Context) {
+func (s *Server) regUserEndpoints(r *gin.Engine) {
+	r.POST("/api/login", s.audit("login", "username"), func(ctx *gin.Context) {
 		username := ctx.PostForm("username")
 		password := ctx.PostForm("password")
-		if storage.CheckPassword(username, password) {
-			sid := uuid.NewV4().String()
-			sessions[sid] = session{
-				username: username,
-				expire:   time.Now().Add(time.Hour),
+		ip := s.clientIP(ctx)
+		if !s.loginAllowed(ctx, username, ip) {
+			return
+		}
+		name, err := s.auth.Authenticate(username, password)
+		if !errors.Is(err, auth.ErrWrongPassword) {
+			s.refundLogin(username, ip)
+		}
+		if err == nil {
+			username = name
+			// The second factor is checked by /api/loginTotp with the returned ticket
+			if st, err := s.store.GetTotp(username); err == nil && st.Enabled {
+				ctx.Header("X-Status-Reason", "TOTP_REQUIRED")
+				ctx.String(http.StatusAccepted, s.tickets.issue(username))
+				return
 			}
-			ctx.SetCookie("sessionId", sid, 0, "/", "", false, true)
-			ctx.Status(http.StatusOK)
+			s.startSession(ctx, username)
+		} else if !errors.Is(err, auth.ErrWrongPassword) {
+			logger(ctx).Errorf("Failed to authenticate %s: %v\n", username, err)
+			s.metrics.loginFailures.Inc("unavailable")
+			ctx.Header("X-Status-Reason", "AUTH_UNAVAILABLE")
+			ctx.Status(http.StatusServiceUnavailable)
 		} else {
+			s.metrics.loginFailures.Inc("password")
 			ctx.Status(http.StatusUnauthorized)
 		}
 	})
-	r.POST("/api/register", func(ctx *gin.Context) {
+	r.POST("/api/listLockedUsers", s.requirePermission(storage.PermManageUsers), func(ctx *gin.Context) {
+		ctx.JSON(http.StatusOK, s.userLogins.Locks())
+	})
+	// Lockouts of an address are lifted separately, they keep every account from logging in from there
+	r.POST("/api/unlockUser", s.audit("unlockUser", "username"), s.requirePermission(storage.PermManageUsers), func(ctx *gin.Context) {
+		if username := ctx.PostForm("username"); username != "" {
+			s.userLogins.Reset(username)
+		}
+		if ip := ctx.PostForm("ip"); ip != "" {
+			s.ipLogins.Reset(ip)
+		}
+		ctx.Status(http.StatusOK)
+	})
+	// Creates the owner account of a fresh instance, only works while there are no users
+	r.POST("/api/setup", s.audit("setup", "username"), func(ctx *gin.Context) {
 		username := ctx.PostForm("username")
 		password := ctx.PostForm("password")
-		code := ctx.PostForm("inviteCode")
-		if storage.UserExists(username) || !usernameExp.MatchString(username) {
+		s.setupMu.Lock()
+		defer s.setupMu.Unlock()
+		if n, err := s.store.CountUsers(); err != nil {
+			ctx.Status(http.StatusInternalServerError)
+			logger(ctx).Errorf("Failed to count users: %v\n", err)
+		} else if n > 0 {
+			ctx.Header("X-Status-Reason", "ALREADY_SET_UP")
+			ctx.Status(http.StatusForbidden)
+		} else if !usernameExp.MatchString(username) {
 			ctx.Header("X-Status-Reason", "USERNAME_UNAVAILABLE")
 			ctx.Status(http.StatusConflict)
 		} else if len(password) < 5 {
 			ctx.Header("X-Status-Reason", "PASSWORD_TOO_SHORT")
 			ctx.Status(http.StatusForbidden)
 		} else {
-			if !storage.ShrinkInviteCode(code) {
-				ctx.Header("X-Status-Reason", "INVALID_INVITE_CODE")
-				ctx.Status(http.StatusForbidden)
-				return
-			}
-			err := storage.Register(ctx.PostForm("username"), ctx.PostForm("password"))
+			err := storage.CreateOwner(s.store, username, password, false)
 			if err != nil {
 				ctx.Status(http.StatusInternalServerError)
+				logger(ctx).Errorf("Failed to create owner %s: %v\n", username, err)
 			} else {
+				ctx.Set("username", username)
 				ctx.Status(http.StatusOK)
 			}
 		}
 	})
-	r.POST("/api/revoke", func(ctx *gin.Context) {
-		username := ""
-		if authorize(ctx, &username) {
-			revoke := ctx.PostForm("username")
-			if !storage.UserExists(revoke) {
-				ctx.Status(http.StatusNotFound)
-				return
-			}
-			if revoke == username || storage.IsAdmin(username) {
-				err := storage.RevokeUser(revoke)
-				if err != nil {
-					ctx.Status(http.StatusInternalServerError)
-					log.Printf("Failed to revoke %s: %v\n", username, err)
-				} else {
-					ctx.Status(http.StatusOK)
-				}
-			} else {
-				ctx.Status(http.StatusForbidden)
-			}
+	r.POST("/api/register", s.audit("register", "username"), func(ctx *gin.Context) {
+		username := ctx.PostForm("username")
+		code := ctx.PostForm("inviteCode")
+		if e := s.registerUser(ctx, username, ctx.PostForm("password"), code, ctx.PostForm("email")); e != nil {
+			fail(ctx, e)
+			return
 		}
+		ctx.Set("username", username)
+		ctx.Set("auditDetail", "inviteCode="+code)
+		ctx.Status(http.StatusOK)
 	})
-	r.POST("/api/grantAdmin", func(ctx *gin.Context) {
-		username := ""
-		if authorize(ctx, &username) {
-			grant := ctx.PostForm("username")
-			if !storage.IsAdmin(username) {
-				ctx.Status(http.StatusForbidden)
-				return
-			}
-			if !storage.UserExists(grant) {
-				ctx.Status(http.StatusNotFound)
-				return
-			}
-			err := storage.SetAdmin(grant, true)
-			if err != nil {
-				ctx.Status(http.StatusInternalServerError)
-				log.Printf("Failed to grant admin for %s: %v\n", grant, err)
-			} else {
-				ctx.Status(http.StatusOK)
-			}
+	r.POST("/api/revoke", s.audit("revoke", "username"), s.requirePermission(""), func(ctx *gin.Context) {
+		if e := s.revokeUser(ctx, ctx.GetString("username"), ctx.PostForm("username")); e != nil {
+			fail(ctx, e)
+			return
 		}
+		ctx.Status(http.StatusOK)
 	})
-	r.POST("/api/revokeAdmin", func(ctx *gin.Context) {
-		username := ""
-		if authorize(ctx, &username) {
-			revoke := ctx.PostForm("username")
-			if !storage.IsAdmin(username) {
-				ctx.Status(http.StatusForbidden)
-				return
-			}
-			if !storage.UserExists(revoke) {
-				ctx.Status(http.StatusNotFound)
-				return
-			}
-			if revoke == username {
-				ctx.Status(http.StatusForbidden)
-				return
-			}
-			err := storage.SetAdmin(revoke, false)
-			if err != nil {
-				ctx.Status(http.StatusInternalServerError)
-				log.Printf("Failed to revoke admin for %s: %v\n", revoke, err)
-			} else {
-				ctx.Status(http.StatusOK)
-			}
+	r.POST("/api/setRole", s.audit("setRole", "username"), s.requirePermission(storage.PermManageUsers), func(ctx *gin.Context) {
+		s.setRole(ctx, ctx.PostForm("username"), ctx.PostForm("role"))
+	})
+	// Legacy endpoints for the Admin and AllowShare flags, mapped to built-in roles
+	r.POST("/api/grantAdmin", s.audit("grantAdmin", "username"), s.requirePermission(storage.PermManageUsers), func(ctx *gin.Context) {
+		s.setRole(ctx, ctx.PostForm("username"), storage.RoleAdmin)
+	})
+	r.POST("/api/revokeAdmin", s.audit("revokeAdmin", "username"), s.requirePermission(storage.PermManageUsers), func(ctx *gin.Context) {
+		revoke := ctx.PostForm("username")
+		if revoke == ctx.GetString("username") {
+			ctx.Status(http.StatusForbidden)
+			return
+		}
+		if !s.store.UserExists(revoke) {
+			ctx.Status(http.StatusNotFound)
+		} else if s.store.UserRole(revoke) != storage.RoleAdmin && s.store.UserRole(revoke) != storage.RoleOwner {
+			ctx.Status(http.StatusOK)
+		} else {
+			s.setRole(ctx, revoke, storage.RoleMember)
 		}
 	})
-	r.POST("/api/allowShare", func(ctx *gin.Context) {
-		username := ""
-		if authorize(ctx, &username) {
-			grant := ctx.PostForm("username")
-			if !storage.IsAdmin(username) {
-				ctx.Status(http.StatusForbidden)
-				return
-			}
-			if !storage.UserExists(grant) {
-				ctx.Status(http.StatusNotFound)
-				return
-			}
-			err := storage.SetAllowShare(grant, true)
-			if err != nil {
-				ctx.Status(http.StatusInternalServerError)
-				log.Printf("Failed to grant share for %s: %v\n", grant, err)
-			} else {
-				ctx.Status(http.StatusOK)
-			}
+	r.POST("/api/allowShare", s.audit("allowShare", "username"), s.requirePermission(storage.PermManageUsers), func(ctx *gin.Context) {
+		grant := ctx.PostForm("username")
+		if storage.HasPermission(s.store, grant, storage.PermShare) {
+			ctx.Status(http.StatusOK)
+		} else if s.store.UserRole(grant) == storage.RoleGuest {
+			s.setRole(ctx, grant, storage.RoleMember)
+		} else if !s.store.UserExists(grant) {
+			ctx.Status(http.StatusNotFound)
+		} else {
+			ctx.Header("X-Status-Reason", "CUSTOM_ROLE")
+			ctx.Status(http.StatusConflict)
 		}
 	})
-	r.POST("/api/disallowShare", func(ctx *gin.Context) {
-		username := ""
-		if authorize(ctx, &username) {
-			revoke := ctx.PostForm("username")
-			if !storage.IsAdmin(username) {
-				ctx.Status(http.StatusForbidden)
-				return
-			}
-			if !storage.UserExists(revoke) {
-				ctx.Status(http.StatusNotFound)
-				return
-			}
-			err := storage.SetAllowShare(revoke, false)
-			if err != nil {
-				ctx.Status(http.StatusInternalServerError)
-				log.Printf("Failed to revoke share for %s: %v\n", revoke, err)
-			} else {
-				ctx.Status(http.StatusOK)
-			}
+	r.POST("/api/disallowShare", s.audit("disallowShare", "username"), s.requirePermission(storage.PermManageUsers), func(ctx *gin.Context) {
+		revoke := ctx.PostForm("username")
+		if !s.store.UserExists(revoke) {
+			ctx.Status(http.StatusNotFound)
+		} else if !storage.HasPermission(s.store, revoke, storage.PermShare) {
+			ctx.Status(http.StatusOK)
+		} else if s.store.UserRole(revoke) == storage.RoleMember {
+			s.setRole(ctx, revoke, storage.RoleGuest)
+		} else {
+			ctx.Header("X-Status-Reason", "CUSTOM_ROLE")
+			ctx.Status(http.StatusConflict)
 		}
 	})
-	r.POST("/api/changePassword", func(ctx *gin.Context) {
-		username := ""
-		if authorize(ctx, &username) {
-			oldPass := ctx.PostForm("oldPassword")
-			newPass := ctx.PostForm("newPassword")
-			if !storage.CheckPassword(username, oldPass) {
-				ctx.Header("X-Status-Reason", "WRONG_OLD_PASSWORD")
-				ctx.Status(http.StatusForbidden)
-				return
-			}
-			if len(newPass) < 5 {
-				ctx.Header("X-Status-Reason", "PASSWORD_TOO_SHORT")
-				ctx.Status(http.StatusForbidden)
-				return
-			}
-			err := storage.ChangePassword(username, newPass)
-			if err != nil {
-				ctx.Status(http.StatusInternalServerError)
-				log.Printf("Failed to change password for %s: %v\n", username, err)
-			} else {
-				ctx.Status(http.StatusOK)
-			}
+	r.POST("/api/changePassword", s.audit("changePassword", ""), s.requireSession(), func(ctx *gin.Context) {
+		if e := s.changePassword(ctx, ctx.GetString("username"), ctx.PostForm("oldPassword"), ctx.PostForm("newPassword")); e != nil {
+			fail(ctx, e)
+			return
 		}
+		ctx.Status(http.StatusOK)
 	})
-	r.POST("/api/generateToken", func(ctx *gin.Context) {
-		username := ""
-		if authorize(ctx, &username) {
-			tok, err := token.GenerateUserToken(username)
-			if err != nil {
-				log.Printf("Failed to generate user token for %s: %v\n", username, err)
-				ctx.Status(http.StatusInternalServerError)
-			} else {
-				ctx.String(http.StatusOK, tok)
+	r.POST("/api/generateToken", s.audit("generateToken", ""), s.requirePermission(""), func(ctx *gin.Context) {
+		username := ctx.GetString("username")
+		scope := token.Scope{
+			CoverOnly: ctx.PostForm("coverOnly") == "true",
+		}
+		for _, c := range strings.Split(ctx.PostForm("catalogs"), ",") {
+			if c = strings.TrimSpace(c); c != "" {
+				scope.Catalogs = append(scope.Catalogs, c)
 			}
 		}
-	})
-	r.POST("/api/listUsers", func(ctx *gin.Context) {
-		username := ""
-		if authorize(ctx, &username) {
-			if !storage.IsAdmin(username) {
-				ctx.Status(http.StatusForbidden)
+		expire := 0
+		if e := ctx.PostForm("expire"); e != "" {
+			var err error
+			expire, err = strconv.Atoi(e)
+			if err != nil || expire < 0 {
+				ctx.Status(http.StatusBadRequest)
 				return
 			}
-			ctx.JSON(http.StatusOK, storage.ListUsers())
+		}
+		ctx.Set("auditDetail", fmt.Sprintf("catalogs=%s coverOnly=%t expire=%d", strings.Join(scope.Catalogs, ","), scope.CoverOnly, expire))
+		tok, err := s.tokens.GenerateScopedUserToken(username, scope, time.Hour*time.Duration(expire), ctx.PostForm("note"))
+		if err != nil {
+			logger(ctx).Errorf("Failed to generate user token for %s: %v\n", username, err)
+			ctx.Status(http.StatusInternalServerError)
+		} else {
+			ctx.String(http.StatusOK, tok)
 		}
 	})
-	r.POST("/api/current", func(ctx *gin.Context) {
-		username := ""
-		if authorize(ctx, &username) {
-			ctx.String(http.StatusOK, username)
+	r.POST("/api/listTokens", s.auditRead("listTokens", "username"), s.requirePermission(""), func(ctx *gin.Context) {
+		username := ctx.GetString("username")
+		list := username
+		if storage.HasPermission(s.store, username, storage.PermManageTokens) {
+			list = ctx.PostForm("username")
+		}
+		ctx.JSON(http.StatusOK, s.store.ListTokens(list))
+	})
+	r.POST("/api/revokeToken", s.audit("revokeToken", "id"), s.requirePermission(""), func(ctx *gin.Context) {
+		username := ctx.GetString("username")
+		t, err := s.store.GetToken(ctx.PostForm("id"))
+		if err != nil {
+			ctx.Status(http.StatusNotFound)
+			return
+		}
+		if t.Username != username && !storage.HasPermission(s.store, username, storage.PermManageTokens) {
+			ctx.Status(http.StatusForbidden)
+			return
+		}
+		err = s.store.RevokeToken(t.Id)
+		if err != nil {
+			ctx.Status(http.StatusInternalServerError)
+			logger(ctx).Errorf("Failed to revoke token %s: %v\n", t.Id, err)
+		} else {
+			ctx.Status(http.StatusOK)
 		}
 	})
+	r.POST("/api/listUsers", s.auditRead("listUsers", ""), s.requirePermission(storage.PermManageUsers), func(ctx *gin.Context) {
+		ctx.JSON(http.StatusOK, s.store.ListUsers())
+	})
+	r.POST("/api/current", s.auditRead("current", ""), s.requireSession(), func(ctx *gin.Context) {
+		ctx.String(http.StatusOK, ctx.GetString("username"))
+	})
 
-	r.POST("/api/createInviteCode", func(ctx *gin.Context) {
-		username := ""
-		if authorize(ctx, &username) {
-			if !storage.IsAdmin(username) {
-				ctx.Status(http.StatusForbidden)
-				return
-			}
-			limit, err := strconv.Atoi(ctx.PostForm("limit"))
-			if err != nil || limit < -1 || limit == 0 {
+	r.POST("/api/createInviteCode", s.audit("createInviteCode", ""), s.requirePermission(storage.PermManageInvites), func(ctx *gin.Context) {
+		username := ctx.GetString("username")
+		limit, err := strconv.Atoi(ctx.PostForm("limit"))
+		if err != nil || limit < -1 || limit == 0 {
+			ctx.Status(http.StatusBadRequest)
+			return
+		}
+		code := storage.InviteCode{
+			Limit:   limit,
+			Creator: username,
+			Note:    ctx.PostForm("note"),
+			Role:    ctx.PostForm("role"),
+		}
+		// Expiry in hours, 0 for never
+		if e := ctx.PostForm("expire"); e != "" {
+			expire, err := strconv.Atoi(e)
+			if err != nil || expire < 0 {
 				ctx.Status(http.StatusBadRequest)
 				return
 			}
-			code, err := storage.NewInviteCode(limit)
-			if err != nil {
-				ctx.Status(http.StatusInternalServerError)
-				return
+			if expire > 0 {
+				code.Expire = time.Now().Add(time.Hour * time.Duration(expire)).Unix()
 			}
-			ctx.String(http.StatusOK, code)
 		}
-	})
-	r.POST("/api/listInviteCodes", func(ctx *gin.Context) {
-		username := ""
-		if authorize(ctx, &username) {
-			if !storage.IsAdmin(username) {
-				ctx.Status(http.StatusForbidden)
-				return
+		for _, g := range strings.Split(ctx.PostForm("groups"), ",") {
+			if g = strings.TrimSpace(g); g != "" {
+				code.Groups = append(code.Groups, g)
 			}
-			ctx.JSON(http.StatusOK, storage.ListInviteCodes())
 		}
+		code, e := s.newInviteCode(ctx, code)
+		if e != nil {
+			fail(ctx, e)
+			return
+		}
+		ctx.Set("auditTarget", code.Code)
+		ctx.Set("auditDetail", fmt.Sprintf("limit=%d role=%s groups=%s", code.Limit, code.Role, strings.Join(code.Groups, ",")))
+		ctx.String(http.StatusOK, code.Code)
 	})
-	r.POST("/api/revokeInviteCode", func(ctx *gin.Context) {
-		username := ""
-		if authorize(ctx, &username) {
-			if !storage.IsAdmin(username) {
-				ctx.Status(http.StatusForbidden)
-				return
-			}
-			code := ctx.PostForm("code")
-			err := storage.RevokeInviteCode(code)
-			if err != nil {
-				ctx.Status(http.StatusInternalServerError)
-			} else {
-				ctx.Status(http.StatusOK)
-			}
+	r.POST("/api/listInviteCodes", s.auditRead("listInviteCodes", ""), s.requirePermission(storage.PermManageInvites), func(ctx *gin.Context) {
+		ctx.JSON(http.StatusOK, s.store.ListInviteCodes())
+	})
+	r.POST("/api/listRedemptions", s.auditRead("listRedemptions", "code"), s.requirePermission(storage.PermManageInvites), func(ctx *gin.Context) {
+		ctx.JSON(http.StatusOK, s.store.ListRedemptions(ctx.PostForm("code")))
+	})
+	r.POST("/api/revokeInviteCode", s.audit("revokeInviteCode", "code"), s.requirePermission(storage.PermManageInvites), func(ctx *gin.Context) {
+		code := ctx.PostForm("code")
+		err := s.store.RevokeInviteCode(code)
+		if err != nil {
+			ctx.Status(http.StatusInternalServerError)
+		} else {
+			ctx.Status(http.StatusOK)
 		}
 	})
 }
 
-func authorize(ctx *gin.Context, u *string) bool {
-	sid, err := ctx.Cookie("sessionId")
+// requirePermission authorizes the session and checks that its user has perm.
+// An empty perm only requires a valid session. The username is stored in the context.
+// Users who must change their password or enroll TOTP are denied until they do.
+func (s *Server) requirePermission(perm string) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		username, e := s.authorize(ctx)
+		if e != nil {
+			fail(ctx, e)
+			return
+		}
+		// Set before the permission check so that denied requests are audited with their actor
+		ctx.Set("username", username)
+		if e = s.permitted(ctx, username, perm); e != nil {
+			fail(ctx, e)
+		}
+	}
+}
+
+// permitted checks that username has perm and has no pending password change or TOTP enrollment.
+func (s *Server) permitted(ctx *gin.Context, username, perm string) *apiError {
+	if s.store.MustChangePassword(username) {
+		return &apiError{http.StatusForbidden, "PASSWORD_CHANGE_REQUIRED"}
+	}
+	if s.totpEnrollmentRequired(ctx, username) {
+		return &apiError{http.StatusForbidden, "TOTP_ENROLLMENT_REQUIRED"}
+	}
+	if perm != "" && !storage.HasPermission(s.store, username, perm) {
+		return &apiError{Status: http.StatusForbidden}
+	}
+	return nil
+}
+
+// startSession logs username in once every factor has been checked.
+func (s *Server) startSession(ctx *gin.Context, username string) {
+	s.userLogins.Reset(username)
+	if !s.newSession(ctx, username) {
+		return
+	}
+	if s.store.MustChangePassword(username) {
+		ctx.Header("X-Status-Reason", "PASSWORD_CHANGE_REQUIRED")
+	} else if s.totpEnrollmentRequired(ctx, username) {
+		ctx.Header("X-Status-Reason", "TOTP_ENROLLMENT_REQUIRED")
+	}
+	ctx.Status(http.StatusOK)
+}
+
+// checkPassword confirms the password of a logged in user, with the provider the user logs in with.
+func (s *Server) checkPassword(username, password string) bool {
+	name, err := s.auth.Authenticate(username, password)
+	return err == nil && name == username
+}
+
+// newSession sets the session cookie of username.
+func (s *Server) newSession(ctx *gin.Context, username string) bool {
+	sid, err := s.store.NewSession(username, time.Now().Add(time.Hour))
 	if err != nil {
-		ctx.Status(http.StatusUnauthorized)
+		ctx.Status(http.StatusInternalServerError)
+		logger(ctx).Errorf("Failed to create session for %s: %v\n", username, err)
 		return false
 	}
-	s, ok := sessions[sid]
-	if ok {
-		if time.Now().After(s.expire) {
-			ctx.Status(http.StatusUnauthorized)
-			return false
+	s.setCookie(ctx, &http.Cookie{Name: sessionCookie, Value: sid, Path: "/", HttpOnly: true})
+	s.setCookie(ctx, &http.Cookie{Name: csrfCookie, Value: s.csrfToken(sid), Path: "/"})
+	ctx.Set("username", username)
+	return true
+}
+
+// loginAllowed checks whether username may attempt to login from ip, which is throttled after failures.
+// An allowed attempt counts as failed until refundLogin is called, so that parallel attempts are
+// throttled as well.
+func (s *Server) loginAllowed(ctx *gin.Context, username, ip string) bool {
+	wait, locked := s.userLogins.Attempt(username)
+	if locked {
+		ctx.Header("Retry-After", retryAfter(wait))
+		ctx.Header("X-Status-Reason", "ACCOUNT_LOCKED")
+		s.metrics.loginFailures.Inc("locked")
+		ctx.Status(http.StatusForbidden)
+		return false
+	}
+	var ipWait time.Duration
+	var ipLocked bool
+	if wait > 0 {
+		ipWait, ipLocked = s.ipLogins.Check(ip)
+	} else if ipWait, ipLocked = s.ipLogins.Attempt(ip); ipWait > 0 {
+		s.userLogins.Refund(username)
+	}
+	if ipLocked {
+		ctx.Header("Retry-After", retryAfter(ipWait))
+		ctx.Header("X-Status-Reason", "IP_LOCKED")
+		s.metrics.loginFailures.Inc("locked")
+		ctx.Status(http.StatusTooManyRequests)
+		return false
+	}
+	if ipWait > wait {
+		wait = ipWait
+	}
+	if wait > 0 {
+		ctx.Header("Retry-After", retryAfter(wait))
+		ctx.Header("X-Status-Reason", "TOO_MANY_ATTEMPTS")
+		s.metrics.loginFailures.Inc("throttled")
+		ctx.Status(http.StatusTooManyRequests)
+		return false
+	}
+	return true
+}
+
+// refundLogin takes back the failure counted by loginAllowed, for an attempt that did not fail.
+func (s *Server) refundLogin(username, ip string) {
+	s.userLogins.Refund(username)
+	s.ipLogins.Refund(ip)
+}
+
+// retryAfter formats d as whole seconds, rounded up.
+func retryAfter(d time.Duration) string {
+	return strconv.FormatInt(int64((d+time.Second-1)/time.Second), 10)
+}
+
+// requireSession authorizes the session and stores its username in the context,
+// even if the user must change the password or enroll TOTP.
+func (s *Server) requireSession() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		username, e := s.authorize(ctx)
+		if e != nil {
+			fail(ctx, e)
+			return
+		}
+		ctx.Set("username", username)
+	}
+}
+
+// authorize returns the user of the session cookie.
+func (s *Server) authorize(ctx *gin.Context) (string, *apiError) {
+	sid, err := ctx.Cookie(sessionCookie)
+	if err != nil {
+		return "", &apiError{Status: http.StatusUnauthorized}
+	}
+	ses, err := s.store.GetSession(sid)
+	if err != nil || time.Now().After(ses.Expire) || !s.store.UserExists(ses.Username) {
+		return "", &apiError{Status: http.StatusUnauthorized}
+	}
+	return ses.Username, nil
+}
+
+func (s *Server) setRole(ctx *gin.Context, target, role string) {
+	ctx.Set("auditDetail", "role="+role)
+	if e := s.assignRole(ctx, ctx.GetString("username"), target, role); e != nil {
+		fail(ctx, e)
+		return
+	}
+	ctx.Status(http.StatusOK)
+}
+
+// registerUser registers username with an invite code, and an optional email address
+// which is verified afterwards.
+func (s *Server) registerUser(ctx *gin.Context, username, password, code, rawEmail string) *apiError {
+	email, emailOk := parseEmail(rawEmail)
+	if s.store.UserExists(username) || !usernameExp.MatchString(username) {
+		return &apiError{http.StatusConflict, "USERNAME_UNAVAILABLE"}
+	} else if !emailOk {
+		return &apiError{http.StatusBadRequest, "INVALID_EMAIL"}
+	} else if email == "" && s.mailCfg.RequireEmail {
+		return &apiError{http.StatusBadRequest, "EMAIL_REQUIRED"}
+	} else if email != "" && s.emailInUse(email, "") {
+		return &apiError{http.StatusConflict, "EMAIL_IN_USE"}
+	} else if len(password) < 5 {
+		return &apiError{http.StatusForbidden, "PASSWORD_TOO_SHORT"}
+	}
+	err := s.store.RedeemInviteCode(code, username, password)
+	if err == storage.ErrInvalidInviteCode {
+		return &apiError{http.StatusForbidden, "INVALID_INVITE_CODE"}
+	} else if err != nil {
+		logger(ctx).Errorf("Failed to register %s: %v\n", username, err)
+		return &apiError{Status: http.StatusInternalServerError}
+	}
+	if email != "" {
+		if err = s.store.SetEmail(username, email); err != nil {
+			logger(ctx).Errorf("Failed to set email of %s: %v\n", username, err)
 		} else {
-			if !storage.UserExists(s.username) {
-				ctx.Status(http.StatusUnauthorized)
-				return false
-			}
-			*u = s.username
-			return true
+			s.sendVerification(ctx, username, email)
 		}
-	} else {
-		ctx.Status(http.StatusUnauthorized)
+	}
+	return nil
+}
+
+// revokeUser deletes target, which actor may do to themselves and to users they can manage.
+func (s *Server) revokeUser(ctx *gin.Context, actor, target string) *apiError {
+	if !s.store.UserExists(target) {
+		return &apiError{Status: http.StatusNotFound}
+	}
+	if target != actor && !s.canManage(actor, target) {
+		return &apiError{Status: http.StatusForbidden}
+	}
+	if s.isLastOwner(target) {
+		return &apiError{http.StatusForbidden, "LAST_OWNER"}
+	}
+	if err := s.store.RevokeUser(target); err != nil {
+		logger(ctx).Errorf("Failed to revoke %s: %v\n", target, err)
+		return &apiError{Status: http.StatusInternalServerError}
+	}
+	return nil
+}
+
+// assignRole gives target role on behalf of actor.
+func (s *Server) assignRole(ctx *gin.Context, actor, target, role string) *apiError {
+	if !s.store.UserExists(target) {
+		return &apiError{Status: http.StatusNotFound}
+	}
+	if !s.store.RoleExists(role) {
+		return &apiError{http.StatusBadRequest, "UNKNOWN_ROLE"}
+	}
+	if !s.canManage(actor, target) || !s.canAssign(actor, role) {
+		return &apiError{Status: http.StatusForbidden}
+	}
+	if role != storage.RoleOwner && s.isLastOwner(target) {
+		return &apiError{http.StatusForbidden, "LAST_OWNER"}
+	}
+	if err := s.store.SetRole(target, role); err != nil {
+		logger(ctx).Errorf("Failed to set role %s for %s: %v\n", role, target, err)
+		return &apiError{Status: http.StatusInternalServerError}
+	}
+	return nil
+}
+
+func (s *Server) changePassword(ctx *gin.Context, username, oldPass, newPass string) *apiError {
+	if !s.checkPassword(username, oldPass) {
+		return &apiError{http.StatusForbidden, "WRONG_OLD_PASSWORD"}
+	}
+	if len(newPass) < 5 {
+		return &apiError{http.StatusForbidden, "PASSWORD_TOO_SHORT"}
+	}
+	if err := s.store.ChangePassword(username, newPass); err != nil {
+		logger(ctx).Errorf("Failed to change password for %s: %v\n", username, err)
+		return &apiError{Status: http.StatusInternalServerError}
+	}
+	return nil
+}
+
+// newInviteCode creates code for its creator, who may only hand out roles they can assign
+// and groups if they manage groups.
+func (s *Server) newInviteCode(ctx *gin.Context, code storage.InviteCode) (storage.InviteCode, *apiError) {
+	if code.Role != "" {
+		if !s.store.RoleExists(code.Role) {
+			return code, &apiError{http.StatusBadRequest, "UNKNOWN_ROLE"}
+		}
+		if !s.canAssign(code.Creator, code.Role) {
+			return code, &apiError{Status: http.StatusForbidden}
+		}
+	}
+	if len(code.Groups) > 0 && !storage.HasPermission(s.store, code.Creator, storage.PermManageGroups) {
+		return code, &apiError{Status: http.StatusForbidden}
+	}
+	for _, g := range code.Groups {
+		if !s.store.GroupExists(g) {
+			return code, &apiError{http.StatusBadRequest, "UNKNOWN_GROUP"}
+		}
+	}
+	created, err := s.store.NewInviteCode(code)
+	if err != nil {
+		logger(ctx).Errorf("Failed to create invite code for %s: %v\n", code.Creator, err)
+		return code, &apiError{Status: http.StatusInternalServerError}
+	}
+	return created, nil
+}
+
+// canAssign reports whether actor may give role to someone.
+// Only owners may create owners, and nobody may grant permissions they don't have.
+func (s *Server) canAssign(actor, role string) bool {
+	actorRole := s.store.UserRole(actor)
+	if role == storage.RoleOwner {
+		return actorRole == storage.RoleOwner
+	}
+	return subset(s.store.RolePermissions(role), s.store.RolePermissions(actorRole))
+}
+
+// canManage reports whether actor may change the role of or revoke target.
+func (s *Server) canManage(actor, target string) bool {
+	return s.canAssign(actor, s.store.UserRole(target))
+}
+
+func (s *Server) isLastOwner(username string) bool {
+	if s.store.UserRole(username) != storage.RoleOwner {
 		return false
 	}
+	return len(s.store.RoleUsers(storage.RoleOwner)) <= 1
+}
+
+func subset(a, b []string) bool {
+	for _, x := range a {
+		found := false
+		for _, y := range b {
+			if x == y {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
 }
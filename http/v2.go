@@ -0,0 +1,237 @@
+package http
+
+import (
+	"github.com/SeraphJACK/go-annil/storage"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Me describes the logged in user.
+type Me struct {
+	storage.User
+	Permissions []string `json:"permissions"`
+	TotpEnabled bool     `json:"totpEnabled"`
+	// Set until the user enrolls TOTP, which their role requires
+	TotpEnrollmentRequired bool `json:"totpEnrollmentRequired"`
+}
+
+type NewUser struct {
+	Username   string `json:"username"`
+	Password   string `json:"password"`
+	InviteCode string `json:"inviteCode"`
+	Email      string `json:"email"`
+}
+
+// UserPatch changes the fields which are set. Users change their own password and email,
+// the role of others requires the permission to manage users.
+type UserPatch struct {
+	Role     *string `json:"role"`
+	Email    *string `json:"email"`
+	Password *string `json:"password"`
+	// Required to change the password
+	OldPassword string `json:"oldPassword"`
+}
+
+type NewInviteCode struct {
+	// -1 for unlimited
+	Limit int `json:"limit"`
+	// 0 for never
+	ExpireHours int      `json:"expireHours"`
+	Note        string   `json:"note"`
+	Role        string   `json:"role"`
+	Groups      []string `json:"groups"`
+}
+
+// regV2Endpoints registers the JSON API. Errors are reported as an ErrorBody by fail.
+func (s *Server) regV2Endpoints(r *gin.Engine) {
+	g := r.Group("/api/v2")
+
+	g.GET("/me", s.requireSession(), func(ctx *gin.Context) {
+		username := ctx.GetString("username")
+		u, ok := s.findUser(username)
+		if !ok {
+			fail(ctx, &apiError{Status: http.StatusNotFound})
+			return
+		}
+		me := Me{
+			User:                   u,
+			Permissions:            s.store.RolePermissions(u.Role),
+			TotpEnrollmentRequired: s.totpEnrollmentRequired(ctx, username),
+		}
+		if st, err := s.store.GetTotp(username); err == nil {
+			me.TotpEnabled = st.Enabled
+		}
+		ctx.JSON(http.StatusOK, me)
+	})
+
+	g.GET("/users", s.requirePermission(storage.PermManageUsers), func(ctx *gin.Context) {
+		ctx.JSON(http.StatusOK, s.store.ListUsers())
+	})
+	g.GET("/users/:name", s.requirePermission(""), func(ctx *gin.Context) {
+		name := ctx.Param("name")
+		if name != ctx.GetString("username") && !storage.HasPermission(s.store, ctx.GetString("username"), storage.PermManageUsers) {
+			fail(ctx, &apiError{Status: http.StatusForbidden})
+			return
+		}
+		u, ok := s.findUser(name)
+		if !ok {
+			fail(ctx, &apiError{Status: http.StatusNotFound})
+			return
+		}
+		ctx.JSON(http.StatusOK, u)
+	})
+	g.POST("/users", s.audit("register", ""), func(ctx *gin.Context) {
+		var req NewUser
+		if !bindJSON(ctx, &req) {
+			return
+		}
+		ctx.Set("auditTarget", req.Username)
+		if e := s.registerUser(ctx, req.Username, req.Password, req.InviteCode, req.Email); e != nil {
+			fail(ctx, e)
+			return
+		}
+		ctx.Set("username", req.Username)
+		ctx.Set("auditDetail", "inviteCode="+req.InviteCode)
+		u, _ := s.findUser(req.Username)
+		ctx.JSON(http.StatusCreated, u)
+	})
+	// Changes are applied in the order role, email, password and stop at the first error.
+	g.PATCH("/users/:name", s.audit("updateUser", ""), s.requireSession(), func(ctx *gin.Context) {
+		username, name := ctx.GetString("username"), ctx.Param("name")
+		ctx.Set("auditTarget", name)
+		var req UserPatch
+		if !bindJSON(ctx, &req) {
+			return
+		}
+		if (req.Email != nil || req.Password != nil) && name != username {
+			fail(ctx, &apiError{Status: http.StatusForbidden})
+			return
+		}
+		if req.Role != nil {
+			ctx.Set("auditDetail", "role="+*req.Role)
+			e := s.permitted(ctx, username, storage.PermManageUsers)
+			if e == nil {
+				e = s.assignRole(ctx, username, name, *req.Role)
+			}
+			if e != nil {
+				fail(ctx, e)
+				return
+			}
+		}
+		if req.Email != nil {
+			e := s.permitted(ctx, username, "")
+			if e == nil {
+				e = s.setEmail(ctx, username, *req.Email)
+			}
+			if e != nil {
+				fail(ctx, e)
+				return
+			}
+		}
+		// Allowed while a password change is pending, which this completes
+		if req.Password != nil {
+			if e := s.changePassword(ctx, username, req.OldPassword, *req.Password); e != nil {
+				fail(ctx, e)
+				return
+			}
+		}
+		u, ok := s.findUser(name)
+		if !ok {
+			fail(ctx, &apiError{Status: http.StatusNotFound})
+			return
+		}
+		ctx.JSON(http.StatusOK, u)
+	})
+	g.DELETE("/users/:name", s.audit("revoke", ""), s.requirePermission(""), func(ctx *gin.Context) {
+		name := ctx.Param("name")
+		ctx.Set("auditTarget", name)
+		if e := s.revokeUser(ctx, ctx.GetString("username"), name); e != nil {
+			fail(ctx, e)
+			return
+		}
+		ctx.Status(http.StatusNoContent)
+	})
+
+	g.GET("/invite-codes", s.requirePermission(storage.PermManageInvites), func(ctx *gin.Context) {
+		ctx.JSON(http.StatusOK, s.store.ListInviteCodes())
+	})
+	g.POST("/invite-codes", s.audit("createInviteCode", ""), s.requirePermission(storage.PermManageInvites), func(ctx *gin.Context) {
+		var req NewInviteCode
+		if !bindJSON(ctx, &req) {
+			return
+		}
+		if req.Limit < -1 || req.Limit == 0 || req.ExpireHours < 0 {
+			fail(ctx, &apiError{Status: http.StatusBadRequest})
+			return
+		}
+		code := storage.InviteCode{
+			Limit:   req.Limit,
+			Creator: ctx.GetString("username"),
+			Note:    req.Note,
+			Role:    req.Role,
+			Groups:  req.Groups,
+		}
+		if req.ExpireHours > 0 {
+			code.Expire = time.Now().Add(time.Hour * time.Duration(req.ExpireHours)).Unix()
+		}
+		code, e := s.newInviteCode(ctx, code)
+		if e != nil {
+			fail(ctx, e)
+			return
+		}
+		ctx.Set("auditTarget", code.Code)
+		ctx.JSON(http.StatusCreated, code)
+	})
+	g.DELETE("/invite-codes/:code", s.audit("revokeInviteCode", ""), s.requirePermission(storage.PermManageInvites), func(ctx *gin.Context) {
+		code := ctx.Param("code")
+		ctx.Set("auditTarget", code)
+		if _, err := s.store.GetInviteCode(code); err != nil {
+			fail(ctx, &apiError{Status: http.StatusNotFound})
+			return
+		}
+		if err := s.store.RevokeInviteCode(code); err != nil {
+			fail(ctx, &apiError{Status: http.StatusInternalServerError})
+			return
+		}
+		ctx.Status(http.StatusNoContent)
+	})
+	g.GET("/invite-codes/:code/redemptions", s.requirePermission(storage.PermManageInvites), func(ctx *gin.Context) {
+		ctx.JSON(http.StatusOK, s.store.ListRedemptions(ctx.Param("code")))
+	})
+}
+
+// bindJSON decodes the request body into v, rejecting the request if it is malformed.
+func bindJSON(ctx *gin.Context, v interface{}) bool {
+	if err := ctx.ShouldBindJSON(v); err != nil {
+		fail(ctx, &apiError{Status: http.StatusBadRequest})
+		return false
+	}
+	return true
+}
+
+// noRoute serves the front-end and the admin console below /admin/, except below /api/v2
+// where unknown paths are JSON errors.
+func (s *Server) noRoute(ctx *gin.Context) {
+	p := ctx.Request.URL.Path
+	switch {
+	case strings.HasPrefix(p, "/api/v2/"):
+		fail(ctx, &apiError{Status: http.StatusNotFound})
+	case p == "/admin":
+		ctx.Redirect(http.StatusMovedPermanently, "/admin/")
+	case strings.HasPrefix(p, "/admin/"):
+		s.admin.serve(ctx, strings.TrimPrefix(p, "/admin"))
+	default:
+		s.front.serve(ctx, p)
+	}
+}
+
+func (s *Server) findUser(username string) (storage.User, bool) {
+	for _, u := range s.store.ListUsers() {
+		if u.Username == username {
+			return u, true
+		}
+	}
+	return storage.User{}, false
+}
@@ -0,0 +1,218 @@
+// Package ber encodes and decodes the subset of ASN.1 BER used by LDAP.
+// Only single byte tags and definite lengths are supported.
+package ber
+
+import (
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Universal tags
+const (
+	TagBoolean     byte = 0x01
+	TagInteger     byte = 0x02
+	TagOctetString byte = 0x04
+	TagNull        byte = 0x05
+	TagEnumerated  byte = 0x0a
+	TagSequence    byte = 0x30
+	TagSet         byte = 0x31
+)
+
+// Class and form bits of a tag
+const (
+	ClassApplication byte = 0x40
+	ClassContext     byte = 0x80
+	Constructed      byte = 0x20
+)
+
+// Largest element accepted when reading, to protect against bogus lengths
+const maxLength = 16 << 20
+
+// Packet is an element, which either holds a value or, if its tag is constructed, children.
+type Packet struct {
+	Tag      byte
+	Value    []byte
+	Children []*Packet
+}
+
+func (p *Packet) IsConstructed() bool {
+	return p.Tag&Constructed != 0
+}
+
+// Sequence creates a constructed element.
+func Sequence(tag byte, children ...*Packet) *Packet {
+	return &Packet{Tag: tag | Constructed, Children: children}
+}
+
+func String(tag byte, s string) *Packet {
+	return &Packet{Tag: tag, Value: []byte(s)}
+}
+
+func Int(tag byte, n int64) *Packet {
+	// Minimal two's complement encoding
+	b := []byte{byte(n)}
+	for n > 127 || n < -128 {
+		n >>= 8
+		b = append([]byte{byte(n)}, b...)
+	}
+	return &Packet{Tag: tag, Value: b}
+}
+
+func Bool(tag byte, v bool) *Packet {
+	if v {
+		return &Packet{Tag: tag, Value: []byte{0xff}}
+	}
+	return &Packet{Tag: tag, Value: []byte{0}}
+}
+
+func (p *Packet) Str() string {
+	return string(p.Value)
+}
+
+func (p *Packet) Int() int64 {
+	var n int64
+	for i, b := range p.Value {
+		if i == 0 {
+			n = int64(int8(b))
+		} else {
+			n = n<<8 | int64(b)
+		}
+	}
+	return n
+}
+
+func (p *Packet) Bool() bool {
+	return len(p.Value) > 0 && p.Value[0] != 0
+}
+
+// Child returns the i-th child, or nil if there are fewer children.
+func (p *Packet) Child(i int) *Packet {
+	if i < 0 || i >= len(p.Children) {
+		return nil
+	}
+	return p.Children[i]
+}
+
+// Bytes encodes the packet.
+func (p *Packet) Bytes() []byte {
+	content := p.Value
+	if p.IsConstructed() {
+		content = nil
+		for _, c := range p.Children {
+			content = append(content, c.Bytes()...)
+		}
+	}
+	return append(append([]byte{p.Tag}, encodeLength(len(content))...), content...)
+}
+
+func encodeLength(n int) []byte {
+	if n < 128 {
+		return []byte{byte(n)}
+	}
+	var b []byte
+	for ; n > 0; n >>= 8 {
+		b = append([]byte{byte(n)}, b...)
+	}
+	return append([]byte{0x80 | byte(len(b))}, b...)
+}
+
+// Reader is a buffered reader, such as bufio.Reader.
+type Reader interface {
+	io.Reader
+	io.ByteReader
+}
+
+// Read reads one packet from r.
+func Read(r Reader) (*Packet, error) {
+	tag, err := r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	length, err := readLength(r)
+	if err != nil {
+		return nil, err
+	}
+	content := make([]byte, length)
+	if _, err = io.ReadFull(r, content); err != nil {
+		return nil, err
+	}
+	return newPacket(tag, content)
+}
+
+// Parse decodes the packet at the start of b and returns the remaining bytes.
+func Parse(b []byte) (*Packet, []byte, error) {
+	r := &sliceReader{b: b}
+	tag, err := r.ReadByte()
+	if err != nil {
+		return nil, nil, err
+	}
+	length, err := readLength(r)
+	if err != nil {
+		return nil, nil, err
+	}
+	if length > len(r.b) {
+		return nil, nil, io.ErrUnexpectedEOF
+	}
+	p, err := newPacket(tag, r.b[:length])
+	return p, r.b[length:], err
+}
+
+func newPacket(tag byte, content []byte) (*Packet, error) {
+	if tag&0x1f == 0x1f {
+		return nil, errors.New("multi-byte tags are not supported")
+	}
+	p := &Packet{Tag: tag}
+	if !p.IsConstructed() {
+		p.Value = content
+		return p, nil
+	}
+	for len(content) > 0 {
+		c, rest, err := Parse(content)
+		if err != nil {
+			return nil, fmt.Errorf("invalid child of %#x: %v", tag, err)
+		}
+		p.Children = append(p.Children, c)
+		content = rest
+	}
+	return p, nil
+}
+
+func readLength(r io.ByteReader) (int, error) {
+	first, err := r.ReadByte()
+	if err != nil {
+		return 0, err
+	}
+	if first&0x80 == 0 {
+		return int(first), nil
+	}
+	n := int(first & 0x7f)
+	if n == 0 || n > 4 {
+		return 0, fmt.Errorf("unsupported length of %d bytes", n)
+	}
+	length := 0
+	for i := 0; i < n; i++ {
+		b, err := r.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+		length = length<<8 | int(b)
+	}
+	if length > maxLength {
+		return 0, fmt.Errorf("element of %d bytes is too large", length)
+	}
+	return length, nil
+}
+
+type sliceReader struct {
+	b []byte
+}
+
+func (r *sliceReader) ReadByte() (byte, error) {
+	if len(r.b) == 0 {
+		return 0, io.ErrUnexpectedEOF
+	}
+	b := r.b[0]
+	r.b = r.b[1:]
+	return b, nil
+}
@@ -0,0 +1,172 @@
+package ldap
+
+import (
+	"encoding/hex"
+	"fmt"
+	"github.com/SeraphJACK/go-annil/ldap/ber"
+	"strings"
+)
+
+// Filter choices, RFC 4511 section 4.5.1
+const (
+	FilterAnd            = ber.ClassContext | ber.Constructed | 0
+	FilterOr             = ber.ClassContext | ber.Constructed | 1
+	FilterNot            = ber.ClassContext | ber.Constructed | 2
+	FilterEquality       = ber.ClassContext | ber.Constructed | 3
+	FilterSubstrings     = ber.ClassContext | ber.Constructed | 4
+	FilterGreaterOrEqual = ber.ClassContext | ber.Constructed | 5
+	FilterLessOrEqual    = ber.ClassContext | ber.Constructed | 6
+	FilterPresent        = ber.ClassContext | 7
+	FilterApprox         = ber.ClassContext | ber.Constructed | 8
+
+	SubstringInitial = ber.ClassContext | 0
+	SubstringAny     = ber.ClassContext | 1
+	SubstringFinal   = ber.ClassContext | 2
+)
+
+// EscapeFilter escapes a value for use in a filter string, RFC 4515 section 3.
+func EscapeFilter(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; c {
+		case '*', '(', ')', '\\', 0:
+			fmt.Fprintf(&b, "\\%02x", c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// ParseFilter encodes a filter string such as (&(objectClass=person)(uid=alice)).
+func ParseFilter(f string) (*ber.Packet, error) {
+	p, rest, err := parseFilter(f)
+	if err != nil {
+		return nil, err
+	}
+	if rest != "" {
+		return nil, fmt.Errorf("unexpected %q after filter", rest)
+	}
+	return p, nil
+}
+
+func parseFilter(f string) (*ber.Packet, string, error) {
+	if len(f) < 2 || f[0] != '(' {
+		return nil, "", fmt.Errorf("filter %q does not start with (", f)
+	}
+	f = f[1:]
+	var p *ber.Packet
+	var err error
+	switch f[0] {
+	case '&', '|':
+		p = &ber.Packet{Tag: FilterAnd}
+		if f[0] == '|' {
+			p.Tag = FilterOr
+		}
+		f = f[1:]
+		for len(f) > 0 && f[0] == '(' {
+			var c *ber.Packet
+			c, f, err = parseFilter(f)
+			if err != nil {
+				return nil, "", err
+			}
+			p.Children = append(p.Children, c)
+		}
+	case '!':
+		var c *ber.Packet
+		c, f, err = parseFilter(f[1:])
+		if err != nil {
+			return nil, "", err
+		}
+		p = ber.Sequence(FilterNot, c)
+	default:
+		end := strings.IndexByte(f, ')')
+		if end < 0 {
+			return nil, "", fmt.Errorf("unterminated filter item %q", f)
+		}
+		p, err = parseItem(f[:end])
+		if err != nil {
+			return nil, "", err
+		}
+		f = f[end:]
+	}
+	if f == "" || f[0] != ')' {
+		return nil, "", fmt.Errorf("missing ) in filter")
+	}
+	return p, f[1:], nil
+}
+
+func parseItem(item string) (*ber.Packet, error) {
+	i := strings.IndexByte(item, '=')
+	if i <= 0 {
+		return nil, fmt.Errorf("invalid filter item %q", item)
+	}
+	attr, value := item[:i], item[i+1:]
+	tag := byte(FilterEquality)
+	switch attr[len(attr)-1] {
+	case '>':
+		tag = FilterGreaterOrEqual
+	case '<':
+		tag = FilterLessOrEqual
+	case '~':
+		tag = FilterApprox
+	}
+	if tag != FilterEquality {
+		attr = attr[:len(attr)-1]
+	}
+	if attr == "" {
+		return nil, fmt.Errorf("invalid filter item %q", item)
+	}
+	if tag == FilterEquality && value == "*" {
+		return ber.String(FilterPresent, attr), nil
+	}
+	if tag == FilterEquality && strings.Contains(value, "*") {
+		parts := strings.Split(value, "*")
+		subs := ber.Sequence(ber.TagSequence)
+		for i, part := range parts {
+			if part == "" {
+				continue
+			}
+			v, err := unescape(part)
+			if err != nil {
+				return nil, err
+			}
+			t := byte(SubstringAny)
+			if i == 0 {
+				t = SubstringInitial
+			} else if i == len(parts)-1 {
+				t = SubstringFinal
+			}
+			subs.Children = append(subs.Children, ber.String(t, v))
+		}
+		return ber.Sequence(FilterSubstrings, ber.String(ber.TagOctetString, attr), subs), nil
+	}
+	v, err := unescape(value)
+	if err != nil {
+		return nil, err
+	}
+	return ber.Sequence(tag, ber.String(ber.TagOctetString, attr), ber.String(ber.TagOctetString, v)), nil
+}
+
+func unescape(s string) (string, error) {
+	if !strings.Contains(s, "\\") {
+		return s, nil
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' {
+			b.WriteByte(s[i])
+			continue
+		}
+		if i+3 > len(s) {
+			return "", fmt.Errorf("invalid escape in %q", s)
+		}
+		c, err := hex.DecodeString(s[i+1 : i+3])
+		if err != nil {
+			return "", fmt.Errorf("invalid escape in %q", s)
+		}
+		b.Write(c)
+		i += 2
+	}
+	return b.String(), nil
+}
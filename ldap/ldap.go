@@ -0,0 +1,267 @@
+// Package ldap is a minimal LDAPv3 client, just enough to search for and bind as users.
+package ldap
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"github.com/SeraphJACK/go-annil/ldap/ber"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Protocol operations, RFC 4511 section 4.2 onwards
+const (
+	OpBindRequest      = ber.ClassApplication | ber.Constructed | 0
+	OpBindResponse     = ber.ClassApplication | ber.Constructed | 1
+	OpUnbindRequest    = ber.ClassApplication | 2
+	OpSearchRequest    = ber.ClassApplication | ber.Constructed | 3
+	OpSearchResultItem = ber.ClassApplication | ber.Constructed | 4
+	OpSearchResultDone = ber.ClassApplication | ber.Constructed | 5
+	OpSearchResultRef  = ber.ClassApplication | ber.Constructed | 19
+	OpExtendedRequest  = ber.ClassApplication | ber.Constructed | 23
+	OpExtendedResponse = ber.ClassApplication | ber.Constructed | 24
+
+	// Simple authentication in a bind request
+	AuthSimple = ber.ClassContext | 0
+	// Name of the operation in an extended request
+	ExtendedRequestName = ber.ClassContext | 0
+)
+
+// OIDStartTLS names the StartTLS extended operation, RFC 4511 section 4.14
+const OIDStartTLS = "1.3.6.1.4.1.1466.20037"
+
+// Result codes
+const (
+	ResultSuccess            = 0
+	ResultNoSuchObject       = 32
+	ResultInvalidCredentials = 49
+)
+
+// ScopeSubtree searches the base object and everything below it.
+const ScopeSubtree = 2
+
+// Error is an unsuccessful result returned by the server.
+type Error struct {
+	Code    int
+	Message string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("ldap result %d: %s", e.Code, e.Message)
+}
+
+// IsInvalidCredentials reports whether err is a rejected bind.
+func IsInvalidCredentials(err error) bool {
+	var e *Error
+	return errors.As(err, &e) && e.Code == ResultInvalidCredentials
+}
+
+// Entry is a search result.
+type Entry struct {
+	DN         string
+	Attributes map[string][]string
+}
+
+// Values returns the values of an attribute, whose name is matched case insensitively.
+func (e Entry) Values(attr string) []string {
+	for k, v := range e.Attributes {
+		if strings.EqualFold(k, attr) {
+			return v
+		}
+	}
+	return nil
+}
+
+// Value returns the first value of an attribute.
+func (e Entry) Value(attr string) string {
+	if v := e.Values(attr); len(v) > 0 {
+		return v[0]
+	}
+	return ""
+}
+
+// Conn is a connection to a directory, which handles one request at a time.
+type Conn struct {
+	conn    net.Conn
+	r       *bufio.Reader
+	id      int64
+	timeout time.Duration
+}
+
+// Dial connects to an ldap:// or ldaps:// URL.
+func Dial(rawurl string, timeout time.Duration) (*Conn, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	host := u.Host
+	d := &net.Dialer{Timeout: timeout}
+	var conn net.Conn
+	switch u.Scheme {
+	case "ldap":
+		if u.Port() == "" {
+			host = net.JoinHostPort(host, "389")
+		}
+		conn, err = d.Dial("tcp", host)
+	case "ldaps":
+		if u.Port() == "" {
+			host = net.JoinHostPort(host, "636")
+		}
+		conn, err = tls.DialWithDialer(d, "tcp", host, &tls.Config{ServerName: u.Hostname()})
+	default:
+		return nil, fmt.Errorf("unsupported scheme %s", u.Scheme)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &Conn{conn: conn, r: bufio.NewReader(conn), timeout: timeout}, nil
+}
+
+// StartTLS upgrades a plain connection to TLS, before anything is sent over it in clear.
+func (c *Conn) StartTLS(config *tls.Config) error {
+	resp, err := c.request(ber.Sequence(OpExtendedRequest, ber.String(ExtendedRequestName, OIDStartTLS)))
+	if err != nil {
+		return err
+	}
+	if len(resp) != 1 || resp[0].Tag != OpExtendedResponse {
+		return errors.New("unexpected response to starttls")
+	}
+	if err = result(resp[0]); err != nil {
+		return fmt.Errorf("starttls refused: %v", err)
+	}
+	conn := tls.Client(c.conn, config)
+	if c.timeout > 0 {
+		_ = conn.SetDeadline(time.Now().Add(c.timeout))
+	}
+	if err = conn.Handshake(); err != nil {
+		return err
+	}
+	c.conn, c.r = conn, bufio.NewReader(conn)
+	return nil
+}
+
+// Close unbinds and closes the connection.
+func (c *Conn) Close() error {
+	c.id++
+	_ = c.write(ber.Sequence(ber.TagSequence, ber.Int(ber.TagInteger, c.id), &ber.Packet{Tag: OpUnbindRequest}))
+	return c.conn.Close()
+}
+
+// Bind authenticates the connection with a password. An empty password is an
+// unauthenticated bind, which servers usually accept, so callers must not pass one for users.
+func (c *Conn) Bind(dn, password string) error {
+	resp, err := c.request(ber.Sequence(OpBindRequest,
+		ber.Int(ber.TagInteger, 3),
+		ber.String(ber.TagOctetString, dn),
+		ber.String(AuthSimple, password),
+	))
+	if err != nil {
+		return err
+	}
+	if len(resp) != 1 || resp[0].Tag != OpBindResponse {
+		return errors.New("unexpected response to bind")
+	}
+	return result(resp[0])
+}
+
+// Search returns the entries below base matching filter, with the requested attributes.
+func (c *Conn) Search(base, filter string, attrs []string) ([]Entry, error) {
+	f, err := ParseFilter(filter)
+	if err != nil {
+		return nil, err
+	}
+	attrList := ber.Sequence(ber.TagSequence)
+	for _, a := range attrs {
+		attrList.Children = append(attrList.Children, ber.String(ber.TagOctetString, a))
+	}
+	resp, err := c.request(ber.Sequence(OpSearchRequest,
+		ber.String(ber.TagOctetString, base),
+		ber.Int(ber.TagEnumerated, ScopeSubtree),
+		ber.Int(ber.TagEnumerated, 0), // never dereference aliases
+		ber.Int(ber.TagInteger, 0),
+		ber.Int(ber.TagInteger, int64(c.timeout/time.Second)),
+		ber.Bool(ber.TagBoolean, false),
+		f,
+		attrList,
+	))
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]Entry, 0)
+	for _, op := range resp {
+		switch op.Tag {
+		case OpSearchResultItem:
+			entries = append(entries, parseEntry(op))
+		case OpSearchResultDone:
+			if err = result(op); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return entries, nil
+}
+
+// request sends op and reads responses until one which is not a search result.
+func (c *Conn) request(op *ber.Packet) ([]*ber.Packet, error) {
+	c.id++
+	id := c.id
+	if err := c.write(ber.Sequence(ber.TagSequence, ber.Int(ber.TagInteger, id), op)); err != nil {
+		return nil, err
+	}
+	resp := make([]*ber.Packet, 0)
+	for {
+		msg, err := ber.Read(c.r)
+		if err != nil {
+			return nil, err
+		}
+		if len(msg.Children) < 2 || msg.Children[0].Int() != id {
+			return nil, errors.New("unexpected message from server")
+		}
+		op := msg.Children[1]
+		resp = append(resp, op)
+		if op.Tag != OpSearchResultItem && op.Tag != OpSearchResultRef {
+			return resp, nil
+		}
+	}
+}
+
+func (c *Conn) write(p *ber.Packet) error {
+	if c.timeout > 0 {
+		_ = c.conn.SetDeadline(time.Now().Add(c.timeout))
+	}
+	_, err := c.conn.Write(p.Bytes())
+	return err
+}
+
+func result(op *ber.Packet) error {
+	if len(op.Children) < 3 {
+		return errors.New("malformed result")
+	}
+	if code := int(op.Children[0].Int()); code != ResultSuccess {
+		return &Error{Code: code, Message: op.Children[2].Str()}
+	}
+	return nil
+}
+
+func parseEntry(op *ber.Packet) Entry {
+	e := Entry{Attributes: make(map[string][]string)}
+	if dn := op.Child(0); dn != nil {
+		e.DN = dn.Str()
+	}
+	if attrs := op.Child(1); attrs != nil {
+		for _, a := range attrs.Children {
+			if len(a.Children) < 2 {
+				continue
+			}
+			name := a.Children[0].Str()
+			for _, v := range a.Children[1].Children {
+				e.Attributes[name] = append(e.Attributes[name], v.Str())
+			}
+		}
+	}
+	return e
+}
@@ -0,0 +1,116 @@
+package ldap_test
+
+import (
+	"crypto/tls"
+	"github.com/SeraphJACK/go-annil/ldap"
+	"github.com/SeraphJACK/go-annil/ldap/ber"
+	"github.com/SeraphJACK/go-annil/ldap/ldaptest"
+	"testing"
+	"time"
+)
+
+func TestParseFilter(t *testing.T) {
+	f, err := ldap.ParseFilter("(&(objectClass=person)(!(uid=a\\2ab))(cn=Al*ce*)(mail=*))")
+	if err != nil {
+		t.Fatalf("failed to parse filter: %v", err)
+	}
+	if f.Tag != ldap.FilterAnd || len(f.Children) != 4 {
+		t.Fatalf("wrong filter: %#x with %d children", f.Tag, len(f.Children))
+	}
+	if not := f.Children[1]; not.Tag != ldap.FilterNot || not.Child(0).Child(1).Str() != "a*b" {
+		t.Errorf("escaped value not decoded")
+	}
+	if subs := f.Children[2].Child(1); len(subs.Children) != 2 || subs.Children[0].Tag != ldap.SubstringInitial || subs.Children[1].Tag != ldap.SubstringAny {
+		t.Errorf("wrong substrings")
+	}
+	if f.Children[3].Tag != ldap.FilterPresent || f.Children[3].Str() != "mail" {
+		t.Errorf("wrong presence filter")
+	}
+	// Round trip through the encoding
+	p, rest, err := ber.Parse(f.Bytes())
+	if err != nil || len(rest) != 0 || len(p.Children) != 4 {
+		t.Errorf("failed to decode encoded filter: %v", err)
+	}
+
+	for _, bad := range []string{"", "uid=a", "(uid=a", "(uid=a))", "(=a)", "(uid=\\zz)"} {
+		if _, err = ldap.ParseFilter(bad); err == nil {
+			t.Errorf("accepted invalid filter %q", bad)
+		}
+	}
+	if ldap.EscapeFilter("a*(b)\\") != "a\\2a\\28b\\29\\5c" {
+		t.Errorf("wrong escape: %s", ldap.EscapeFilter("a*(b)\\"))
+	}
+}
+
+func TestConn(t *testing.T) {
+	srv, err := ldaptest.NewServer()
+	if err != nil {
+		t.Fatalf("failed to start server: %v", err)
+	}
+	defer srv.Close()
+	srv.Add("uid=alice,ou=people,dc=example", "secret", map[string][]string{
+		"objectClass": {"person"},
+		"uid":         {"alice"},
+		"memberOf":    {"cn=staff,ou=groups,dc=example"},
+	})
+	srv.Add("uid=bob,ou=people,dc=example", "hunter2", map[string][]string{"objectClass": {"person"}, "uid": {"bob"}})
+
+	c, err := ldap.Dial(srv.URL(), time.Second)
+	if err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	defer c.Close()
+	if err = c.Bind("uid=alice,ou=people,dc=example", "wrong"); !ldap.IsInvalidCredentials(err) {
+		t.Errorf("wrong password accepted: %v", err)
+	}
+	if err = c.Bind("uid=alice,ou=people,dc=example", "secret"); err != nil {
+		t.Fatalf("failed to bind: %v", err)
+	}
+	entries, err := c.Search("dc=example", "(&(objectClass=person)(uid=al*))", []string{"uid", "memberOf"})
+	if err != nil {
+		t.Fatalf("failed to search: %v", err)
+	}
+	if len(entries) != 1 || entries[0].DN != "uid=alice,ou=people,dc=example" || entries[0].Value("MEMBEROF") != "cn=staff,ou=groups,dc=example" {
+		t.Errorf("wrong search result: %v", entries)
+	}
+	if entries[0].Value("objectClass") != "" {
+		t.Errorf("returned an attribute which was not requested")
+	}
+	if entries, _ = c.Search("dc=example", "(objectClass=person)", nil); len(entries) != 2 {
+		t.Errorf("wrong number of entries: %d", len(entries))
+	}
+}
+
+func TestStartTLS(t *testing.T) {
+	srv, err := ldaptest.NewServer()
+	if err != nil {
+		t.Fatalf("failed to start server: %v", err)
+	}
+	defer srv.Close()
+	srv.Add("uid=alice,ou=people,dc=example", "secret", nil)
+
+	c, err := ldap.Dial(srv.URL(), time.Second)
+	if err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	if err = c.StartTLS(&tls.Config{ServerName: "127.0.0.1"}); err == nil {
+		t.Errorf("starttls succeeded on a server without it")
+	}
+	c.Close()
+
+	roots, err := srv.EnableStartTLS()
+	if err != nil {
+		t.Fatalf("failed to enable starttls: %v", err)
+	}
+	c, err = ldap.Dial(srv.URL(), time.Second)
+	if err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	defer c.Close()
+	if err = c.StartTLS(&tls.Config{ServerName: "127.0.0.1", RootCAs: roots}); err != nil {
+		t.Fatalf("failed to start tls: %v", err)
+	}
+	if err = c.Bind("uid=alice,ou=people,dc=example", "secret"); err != nil || !srv.Upgraded() {
+		t.Errorf("failed to bind over tls: %v", err)
+	}
+}
@@ -0,0 +1,308 @@
+// Package ldaptest provides a stand-in LDAP directory for tests.
+package ldaptest
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"github.com/SeraphJACK/go-annil/ldap"
+	"github.com/SeraphJACK/go-annil/ldap/ber"
+	"math/big"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	resultProtocolError      = 2
+	resultInsufficientAccess = 50
+)
+
+type entry struct {
+	dn       string
+	password string
+	attrs    map[string][]string
+}
+
+// Server is a directory listening on a local port. It supports simple binds and
+// subtree searches, which are only allowed on connections bound with a password.
+type Server struct {
+	listener net.Listener
+
+	mu      sync.Mutex
+	entries []entry
+	tls     *tls.Config
+	// Set once a connection completed StartTLS
+	upgraded bool
+}
+
+func NewServer() (*Server, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	s := &Server{listener: l}
+	go s.serve()
+	return s, nil
+}
+
+// URL returns the ldap:// URL of the server.
+func (s *Server) URL() string {
+	return "ldap://" + s.listener.Addr().String()
+}
+
+func (s *Server) Close() {
+	_ = s.listener.Close()
+}
+
+// EnableStartTLS lets clients upgrade connections with a self-signed certificate for 127.0.0.1,
+// which is returned to verify the server with.
+func (s *Server) EnableStartTLS() (*x509.CertPool, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "ldaptest"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IsCA:         true,
+
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	s.mu.Lock()
+	s.tls = &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}}
+	s.mu.Unlock()
+	return pool, nil
+}
+
+// Upgraded reports whether a client completed StartTLS.
+func (s *Server) Upgraded() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.upgraded
+}
+
+// Add adds an entry, which can be bound to with password unless it is empty.
+func (s *Server) Add(dn, password string, attrs map[string][]string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.entries = append(s.entries, entry{dn: dn, password: password, attrs: attrs})
+}
+
+func (s *Server) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		go s.handle(conn)
+	}
+}
+
+func (s *Server) handle(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	bound := false
+	for {
+		msg, err := ber.Read(r)
+		if err != nil || len(msg.Children) < 2 {
+			return
+		}
+		id := msg.Children[0].Int()
+		op := msg.Children[1]
+		reply := func(ops ...*ber.Packet) {
+			for _, o := range ops {
+				_, _ = conn.Write(ber.Sequence(ber.TagSequence, ber.Int(ber.TagInteger, id), o).Bytes())
+			}
+		}
+		switch op.Tag {
+		case ldap.OpBindRequest:
+			dn, password := op.Child(1).Str(), op.Child(2).Str()
+			code := ldap.ResultInvalidCredentials
+			if password == "" {
+				// Unauthenticated bind
+				code, bound = ldap.ResultSuccess, false
+			} else if s.bind(dn, password) {
+				code, bound = ldap.ResultSuccess, true
+			}
+			reply(result(ldap.OpBindResponse, code))
+		case ldap.OpSearchRequest:
+			if !bound {
+				reply(result(ldap.OpSearchResultDone, resultInsufficientAccess))
+				continue
+			}
+			ops := make([]*ber.Packet, 0)
+			for _, e := range s.search(op.Child(0).Str(), op.Child(6)) {
+				ops = append(ops, encodeEntry(e, op.Child(7)))
+			}
+			reply(append(ops, result(ldap.OpSearchResultDone, ldap.ResultSuccess))...)
+		case ldap.OpExtendedRequest:
+			s.mu.Lock()
+			config := s.tls
+			s.mu.Unlock()
+			if op.Child(0).Str() != ldap.OIDStartTLS || config == nil {
+				reply(result(ldap.OpExtendedResponse, resultProtocolError))
+				continue
+			}
+			reply(result(ldap.OpExtendedResponse, ldap.ResultSuccess))
+			tc := tls.Server(conn, config)
+			if tc.Handshake() != nil {
+				return
+			}
+			conn, r = tc, bufio.NewReader(tc)
+			s.mu.Lock()
+			s.upgraded = true
+			s.mu.Unlock()
+		case ldap.OpUnbindRequest:
+			return
+		}
+	}
+}
+
+func (s *Server) bind(dn, password string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, e := range s.entries {
+		if strings.EqualFold(e.dn, dn) {
+			return e.password != "" && e.password == password
+		}
+	}
+	return false
+}
+
+func (s *Server) search(base string, filter *ber.Packet) []entry {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ret := make([]entry, 0)
+	for _, e := range s.entries {
+		if strings.HasSuffix(strings.ToLower(e.dn), strings.ToLower(base)) && match(e, filter) {
+			ret = append(ret, e)
+		}
+	}
+	return ret
+}
+
+func match(e entry, f *ber.Packet) bool {
+	if f == nil {
+		return false
+	}
+	switch f.Tag {
+	case ldap.FilterAnd:
+		for _, c := range f.Children {
+			if !match(e, c) {
+				return false
+			}
+		}
+		return true
+	case ldap.FilterOr:
+		for _, c := range f.Children {
+			if match(e, c) {
+				return true
+			}
+		}
+		return false
+	case ldap.FilterNot:
+		return !match(e, f.Child(0))
+	case ldap.FilterPresent:
+		return len(values(e, f.Str())) > 0
+	case ldap.FilterEquality, ldap.FilterApprox:
+		for _, v := range values(e, f.Child(0).Str()) {
+			if strings.EqualFold(v, f.Child(1).Str()) {
+				return true
+			}
+		}
+	case ldap.FilterSubstrings:
+		for _, v := range values(e, f.Child(0).Str()) {
+			if matchSubstrings(strings.ToLower(v), f.Child(1)) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func matchSubstrings(v string, subs *ber.Packet) bool {
+	for _, s := range subs.Children {
+		part := strings.ToLower(s.Str())
+		switch s.Tag {
+		case ldap.SubstringInitial:
+			if !strings.HasPrefix(v, part) {
+				return false
+			}
+			v = v[len(part):]
+		case ldap.SubstringAny:
+			i := strings.Index(v, part)
+			if i < 0 {
+				return false
+			}
+			v = v[i+len(part):]
+		case ldap.SubstringFinal:
+			return strings.HasSuffix(v, part)
+		}
+	}
+	return true
+}
+
+func values(e entry, attr string) []string {
+	for k, v := range e.attrs {
+		if strings.EqualFold(k, attr) {
+			return v
+		}
+	}
+	return nil
+}
+
+func encodeEntry(e entry, attrs *ber.Packet) *ber.Packet {
+	list := ber.Sequence(ber.TagSequence)
+	for name, vals := range e.attrs {
+		if !requested(name, attrs) {
+			continue
+		}
+		set := ber.Sequence(ber.TagSet)
+		for _, v := range vals {
+			set.Children = append(set.Children, ber.String(ber.TagOctetString, v))
+		}
+		list.Children = append(list.Children, ber.Sequence(ber.TagSequence, ber.String(ber.TagOctetString, name), set))
+	}
+	return ber.Sequence(ldap.OpSearchResultItem, ber.String(ber.TagOctetString, e.dn), list)
+}
+
+func requested(name string, attrs *ber.Packet) bool {
+	if attrs == nil || len(attrs.Children) == 0 {
+		return true
+	}
+	for _, a := range attrs.Children {
+		if a.Str() == "*" || strings.EqualFold(a.Str(), name) {
+			return true
+		}
+	}
+	return false
+}
+
+func result(tag byte, code int) *ber.Packet {
+	return ber.Sequence(tag,
+		ber.Int(ber.TagEnumerated, int64(code)),
+		ber.String(ber.TagOctetString, ""),
+		ber.String(ber.TagOctetString, ""),
+	)
+}
@@ -0,0 +1,303 @@
+// Package logging writes leveled, structured log records as logfmt or JSON lines.
+// Values of keys which may hold secrets, and anything that looks like a token, are redacted.
+package logging
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type Level int
+
+const (
+	Debug Level = iota
+	Info
+	Warn
+	Error
+)
+
+var levelNames = []string{"debug", "info", "warn", "error"}
+
+func (l Level) String() string {
+	if l < Debug || l > Error {
+		return "unknown"
+	}
+	return levelNames[l]
+}
+
+// ParseLevel parses debug, info, warn or error.
+func ParseLevel(s string) (Level, error) {
+	for i, n := range levelNames {
+		if strings.EqualFold(s, n) {
+			return Level(i), nil
+		}
+	}
+	return Info, fmt.Errorf("unknown log level %q", s)
+}
+
+const (
+	FormatLogfmt = "logfmt"
+	FormatJSON   = "json"
+)
+
+// Logger writes records at or above its level. Loggers derived with With share the output.
+type Logger struct {
+	out    *output
+	level  Level
+	fields []interface{}
+}
+
+type output struct {
+	mu     sync.Mutex
+	w      io.Writer
+	format string
+}
+
+// New creates a logger writing to w in format, logfmt unless it is FormatJSON.
+func New(w io.Writer, level Level, format string) *Logger {
+	if format != FormatJSON {
+		format = FormatLogfmt
+	}
+	return &Logger{out: &output{w: w, format: format}, level: level}
+}
+
+var (
+	defMu sync.RWMutex
+	def   = New(os.Stderr, Info, FormatLogfmt)
+)
+
+// Default returns the logger used when a context carries none.
+func Default() *Logger {
+	defMu.RLock()
+	defer defMu.RUnlock()
+	return def
+}
+
+func SetDefault(l *Logger) {
+	defMu.Lock()
+	def = l
+	defMu.Unlock()
+}
+
+// With returns a logger adding the key value pairs kv to every record.
+func (l *Logger) With(kv ...interface{}) *Logger {
+	fields := make([]interface{}, 0, len(l.fields)+len(kv))
+	fields = append(fields, l.fields...)
+	fields = append(fields, kv...)
+	return &Logger{out: l.out, level: l.level, fields: fields}
+}
+
+// Enabled reports whether records of level are written.
+func (l *Logger) Enabled(level Level) bool {
+	return level >= l.level
+}
+
+func (l *Logger) Debug(msg string, kv ...interface{}) { l.Log(Debug, msg, kv...) }
+func (l *Logger) Info(msg string, kv ...interface{})  { l.Log(Info, msg, kv...) }
+func (l *Logger) Warn(msg string, kv ...interface{})  { l.Log(Warn, msg, kv...) }
+func (l *Logger) Error(msg string, kv ...interface{}) { l.Log(Error, msg, kv...) }
+
+// Errorf logs a formatted message, for call sites which describe the failure in the message.
+func (l *Logger) Errorf(format string, args ...interface{}) {
+	l.Log(Error, strings.TrimSuffix(fmt.Sprintf(format, args...), "\n"))
+}
+
+func (l *Logger) Warnf(format string, args ...interface{}) {
+	l.Log(Warn, strings.TrimSuffix(fmt.Sprintf(format, args...), "\n"))
+}
+
+func (l *Logger) Infof(format string, args ...interface{}) {
+	l.Log(Info, strings.TrimSuffix(fmt.Sprintf(format, args...), "\n"))
+}
+
+// Log writes a record with the fields of l followed by the key value pairs kv.
+func (l *Logger) Log(level Level, msg string, kv ...interface{}) {
+	if !l.Enabled(level) {
+		return
+	}
+	all := make([]interface{}, 0, 6+len(l.fields)+len(kv))
+	all = append(all, "time", time.Now().UTC().Format(time.RFC3339Nano), "level", level.String(), "msg", Scrub(msg))
+	all = append(all, l.fields...)
+	all = append(all, kv...)
+	if len(all)%2 != 0 {
+		all = append(all, "(missing)")
+	}
+	var b bytes.Buffer
+	if l.out.format == FormatJSON {
+		writeJSON(&b, all)
+	} else {
+		writeLogfmt(&b, all)
+	}
+	b.WriteByte('\n')
+	l.out.mu.Lock()
+	_, _ = l.out.w.Write(b.Bytes())
+	l.out.mu.Unlock()
+}
+
+func writeLogfmt(b *bytes.Buffer, kv []interface{}) {
+	for i := 0; i < len(kv); i += 2 {
+		if i > 0 {
+			b.WriteByte(' ')
+		}
+		key := fmt.Sprint(kv[i])
+		b.WriteString(key)
+		b.WriteByte('=')
+		v := value(key, kv[i+1])
+		if v == "" || strings.ContainsAny(v, " =\"\\\n\t") {
+			v = strconv.Quote(v)
+		}
+		b.WriteString(v)
+	}
+}
+
+func writeJSON(b *bytes.Buffer, kv []interface{}) {
+	b.WriteByte('{')
+	for i := 0; i < len(kv); i += 2 {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		key := fmt.Sprint(kv[i])
+		k, _ := json.Marshal(key)
+		b.Write(k)
+		b.WriteByte(':')
+		var v []byte
+		switch x := kv[i+1].(type) {
+		case bool, int, int64, uint64, float64:
+			v, _ = json.Marshal(x)
+		case time.Duration:
+			v, _ = json.Marshal(x.Seconds())
+		default:
+			v, _ = json.Marshal(value(key, x))
+		}
+		if sensitive(key) {
+			v, _ = json.Marshal(redacted)
+		}
+		b.Write(v)
+	}
+	b.WriteByte('}')
+}
+
+// value formats v, redacted if key may hold a secret.
+func value(key string, v interface{}) string {
+	if sensitive(key) {
+		return redacted
+	}
+	switch x := v.(type) {
+	case error:
+		if x == nil {
+			return "<nil>"
+		}
+		return Scrub(x.Error())
+	case time.Duration:
+		return strconv.FormatFloat(x.Seconds(), 'f', -1, 64)
+	case fmt.Stringer:
+		return Scrub(x.String())
+	case string:
+		return Scrub(x)
+	}
+	return Scrub(fmt.Sprint(v))
+}
+
+const redacted = "[REDACTED]"
+
+var sensitiveKeys = []string{"authorization", "cookie", "password", "secret", "token", "ticket"}
+
+// sensitive reports whether values of key may hold a secret.
+func sensitive(key string) bool {
+	key = strings.ToLower(key)
+	for _, s := range sensitiveKeys {
+		if strings.Contains(key, s) {
+			return true
+		}
+	}
+	return false
+}
+
+var tokenExp = regexp.MustCompile(`(?i)\bbearer\s+\S+|\b[A-Za-z0-9_-]{8,}\.[A-Za-z0-9_-]{8,}\.[A-Za-z0-9_-]{8,}\b`)
+
+// Scrub redacts bearer credentials and JWTs in s.
+func Scrub(s string) string {
+	return tokenExp.ReplaceAllString(s, redacted)
+}
+
+// Query formats a URL query with the values of sensitive parameters, and OAuth codes, redacted.
+func Query(q map[string][]string) string {
+	keys := make([]string, 0, len(q))
+	for k := range q {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	parts := make([]string, 0, len(keys))
+	for _, k := range keys {
+		for _, v := range q[k] {
+			if sensitive(k) || k == "code" || k == "state" {
+				v = redacted
+			}
+			parts = append(parts, k+"="+Scrub(v))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+type contextKey int
+
+const (
+	loggerKey contextKey = iota
+	requestIDKey
+)
+
+// NewContext returns a context carrying l.
+func NewContext(ctx context.Context, l *Logger) context.Context {
+	return context.WithValue(ctx, loggerKey, l)
+}
+
+// FromContext returns the logger of ctx, or the default logger.
+func FromContext(ctx context.Context) *Logger {
+	if ctx != nil {
+		if l, ok := ctx.Value(loggerKey).(*Logger); ok {
+			return l
+		}
+	}
+	return Default()
+}
+
+// WithRequestID returns a context carrying the request id, and a logger adding it to records.
+func WithRequestID(ctx context.Context, id string) context.Context {
+	ctx = context.WithValue(ctx, requestIDKey, id)
+	return NewContext(ctx, FromContext(ctx).With("request_id", id))
+}
+
+// RequestID returns the request id of ctx, empty if there is none.
+func RequestID(ctx context.Context) string {
+	if ctx == nil {
+		return ""
+	}
+	id, _ := ctx.Value(requestIDKey).(string)
+	return id
+}
+
+// Writer adapts l for writers which don't log through it, such as the standard log package.
+// Every write is a record at level.
+func Writer(l *Logger, level Level) io.Writer {
+	return stdWriter{l, level}
+}
+
+type stdWriter struct {
+	l     *Logger
+	level Level
+}
+
+func (w stdWriter) Write(p []byte) (int, error) {
+	w.l.Log(w.level, strings.TrimRight(string(p), "\n"))
+	return len(p), nil
+}
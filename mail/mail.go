@@ -0,0 +1,186 @@
+// Package mail sends templated plain text messages over SMTP.
+package mail
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"mime/quotedprintable"
+	"net"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+)
+
+type Config struct {
+	Host     string
+	Port     int
+	Username string
+	Password string
+	// Sender address
+	From string
+	// Connect with TLS instead of upgrading the connection with STARTTLS
+	TLS bool
+	// Directory with <name>.txt templates overriding the built-in ones
+	TemplateDir string
+}
+
+// Built-in templates, the subject is defined in the subject template.
+var builtin = map[string]string{
+	"verify": `{{define "subject"}}Verify your email address{{end}}Hi {{.Username}},
+
+please open the link below within {{.Valid}} to verify that this is your email address:
+
+{{.URL}}
+
+If you did not add this address to your account, ignore this message.
+`,
+	"reset": `{{define "subject"}}Reset your password{{end}}Hi {{.Username}},
+
+someone asked to reset the password of your account. Open the link below within {{.Valid}} to choose a new one:
+
+{{.URL}}
+
+If it was not you, ignore this message and your password stays the same.
+`,
+}
+
+const timeout = 10 * time.Second
+
+// Mailer sends messages from templates.
+type Mailer struct {
+	cfg       Config
+	templates map[string]*template.Template
+}
+
+// New parses the templates, preferring those in cfg.TemplateDir.
+func New(cfg Config) (*Mailer, error) {
+	m := &Mailer{cfg: cfg, templates: make(map[string]*template.Template)}
+	for name, text := range builtin {
+		if cfg.TemplateDir != "" {
+			b, err := ioutil.ReadFile(filepath.Join(cfg.TemplateDir, name+".txt"))
+			if err == nil {
+				text = string(b)
+			} else if !os.IsNotExist(err) {
+				return nil, err
+			}
+		}
+		t, err := template.New(name).Parse(text)
+		if err != nil {
+			return nil, fmt.Errorf("invalid template %s: %v", name, err)
+		}
+		if t.Lookup("subject") == nil {
+			return nil, fmt.Errorf("template %s defines no subject", name)
+		}
+		m.templates[name] = t
+	}
+	return m, nil
+}
+
+// Send renders template name with data and sends it to the address to.
+func (m *Mailer) Send(to, name string, data interface{}) error {
+	if strings.ContainsAny(to, "\r\n") {
+		return errors.New("invalid recipient")
+	}
+	msg, err := m.render(to, name, data)
+	if err != nil {
+		return err
+	}
+	c, err := m.dial()
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	if m.cfg.Username != "" {
+		// PlainAuth refuses to send the password over unencrypted connections to other hosts
+		err = c.Auth(smtp.PlainAuth("", m.cfg.Username, m.cfg.Password, m.cfg.Host))
+		if err != nil {
+			return err
+		}
+	}
+	if err = c.Mail(m.cfg.From); err != nil {
+		return err
+	}
+	if err = c.Rcpt(to); err != nil {
+		return err
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err = w.Write(msg); err != nil {
+		return err
+	}
+	if err = w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
+func (m *Mailer) render(to, name string, data interface{}) ([]byte, error) {
+	t, ok := m.templates[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown template %s", name)
+	}
+	var subject, body bytes.Buffer
+	if err := t.ExecuteTemplate(&subject, "subject", data); err != nil {
+		return nil, err
+	}
+	if err := t.Execute(&body, data); err != nil {
+		return nil, err
+	}
+
+	var msg bytes.Buffer
+	header := func(k, v string) {
+		msg.WriteString(k + ": " + v + "\r\n")
+	}
+	header("From", m.cfg.From)
+	header("To", to)
+	header("Subject", mime.QEncoding.Encode("utf-8", strings.TrimSpace(subject.String())))
+	header("Date", time.Now().Format(time.RFC1123Z))
+	header("MIME-Version", "1.0")
+	header("Content-Type", "text/plain; charset=utf-8")
+	header("Content-Transfer-Encoding", "quoted-printable")
+	msg.WriteString("\r\n")
+	w := quotedprintable.NewWriter(&msg)
+	_, _ = w.Write(bytes.ReplaceAll(body.Bytes(), []byte("\n"), []byte("\r\n")))
+	_ = w.Close()
+	return msg.Bytes(), nil
+}
+
+func (m *Mailer) dial() (*smtp.Client, error) {
+	addr := net.JoinHostPort(m.cfg.Host, strconv.Itoa(m.cfg.Port))
+	tlsCfg := &tls.Config{ServerName: m.cfg.Host}
+	var conn net.Conn
+	var err error
+	if m.cfg.TLS {
+		conn, err = tls.DialWithDialer(&net.Dialer{Timeout: timeout}, "tcp", addr, tlsCfg)
+	} else {
+		conn, err = net.DialTimeout("tcp", addr, timeout)
+	}
+	if err != nil {
+		return nil, err
+	}
+	_ = conn.SetDeadline(time.Now().Add(timeout))
+	c, err := smtp.NewClient(conn, m.cfg.Host)
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	if !m.cfg.TLS {
+		if ok, _ := c.Extension("STARTTLS"); ok {
+			if err = c.StartTLS(tlsCfg); err != nil {
+				_ = c.Close()
+				return nil, err
+			}
+		}
+	}
+	return c, nil
+}
@@ -0,0 +1,63 @@
+package mail
+
+import (
+	"github.com/SeraphJACK/go-annil/mail/mailtest"
+	"io/ioutil"
+	"mime/quotedprintable"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSend(t *testing.T) {
+	sink, err := mailtest.NewSink()
+	if err != nil {
+		t.Fatalf("failed to start sink: %v", err)
+	}
+	defer sink.Close()
+	cfg := Config{Host: sink.Host(), Port: sink.Port(), From: "annil@example.com"}
+	m, err := New(cfg)
+	if err != nil {
+		t.Fatalf("failed to create mailer: %v", err)
+	}
+	data := map[string]string{"Username": "alice", "URL": "https://annil.example/reset-password?token=abc", "Valid": "1h0m0s"}
+	if err = m.Send("alice@example.com", "reset", data); err != nil {
+		t.Fatalf("failed to send: %v", err)
+	}
+	msg, err := sink.Next(time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.From != "annil@example.com" || len(msg.To) != 1 || msg.To[0] != "alice@example.com" {
+		t.Errorf("wrong envelope: %v", msg)
+	}
+	parts := strings.SplitN(msg.Data, "\n\n", 2)
+	if !strings.Contains(parts[0], "Subject: Reset your password") {
+		t.Errorf("wrong headers: %s", parts[0])
+	}
+	body, _ := ioutil.ReadAll(quotedprintable.NewReader(strings.NewReader(parts[1])))
+	if !strings.Contains(string(body), data["URL"]) || !strings.Contains(string(body), "Hi alice") {
+		t.Errorf("wrong body: %s", body)
+	}
+	if err = m.Send("a@example.com\r\nBcc: b@example.com", "reset", data); err == nil {
+		t.Errorf("accepted a recipient with a line break")
+	}
+
+	// Templates in the template directory override the built-in ones
+	cfg.TemplateDir = t.TempDir()
+	_ = ioutil.WriteFile(filepath.Join(cfg.TemplateDir, "verify.txt"), []byte(`{{define "subject"}}Willkommen{{end}}Hallo {{.Username}}`), 0644)
+	if m, err = New(cfg); err != nil {
+		t.Fatalf("failed to load templates: %v", err)
+	}
+	if err = m.Send("alice@example.com", "verify", data); err != nil {
+		t.Fatalf("failed to send: %v", err)
+	}
+	if msg, _ = sink.Next(time.Second); !strings.Contains(msg.Data, "Subject: Willkommen") || !strings.Contains(msg.Data, "Hallo alice") {
+		t.Errorf("template not overridden: %s", msg.Data)
+	}
+	_ = ioutil.WriteFile(filepath.Join(cfg.TemplateDir, "reset.txt"), []byte(`no subject`), 0644)
+	if _, err = New(cfg); err == nil {
+		t.Errorf("accepted a template without subject")
+	}
+}
@@ -0,0 +1,120 @@
+// Package mailtest provides an SMTP server which keeps the messages it receives, for tests.
+package mailtest
+
+import (
+	"errors"
+	"net"
+	"net/textproto"
+	"strings"
+	"time"
+)
+
+// Message is a received message.
+type Message struct {
+	From string
+	To   []string
+	Data string
+}
+
+// Sink accepts every message without authentication or TLS.
+type Sink struct {
+	listener net.Listener
+	messages chan Message
+}
+
+func NewSink() (*Sink, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	s := &Sink{listener: l, messages: make(chan Message, 100)}
+	go s.serve()
+	return s, nil
+}
+
+func (s *Sink) Host() string {
+	return s.listener.Addr().(*net.TCPAddr).IP.String()
+}
+
+func (s *Sink) Port() int {
+	return s.listener.Addr().(*net.TCPAddr).Port
+}
+
+func (s *Sink) Close() {
+	_ = s.listener.Close()
+}
+
+// Next waits for the next message.
+func (s *Sink) Next(timeout time.Duration) (Message, error) {
+	select {
+	case m := <-s.messages:
+		return m, nil
+	case <-time.After(timeout):
+		return Message{}, errors.New("no message received")
+	}
+}
+
+func (s *Sink) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		go s.handle(conn)
+	}
+}
+
+func (s *Sink) handle(conn net.Conn) {
+	defer conn.Close()
+	c := textproto.NewConn(conn)
+	_ = c.PrintfLine("220 mailtest ready")
+	var m Message
+	for {
+		line, err := c.ReadLine()
+		if err != nil {
+			return
+		}
+		verb := strings.ToUpper(strings.SplitN(line, " ", 2)[0])
+		arg := strings.TrimSpace(line[len(verb):])
+		switch verb {
+		case "EHLO", "HELO":
+			_ = c.PrintfLine("250 mailtest")
+		case "MAIL":
+			m = Message{From: address(arg)}
+			_ = c.PrintfLine("250 OK")
+		case "RCPT":
+			m.To = append(m.To, address(arg))
+			_ = c.PrintfLine("250 OK")
+		case "DATA":
+			_ = c.PrintfLine("354 Go ahead")
+			data, err := c.ReadDotBytes()
+			if err != nil {
+				return
+			}
+			m.Data = string(data)
+			s.messages <- m
+			_ = c.PrintfLine("250 OK")
+		case "RSET":
+			m = Message{}
+			_ = c.PrintfLine("250 OK")
+		case "NOOP":
+			_ = c.PrintfLine("250 OK")
+		case "QUIT":
+			_ = c.PrintfLine("221 Bye")
+			return
+		default:
+			_ = c.PrintfLine("502 %s not implemented", verb)
+		}
+	}
+}
+
+// address strips the FROM:<...> or TO:<...> around an address.
+func address(arg string) string {
+	if i := strings.IndexByte(arg, '<'); i >= 0 {
+		arg = arg[i+1:]
+	}
+	if i := strings.IndexByte(arg, '>'); i >= 0 {
+		arg = arg[:i]
+	}
+	return arg
+}
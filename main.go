@@ -1,35 +1,339 @@
 package main
 
 import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"flag"
 	"fmt"
 	"github.com/SeraphJACK/go-annil/config"
 	"github.com/SeraphJACK/go-annil/http"
+	"github.com/SeraphJACK/go-annil/logging"
 	"github.com/SeraphJACK/go-annil/storage"
+	"github.com/SeraphJACK/go-annil/tracing"
+	"io/ioutil"
+	"log"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
+	"time"
 )
 
 func main() {
-	err := config.Init()
+	configPath := flag.String("config", envOr("ANNIL_CONFIG", "config.yml"), "path of the config file")
+	flag.Usage = usage
+	flag.Parse()
+	args := flag.Args()
+	if len(args) == 0 {
+		args = []string{"serve"}
+	}
+	cmd, ok := commands[args[0]]
+	if !ok {
+		usage()
+		os.Exit(2)
+	}
+	// config check reports problems itself
+	if args[0] != "config" {
+		if err := loadConfig(args[0], *configPath); err != nil {
+			_, _ = fmt.Fprintf(os.Stderr, "Failed to read config:\n%v\n", err)
+			os.Exit(1)
+		}
+		setupLogging(config.Cfg.Log)
+	}
+	os.Exit(cmd(*configPath, args[1:]))
+}
+
+// loadConfig reads the config file of command. Only the server creates a missing file, admin
+// commands run in the wrong directory would otherwise work on a new, empty database.
+func loadConfig(command, path string) error {
+	if command == "serve" {
+		return config.Init(path)
+	}
+	err := config.Load(path)
+	if os.IsNotExist(err) {
+		return fmt.Errorf("%s does not exist, pass the config of the server with --config", path)
+	}
+	return err
+}
+
+// serve runs the server until it is stopped by a signal.
+func serve(_ string, args []string) int {
+	if len(args) > 0 {
+		return usageError("serve takes no arguments")
+	}
+	tracer, err := setupTracing(config.Cfg.Tracing)
 	if err != nil {
-		_, _ = fmt.Fprintf(os.Stderr, "Failed to read config: %v\n", err)
-		os.Exit(1)
+		_, _ = fmt.Fprintf(os.Stderr, "Failed to set up tracing: %v\n", err)
+		return 1
 	}
-	err = storage.Init()
+	store, err := openStore()
 	if err != nil {
 		_, _ = fmt.Fprintf(os.Stderr, "Failed to initialize database: %v\n", err)
-		os.Exit(1)
+		return 1
 	}
+	s, err := http.Init(store)
+	if err != nil {
+		_, _ = fmt.Fprintf(os.Stderr, "Failed to start http server: %v\n", err)
+		_ = store.Close()
+		return 1
+	}
+	errs := make(chan error, 1)
 	go func() {
-		err = http.Init()
-		if err != nil {
-			_, _ = fmt.Fprintf(os.Stderr, "Failed to start http server: %v\n", err)
-			os.Exit(1)
-		}
+		errs <- s.ListenAndServe(config.Cfg.Listen)
 	}()
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
-	_ = <-sigChan
-	os.Exit(0)
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	for {
+		select {
+		case err = <-errs:
+			_, _ = fmt.Fprintf(os.Stderr, "Failed to start http server: %v\n", err)
+			_ = store.Close()
+			return 1
+		case <-hup:
+			reload(s)
+		case <-sigChan:
+			return shutdown(s, store, tracer, sigChan)
+		}
+	}
+}
+
+// reload applies the backends of the config file on SIGHUP.
+func reload(s *http.Server) {
+	res, err := s.ReloadFile()
+	if err != nil {
+		logging.Default().Error("Failed to reload config, keeping the current one", "err", err)
+		return
+	}
+	logging.Default().Info("Reloaded config", "backends", strings.Join(res.Backends, ","))
+	if len(res.RestartRequired) > 0 {
+		logging.Default().Warn("Changed settings need a restart to apply", "settings", strings.Join(res.RestartRequired, ","))
+	}
+}
+
+// shutdown drains the server, then exports remaining spans and closes the database,
+// which holds the sessions. A second signal cuts draining short.
+func shutdown(s *http.Server, store storage.Store, tracer *tracing.Tracer, sig <-chan os.Signal) int {
+	logging.Default().Info("Shutting down, waiting for in-flight requests")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-sig:
+			logging.Default().Warn("Cutting off in-flight requests")
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	code := 0
+	if err := s.Shutdown(ctx); err != nil {
+		logging.Default().Error("Failed to drain connections", "err", err)
+		code = 1
+	}
+	tctx, tcancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer tcancel()
+	if err := tracer.Shutdown(tctx); err != nil {
+		logging.Default().Error("Failed to export remaining spans", "err", err)
+	}
+	if err := store.Close(); err != nil {
+		logging.Default().Error("Failed to close database", "err", err)
+		code = 1
+	}
+	return code
+}
+
+func envOr(name, def string) string {
+	if v := os.Getenv(name); v != "" {
+		return v
+	}
+	return def
+}
+
+// setupLogging makes the configured logger the default, also for the standard log package.
+func setupLogging(cfg config.LogConfig) {
+	level, err := logging.ParseLevel(cfg.Level)
+	l := logging.New(os.Stderr, level, cfg.Format)
+	logging.SetDefault(l)
+	log.SetFlags(0)
+	log.SetOutput(logging.Writer(l, logging.Info))
+	if err != nil {
+		l.Warn("Invalid log level, logging at info level", "err", err)
+	}
+}
+
+// setupTracing makes a tracer with the configured exporter the default, nil if tracing is disabled.
+func setupTracing(cfg config.TracingConfig) (*tracing.Tracer, error) {
+	if !cfg.Enabled {
+		return nil, nil
+	}
+	var e tracing.Exporter
+	switch cfg.Exporter {
+	case "stdout", "":
+		e = tracing.NewWriterExporter(os.Stdout)
+	case "file":
+		if cfg.File == "" {
+			return nil, fmt.Errorf("the file exporter needs a file")
+		}
+		f, err := tracing.OpenFileExporter(cfg.File)
+		if err != nil {
+			return nil, err
+		}
+		e = f
+	case "otlp":
+		o := tracing.NewOTLPExporter(cfg.Endpoint, "go-annil")
+		o.OnError = func(err error) {
+			logging.Default().Error("Failed to export spans", "err", err)
+		}
+		e = o
+	default:
+		return nil, fmt.Errorf("unknown tracing exporter: %s", cfg.Exporter)
+	}
+	t := tracing.New(e, cfg.SampleRatio)
+	tracing.SetDefault(t)
+	return t, nil
+}
+
+// openStore opens and migrates the configured database, and creates the owner on first run.
+func openStore() (storage.Store, error) {
+	store, err := openDatabase()
+	if err != nil {
+		return nil, err
+	}
+	err = bootstrap(store)
+	if err != nil {
+		_ = store.Close()
+		return nil, err
+	}
+	return store, nil
+}
+
+const (
+	adminUsername = "Admin"
+	// Password of the owner of instances created before first-run bootstrap shipped
+	legacyPassword = "12345"
+)
+
+// bootstrap creates the owner account on first run, which has to change its password at first login.
+func bootstrap(store storage.Store) error {
+	n, err := store.CountUsers()
+	if err != nil {
+		return fmt.Errorf("failed to count users: %v", err)
+	}
+	if n > 0 {
+		if store.CheckPassword(adminUsername, legacyPassword) {
+			return replaceLegacyPassword(store)
+		}
+		return nil
+	}
+	password, err := adminPassword()
+	if err != nil {
+		return err
+	}
+	if password == "" {
+		switch config.Cfg.Bootstrap {
+		case "setup":
+			logging.Default().Info("No users exist, create the owner account with POST /api/setup")
+			return nil
+		case "random", "":
+			password, err = randomPassword()
+			if err != nil {
+				return err
+			}
+			fmt.Printf("Created owner account %s with one-time password: %s\n", adminUsername, password)
+		default:
+			return fmt.Errorf("unknown bootstrap mode: %s", config.Cfg.Bootstrap)
+		}
+	}
+	return storage.CreateOwner(store, adminUsername, password, true)
+}
+
+// replaceLegacyPassword replaces the well-known password of the owner of an upgraded instance,
+// which anyone could otherwise log in with, like the password of a fresh instance is chosen.
+func replaceLegacyPassword(store storage.Store) error {
+	password, err := adminPassword()
+	if err != nil {
+		return err
+	}
+	if password == legacyPassword {
+		return fmt.Errorf("ANNIL_ADMIN_PASSWORD must not be the former default password")
+	}
+	if password == "" {
+		password, err = randomPassword()
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%s used the former default password, its one-time password is now: %s\n", adminUsername, password)
+	} else {
+		logging.Default().Warn("The owner used the former default password, it is now set from ANNIL_ADMIN_PASSWORD", "username", adminUsername)
+	}
+	err = store.ChangePassword(adminUsername, password)
+	if err != nil {
+		return err
+	}
+	return store.SetMustChangePassword(adminUsername, true)
+}
+
+// adminPassword reads the initial owner password from the environment, empty if not set.
+func adminPassword() (string, error) {
+	if p := os.Getenv("ANNIL_ADMIN_PASSWORD"); p != "" {
+		return p, nil
+	}
+	if f := os.Getenv("ANNIL_ADMIN_PASSWORD_FILE"); f != "" {
+		b, err := ioutil.ReadFile(f)
+		if err != nil {
+			return "", fmt.Errorf("failed to read admin password file: %v", err)
+		}
+		return strings.TrimSpace(string(b)), nil
+	}
+	return "", nil
+}
+
+func randomPassword() (string, error) {
+	b := make([]byte, 12)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// migrate implements `go-annil migrate [status|up]`.
+func migrate(_ string, args []string) int {
+	cmd := "status"
+	if len(args) > 0 {
+		cmd = args[0]
+	}
+	store, err := storage.OpenSQLite(config.Cfg.Database)
+	if err != nil {
+		_, _ = fmt.Fprintf(os.Stderr, "Failed to open database: %v\n", err)
+		return 1
+	}
+	defer store.Close()
+	switch cmd {
+	case "status":
+		states, err := store.MigrationStatus()
+		if err != nil {
+			_, _ = fmt.Fprintf(os.Stderr, "Failed to read migration status: %v\n", err)
+			return 1
+		}
+		for _, s := range states {
+			applied := "pending"
+			if s.Applied {
+				applied = "applied " + time.Unix(s.AppliedAt, 0).Format(time.RFC3339)
+			}
+			fmt.Printf("%4d  %-40s %s\n", s.Version, s.Name, applied)
+		}
+	case "up":
+		err = store.Migrate()
+		if err != nil {
+			_, _ = fmt.Fprintf(os.Stderr, "Failed to migrate database: %v\n", err)
+			return 1
+		}
+		v, _ := store.SchemaVersion()
+		fmt.Printf("Database is at schema version %d\n", v)
+	default:
+		return usageError("usage: migrate [status|up]")
+	}
+	return 0
 }
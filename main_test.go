@@ -0,0 +1,362 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/SeraphJACK/go-annil/config"
+	"github.com/SeraphJACK/go-annil/storage"
+	"github.com/SeraphJACK/go-annil/token"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// setenv sets an environment variable until the end of the test.
+func setenv(t *testing.T, key, value string) {
+	old, ok := os.LookupEnv(key)
+	_ = os.Setenv(key, value)
+	t.Cleanup(func() {
+		if ok {
+			_ = os.Setenv(key, old)
+		} else {
+			_ = os.Unsetenv(key)
+		}
+	})
+}
+
+// capture runs a command and returns what it printed along with its exit code.
+func capture(t *testing.T, run func() int) (string, int) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("failed to create pipe: %v", err)
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+	out := make(chan []byte)
+	go func() {
+		b, _ := ioutil.ReadAll(r)
+		out <- b
+	}()
+	code := run()
+	os.Stdout = stdout
+	_ = w.Close()
+	return string(<-out), code
+}
+
+// audited returns the targets of the events of action recorded by commands.
+func audited(store storage.Store, action string) []string {
+	ret := make([]string, 0)
+	for _, e := range store.QueryAudit(storage.AuditFilter{Action: action}) {
+		if e.Actor == cliActor {
+			ret = append(ret, e.Target)
+		}
+	}
+	return ret
+}
+
+func TestBootstrapLegacyPassword(t *testing.T) {
+	setenv(t, "ANNIL_ADMIN_PASSWORD", "")
+	setenv(t, "ANNIL_ADMIN_PASSWORD_FILE", "")
+	store := storage.NewMemoryStore()
+	if err := storage.CreateOwner(store, adminUsername, legacyPassword, false); err != nil {
+		t.Fatalf("failed to create owner: %v", err)
+	}
+	if err := bootstrap(store); err != nil {
+		t.Fatalf("failed to bootstrap: %v", err)
+	}
+	if store.CheckPassword(adminUsername, legacyPassword) || !store.MustChangePassword(adminUsername) {
+		t.Errorf("former default password kept")
+	}
+
+	setenv(t, "ANNIL_ADMIN_PASSWORD", "chosen")
+	_ = store.ChangePassword(adminUsername, legacyPassword)
+	if err := bootstrap(store); err != nil {
+		t.Fatalf("failed to bootstrap: %v", err)
+	}
+	if !store.CheckPassword(adminUsername, "chosen") {
+		t.Errorf("password not taken from the environment")
+	}
+	// Changed passwords are left alone
+	if err := bootstrap(store); err != nil || !store.CheckPassword(adminUsername, "chosen") {
+		t.Errorf("changed password replaced: %v", err)
+	}
+}
+
+func TestUserCommands(t *testing.T) {
+	store := storage.NewMemoryStore()
+	if err := storage.CreateOwner(store, adminUsername, "owner-pw", false); err != nil {
+		t.Fatalf("failed to create owner: %v", err)
+	}
+
+	if code := userAdd(store, []string{"alice", "-role", storage.RoleAdmin, "-password", "alice-pw"}); code != 0 {
+		t.Fatalf("failed to add user: %d", code)
+	}
+	if !store.CheckPassword("alice", "alice-pw") || store.UserRole("alice") != storage.RoleAdmin || store.MustChangePassword("alice") {
+		t.Errorf("user added with wrong password or role: %s", store.UserRole("alice"))
+	}
+	for _, args := range [][]string{
+		{"alice"},
+		{"bad name"},
+		{"bob", "-role", "nobody"},
+		{"bob", "-password", "1234"},
+		{"bob", "carol"},
+	} {
+		if code := userAdd(store, args); code == 0 {
+			t.Errorf("added user with %v", args)
+		}
+	}
+	if store.UserExists("bob") {
+		t.Errorf("user added by a failed command")
+	}
+	// Without a password a one-time password is generated
+	if code := userAdd(store, []string{"bob"}); code != 0 || !store.MustChangePassword("bob") || store.UserRole("bob") != storage.RoleMember {
+		t.Errorf("failed to add user with a generated password: %d", code)
+	}
+
+	sid, _ := store.NewSession("alice", time.Now().Add(time.Hour))
+	if code := userPasswd(store, []string{"alice", "-password", "new-pw"}); code != 0 {
+		t.Fatalf("failed to change password: %d", code)
+	}
+	if !store.CheckPassword("alice", "new-pw") || store.MustChangePassword("alice") {
+		t.Errorf("password not changed")
+	}
+	if _, err := store.GetSession(sid); err == nil {
+		t.Errorf("sessions kept after a password change")
+	}
+	if code := userPasswd(store, []string{"alice"}); code != 0 || store.CheckPassword("alice", "new-pw") || !store.MustChangePassword("alice") {
+		t.Errorf("failed to reset password: %d", code)
+	}
+	if code := userPasswd(store, []string{"nobody"}); code == 0 {
+		t.Errorf("changed the password of a missing user")
+	}
+
+	if code := userGrant(store, []string{"bob", storage.RoleAdmin}); code != 0 || store.UserRole("bob") != storage.RoleAdmin {
+		t.Errorf("failed to grant role: %d %s", code, store.UserRole("bob"))
+	}
+	if code := userGrant(store, []string{"bob", "nobody"}); code == 0 || store.UserRole("bob") != storage.RoleAdmin {
+		t.Errorf("granted a missing role")
+	}
+	// The last owner stays one
+	if code := userGrant(store, []string{adminUsername, storage.RoleMember}); code == 0 || store.UserRole(adminUsername) != storage.RoleOwner {
+		t.Errorf("demoted the last owner")
+	}
+	if code := userDelete(store, []string{adminUsername}); code == 0 || !store.UserExists(adminUsername) {
+		t.Errorf("deleted the last owner")
+	}
+	if code := userGrant(store, []string{"alice", storage.RoleOwner}); code != 0 {
+		t.Fatalf("failed to grant owner: %d", code)
+	}
+	if code := userGrant(store, []string{adminUsername, storage.RoleMember}); code != 0 || store.UserRole(adminUsername) != storage.RoleMember {
+		t.Errorf("failed to demote an owner who is not the last: %d", code)
+	}
+
+	events := store.QueryAudit(storage.AuditFilter{User: cliActor})
+	if len(events) == 0 || events[0].Actor != cliActor {
+		t.Errorf("changes not audited: %v", events)
+	}
+}
+
+func TestConfigCommands(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "config.yml")
+	if code := configCommand(path, []string{"check"}); code == 0 {
+		t.Errorf("missing config passed the check")
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("config check created the config: %v", err)
+	}
+
+	// Admin commands don't create a config and database in the wrong directory
+	if err := loadConfig("user", path); err == nil {
+		t.Errorf("admin command loaded a missing config")
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("admin command created the config: %v", err)
+	}
+	defer func() { config.Cfg = config.Default() }()
+	if err := loadConfig("serve", path); err != nil {
+		t.Fatalf("server failed to create the config: %v", err)
+	}
+	if code := configCommand(path, []string{"check"}); code != 0 {
+		t.Errorf("created config failed the check: %d", code)
+	}
+	if err := loadConfig("user", path); err != nil {
+		t.Errorf("admin command failed to load the config: %v", err)
+	}
+
+	_ = ioutil.WriteFile(path, []byte("secret: s\nbackends:\n  - type: ftp\n"), 0600)
+	if code := configCommand(path, []string{"check"}); code != 1 {
+		t.Errorf("invalid config passed the check: %d", code)
+	}
+	if code := configCommand(path, []string{"fix"}); code != 2 {
+		t.Errorf("unknown subcommand accepted: %d", code)
+	}
+}
+
+func TestInviteCommands(t *testing.T) {
+	store := storage.NewMemoryStore()
+	_ = store.NewGroup("staff")
+
+	for _, c := range []struct {
+		args []string
+		code int
+	}{
+		{[]string{"-limit", "0"}, 2},
+		{[]string{"-expire-hours", "-1"}, 2},
+		{[]string{"extra"}, 2},
+		{[]string{"-role", "nobody"}, 1},
+		{[]string{"-groups", "staff,nobody"}, 1},
+	} {
+		if _, code := capture(t, func() int { return inviteCreate(store, c.args) }); code != c.code {
+			t.Errorf("invite create %v exited with %d, want %d", c.args, code, c.code)
+		}
+	}
+	if len(store.ListInviteCodes()) != 0 {
+		t.Errorf("invite code created by a failed command")
+	}
+
+	out, code := capture(t, func() int {
+		return inviteCreate(store, []string{"-limit", "2", "-role", storage.RoleMember, "-groups", "staff", "-note", "friends"})
+	})
+	if code != 0 {
+		t.Fatalf("failed to create invite code: %d", code)
+	}
+	created := strings.TrimSpace(out)
+	ic, err := store.GetInviteCode(created)
+	if err != nil || ic.Limit != 2 || ic.Role != storage.RoleMember || len(ic.Groups) != 1 || ic.Creator != cliActor || ic.Note != "friends" {
+		t.Errorf("wrong invite code %q: %+v %v", created, ic, err)
+	}
+
+	if out, code = capture(t, func() int { return inviteList(store, nil) }); code != 0 || !strings.Contains(out, created) || !strings.Contains(out, "0/2") {
+		t.Errorf("wrong invite list: %d %s", code, out)
+	}
+	var codes []storage.InviteCode
+	out, code = capture(t, func() int { return inviteList(store, []string{"-json"}) })
+	if err = json.Unmarshal([]byte(out), &codes); err != nil || code != 0 || len(codes) != 1 || codes[0].Code != created {
+		t.Errorf("wrong invite list json: %d %v %s", code, err, out)
+	}
+
+	if _, code = capture(t, func() int { return inviteRevoke(store, nil) }); code != 2 {
+		t.Errorf("revoke without a code exited with %d", code)
+	}
+	if _, code = capture(t, func() int { return inviteRevoke(store, []string{"nothing"}) }); code != 1 {
+		t.Errorf("revoked a missing code: %d", code)
+	}
+	if _, code = capture(t, func() int { return inviteRevoke(store, []string{created}) }); code != 0 {
+		t.Errorf("failed to revoke invite code: %d", code)
+	}
+	if _, err = store.GetInviteCode(created); err == nil {
+		t.Errorf("invite code kept after revoking it")
+	}
+
+	if got := audited(store, "createInviteCode"); len(got) != 1 || got[0] != created {
+		t.Errorf("wrong audited creations: %v", got)
+	}
+	if got := audited(store, "revokeInviteCode"); len(got) != 1 || got[0] != created {
+		t.Errorf("wrong audited revocations: %v", got)
+	}
+}
+
+func TestTokenCommands(t *testing.T) {
+	defer func() { config.Cfg = config.Default() }()
+	config.Cfg.Secret = "secret"
+	store := storage.NewMemoryStore()
+	_ = store.Register("alice", "alice-pw")
+
+	for _, c := range []struct {
+		args []string
+		code int
+	}{
+		{nil, 2},
+		{[]string{"alice", "-expire-hours", "-1"}, 2},
+		{[]string{"nobody"}, 1},
+	} {
+		if _, code := capture(t, func() int { return tokenIssue(store, c.args) }); code != c.code {
+			t.Errorf("token issue %v exited with %d, want %d", c.args, code, c.code)
+		}
+	}
+
+	out, code := capture(t, func() int {
+		return tokenIssue(store, []string{"alice", "-catalogs", "LACA-12345,KICA-1234", "-cover-only", "-note", "car"})
+	})
+	if code != 0 {
+		t.Fatalf("failed to issue token: %d", code)
+	}
+	// The token is signed with the secret the server uses
+	name, scope, err := token.NewManager(store, config.Cfg.Secret).ValidateScopedUserToken(strings.TrimSpace(out))
+	if err != nil || name != "alice" || !scope.CoverOnly || len(scope.Catalogs) != 2 {
+		t.Errorf("wrong token: %s %+v %v", name, scope, err)
+	}
+	tokens := store.ListTokens("alice")
+	if len(tokens) != 1 || tokens[0].Note != "car" {
+		t.Fatalf("wrong tokens: %+v", tokens)
+	}
+	id := tokens[0].Id
+
+	if out, code = capture(t, func() int { return tokenList(store, []string{"alice"}) }); code != 0 || !strings.Contains(out, id) || !strings.Contains(out, "LACA-12345,KICA-1234 (covers)") {
+		t.Errorf("wrong token list: %d %s", code, out)
+	}
+	var listed []storage.Token
+	out, code = capture(t, func() int { return tokenList(store, []string{"alice", "-json"}) })
+	if err = json.Unmarshal([]byte(out), &listed); err != nil || code != 0 || len(listed) != 1 || listed[0].Id != id {
+		t.Errorf("wrong token list json: %d %v %s", code, err, out)
+	}
+	if _, code = capture(t, func() int { return tokenList(store, nil) }); code != 2 {
+		t.Errorf("token list without a user exited with %d", code)
+	}
+
+	if _, code = capture(t, func() int { return tokenRevoke(store, []string{"nothing"}) }); code != 1 {
+		t.Errorf("revoked a missing token: %d", code)
+	}
+	if _, code = capture(t, func() int { return tokenRevoke(store, []string{id}) }); code != 0 || store.TokenExists(id) {
+		t.Errorf("failed to revoke token: %d", code)
+	}
+
+	if got := audited(store, "generateToken"); len(got) != 1 || got[0] != "alice" {
+		t.Errorf("wrong audited tokens: %v", got)
+	}
+	if got := audited(store, "revokeToken"); len(got) != 1 || got[0] != id {
+		t.Errorf("wrong audited revocations: %v", got)
+	}
+}
+
+func TestLibraryCommands(t *testing.T) {
+	defer func() { config.Cfg = config.Default() }()
+	dir := t.TempDir()
+	for _, c := range []string{"LACA-12345", "KICA-1234"} {
+		_ = os.MkdirAll(filepath.Join(dir, c), 0755)
+		_ = ioutil.WriteFile(filepath.Join(dir, c, "01. Track.flac"), []byte("audio"), 0644)
+	}
+	_ = ioutil.WriteFile(filepath.Join(dir, "LACA-12345", "cover.jpg"), []byte("cover"), 0644)
+	config.Cfg.Backends = []config.BackendEntry{{Name: "local", Type: "file", Path: dir}}
+
+	if _, code := capture(t, func() int { return library("", nil) }); code != 2 {
+		t.Errorf("library without a subcommand exited with %d", code)
+	}
+	out, code := capture(t, func() int { return library("", []string{"scan"}) })
+	if code != 0 || !strings.Contains(out, "local") || !strings.Contains(out, "2") {
+		t.Errorf("wrong scan: %d %s", code, out)
+	}
+	var catalogs map[string][]string
+	out, code = capture(t, func() int { return library("", []string{"scan", "-json"}) })
+	if err := json.Unmarshal([]byte(out), &catalogs); err != nil || code != 0 || len(catalogs["local"]) != 2 {
+		t.Errorf("wrong scan json: %d %v %s", code, err, out)
+	}
+
+	// KICA-1234 has no cover
+	out, code = capture(t, func() int { return library("", []string{"verify"}) })
+	if code != 1 || !strings.Contains(out, "local: KICA-1234: cover") || !strings.Contains(out, "Checked 2 catalogs, 1 problems") {
+		t.Errorf("missing cover not reported: %d %s", code, out)
+	}
+	_ = ioutil.WriteFile(filepath.Join(dir, "KICA-1234", "cover.jpg"), []byte("cover"), 0644)
+	if out, code = capture(t, func() int { return library("", []string{"verify"}) }); code != 0 {
+		t.Errorf("complete library failed verification: %d %s", code, out)
+	}
+
+	config.Cfg.Backends = []config.BackendEntry{{Type: "file", Path: filepath.Join(dir, "missing")}}
+	if _, code = capture(t, func() int { return library("", []string{"scan"}) }); code != 1 {
+		t.Errorf("scanned a missing backend: %d", code)
+	}
+}
@@ -0,0 +1,256 @@
+// Package metrics collects counters, gauges and histograms and writes them in the Prometheus text format.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DefBuckets are upper bounds in seconds, suitable for request latencies.
+var DefBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// Registry holds metric families in the order they were created.
+type Registry struct {
+	mu       sync.Mutex
+	families []*family
+}
+
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+type kind string
+
+const (
+	counter   kind = "counter"
+	gauge     kind = "gauge"
+	histogram kind = "histogram"
+)
+
+type family struct {
+	name    string
+	help    string
+	kind    kind
+	labels  []string
+	buckets []float64
+	// Read at every scrape instead of series
+	fn func() float64
+
+	mu     sync.Mutex
+	series map[string]*series
+}
+
+type series struct {
+	values []string
+	value  float64
+	// Histograms only, counts per bucket without the +Inf bucket
+	counts []uint64
+	count  uint64
+}
+
+func (r *Registry) add(f *family) *family {
+	f.series = make(map[string]*series)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, o := range r.families {
+		if o.name == f.name {
+			panic("metrics: duplicate metric " + f.name)
+		}
+	}
+	r.families = append(r.families, f)
+	return f
+}
+
+// Counter creates a counter with the given label names.
+func (r *Registry) Counter(name, help string, labels ...string) *CounterVec {
+	return &CounterVec{r.add(&family{name: name, help: help, kind: counter, labels: labels})}
+}
+
+// Gauge creates a gauge with the given label names.
+func (r *Registry) Gauge(name, help string, labels ...string) *GaugeVec {
+	return &GaugeVec{r.add(&family{name: name, help: help, kind: gauge, labels: labels})}
+}
+
+// GaugeFunc creates a gauge without labels whose value is read from f at every scrape.
+func (r *Registry) GaugeFunc(name, help string, f func() float64) {
+	r.add(&family{name: name, help: help, kind: gauge, fn: f})
+}
+
+// Histogram creates a histogram with the given upper bounds, which have to be sorted.
+func (r *Registry) Histogram(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	return &HistogramVec{r.add(&family{name: name, help: help, kind: histogram, labels: labels, buckets: buckets})}
+}
+
+// with returns the series of the label values, creating it if needed. f.mu has to be held.
+func (f *family) with(values []string) *series {
+	if len(values) != len(f.labels) {
+		panic(fmt.Sprintf("metrics: %s has %d labels, got %d values", f.name, len(f.labels), len(values)))
+	}
+	key := strings.Join(values, "\xff")
+	s, ok := f.series[key]
+	if !ok {
+		s = &series{values: append([]string(nil), values...)}
+		if f.kind == histogram {
+			s.counts = make([]uint64, len(f.buckets))
+		}
+		f.series[key] = s
+	}
+	return s
+}
+
+type CounterVec struct{ f *family }
+
+// Add adds v, which must not be negative, to the series of the label values.
+func (c *CounterVec) Add(v float64, values ...string) {
+	if v < 0 {
+		panic("metrics: counter " + c.f.name + " decreased")
+	}
+	c.f.mu.Lock()
+	c.f.with(values).value += v
+	c.f.mu.Unlock()
+}
+
+func (c *CounterVec) Inc(values ...string) {
+	c.Add(1, values...)
+}
+
+// Value returns the current value of the series of the label values.
+func (c *CounterVec) Value(values ...string) float64 {
+	c.f.mu.Lock()
+	defer c.f.mu.Unlock()
+	return c.f.with(values).value
+}
+
+type GaugeVec struct{ f *family }
+
+func (g *GaugeVec) Add(v float64, values ...string) {
+	g.f.mu.Lock()
+	g.f.with(values).value += v
+	g.f.mu.Unlock()
+}
+
+func (g *GaugeVec) Set(v float64, values ...string) {
+	g.f.mu.Lock()
+	g.f.with(values).value = v
+	g.f.mu.Unlock()
+}
+
+func (g *GaugeVec) Value(values ...string) float64 {
+	g.f.mu.Lock()
+	defer g.f.mu.Unlock()
+	return g.f.with(values).value
+}
+
+type HistogramVec struct{ f *family }
+
+// Observe records v in the series of the label values.
+func (h *HistogramVec) Observe(v float64, values ...string) {
+	h.f.mu.Lock()
+	defer h.f.mu.Unlock()
+	s := h.f.with(values)
+	for i, b := range h.f.buckets {
+		if v <= b {
+			s.counts[i]++
+		}
+	}
+	s.count++
+	s.value += v
+}
+
+// Count returns the number of observations of the series of the label values.
+func (h *HistogramVec) Count(values ...string) uint64 {
+	h.f.mu.Lock()
+	defer h.f.mu.Unlock()
+	return h.f.with(values).count
+}
+
+// ContentType is the media type of the exposition format written by Write.
+const ContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// Write writes every metric in the text exposition format, series sorted by their labels.
+func (r *Registry) Write(w io.Writer) error {
+	r.mu.Lock()
+	families := append([]*family(nil), r.families...)
+	r.mu.Unlock()
+	bw := bufio.NewWriter(w)
+	for _, f := range families {
+		fmt.Fprintf(bw, "# HELP %s %s\n# TYPE %s %s\n", f.name, escapeHelp(f.help), f.name, f.kind)
+		if f.fn != nil {
+			fmt.Fprintf(bw, "%s %s\n", f.name, formatFloat(f.fn()))
+			continue
+		}
+		f.mu.Lock()
+		keys := make([]string, 0, len(f.series))
+		for k := range f.series {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			s := f.series[k]
+			if f.kind != histogram {
+				fmt.Fprintf(bw, "%s%s %s\n", f.name, labels(f.labels, s.values, "", ""), formatFloat(s.value))
+				continue
+			}
+			for i, b := range f.buckets {
+				fmt.Fprintf(bw, "%s_bucket%s %d\n", f.name, labels(f.labels, s.values, "le", formatFloat(b)), s.counts[i])
+			}
+			fmt.Fprintf(bw, "%s_bucket%s %d\n", f.name, labels(f.labels, s.values, "le", "+Inf"), s.count)
+			fmt.Fprintf(bw, "%s_sum%s %s\n", f.name, labels(f.labels, s.values, "", ""), formatFloat(s.value))
+			fmt.Fprintf(bw, "%s_count%s %d\n", f.name, labels(f.labels, s.values, "", ""), s.count)
+		}
+		f.mu.Unlock()
+	}
+	return bw.Flush()
+}
+
+// labels formats names and values, with an extra label if extra is not empty.
+func labels(names, values []string, extra, extraValue string) string {
+	if len(names) == 0 && extra == "" {
+		return ""
+	}
+	var b strings.Builder
+	b.WriteByte('{')
+	for i, n := range names {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(n + `="` + escapeValue(values[i]) + `"`)
+	}
+	if extra != "" {
+		if len(names) > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(extra + `="` + extraValue + `"`)
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+var (
+	helpEscaper  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	valueEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+)
+
+func escapeHelp(s string) string {
+	return helpEscaper.Replace(s)
+}
+
+func escapeValue(s string) string {
+	return valueEscaper.Replace(s)
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
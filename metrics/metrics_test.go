@@ -0,0 +1,64 @@
+package metrics
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestWrite(t *testing.T) {
+	r := NewRegistry()
+	requests := r.Counter("requests_total", "Handled requests.", "route", "status")
+	streams := r.Gauge("streams", "Active streams.")
+	latency := r.Histogram("latency_seconds", "Latency.", []float64{.1, 1}, "route")
+	r.GaugeFunc("sessions", "Sessions.", func() float64 { return 3 })
+
+	requests.Inc("/a", "200")
+	requests.Add(2, "/a", "200")
+	requests.Inc(`/"b"`, "404")
+	streams.Add(1)
+	streams.Add(1)
+	streams.Add(-1)
+	latency.Observe(.05, "/a")
+	latency.Observe(.5, "/a")
+	latency.Observe(5, "/a")
+
+	var b bytes.Buffer
+	if err := r.Write(&b); err != nil {
+		t.Fatalf("failed to write: %v", err)
+	}
+	want := `# HELP requests_total Handled requests.
+# TYPE requests_total counter
+requests_total{route="/\"b\"",status="404"} 1
+requests_total{route="/a",status="200"} 3
+# HELP streams Active streams.
+# TYPE streams gauge
+streams 1
+# HELP latency_seconds Latency.
+# TYPE latency_seconds histogram
+latency_seconds_bucket{route="/a",le="0.1"} 1
+latency_seconds_bucket{route="/a",le="1"} 2
+latency_seconds_bucket{route="/a",le="+Inf"} 3
+latency_seconds_sum{route="/a"} 5.55
+latency_seconds_count{route="/a"} 3
+# HELP sessions Sessions.
+# TYPE sessions gauge
+sessions 3
+`
+	if b.String() != want {
+		t.Errorf("wrong exposition:\n%s\nwant:\n%s", b.String(), want)
+	}
+	if requests.Value("/a", "200") != 3 || latency.Count("/a") != 3 {
+		t.Errorf("wrong values")
+	}
+}
+
+func TestLabelCount(t *testing.T) {
+	r := NewRegistry()
+	c := r.Counter("c", "", "a")
+	defer func() {
+		if recover() == nil {
+			t.Errorf("missing label value accepted")
+		}
+	}()
+	c.Inc()
+}
@@ -0,0 +1,73 @@
+package oidc
+
+import (
+	"github.com/SeraphJACK/go-annil/oidc/oidctest"
+	"net/url"
+	"testing"
+)
+
+func TestProvider(t *testing.T) {
+	op, err := oidctest.NewProvider("annil", "secret")
+	if err != nil {
+		t.Fatalf("failed to start provider: %v", err)
+	}
+	defer op.Close()
+	p := NewProvider(Config{
+		Issuer:       op.Issuer(),
+		ClientID:     "annil",
+		ClientSecret: "secret",
+		RedirectURL:  "http://annil.example/api/oidc/callback",
+		Scopes:       []string{"profile", "groups"},
+	})
+	state, _ := NewState()
+	nonce, _ := NewState()
+	verifier, _ := NewState()
+	authURL, err := p.AuthCodeURL(state, nonce, verifier)
+	if err != nil {
+		t.Fatalf("failed to build authorization url: %v", err)
+	}
+	callback, err := op.Authorize(authURL, map[string]interface{}{
+		"sub":                "1234",
+		"preferred_username": "alice",
+		"groups":             []string{"staff", "music"},
+	})
+	if err != nil {
+		t.Fatalf("failed to authorize: %v", err)
+	}
+	u, _ := url.Parse(callback)
+	if u.Query().Get("state") != state {
+		t.Errorf("wrong state in callback: %s", callback)
+	}
+	code := u.Query().Get("code")
+
+	if _, err = p.Exchange(code, "wrong verifier", nonce); err == nil {
+		t.Errorf("exchanged a code with a wrong verifier")
+	}
+	callback, _ = op.Authorize(authURL, map[string]interface{}{"sub": "1234"})
+	u, _ = url.Parse(callback)
+	if _, err = p.Exchange(u.Query().Get("code"), verifier, "wrong nonce"); err == nil {
+		t.Errorf("accepted a token with a wrong nonce")
+	}
+
+	callback, _ = op.Authorize(authURL, map[string]interface{}{
+		"sub":                "1234",
+		"preferred_username": "alice",
+		"groups":             []string{"staff", "music"},
+	})
+	u, _ = url.Parse(callback)
+	claims, err := p.Exchange(u.Query().Get("code"), verifier, nonce)
+	if err != nil {
+		t.Fatalf("failed to exchange code: %v", err)
+	}
+	if claims.Subject() != "1234" || claims.String("preferred_username") != "alice" || len(claims.Strings("groups")) != 2 {
+		t.Errorf("wrong claims: %v", claims)
+	}
+
+	other, _ := oidctest.NewProvider("annil", "secret")
+	defer other.Close()
+	callback, _ = other.Authorize(authURL, map[string]interface{}{"sub": "1234"})
+	u, _ = url.Parse(callback)
+	if _, err = p.Exchange(u.Query().Get("code"), verifier, nonce); err == nil {
+		t.Errorf("exchanged a code of another provider")
+	}
+}
@@ -0,0 +1,100 @@
+package storage
+
+import (
+	"strings"
+)
+
+// AuditEvent is an entry of the append-only audit log.
+type AuditEvent struct {
+	Id   int64 `json:"id"`
+	Time int64 `json:"time"`
+	// Empty for anonymous requests
+	Actor     string `json:"actor"`
+	Action    string `json:"action"`
+	Target    string `json:"target"`
+	Detail    string `json:"detail"`
+	IP        string `json:"ip"`
+	UserAgent string `json:"userAgent"`
+	// HTTP status of the request and its X-Status-Reason
+	Status int    `json:"status"`
+	Reason string `json:"reason"`
+}
+
+// AuditFilter selects audit events, zero fields match everything.
+type AuditFilter struct {
+	// Matches events where User is either the actor or the target
+	User   string
+	Action string
+	// Unix time range, both ends inclusive
+	Since int64
+	Until int64
+	// Keep only the latest Limit events
+	Limit int
+}
+
+// Match reports whether e is selected by f, ignoring Limit.
+func (f AuditFilter) Match(e AuditEvent) bool {
+	if f.User != "" && e.Actor != f.User && e.Target != f.User {
+		return false
+	}
+	if f.Action != "" && e.Action != f.Action {
+		return false
+	}
+	if f.Since != 0 && e.Time < f.Since {
+		return false
+	}
+	return f.Until == 0 || e.Time <= f.Until
+}
+
+// AppendAudit adds e to the audit log, its id is assigned by the store.
+func (s *SQLiteStore) AppendAudit(e AuditEvent) error {
+	_, err := s.db.Exec("INSERT INTO AuditLog(`Time`, `Actor`, `Action`, `Target`, `Detail`, `IP`, `UserAgent`, `Status`, `Reason`) VALUES (?,?,?,?,?,?,?,?,?)",
+		e.Time, e.Actor, e.Action, e.Target, e.Detail, e.IP, e.UserAgent, e.Status, e.Reason)
+	return err
+}
+
+// QueryAudit lists the events selected by f in chronological order.
+func (s *SQLiteStore) QueryAudit(f AuditFilter) []AuditEvent {
+	ret := make([]AuditEvent, 0)
+	var cond []string
+	var args []interface{}
+	if f.User != "" {
+		cond = append(cond, "(`Actor`=? OR `Target`=?)")
+		args = append(args, f.User, f.User)
+	}
+	if f.Action != "" {
+		cond = append(cond, "`Action`=?")
+		args = append(args, f.Action)
+	}
+	if f.Since != 0 {
+		cond = append(cond, "`Time`>=?")
+		args = append(args, f.Since)
+	}
+	if f.Until != 0 {
+		cond = append(cond, "`Time`<=?")
+		args = append(args, f.Until)
+	}
+	q := "SELECT `Id`, `Time`, `Actor`, `Action`, `Target`, `Detail`, `IP`, `UserAgent`, `Status`, `Reason` FROM AuditLog"
+	if len(cond) > 0 {
+		q += " WHERE " + strings.Join(cond, " AND ")
+	}
+	q += " ORDER BY `Id` DESC"
+	if f.Limit > 0 {
+		q += " LIMIT ?"
+		args = append(args, f.Limit)
+	}
+	rows, err := s.db.Query("SELECT * FROM ("+q+") ORDER BY `Id`", args...)
+	if err != nil {
+		return ret
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var e AuditEvent
+		err = rows.Scan(&e.Id, &e.Time, &e.Actor, &e.Action, &e.Target, &e.Detail, &e.IP, &e.UserAgent, &e.Status, &e.Reason)
+		if err != nil {
+			return ret
+		}
+		ret = append(ret, e)
+	}
+	return ret
+}
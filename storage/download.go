@@ -0,0 +1,55 @@
+package storage
+
+import (
+	"sort"
+	"time"
+)
+
+// DownloadCount is the number of tracks of a catalog streamed to a user on a day.
+type DownloadCount struct {
+	// Unix time of midnight UTC
+	Day      int64  `json:"day"`
+	Username string `json:"username"`
+	Catalog  string `json:"catalog"`
+	Count    int    `json:"count"`
+}
+
+func downloadDay(t time.Time) int64 {
+	return t.Unix() - t.Unix()%86400
+}
+
+func sortDownloads(d []DownloadCount) {
+	sort.Slice(d, func(i, j int) bool {
+		if d[i].Day != d[j].Day {
+			return d[i].Day < d[j].Day
+		}
+		if d[i].Username != d[j].Username {
+			return d[i].Username < d[j].Username
+		}
+		return d[i].Catalog < d[j].Catalog
+	})
+}
+
+func (s *SQLiteStore) RecordDownload(username, catalog string, t time.Time) error {
+	_, err := s.db.Exec("INSERT INTO Downloads(`Day`, `Username`, `Catalog`, `Count`) VALUES (?,?,?,1) "+
+		"ON CONFLICT(`Day`, `Username`, `Catalog`) DO UPDATE SET `Count`=`Count`+1", downloadDay(t), username, catalog)
+	return err
+}
+
+func (s *SQLiteStore) ListDownloads(since int64) []DownloadCount {
+	ret := make([]DownloadCount, 0)
+	rows, err := s.db.Query("SELECT `Day`, `Username`, `Catalog`, `Count` FROM Downloads WHERE `Day`>=? ORDER BY `Day`, `Username`, `Catalog`",
+		downloadDay(time.Unix(since, 0)))
+	if err != nil {
+		return ret
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var d DownloadCount
+		if err = rows.Scan(&d.Day, &d.Username, &d.Catalog, &d.Count); err != nil {
+			return ret
+		}
+		ret = append(ret, d)
+	}
+	return ret
+}
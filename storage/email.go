@@ -0,0 +1,110 @@
+package storage
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"time"
+)
+
+var ErrInvalidMailToken = errors.New("invalid mail token")
+
+// Purposes of mail tokens
+const (
+	MailTokenReset  = "reset"
+	MailTokenVerify = "verify"
+)
+
+// MailToken is a single-use token sent by mail, such as a password reset link.
+type MailToken struct {
+	Username string
+	Purpose  string
+	// Address the token was sent to
+	Email  string
+	Expire int64
+}
+
+// hashMailToken hashes a token before it is stored. Tokens are random, so a fast hash is enough.
+func hashMailToken(token string) string {
+	h := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(h[:])
+}
+
+// SetEmail changes the email address of username, which has to be verified again.
+func (s *SQLiteStore) SetEmail(username, email string) error {
+	_, err := s.db.Exec("UPDATE Users SET `Email`=?, `EmailVerified`=0 WHERE `Username`=?", email, username)
+	return err
+}
+
+func (s *SQLiteStore) UserEmail(username string) (email string, verified bool) {
+	_ = s.db.QueryRow("SELECT `Email`, `EmailVerified` FROM Users WHERE `Username`=?", username).Scan(&email, &verified)
+	return
+}
+
+// EmailUser returns the user whose verified email address is email.
+func (s *SQLiteStore) EmailUser(email string) (string, error) {
+	var ret string
+	err := s.db.QueryRow("SELECT `Username` FROM Users WHERE `Email`=? AND `EmailVerified`=1", email).Scan(&ret)
+	return ret, err
+}
+
+// VerifyEmail marks the email address of username as verified, unless it was changed to another one.
+func (s *SQLiteStore) VerifyEmail(username, email string) error {
+	res, err := s.db.Exec("UPDATE Users SET `EmailVerified`=1 WHERE `Username`=? AND `Email`=?", username, email)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil || n != 1 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// NewMailToken stores the hash of token, replacing earlier tokens of the user with the same purpose.
+func (s *SQLiteStore) NewMailToken(token string, t MailToken) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("DELETE FROM MailTokens WHERE `Username`=? AND `Purpose`=?", t.Username, t.Purpose)
+	if err == nil {
+		_, err = tx.Exec("INSERT INTO MailTokens(`Hash`, `Username`, `Purpose`, `Email`, `Expire`) VALUES (?,?,?,?,?)",
+			hashMailToken(token), t.Username, t.Purpose, t.Email, t.Expire)
+	}
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// UseMailToken consumes an unexpired token of purpose, or returns ErrInvalidMailToken.
+func (s *SQLiteStore) UseMailToken(token, purpose string) (MailToken, error) {
+	var t MailToken
+	hash := hashMailToken(token)
+	err := s.db.QueryRow("SELECT `Username`, `Purpose`, `Email`, `Expire` FROM MailTokens WHERE `Hash`=? AND `Purpose`=?", hash, purpose).
+		Scan(&t.Username, &t.Purpose, &t.Email, &t.Expire)
+	if err == sql.ErrNoRows {
+		return MailToken{}, ErrInvalidMailToken
+	} else if err != nil {
+		return MailToken{}, err
+	}
+	// Only the request deleting the token may use it
+	res, err := s.db.Exec("DELETE FROM MailTokens WHERE `Hash`=?", hash)
+	if err != nil {
+		return MailToken{}, err
+	}
+	if n, err := res.RowsAffected(); err != nil || n != 1 {
+		return MailToken{}, ErrInvalidMailToken
+	}
+	if time.Now().Unix() > t.Expire {
+		return MailToken{}, ErrInvalidMailToken
+	}
+	return t, nil
+}
+
+func (s *SQLiteStore) DeleteExpiredMailTokens() error {
+	_, err := s.db.Exec("DELETE FROM MailTokens WHERE `Expire`<?", time.Now().Unix())
+	return err
+}
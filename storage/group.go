@@ -0,0 +1,154 @@
+package storage
+
+type Group struct {
+	Name    string   `json:"name"`
+	Members []string `json:"members"`
+}
+
+// AccessRule allows members of Group to access catalogs matching Pattern from Backend.
+// An empty Backend or Pattern matches everything.
+type AccessRule struct {
+	Id      int64  `json:"id"`
+	Group   string `json:"group"`
+	Backend string `json:"backend"`
+	Pattern string `json:"pattern"`
+}
+
+func (s *SQLiteStore) NewGroup(name string) error {
+	_, err := s.db.Exec("INSERT INTO `Groups`(`Name`) VALUES (?)", name)
+	return err
+}
+
+func (s *SQLiteStore) GroupExists(name string) bool {
+	ret := false
+	_ = s.db.QueryRow("SELECT EXISTS(SELECT * FROM `Groups` WHERE `Name`=?)", name).Scan(&ret)
+	return ret
+}
+
+func (s *SQLiteStore) DeleteGroup(name string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	for _, q := range []string{
+		"DELETE FROM GroupMembers WHERE `Group`=?",
+		"DELETE FROM AccessRules WHERE `Group`=?",
+		"DELETE FROM `Groups` WHERE `Name`=?",
+	} {
+		_, err = tx.Exec(q, name)
+		if err != nil {
+			_ = tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *SQLiteStore) ListGroups() []Group {
+	ret := make([]Group, 0)
+	rows, err := s.db.Query("SELECT `Name` FROM `Groups`")
+	if err != nil {
+		return ret
+	}
+	for rows.Next() {
+		g := Group{Members: make([]string, 0)}
+		err = rows.Scan(&g.Name)
+		if err != nil {
+			_ = rows.Close()
+			return ret
+		}
+		ret = append(ret, g)
+	}
+	_ = rows.Close()
+	for i := range ret {
+		ret[i].Members = s.queryStrings("SELECT `Username` FROM GroupMembers WHERE `Group`=?", ret[i].Name)
+	}
+	return ret
+}
+
+func (s *SQLiteStore) AddGroupMember(group, username string) error {
+	_, err := s.db.Exec("INSERT OR IGNORE INTO GroupMembers(`Group`, `Username`) VALUES (?,?)", group, username)
+	return err
+}
+
+func (s *SQLiteStore) RemoveGroupMember(group, username string) error {
+	_, err := s.db.Exec("DELETE FROM GroupMembers WHERE `Group`=? AND `Username`=?", group, username)
+	return err
+}
+
+// UserGroups lists the groups username belongs to.
+func (s *SQLiteStore) UserGroups(username string) ([]string, error) {
+	return s.queryStringList("SELECT `Group` FROM GroupMembers WHERE `Username`=?", username)
+}
+
+func (s *SQLiteStore) AddAccessRule(group, backend, pattern string) (int64, error) {
+	res, err := s.db.Exec("INSERT INTO AccessRules(`Group`, `Backend`, `Pattern`) VALUES (?,?,?)", group, backend, pattern)
+	if err != nil {
+		return 0, err
+	}
+	return res.LastInsertId()
+}
+
+func (s *SQLiteStore) RemoveAccessRule(id int64) error {
+	_, err := s.db.Exec("DELETE FROM AccessRules WHERE `Id`=?", id)
+	return err
+}
+
+// ListAccessRules lists rules of group, or all rules if group is empty.
+func (s *SQLiteStore) ListAccessRules(group string) []AccessRule {
+	var ret []AccessRule
+	if group == "" {
+		ret, _ = s.queryAccessRules("SELECT `Id`, `Group`, `Backend`, `Pattern` FROM AccessRules")
+	} else {
+		ret, _ = s.queryAccessRules("SELECT `Id`, `Group`, `Backend`, `Pattern` FROM AccessRules WHERE `Group`=?", group)
+	}
+	return ret
+}
+
+// UserAccessRules lists rules of every group username belongs to.
+func (s *SQLiteStore) UserAccessRules(username string) ([]AccessRule, error) {
+	return s.queryAccessRules("SELECT r.`Id`, r.`Group`, r.`Backend`, r.`Pattern` FROM AccessRules r "+
+		"INNER JOIN GroupMembers m ON r.`Group`=m.`Group` WHERE m.`Username`=?", username)
+}
+
+func (s *SQLiteStore) queryAccessRules(query string, args ...interface{}) ([]AccessRule, error) {
+	ret := make([]AccessRule, 0)
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return ret, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var r AccessRule
+		err = rows.Scan(&r.Id, &r.Group, &r.Backend, &r.Pattern)
+		if err != nil {
+			return ret, err
+		}
+		ret = append(ret, r)
+	}
+	return ret, rows.Err()
+}
+
+// queryStrings is queryStringList for callers which may treat a failed query as an empty result.
+func (s *SQLiteStore) queryStrings(query string, args ...interface{}) []string {
+	ret, _ := s.queryStringList(query, args...)
+	return ret
+}
+
+func (s *SQLiteStore) queryStringList(query string, args ...interface{}) ([]string, error) {
+	ret := make([]string, 0)
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return ret, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var str string
+		err = rows.Scan(&str)
+		if err != nil {
+			return ret, err
+		}
+		ret = append(ret, str)
+	}
+	return ret, rows.Err()
+}
@@ -0,0 +1,48 @@
+package storage
+
+import (
+	"time"
+)
+
+// Identity links a subject of an external identity provider to a user.
+type Identity struct {
+	Issuer   string `json:"issuer"`
+	Subject  string `json:"subject"`
+	Username string `json:"username"`
+	LinkTime int64  `json:"linkTime"`
+}
+
+func (s *SQLiteStore) LinkIdentity(issuer, subject, username string) error {
+	_, err := s.db.Exec("INSERT INTO Identities(`Issuer`, `Subject`, `Username`, `LinkTime`) VALUES (?,?,?,?)", issuer, subject, username, time.Now().Unix())
+	return err
+}
+
+// IdentityUser returns the user subject of issuer is linked to.
+func (s *SQLiteStore) IdentityUser(issuer, subject string) (string, error) {
+	var ret string
+	err := s.db.QueryRow("SELECT `Username` FROM Identities WHERE `Issuer`=? AND `Subject`=?", issuer, subject).Scan(&ret)
+	return ret, err
+}
+
+func (s *SQLiteStore) UserIdentities(username string) []Identity {
+	ret := make([]Identity, 0)
+	rows, err := s.db.Query("SELECT `Issuer`, `Subject`, `Username`, `LinkTime` FROM Identities WHERE `Username`=? ORDER BY `LinkTime`", username)
+	if err != nil {
+		return ret
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var i Identity
+		err = rows.Scan(&i.Issuer, &i.Subject, &i.Username, &i.LinkTime)
+		if err != nil {
+			return ret
+		}
+		ret = append(ret, i)
+	}
+	return ret
+}
+
+func (s *SQLiteStore) UnlinkIdentity(issuer, subject string) error {
+	_, err := s.db.Exec("DELETE FROM Identities WHERE `Issuer`=? AND `Subject`=?", issuer, subject)
+	return err
+}
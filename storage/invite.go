@@ -0,0 +1,197 @@
+package storage
+
+import (
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	uuid "github.com/satori/go.uuid"
+	"golang.org/x/crypto/bcrypt"
+	"time"
+)
+
+// ErrInvalidInviteCode is returned when redeeming a code which doesn't exist, has expired or is used up.
+var ErrInvalidInviteCode = errors.New("invalid invite code")
+
+type InviteCode struct {
+	Code string `json:"code"`
+	// -1 indicates infinity
+	Limit      int    `json:"limit"`
+	Creator    string `json:"creator"`
+	CreateTime int64  `json:"createTime"`
+	// 0 indicates the code never expires
+	Expire int64  `json:"expire"`
+	Note   string `json:"note"`
+	// Role and groups granted to users registered with the code, empty role indicates guest
+	Role   string   `json:"role"`
+	Groups []string `json:"groups"`
+	// Number of users registered with the code
+	Redeemed int `json:"redeemed"`
+}
+
+// Redemption records a user registered with an invite code.
+type Redemption struct {
+	Code     string `json:"code"`
+	Username string `json:"username"`
+	Time     int64  `json:"time"`
+}
+
+// Usable reports whether the code can still be redeemed at t.
+func (c InviteCode) Usable(t time.Time) bool {
+	if c.Expire != 0 && t.Unix() >= c.Expire {
+		return false
+	}
+	return c.Limit == -1 || c.Limit > 0
+}
+
+// NewInviteCode stores code and returns it with its code and creation time filled in.
+func (s *SQLiteStore) NewInviteCode(code InviteCode) (InviteCode, error) {
+	if code.Limit == 0 || code.Limit < -1 {
+		return InviteCode{}, fmt.Errorf("invalid limit")
+	}
+	if code.Groups == nil {
+		code.Groups = []string{}
+	}
+	code.Code = uuid.NewV4().String()
+	code.CreateTime = time.Now().Unix()
+	code.Redeemed = 0
+	g, err := json.Marshal(code.Groups)
+	if err != nil {
+		return InviteCode{}, err
+	}
+	_, err = s.db.Exec("INSERT INTO InviteCodes(`Code`, `Limit`, `Creator`, `CreateTime`, `Expire`, `Note`, `Role`, `Groups`) VALUES (?,?,?,?,?,?,?,?)",
+		code.Code, code.Limit, code.Creator, code.CreateTime, code.Expire, code.Note, code.Role, string(g))
+	if err != nil {
+		return InviteCode{}, err
+	}
+	return code, nil
+}
+
+const inviteCodeColumns = "`Code`, `Limit`, `Creator`, `CreateTime`, `Expire`, `Note`, `Role`, `Groups`, (SELECT COUNT(*) FROM Redemptions WHERE Redemptions.`Code`=InviteCodes.`Code`)"
+
+func scanInviteCode(row scanner) (InviteCode, error) {
+	var c InviteCode
+	var groups string
+	err := row.Scan(&c.Code, &c.Limit, &c.Creator, &c.CreateTime, &c.Expire, &c.Note, &c.Role, &groups, &c.Redeemed)
+	if err != nil {
+		return InviteCode{}, err
+	}
+	err = json.Unmarshal([]byte(groups), &c.Groups)
+	return c, err
+}
+
+func (s *SQLiteStore) GetInviteCode(code string) (InviteCode, error) {
+	return scanInviteCode(s.db.QueryRow("SELECT "+inviteCodeColumns+" FROM InviteCodes WHERE `Code`=?", code))
+}
+
+func (s *SQLiteStore) ListInviteCodes() []InviteCode {
+	ret := make([]InviteCode, 0)
+	rows, err := s.db.Query("SELECT " + inviteCodeColumns + " FROM InviteCodes ORDER BY `CreateTime`")
+	if err != nil {
+		return ret
+	}
+	defer rows.Close()
+	for rows.Next() {
+		c, err := scanInviteCode(rows)
+		if err != nil {
+			return ret
+		}
+		ret = append(ret, c)
+	}
+	return ret
+}
+
+// RedeemInviteCode spends one use of code and registers username in a single transaction,
+// so concurrent registrations can't overspend a limited code.
+func (s *SQLiteStore) RedeemInviteCode(code, username, password string) error {
+	hashed, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	err = redeem(tx, code, username, hex.EncodeToString(hashed), now)
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+func redeem(tx *sql.Tx, code, username, hashed string, now time.Time) error {
+	res, err := tx.Exec("UPDATE InviteCodes SET `Limit`=CASE WHEN `Limit`>0 THEN `Limit`-1 ELSE `Limit` END "+
+		"WHERE `Code`=? AND (`Limit`>0 OR `Limit`=-1) AND (`Expire`=0 OR `Expire`>?)", code, now.Unix())
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return ErrInvalidInviteCode
+	}
+	var role, groups string
+	err = tx.QueryRow("SELECT `Role`, `Groups` FROM InviteCodes WHERE `Code`=?", code).Scan(&role, &groups)
+	if err != nil {
+		return err
+	}
+	exists := false
+	err = tx.QueryRow("SELECT EXISTS(SELECT * FROM Roles WHERE `Name`=?)", role).Scan(&exists)
+	if err != nil {
+		return err
+	}
+	if !exists && !IsBuiltinRole(role) {
+		role = RoleGuest
+	}
+	_, err = tx.Exec("INSERT INTO Users(`Username`, `Password`, `Role`) VALUES (?,?,?)", username, hashed, role)
+	if err != nil {
+		return err
+	}
+	var g []string
+	err = json.Unmarshal([]byte(groups), &g)
+	if err != nil {
+		return err
+	}
+	for _, group := range g {
+		_, err = tx.Exec("INSERT OR IGNORE INTO GroupMembers(`Group`, `Username`) SELECT `Name`, ? FROM `Groups` WHERE `Name`=?", username, group)
+		if err != nil {
+			return err
+		}
+	}
+	_, err = tx.Exec("INSERT INTO Redemptions(`Code`, `Username`, `Time`) VALUES (?,?,?)", code, username, now.Unix())
+	return err
+}
+
+// ListRedemptions lists users registered with code, or with any code if code is empty.
+func (s *SQLiteStore) ListRedemptions(code string) []Redemption {
+	ret := make([]Redemption, 0)
+	q := "SELECT `Code`, `Username`, `Time` FROM Redemptions"
+	var args []interface{}
+	if code != "" {
+		q += " WHERE `Code`=?"
+		args = append(args, code)
+	}
+	rows, err := s.db.Query(q+" ORDER BY `Time`", args...)
+	if err != nil {
+		return ret
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var r Redemption
+		err = rows.Scan(&r.Code, &r.Username, &r.Time)
+		if err != nil {
+			return ret
+		}
+		ret = append(ret, r)
+	}
+	return ret
+}
+
+// RevokeInviteCode deletes code, its redemption history is kept.
+func (s *SQLiteStore) RevokeInviteCode(code string) error {
+	_, err := s.db.Exec("DELETE FROM InviteCodes WHERE `Code`=?", code)
+	return err
+}
@@ -0,0 +1,950 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	uuid "github.com/satori/go.uuid"
+	"golang.org/x/crypto/bcrypt"
+	"sort"
+	"sync"
+	"time"
+)
+
+var errNotFound = errors.New("not found")
+
+type memoryUser struct {
+	password     []byte
+	registerTime time.Time
+	role         string
+	mustChange   bool
+	email        string
+	verified     bool
+}
+
+// MemoryStore is a Store which keeps everything in memory, meant for tests.
+type MemoryStore struct {
+	mu          sync.Mutex
+	users       map[string]*memoryUser
+	roles       map[string][]string
+	inviteCodes map[string]*InviteCode
+	redemptions []Redemption
+	sessions    map[string]Session
+	tokens      map[string]Token
+	groups      map[string]map[string]bool
+	rules       map[int64]AccessRule
+	nextRuleId  int64
+	audit       []AuditEvent
+	totp        map[string]*TotpState
+	recovery    map[string]map[string]bool
+	settings    map[string]string
+	identities  map[[2]string]Identity
+	mailTokens  map[string]MailToken
+	downloads   map[downloadKey]int
+}
+
+type downloadKey struct {
+	day               int64
+	username, catalog string
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		users:       make(map[string]*memoryUser),
+		roles:       make(map[string][]string),
+		inviteCodes: make(map[string]*InviteCode),
+		sessions:    make(map[string]Session),
+		tokens:      make(map[string]Token),
+		groups:      make(map[string]map[string]bool),
+		rules:       make(map[int64]AccessRule),
+		nextRuleId:  1,
+		totp:        make(map[string]*TotpState),
+		recovery:    make(map[string]map[string]bool),
+		settings:    make(map[string]string),
+		identities:  make(map[[2]string]Identity),
+		mailTokens:  make(map[string]MailToken),
+		downloads:   make(map[downloadKey]int),
+	}
+}
+
+func (s *MemoryStore) Register(username, password string) error {
+	hashed, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.users[username]; ok {
+		return fmt.Errorf("user %s already exists", username)
+	}
+	s.users[username] = &memoryUser{
+		password: hashed,
+		// Same resolution as the SQLite store
+		registerTime: time.Now().UTC().Truncate(time.Second),
+		role:         RoleGuest,
+	}
+	return nil
+}
+
+func (s *MemoryStore) CheckPassword(username, password string) bool {
+	s.mu.Lock()
+	u, ok := s.users[username]
+	s.mu.Unlock()
+	if !ok {
+		return false
+	}
+	return bcrypt.CompareHashAndPassword(u.password, []byte(password)) == nil
+}
+
+func (s *MemoryStore) ChangePassword(username, password string) error {
+	h, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if u, ok := s.users[username]; ok {
+		u.password = h
+		u.mustChange = false
+	}
+	return nil
+}
+
+func (s *MemoryStore) MustChangePassword(username string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u, ok := s.users[username]
+	return ok && u.mustChange
+}
+
+func (s *MemoryStore) SetMustChangePassword(username string, must bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if u, ok := s.users[username]; ok {
+		u.mustChange = must
+	}
+	return nil
+}
+
+func (s *MemoryStore) RegisterDate(username string) (time.Time, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u, ok := s.users[username]
+	if !ok {
+		return time.Time{}, errNotFound
+	}
+	return u.registerTime, nil
+}
+
+func (s *MemoryStore) RevokeUser(username string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.users, username)
+	for id, t := range s.tokens {
+		if t.Username == username {
+			delete(s.tokens, id)
+		}
+	}
+	for id, ses := range s.sessions {
+		if ses.Username == username {
+			delete(s.sessions, id)
+		}
+	}
+	for _, members := range s.groups {
+		delete(members, username)
+	}
+	delete(s.totp, username)
+	delete(s.recovery, username)
+	for k, i := range s.identities {
+		if i.Username == username {
+			delete(s.identities, k)
+		}
+	}
+	for k, t := range s.mailTokens {
+		if t.Username == username {
+			delete(s.mailTokens, k)
+		}
+	}
+	return nil
+}
+
+func (s *MemoryStore) UserExists(username string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.users[username]
+	return ok
+}
+
+func (s *MemoryStore) CountUsers() (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.users), nil
+}
+
+func (s *MemoryStore) ListUsers() []User {
+	s.mu.Lock()
+	ret := make([]User, 0, len(s.users))
+	for name, u := range s.users {
+		ret = append(ret, User{
+			Username:           name,
+			RegisterDate:       u.registerTime.Unix(),
+			Role:               u.role,
+			MustChangePassword: u.mustChange,
+			Email:              u.email,
+			EmailVerified:      u.verified,
+		})
+	}
+	s.mu.Unlock()
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Username < ret[j].Username })
+	fillPermissions(s, ret)
+	return ret
+}
+
+func (s *MemoryStore) UserRole(username string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if u, ok := s.users[username]; ok {
+		return u.role
+	}
+	return ""
+}
+
+func (s *MemoryStore) SetRole(username, role string) error {
+	if !s.RoleExists(role) {
+		return fmt.Errorf("unknown role %s", role)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if u, ok := s.users[username]; ok {
+		u.role = role
+	}
+	return nil
+}
+
+func (s *MemoryStore) RoleUsers(role string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ret := make([]string, 0)
+	for name, u := range s.users {
+		if u.role == role {
+			ret = append(ret, name)
+		}
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+func (s *MemoryStore) RoleExists(name string) bool {
+	if IsBuiltinRole(name) {
+		return true
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.roles[name]
+	return ok
+}
+
+func (s *MemoryStore) RolePermissions(role string) []string {
+	if perms, ok := builtinRoles[role]; ok {
+		return append([]string{}, perms...)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string{}, s.roles[role]...)
+}
+
+func (s *MemoryStore) ListRoles() []Role {
+	ret := []Role{
+		{Name: RoleOwner, Builtin: true, Permissions: s.RolePermissions(RoleOwner)},
+		{Name: RoleAdmin, Builtin: true, Permissions: s.RolePermissions(RoleAdmin)},
+		{Name: RoleMember, Builtin: true, Permissions: s.RolePermissions(RoleMember)},
+		{Name: RoleGuest, Builtin: true, Permissions: s.RolePermissions(RoleGuest)},
+	}
+	s.mu.Lock()
+	names := make([]string, 0, len(s.roles))
+	for name := range s.roles {
+		names = append(names, name)
+	}
+	s.mu.Unlock()
+	sort.Strings(names)
+	for _, name := range names {
+		ret = append(ret, Role{Name: name, Permissions: s.RolePermissions(name)})
+	}
+	return ret
+}
+
+func (s *MemoryStore) NewRole(name string, perms []string) error {
+	if IsBuiltinRole(name) {
+		return fmt.Errorf("role %s is built in", name)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.roles[name]; ok {
+		return fmt.Errorf("role %s already exists", name)
+	}
+	s.roles[name] = dedup(perms)
+	return nil
+}
+
+func (s *MemoryStore) SetRolePermissions(name string, perms []string) error {
+	if IsBuiltinRole(name) {
+		return fmt.Errorf("role %s is built in", name)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.roles[name]; ok {
+		s.roles[name] = dedup(perms)
+	}
+	return nil
+}
+
+func (s *MemoryStore) DeleteRole(name string) error {
+	if IsBuiltinRole(name) {
+		return fmt.Errorf("role %s is built in", name)
+	}
+	if len(s.RoleUsers(name)) > 0 {
+		return fmt.Errorf("role %s is in use", name)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.roles, name)
+	return nil
+}
+
+// NewInviteCode stores code and returns it with its code and creation time filled in.
+func (s *MemoryStore) NewInviteCode(code InviteCode) (InviteCode, error) {
+	if code.Limit == 0 || code.Limit < -1 {
+		return InviteCode{}, fmt.Errorf("invalid limit")
+	}
+	code.Code = uuid.NewV4().String()
+	code.CreateTime = time.Now().Unix()
+	code.Groups = append([]string{}, code.Groups...)
+	code.Redeemed = 0
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c := code
+	s.inviteCodes[code.Code] = &c
+	return code, nil
+}
+
+func (s *MemoryStore) GetInviteCode(code string) (InviteCode, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c, ok := s.inviteCodes[code]
+	if !ok {
+		return InviteCode{}, errNotFound
+	}
+	return s.inviteCode(c), nil
+}
+
+func (s *MemoryStore) ListInviteCodes() []InviteCode {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ret := make([]InviteCode, 0, len(s.inviteCodes))
+	for _, c := range s.inviteCodes {
+		ret = append(ret, s.inviteCode(c))
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		if ret[i].CreateTime != ret[j].CreateTime {
+			return ret[i].CreateTime < ret[j].CreateTime
+		}
+		return ret[i].Code < ret[j].Code
+	})
+	return ret
+}
+
+// inviteCode copies c with its redemption count, s.mu must be held.
+func (s *MemoryStore) inviteCode(c *InviteCode) InviteCode {
+	ret := *c
+	ret.Groups = append([]string{}, c.Groups...)
+	for _, r := range s.redemptions {
+		if r.Code == c.Code {
+			ret.Redeemed++
+		}
+	}
+	return ret
+}
+
+func (s *MemoryStore) RedeemInviteCode(code, username, password string) error {
+	hashed, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c, ok := s.inviteCodes[code]
+	if !ok || !c.Usable(now) {
+		return ErrInvalidInviteCode
+	}
+	if _, ok := s.users[username]; ok {
+		return fmt.Errorf("user %s already exists", username)
+	}
+	if c.Limit > 0 {
+		c.Limit--
+	}
+	role := c.Role
+	if _, ok := s.roles[role]; !ok && !IsBuiltinRole(role) {
+		role = RoleGuest
+	}
+	s.users[username] = &memoryUser{
+		password:     hashed,
+		registerTime: now.UTC().Truncate(time.Second),
+		role:         role,
+	}
+	for _, g := range c.Groups {
+		if members, ok := s.groups[g]; ok {
+			members[username] = true
+		}
+	}
+	s.redemptions = append(s.redemptions, Redemption{Code: code, Username: username, Time: now.Unix()})
+	return nil
+}
+
+// ListRedemptions lists users registered with code, or with any code if code is empty.
+func (s *MemoryStore) ListRedemptions(code string) []Redemption {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ret := make([]Redemption, 0)
+	for _, r := range s.redemptions {
+		if code == "" || r.Code == code {
+			ret = append(ret, r)
+		}
+	}
+	return ret
+}
+
+func (s *MemoryStore) RevokeInviteCode(code string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.inviteCodes, code)
+	return nil
+}
+
+func (s *MemoryStore) NewSession(username string, expire time.Time) (string, error) {
+	id := uuid.NewV4().String()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sessions[id] = Session{Id: id, Username: username, Expire: expire}
+	return id, nil
+}
+
+func (s *MemoryStore) GetSession(id string) (Session, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ses, ok := s.sessions[id]
+	if !ok {
+		return Session{}, errNotFound
+	}
+	return ses, nil
+}
+
+func (s *MemoryStore) DeleteSession(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.sessions, id)
+	return nil
+}
+
+func (s *MemoryStore) CountSessions() (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := 0
+	now := time.Now()
+	for _, ses := range s.sessions {
+		if !now.After(ses.Expire) {
+			n++
+		}
+	}
+	return n, nil
+}
+
+func (s *MemoryStore) ListSessions(username string) []Session {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ret := make([]Session, 0)
+	now := time.Now()
+	for _, ses := range s.sessions {
+		if !now.After(ses.Expire) && (username == "" || ses.Username == username) {
+			ret = append(ret, ses)
+		}
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].Expire.Before(ret[j].Expire)
+	})
+	return ret
+}
+
+func (s *MemoryStore) DeleteExpiredSessions() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	for id, ses := range s.sessions {
+		if now.After(ses.Expire) {
+			delete(s.sessions, id)
+		}
+	}
+	return nil
+}
+
+func (s *MemoryStore) DeleteUserSessions(username string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for id, ses := range s.sessions {
+		if ses.Username == username {
+			delete(s.sessions, id)
+		}
+	}
+	return nil
+}
+
+func (s *MemoryStore) NewToken(username string, catalogs []string, coverOnly bool, expire int64, note string) (Token, error) {
+	if catalogs == nil {
+		catalogs = []string{}
+	}
+	t := Token{
+		Id:        uuid.NewV4().String(),
+		Username:  username,
+		IssueTime: time.Now().Unix(),
+		Expire:    expire,
+		Catalogs:  append([]string{}, catalogs...),
+		CoverOnly: coverOnly,
+		Note:      note,
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tokens[t.Id] = t
+	return t, nil
+}
+
+func (s *MemoryStore) GetToken(id string) (Token, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t, ok := s.tokens[id]
+	if !ok {
+		return Token{}, errNotFound
+	}
+	return t, nil
+}
+
+func (s *MemoryStore) TokenExists(id string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.tokens[id]
+	return ok
+}
+
+func (s *MemoryStore) ListTokens(username string) []Token {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ret := make([]Token, 0)
+	for _, t := range s.tokens {
+		if username == "" || t.Username == username {
+			ret = append(ret, t)
+		}
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].IssueTime < ret[j].IssueTime })
+	return ret
+}
+
+func (s *MemoryStore) RevokeToken(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.tokens, id)
+	return nil
+}
+
+func (s *MemoryStore) NewGroup(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.groups[name]; ok {
+		return fmt.Errorf("group %s already exists", name)
+	}
+	s.groups[name] = make(map[string]bool)
+	return nil
+}
+
+func (s *MemoryStore) GroupExists(name string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.groups[name]
+	return ok
+}
+
+func (s *MemoryStore) DeleteGroup(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.groups, name)
+	for id, r := range s.rules {
+		if r.Group == name {
+			delete(s.rules, id)
+		}
+	}
+	return nil
+}
+
+func (s *MemoryStore) ListGroups() []Group {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ret := make([]Group, 0, len(s.groups))
+	for name, members := range s.groups {
+		g := Group{Name: name, Members: make([]string, 0, len(members))}
+		for m := range members {
+			g.Members = append(g.Members, m)
+		}
+		sort.Strings(g.Members)
+		ret = append(ret, g)
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Name < ret[j].Name })
+	return ret
+}
+
+func (s *MemoryStore) AddGroupMember(group, username string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	members, ok := s.groups[group]
+	if !ok {
+		return errNotFound
+	}
+	members[username] = true
+	return nil
+}
+
+func (s *MemoryStore) RemoveGroupMember(group, username string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.groups[group], username)
+	return nil
+}
+
+func (s *MemoryStore) UserGroups(username string) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ret := make([]string, 0)
+	for name, members := range s.groups {
+		if members[username] {
+			ret = append(ret, name)
+		}
+	}
+	sort.Strings(ret)
+	return ret, nil
+}
+
+func (s *MemoryStore) AddAccessRule(group, backend, pattern string) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	id := s.nextRuleId
+	s.nextRuleId++
+	s.rules[id] = AccessRule{Id: id, Group: group, Backend: backend, Pattern: pattern}
+	return id, nil
+}
+
+func (s *MemoryStore) RemoveAccessRule(id int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.rules, id)
+	return nil
+}
+
+func (s *MemoryStore) ListAccessRules(group string) []AccessRule {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.filterRules(func(r AccessRule) bool {
+		return group == "" || r.Group == group
+	})
+}
+
+func (s *MemoryStore) UserAccessRules(username string) ([]AccessRule, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.filterRules(func(r AccessRule) bool {
+		return s.groups[r.Group][username]
+	}), nil
+}
+
+// filterRules must be called with the lock held.
+func (s *MemoryStore) filterRules(f func(r AccessRule) bool) []AccessRule {
+	ret := make([]AccessRule, 0)
+	for _, r := range s.rules {
+		if f(r) {
+			ret = append(ret, r)
+		}
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Id < ret[j].Id })
+	return ret
+}
+
+func (s *MemoryStore) Close() error {
+	return nil
+}
+
+func dedup(arr []string) []string {
+	seen := make(map[string]bool)
+	ret := make([]string, 0, len(arr))
+	for _, e := range arr {
+		if !seen[e] {
+			seen[e] = true
+			ret = append(ret, e)
+		}
+	}
+	return ret
+}
+
+func (s *MemoryStore) AppendAudit(e AuditEvent) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e.Id = int64(len(s.audit)) + 1
+	s.audit = append(s.audit, e)
+	return nil
+}
+
+// QueryAudit lists the events selected by f in chronological order.
+func (s *MemoryStore) QueryAudit(f AuditFilter) []AuditEvent {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ret := make([]AuditEvent, 0)
+	for _, e := range s.audit {
+		if f.Match(e) {
+			ret = append(ret, e)
+		}
+	}
+	if f.Limit > 0 && len(ret) > f.Limit {
+		ret = ret[len(ret)-f.Limit:]
+	}
+	return ret
+}
+
+// SetTotpSecret starts a new enrollment of username, replacing the previous one.
+func (s *MemoryStore) SetTotpSecret(username, secret string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.totp[username] = &TotpState{Secret: secret}
+	return nil
+}
+
+func (s *MemoryStore) GetTotp(username string) (TotpState, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t, ok := s.totp[username]
+	if !ok {
+		return TotpState{}, errNotFound
+	}
+	return *t, nil
+}
+
+func (s *MemoryStore) EnableTotp(username string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if t, ok := s.totp[username]; ok {
+		t.Enabled = true
+	}
+	return nil
+}
+
+func (s *MemoryStore) UseTotpStep(username string, step int64) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t, ok := s.totp[username]
+	if !ok || t.LastStep >= step {
+		return false
+	}
+	t.LastStep = step
+	return true
+}
+
+func (s *MemoryStore) DeleteTotp(username string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.totp, username)
+	delete(s.recovery, username)
+	return nil
+}
+
+func (s *MemoryStore) SetRecoveryCodes(username string, codes []string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	hashes := make(map[string]bool)
+	for _, c := range codes {
+		hashes[hashRecoveryCode(c)] = true
+	}
+	s.recovery[username] = hashes
+	return nil
+}
+
+func (s *MemoryStore) UseRecoveryCode(username, code string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	h := hashRecoveryCode(code)
+	if !s.recovery[username][h] {
+		return false
+	}
+	delete(s.recovery[username], h)
+	return true
+}
+
+func (s *MemoryStore) RecoveryCodesLeft(username string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.recovery[username])
+}
+
+func (s *MemoryStore) GetSetting(key string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.settings[key], nil
+}
+
+func (s *MemoryStore) SetSetting(key, value string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.settings[key] = value
+	return nil
+}
+
+func (s *MemoryStore) LinkIdentity(issuer, subject, username string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	k := [2]string{issuer, subject}
+	if _, ok := s.identities[k]; ok {
+		return fmt.Errorf("identity %s of %s is already linked", subject, issuer)
+	}
+	s.identities[k] = Identity{Issuer: issuer, Subject: subject, Username: username, LinkTime: time.Now().Unix()}
+	return nil
+}
+
+func (s *MemoryStore) IdentityUser(issuer, subject string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	i, ok := s.identities[[2]string{issuer, subject}]
+	if !ok {
+		return "", errNotFound
+	}
+	return i.Username, nil
+}
+
+func (s *MemoryStore) UserIdentities(username string) []Identity {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ret := make([]Identity, 0)
+	for _, i := range s.identities {
+		if i.Username == username {
+			ret = append(ret, i)
+		}
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		if ret[i].LinkTime != ret[j].LinkTime {
+			return ret[i].LinkTime < ret[j].LinkTime
+		}
+		return ret[i].Subject < ret[j].Subject
+	})
+	return ret
+}
+
+func (s *MemoryStore) UnlinkIdentity(issuer, subject string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.identities, [2]string{issuer, subject})
+	return nil
+}
+
+func (s *MemoryStore) SetEmail(username, email string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u, ok := s.users[username]
+	if !ok {
+		return errNotFound
+	}
+	u.email, u.verified = email, false
+	return nil
+}
+
+func (s *MemoryStore) UserEmail(username string) (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u, ok := s.users[username]
+	if !ok {
+		return "", false
+	}
+	return u.email, u.verified
+}
+
+func (s *MemoryStore) EmailUser(email string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for name, u := range s.users {
+		if u.verified && u.email == email {
+			return name, nil
+		}
+	}
+	return "", errNotFound
+}
+
+func (s *MemoryStore) VerifyEmail(username, email string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u, ok := s.users[username]
+	if !ok || u.email != email {
+		return errNotFound
+	}
+	u.verified = true
+	return nil
+}
+
+func (s *MemoryStore) NewMailToken(token string, t MailToken) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for k, old := range s.mailTokens {
+		if old.Username == t.Username && old.Purpose == t.Purpose {
+			delete(s.mailTokens, k)
+		}
+	}
+	s.mailTokens[hashMailToken(token)] = t
+	return nil
+}
+
+func (s *MemoryStore) UseMailToken(token, purpose string) (MailToken, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	hash := hashMailToken(token)
+	t, ok := s.mailTokens[hash]
+	if !ok || t.Purpose != purpose {
+		return MailToken{}, ErrInvalidMailToken
+	}
+	delete(s.mailTokens, hash)
+	if time.Now().Unix() > t.Expire {
+		return MailToken{}, ErrInvalidMailToken
+	}
+	return t, nil
+}
+
+func (s *MemoryStore) DeleteExpiredMailTokens() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now().Unix()
+	for k, t := range s.mailTokens {
+		if now > t.Expire {
+			delete(s.mailTokens, k)
+		}
+	}
+	return nil
+}
+
+func (s *MemoryStore) RecordDownload(username, catalog string, t time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.downloads[downloadKey{downloadDay(t), username, catalog}]++
+	return nil
+}
+
+func (s *MemoryStore) ListDownloads(since int64) []DownloadCount {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ret := make([]DownloadCount, 0)
+	first := downloadDay(time.Unix(since, 0))
+	for k, n := range s.downloads {
+		if k.day >= first {
+			ret = append(ret, DownloadCount{Day: k.day, Username: k.username, Catalog: k.catalog, Count: n})
+		}
+	}
+	sortDownloads(ret)
+	return ret
+}
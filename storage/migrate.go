@@ -0,0 +1,211 @@
+package storage
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+type migration struct {
+	version int
+	name    string
+	up      func(tx *sql.Tx) error
+}
+
+// MigrationState describes a migration and whether it has been applied.
+type MigrationState struct {
+	Version int    `json:"version"`
+	Name    string `json:"name"`
+	Applied bool   `json:"applied"`
+	// Unix time, 0 if not applied
+	AppliedAt int64 `json:"appliedAt"`
+}
+
+// Migrations in the order they are applied. Never edit or reorder an existing
+// migration, append a new one instead.
+//
+// Databases created before versioned migrations already contain some of these
+// tables, so the early migrations must tolerate existing objects.
+var migrations = []migration{
+	{1, "create users and invite codes", execAll(
+		"CREATE TABLE IF NOT EXISTS Users (\n    `Username` varchar(64) NOT NULL,\n    `AllowShare` int NOT NULL DEFAULT 0,\n    `RegisterTime` datetime NOT NULL DEFAULT (DATETIME('now')),\n    `Password` varchar(64) NOT NULL,\n    `Admin` int NOT NULL DEFAULT 0,\n    PRIMARY KEY (`Username`)\n)",
+		"CREATE TABLE IF NOT EXISTS InviteCodes(\n    `Code` varchar(64) NOT NULL,\n    `Limit` int NOT NULL DEFAULT 0,\n    PRIMARY KEY(`Code`)\n)",
+	)},
+	{2, "create token registry", execAll(
+		"CREATE TABLE IF NOT EXISTS Tokens(\n    `Id` varchar(64) NOT NULL,\n    `Username` varchar(64) NOT NULL,\n    `IssueTime` datetime NOT NULL DEFAULT (DATETIME('now')),\n    `Expire` int NOT NULL DEFAULT 0,\n    `Catalogs` text NOT NULL DEFAULT '',\n    `CoverOnly` int NOT NULL DEFAULT 0,\n    `Note` varchar(255) NOT NULL DEFAULT '',\n    PRIMARY KEY(`Id`)\n)",
+	)},
+	{3, "create groups and access rules", execAll(
+		"CREATE TABLE IF NOT EXISTS `Groups`(\n    `Name` varchar(64) NOT NULL,\n    PRIMARY KEY(`Name`)\n)",
+		"CREATE TABLE IF NOT EXISTS GroupMembers(\n    `Group` varchar(64) NOT NULL,\n    `Username` varchar(64) NOT NULL,\n    PRIMARY KEY(`Group`, `Username`)\n)",
+		"CREATE TABLE IF NOT EXISTS AccessRules(\n    `Id` integer PRIMARY KEY AUTOINCREMENT,\n    `Group` varchar(64) NOT NULL,\n    `Backend` varchar(255) NOT NULL DEFAULT '',\n    `Pattern` varchar(255) NOT NULL DEFAULT ''\n)",
+	)},
+	{4, "replace admin flags with roles", migrateRoles},
+	{5, "create sessions", execAll(
+		"CREATE TABLE Sessions(\n    `Id` varchar(64) NOT NULL,\n    `Username` varchar(64) NOT NULL,\n    `Expire` int NOT NULL,\n    PRIMARY KEY(`Id`)\n)",
+	)},
+	{6, "add invite code details and redemptions", execAll(
+		"ALTER TABLE InviteCodes ADD COLUMN `Creator` varchar(64) NOT NULL DEFAULT ''",
+		"ALTER TABLE InviteCodes ADD COLUMN `CreateTime` int NOT NULL DEFAULT 0",
+		"ALTER TABLE InviteCodes ADD COLUMN `Expire` int NOT NULL DEFAULT 0",
+		"ALTER TABLE InviteCodes ADD COLUMN `Note` varchar(255) NOT NULL DEFAULT ''",
+		"ALTER TABLE InviteCodes ADD COLUMN `Role` varchar(64) NOT NULL DEFAULT ''",
+		"ALTER TABLE InviteCodes ADD COLUMN `Groups` text NOT NULL DEFAULT '[]'",
+		"CREATE TABLE Redemptions(\n    `Code` varchar(64) NOT NULL,\n    `Username` varchar(64) NOT NULL,\n    `Time` int NOT NULL\n)",
+		"CREATE INDEX RedemptionsCode ON Redemptions(`Code`)",
+	)},
+	{7, "create audit log", execAll(
+		"CREATE TABLE AuditLog(\n    `Id` integer PRIMARY KEY AUTOINCREMENT,\n    `Time` int NOT NULL,\n    `Actor` varchar(64) NOT NULL DEFAULT '',\n    `Action` varchar(64) NOT NULL,\n    `Target` varchar(255) NOT NULL DEFAULT '',\n    `Detail` text NOT NULL DEFAULT '',\n    `IP` varchar(64) NOT NULL DEFAULT '',\n    `UserAgent` varchar(255) NOT NULL DEFAULT '',\n    `Status` int NOT NULL DEFAULT 0,\n    `Reason` varchar(64) NOT NULL DEFAULT ''\n)",
+		"CREATE INDEX AuditLogTime ON AuditLog(`Time`)",
+	)},
+	{8, "add must change password flag", execAll(
+		"ALTER TABLE Users ADD COLUMN `MustChangePassword` int NOT NULL DEFAULT 0",
+	)},
+	{9, "create totp and settings", execAll(
+		"CREATE TABLE Totp(\n    `Username` varchar(64) NOT NULL,\n    `Secret` varchar(64) NOT NULL,\n    `Enabled` int NOT NULL DEFAULT 0,\n    `LastStep` int NOT NULL DEFAULT 0,\n    PRIMARY KEY(`Username`)\n)",
+		"CREATE TABLE RecoveryCodes(\n    `Username` varchar(64) NOT NULL,\n    `Hash` varchar(64) NOT NULL,\n    PRIMARY KEY(`Username`, `Hash`)\n)",
+		"CREATE TABLE Settings(\n    `Key` varchar(64) NOT NULL,\n    `Value` text NOT NULL DEFAULT '',\n    PRIMARY KEY(`Key`)\n)",
+	)},
+	{10, "create external identities", execAll(
+		"CREATE TABLE Identities(\n    `Issuer` varchar(255) NOT NULL,\n    `Subject` varchar(255) NOT NULL,\n    `Username` varchar(64) NOT NULL,\n    `LinkTime` int NOT NULL,\n    PRIMARY KEY(`Issuer`, `Subject`)\n)",
+	)},
+	{11, "add user emails and mail tokens", execAll(
+		"ALTER TABLE Users ADD COLUMN `Email` varchar(255) NOT NULL DEFAULT ''",
+		"ALTER TABLE Users ADD COLUMN `EmailVerified` int NOT NULL DEFAULT 0",
+		"CREATE INDEX Users_Email ON Users(`Email`)",
+		"CREATE TABLE MailTokens(\n    `Hash` varchar(64) PRIMARY KEY NOT NULL,\n    `Username` varchar(64) NOT NULL,\n    `Purpose` varchar(16) NOT NULL,\n    `Email` varchar(255) NOT NULL,\n    `Expire` int NOT NULL\n)",
+	)},
+	{12, "create download statistics", execAll(
+		"CREATE TABLE Downloads(\n    `Day` int NOT NULL,\n    `Username` varchar(64) NOT NULL,\n    `Catalog` varchar(255) NOT NULL,\n    `Count` int NOT NULL DEFAULT 0,\n    PRIMARY KEY(`Day`, `Username`, `Catalog`)\n)",
+	)},
+}
+
+func execAll(queries ...string) func(tx *sql.Tx) error {
+	return func(tx *sql.Tx) error {
+		for _, q := range queries {
+			_, err := tx.Exec(q)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// migrateRoles moves users from the legacy Admin and AllowShare flags to roles.
+func migrateRoles(tx *sql.Tx) error {
+	exists, err := columnExists(tx, "Users", "Role")
+	if err != nil {
+		return err
+	}
+	// Roles may already have been assigned if the column exists
+	if !exists {
+		err = execAll(
+			"ALTER TABLE Users ADD COLUMN `Role` varchar(64) NOT NULL DEFAULT 'guest'",
+			"UPDATE Users SET `Role`='member' WHERE `AllowShare`<>0",
+			"UPDATE Users SET `Role`='admin' WHERE `Admin`<>0",
+			// The earliest admin owns the instance
+			"UPDATE Users SET `Role`='owner' WHERE Username=(SELECT Username FROM Users WHERE `Admin`<>0 ORDER BY RegisterTime LIMIT 1)",
+		)(tx)
+		if err != nil {
+			return err
+		}
+	}
+	return execAll(
+		"CREATE TABLE IF NOT EXISTS Roles(\n    `Name` varchar(64) NOT NULL,\n    PRIMARY KEY(`Name`)\n)",
+		"CREATE TABLE IF NOT EXISTS RolePermissions(\n    `Role` varchar(64) NOT NULL,\n    `Permission` varchar(64) NOT NULL,\n    PRIMARY KEY(`Role`, `Permission`)\n)",
+	)(tx)
+}
+
+func columnExists(tx *sql.Tx, table, column string) (bool, error) {
+	ret := false
+	err := tx.QueryRow("SELECT EXISTS(SELECT * FROM pragma_table_info(?) WHERE `name`=?)", table, column).Scan(&ret)
+	return ret, err
+}
+
+func (s *SQLiteStore) ensureVersionTable() error {
+	_, err := s.db.Exec("CREATE TABLE IF NOT EXISTS schema_version(\n    `Version` int NOT NULL,\n    `Name` varchar(255) NOT NULL,\n    `AppliedAt` datetime NOT NULL DEFAULT (DATETIME('now')),\n    PRIMARY KEY(`Version`)\n)")
+	return err
+}
+
+// SchemaVersion returns the version of the latest applied migration, 0 for a fresh database.
+func (s *SQLiteStore) SchemaVersion() (int, error) {
+	err := s.ensureVersionTable()
+	if err != nil {
+		return 0, err
+	}
+	var v sql.NullInt64
+	err = s.db.QueryRow("SELECT MAX(`Version`) FROM schema_version").Scan(&v)
+	return int(v.Int64), err
+}
+
+// LatestVersion returns the version the database is at once every migration is applied.
+func LatestVersion() int {
+	return migrations[len(migrations)-1].version
+}
+
+// Migrate applies every pending migration, each in its own transaction.
+func (s *SQLiteStore) Migrate() error {
+	current, err := s.SchemaVersion()
+	if err != nil {
+		return err
+	}
+	if current > LatestVersion() {
+		return fmt.Errorf("database schema version %d is newer than supported version %d", current, LatestVersion())
+	}
+	for _, m := range migrations {
+		if m.version <= current {
+			continue
+		}
+		tx, err := s.db.Begin()
+		if err != nil {
+			return err
+		}
+		err = m.up(tx)
+		if err == nil {
+			_, err = tx.Exec("INSERT INTO schema_version(`Version`, `Name`) VALUES (?,?)", m.version, m.name)
+		}
+		if err != nil {
+			_ = tx.Rollback()
+			return fmt.Errorf("migration %d (%s) failed: %v", m.version, m.name, err)
+		}
+		err = tx.Commit()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// MigrationStatus lists every known migration with its state.
+func (s *SQLiteStore) MigrationStatus() ([]MigrationState, error) {
+	err := s.ensureVersionTable()
+	if err != nil {
+		return nil, err
+	}
+	applied := make(map[int]int64)
+	rows, err := s.db.Query("SELECT `Version`, `AppliedAt` FROM schema_version")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var v int
+		var t time.Time
+		err = rows.Scan(&v, &t)
+		if err != nil {
+			return nil, err
+		}
+		applied[v] = t.Unix()
+	}
+	ret := make([]MigrationState, 0, len(migrations))
+	for _, m := range migrations {
+		at, ok := applied[m.version]
+		ret = append(ret, MigrationState{
+			Version:   m.version,
+			Name:      m.name,
+			Applied:   ok,
+			AppliedAt: at,
+		})
+	}
+	return ret, nil
+}
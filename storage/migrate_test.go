@@ -0,0 +1,137 @@
+package storage
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestMigrate(t *testing.T) {
+	s, err := OpenSQLite(filepath.Join(t.TempDir(), "data.db"))
+	if err != nil {
+		t.Fatalf("failed to open database: %v", err)
+	}
+	defer s.Close()
+	err = s.Migrate()
+	if err != nil {
+		t.Fatalf("failed to migrate: %v", err)
+	}
+	// Migrating an up to date database is a no-op
+	err = s.Migrate()
+	if err != nil {
+		t.Fatalf("failed to migrate twice: %v", err)
+	}
+	v, err := s.SchemaVersion()
+	if err != nil || v != LatestVersion() {
+		t.Fatalf("wrong schema version %d: %v", v, err)
+	}
+	states, err := s.MigrationStatus()
+	if err != nil {
+		t.Fatalf("failed to read migration status: %v", err)
+	}
+	for _, st := range states {
+		if !st.Applied || st.AppliedAt == 0 {
+			t.Errorf("migration %d not applied", st.Version)
+		}
+	}
+
+	// Every storage function works against the migrated schema
+	if err = s.Register("alice", "123456"); err != nil {
+		t.Fatalf("failed to register: %v", err)
+	}
+	if !s.UserExists("alice") || !s.CheckPassword("alice", "123456") {
+		t.Errorf("failed to check registered user")
+	}
+	if err = s.ChangePassword("alice", "654321"); err != nil || !s.CheckPassword("alice", "654321") {
+		t.Errorf("failed to change password: %v", err)
+	}
+	if _, err = s.RegisterDate("alice"); err != nil {
+		t.Errorf("failed to read register date: %v", err)
+	}
+	if err = s.SetRole("alice", RoleAdmin); err != nil || !HasPermission(s, "alice", PermManageUsers) {
+		t.Errorf("failed to set role: %v", err)
+	}
+	if users := s.ListUsers(); len(users) != 1 || users[0].Role != RoleAdmin || users[0].RegisterDate == 0 {
+		t.Errorf("wrong user list: %v", users)
+	}
+	if err = s.NewRole("uploader", []string{PermShare}); err != nil || len(s.ListRoles()) != 5 {
+		t.Errorf("failed to create role: %v", err)
+	}
+	if err = s.DeleteRole("uploader"); err != nil {
+		t.Errorf("failed to delete role: %v", err)
+	}
+
+	code, err := s.NewInviteCode(InviteCode{Limit: 1, Groups: []string{"friends"}})
+	if err != nil {
+		t.Fatalf("failed to create invite code: %v", err)
+	}
+	if err = s.RedeemInviteCode(code.Code, "carol", "123456"); err != nil || len(s.ListRedemptions("")) != 1 {
+		t.Errorf("failed to redeem invite code: %v", err)
+	}
+	if len(s.ListInviteCodes()) != 1 || s.RedeemInviteCode(code.Code, "dave", "123456") != ErrInvalidInviteCode {
+		t.Errorf("wrong invite code behaviour")
+	}
+	if err = s.RevokeInviteCode(code.Code); err != nil || len(s.ListInviteCodes()) != 0 {
+		t.Errorf("failed to revoke invite code: %v", err)
+	}
+
+	tok, err := s.NewToken("alice", []string{"LACA-12345"}, false, 0, "")
+	if err != nil {
+		t.Fatalf("failed to create token: %v", err)
+	}
+	if _, err = s.GetToken(tok.Id); err != nil || len(s.ListTokens("")) != 1 {
+		t.Errorf("failed to read token: %v", err)
+	}
+	if err = s.RevokeToken(tok.Id); err != nil || s.TokenExists(tok.Id) {
+		t.Errorf("failed to revoke token: %v", err)
+	}
+
+	if err = s.NewGroup("guests"); err != nil {
+		t.Fatalf("failed to create group: %v", err)
+	}
+	if err = s.AddGroupMember("guests", "alice"); err != nil || len(s.ListGroups()[0].Members) != 1 {
+		t.Errorf("failed to add group member: %v", err)
+	}
+	if _, err = s.AddAccessRule("guests", "", "*"); err != nil || len(mustRules(t, s, "alice")) != 1 {
+		t.Errorf("failed to add access rule: %v", err)
+	}
+	if err = s.RemoveGroupMember("guests", "alice"); err != nil || len(mustGroups(t, s, "alice")) != 0 {
+		t.Errorf("failed to remove group member: %v", err)
+	}
+	if err = s.DeleteGroup("guests"); err != nil || s.GroupExists("guests") {
+		t.Errorf("failed to delete group: %v", err)
+	}
+
+	if err = s.AppendAudit(AuditEvent{Time: 1, Actor: "alice", Action: "login"}); err != nil || len(s.QueryAudit(AuditFilter{User: "alice"})) != 1 {
+		t.Errorf("failed to append audit event: %v", err)
+	}
+
+	if err = s.RevokeUser("alice"); err != nil || s.UserExists("alice") {
+		t.Errorf("failed to revoke user: %v", err)
+	}
+}
+
+func TestMigrateLegacy(t *testing.T) {
+	s, err := OpenSQLite(filepath.Join(t.TempDir(), "data.db"))
+	if err != nil {
+		t.Fatalf("failed to open database: %v", err)
+	}
+	defer s.Close()
+	// Schema created before versioned migrations
+	_, err = s.db.Exec("CREATE TABLE Users (\n    `Username` varchar(64) NOT NULL,\n    `AllowShare` int NOT NULL DEFAULT 0,\n    `RegisterTime` datetime NOT NULL DEFAULT (DATETIME('now')),\n    `Password` varchar(64) NOT NULL,\n    `Admin` int NOT NULL DEFAULT 0,\n    PRIMARY KEY (`Username`)\n)")
+	if err != nil {
+		t.Fatalf("failed to create legacy schema: %v", err)
+	}
+	_, err = s.db.Exec("INSERT INTO Users(Username, Password, `Admin`, AllowShare) VALUES ('a', '', 1, 0), ('b', '', 0, 1), ('c', '', 0, 0)")
+	if err != nil {
+		t.Fatalf("failed to insert legacy users: %v", err)
+	}
+	err = s.Migrate()
+	if err != nil {
+		t.Fatalf("failed to migrate: %v", err)
+	}
+	for username, role := range map[string]string{"a": RoleOwner, "b": RoleMember, "c": RoleGuest} {
+		if s.UserRole(username) != role {
+			t.Errorf("wrong role of %s: %s", username, s.UserRole(username))
+		}
+	}
+}
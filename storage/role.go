@@ -0,0 +1,213 @@
+package storage
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Permissions granted by roles
+const (
+	// Create share tokens
+	PermShare = "share"
+	// List and revoke users, assign roles
+	PermManageUsers = "users.manage"
+	// Create, list and revoke invite codes
+	PermManageInvites = "invites.manage"
+	// List and revoke tokens of other users
+	PermManageTokens = "tokens.manage"
+	// Manage groups and library access rules
+	PermManageGroups = "groups.manage"
+	// Create, edit and delete custom roles
+	PermManageRoles = "roles.manage"
+	// Query and export the audit log
+	PermViewAudit = "audit.view"
+	// Reload the configuration
+	PermManageSettings = "settings.manage"
+)
+
+// Built-in roles
+const (
+	RoleOwner  = "owner"
+	RoleAdmin  = "admin"
+	RoleMember = "member"
+	RoleGuest  = "guest"
+)
+
+var Permissions = []string{PermShare, PermManageUsers, PermManageInvites, PermManageTokens, PermManageGroups, PermManageRoles, PermViewAudit, PermManageSettings}
+
+var builtinRoles = map[string][]string{
+	RoleOwner:  Permissions,
+	RoleAdmin:  Permissions,
+	RoleMember: {PermShare},
+	RoleGuest:  {},
+}
+
+type Role struct {
+	Name        string   `json:"name"`
+	Builtin     bool     `json:"builtin"`
+	Permissions []string `json:"permissions"`
+}
+
+func IsBuiltinRole(name string) bool {
+	_, ok := builtinRoles[name]
+	return ok
+}
+
+func ValidPermission(perm string) bool {
+	for _, p := range Permissions {
+		if p == perm {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *SQLiteStore) RoleExists(name string) bool {
+	if IsBuiltinRole(name) {
+		return true
+	}
+	ret := false
+	_ = s.db.QueryRow("SELECT EXISTS(SELECT * FROM Roles WHERE `Name`=?)", name).Scan(&ret)
+	return ret
+}
+
+// RolePermissions lists the permissions granted by role.
+func (s *SQLiteStore) RolePermissions(role string) []string {
+	if perms, ok := builtinRoles[role]; ok {
+		return append([]string{}, perms...)
+	}
+	return s.queryStrings("SELECT `Permission` FROM RolePermissions WHERE `Role`=?", role)
+}
+
+func (s *SQLiteStore) ListRoles() []Role {
+	ret := []Role{
+		{Name: RoleOwner, Builtin: true, Permissions: s.RolePermissions(RoleOwner)},
+		{Name: RoleAdmin, Builtin: true, Permissions: s.RolePermissions(RoleAdmin)},
+		{Name: RoleMember, Builtin: true, Permissions: s.RolePermissions(RoleMember)},
+		{Name: RoleGuest, Builtin: true, Permissions: s.RolePermissions(RoleGuest)},
+	}
+	for _, name := range s.queryStrings("SELECT `Name` FROM Roles") {
+		ret = append(ret, Role{Name: name, Permissions: s.RolePermissions(name)})
+	}
+	return ret
+}
+
+func (s *SQLiteStore) NewRole(name string, perms []string) error {
+	if IsBuiltinRole(name) {
+		return fmt.Errorf("role %s is built in", name)
+	}
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("INSERT INTO Roles(`Name`) VALUES (?)", name)
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	for _, p := range perms {
+		_, err = tx.Exec("INSERT OR IGNORE INTO RolePermissions(`Role`, `Permission`) VALUES (?,?)", name, p)
+		if err != nil {
+			_ = tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *SQLiteStore) SetRolePermissions(name string, perms []string) error {
+	if IsBuiltinRole(name) {
+		return fmt.Errorf("role %s is built in", name)
+	}
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("DELETE FROM RolePermissions WHERE `Role`=?", name)
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	for _, p := range perms {
+		_, err = tx.Exec("INSERT OR IGNORE INTO RolePermissions(`Role`, `Permission`) VALUES (?,?)", name, p)
+		if err != nil {
+			_ = tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// DeleteRole deletes a custom role, failing if any user still has it.
+func (s *SQLiteStore) DeleteRole(name string) error {
+	if IsBuiltinRole(name) {
+		return fmt.Errorf("role %s is built in", name)
+	}
+	if len(s.RoleUsers(name)) > 0 {
+		return fmt.Errorf("role %s is in use", name)
+	}
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("DELETE FROM RolePermissions WHERE `Role`=?", name)
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	_, err = tx.Exec("DELETE FROM Roles WHERE `Name`=?", name)
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// RoleUsers lists users who have role.
+func (s *SQLiteStore) RoleUsers(role string) []string {
+	return s.queryStrings("SELECT `Username` FROM Users WHERE `Role`=?", role)
+}
+
+func (s *SQLiteStore) UserRole(username string) string {
+	ret := ""
+	_ = s.db.QueryRow("SELECT `Role` FROM Users WHERE Username=?", username).Scan(&ret)
+	return ret
+}
+
+func (s *SQLiteStore) SetRole(username, role string) error {
+	if !s.RoleExists(role) {
+		return fmt.Errorf("unknown role %s", role)
+	}
+	_, err := s.db.Exec("UPDATE Users SET `Role`=? WHERE Username=?", role, username)
+	return err
+}
+
+// HasPermission reports whether the role of username grants perm.
+func HasPermission(s Store, username, perm string) bool {
+	role := s.UserRole(username)
+	if role == "" {
+		return false
+	}
+	for _, p := range s.RolePermissions(role) {
+		if p == perm {
+			return true
+		}
+	}
+	return false
+}
+
+// ParsePermissions parses a comma separated permission list.
+func ParsePermissions(s string) ([]string, error) {
+	ret := make([]string, 0)
+	for _, p := range strings.Split(s, ",") {
+		p = strings.TrimSpace(p)
+		if p == "" {
+			continue
+		}
+		if !ValidPermission(p) {
+			return nil, fmt.Errorf("unknown permission %s", p)
+		}
+		ret = append(ret, p)
+	}
+	return ret, nil
+}
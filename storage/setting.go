@@ -0,0 +1,18 @@
+package storage
+
+import "database/sql"
+
+// GetSetting returns the value of key, empty if it isn't set.
+func (s *SQLiteStore) GetSetting(key string) (string, error) {
+	var ret string
+	err := s.db.QueryRow("SELECT `Value` FROM Settings WHERE `Key`=?", key).Scan(&ret)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return ret, err
+}
+
+func (s *SQLiteStore) SetSetting(key, value string) error {
+	_, err := s.db.Exec("INSERT OR REPLACE INTO Settings(`Key`, `Value`) VALUES (?,?)", key, value)
+	return err
+}
@@ -0,0 +1,201 @@
+package storage
+
+import (
+	"database/sql"
+	"encoding/hex"
+	"github.com/SeraphJACK/go-annil/logging"
+	_ "github.com/mattn/go-sqlite3"
+	uuid "github.com/satori/go.uuid"
+	"golang.org/x/crypto/bcrypt"
+	"time"
+)
+
+// SQLiteStore is a Store backed by a SQLite database.
+type SQLiteStore struct {
+	db *sql.DB
+}
+
+// OpenSQLite opens the database at path without migrating it.
+func OpenSQLite(path string) (*SQLiteStore, error) {
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		return nil, err
+	}
+	return &SQLiteStore{db: db}, nil
+}
+
+func (s *SQLiteStore) Close() error {
+	return s.db.Close()
+}
+
+func (s *SQLiteStore) Register(username, password string) error {
+	hashed, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.Exec("INSERT INTO Users(Username,Password) values (?,?)", username, hex.EncodeToString(hashed))
+	if err != nil {
+		logging.Default().Error("Failed to register user", "username", username, "err", err)
+	}
+	return err
+}
+
+func (s *SQLiteStore) CheckPassword(username, password string) bool {
+	var hashed string
+	err := s.db.QueryRow("SELECT `Password` FROM Users WHERE Username=?", username).Scan(&hashed)
+	if err != nil {
+		return false
+	}
+	pwd, err := hex.DecodeString(hashed)
+	if err != nil {
+		return false
+	}
+	err = bcrypt.CompareHashAndPassword(pwd, []byte(password))
+	return err == nil
+}
+
+func (s *SQLiteStore) ChangePassword(username, password string) error {
+	h, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.Exec("UPDATE Users SET Password=?, MustChangePassword=0 WHERE Username=?", hex.EncodeToString(h), username)
+	return err
+}
+
+func (s *SQLiteStore) MustChangePassword(username string) bool {
+	ret := false
+	_ = s.db.QueryRow("SELECT MustChangePassword FROM Users WHERE Username=?", username).Scan(&ret)
+	return ret
+}
+
+func (s *SQLiteStore) SetMustChangePassword(username string, must bool) error {
+	_, err := s.db.Exec("UPDATE Users SET MustChangePassword=? WHERE Username=?", must, username)
+	return err
+}
+
+func (s *SQLiteStore) RegisterDate(username string) (time.Time, error) {
+	var t time.Time
+	err := s.db.QueryRow("SELECT `RegisterTime` FROM Users WHERE Username=?", username).Scan(&t)
+	return t, err
+}
+
+func (s *SQLiteStore) RevokeUser(username string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	for _, q := range []string{
+		"DELETE FROM Users WHERE Username=?",
+		"DELETE FROM Tokens WHERE Username=?",
+		"DELETE FROM GroupMembers WHERE Username=?",
+		"DELETE FROM Sessions WHERE Username=?",
+		"DELETE FROM Totp WHERE `Username`=?",
+		"DELETE FROM RecoveryCodes WHERE `Username`=?",
+		"DELETE FROM Identities WHERE Username=?",
+		"DELETE FROM MailTokens WHERE Username=?",
+	} {
+		_, err = tx.Exec(q, username)
+		if err != nil {
+			_ = tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *SQLiteStore) UserExists(username string) bool {
+	ret := false
+	_ = s.db.QueryRow("SELECT EXISTS(SELECT * FROM Users WHERE Username=?)", username).Scan(&ret)
+	return ret
+}
+
+func (s *SQLiteStore) CountUsers() (int, error) {
+	n := 0
+	err := s.db.QueryRow("SELECT COUNT(*) FROM Users").Scan(&n)
+	return n, err
+}
+
+func (s *SQLiteStore) ListUsers() []User {
+	ret := make([]User, 0)
+	rows, err := s.db.Query("SELECT Username, RegisterTime, `Role`, MustChangePassword, `Email`, `EmailVerified` FROM Users")
+	if err != nil {
+		return ret
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var u User
+		var t time.Time
+		err = rows.Scan(&u.Username, &t, &u.Role, &u.MustChangePassword, &u.Email, &u.EmailVerified)
+		if err != nil {
+			return ret
+		}
+		u.RegisterDate = t.Unix()
+		ret = append(ret, u)
+	}
+	fillPermissions(s, ret)
+	return ret
+}
+
+func (s *SQLiteStore) NewSession(username string, expire time.Time) (string, error) {
+	id := uuid.NewV4().String()
+	_, err := s.db.Exec("INSERT INTO Sessions(`Id`, `Username`, `Expire`) VALUES (?,?,?)", id, username, expire.Unix())
+	if err != nil {
+		return "", err
+	}
+	return id, nil
+}
+
+func (s *SQLiteStore) GetSession(id string) (Session, error) {
+	ret := Session{Id: id}
+	var expire int64
+	err := s.db.QueryRow("SELECT `Username`, `Expire` FROM Sessions WHERE `Id`=?", id).Scan(&ret.Username, &expire)
+	ret.Expire = time.Unix(expire, 0)
+	return ret, err
+}
+
+func (s *SQLiteStore) DeleteSession(id string) error {
+	_, err := s.db.Exec("DELETE FROM Sessions WHERE `Id`=?", id)
+	return err
+}
+
+func (s *SQLiteStore) DeleteExpiredSessions() error {
+	_, err := s.db.Exec("DELETE FROM Sessions WHERE `Expire`<?", time.Now().Unix())
+	return err
+}
+
+func (s *SQLiteStore) CountSessions() (int, error) {
+	n := 0
+	err := s.db.QueryRow("SELECT COUNT(*) FROM Sessions WHERE `Expire`>=?", time.Now().Unix()).Scan(&n)
+	return n, err
+}
+
+func (s *SQLiteStore) ListSessions(username string) []Session {
+	ret := make([]Session, 0)
+	q := "SELECT `Id`, `Username`, `Expire` FROM Sessions WHERE `Expire`>=?"
+	args := []interface{}{time.Now().Unix()}
+	if username != "" {
+		q += " AND `Username`=?"
+		args = append(args, username)
+	}
+	rows, err := s.db.Query(q+" ORDER BY `Expire`", args...)
+	if err != nil {
+		return ret
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var ses Session
+		var expire int64
+		if err = rows.Scan(&ses.Id, &ses.Username, &expire); err != nil {
+			return ret
+		}
+		ses.Expire = time.Unix(expire, 0)
+		ret = append(ret, ses)
+	}
+	return ret
+}
+
+func (s *SQLiteStore) DeleteUserSessions(username string) error {
+	_, err := s.db.Exec("DELETE FROM Sessions WHERE `Username`=?", username)
+	return err
+}
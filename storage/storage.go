@@ -1,193 +1,193 @@
 package storage
 
 import (
-	"database/sql"
-	"encoding/hex"
 	"fmt"
-	_ "github.com/mattn/go-sqlite3"
-	uuid "github.com/satori/go.uuid"
-	"golang.org/x/crypto/bcrypt"
-	"log"
+	"regexp"
 	"time"
 )
 
+// NameExp matches valid names of users, groups and roles.
+var NameExp = regexp.MustCompile("^[0-9a-zA-Z_]{2,15}$")
+
 type User struct {
 	Username     string `json:"username"`
 	RegisterDate int64  `json:"registerTime"`
-	AllowShare   bool   `json:"allowShare"`
-	IsAdmin      bool   `json:"isAdmin"`
-}
-
-type InviteCode struct {
-	Code string `json:"code"`
-	// -1 indicates infinity
-	Limit string `json:"limit"`
-}
-
-var db *sql.DB
+	Role         string `json:"role"`
+	// The password has to be changed before anything else can be done
+	MustChangePassword bool `json:"mustChangePassword"`
+	// Optional, only verified addresses receive password resets
+	Email         string `json:"email"`
+	EmailVerified bool   `json:"emailVerified"`
+	// Derived from the permissions of Role
+	AllowShare bool `json:"allowShare"`
+	IsAdmin    bool `json:"isAdmin"`
+}
+
+type Session struct {
+	Id       string
+	Username string
+	Expire   time.Time
+}
+
+// Store persists users, roles, invite codes, sessions, tokens, groups, the audit log,
+// second factors, external identities, mail tokens and settings.
+type Store interface {
+	Register(username, password string) error
+	CheckPassword(username, password string) bool
+	// ChangePassword also clears the must change password flag
+	ChangePassword(username, password string) error
+	MustChangePassword(username string) bool
+	SetMustChangePassword(username string, must bool) error
+	RegisterDate(username string) (time.Time, error)
+	// RevokeUser deletes a user along with its tokens, sessions, group memberships, second factors,
+	// external identities and mail tokens
+	RevokeUser(username string) error
+	UserExists(username string) bool
+	ListUsers() []User
+	CountUsers() (int, error)
+	SetEmail(username, email string) error
+	UserEmail(username string) (email string, verified bool)
+	EmailUser(email string) (string, error)
+	VerifyEmail(username, email string) error
+
+	UserRole(username string) string
+	SetRole(username, role string) error
+	RoleUsers(role string) []string
+	RoleExists(name string) bool
+	RolePermissions(role string) []string
+	ListRoles() []Role
+	NewRole(name string, perms []string) error
+	SetRolePermissions(name string, perms []string) error
+	DeleteRole(name string) error
+
+	NewInviteCode(code InviteCode) (InviteCode, error)
+	GetInviteCode(code string) (InviteCode, error)
+	ListInviteCodes() []InviteCode
+	// RedeemInviteCode registers username with code, granting the role and groups of the code
+	RedeemInviteCode(code, username, password string) error
+	ListRedemptions(code string) []Redemption
+	RevokeInviteCode(code string) error
+
+	NewSession(username string, expire time.Time) (string, error)
+	GetSession(id string) (Session, error)
+	DeleteSession(id string) error
+	DeleteExpiredSessions() error
+	// CountSessions returns the number of unexpired sessions
+	CountSessions() (int, error)
+	// ListSessions lists the unexpired sessions of username, or of all users if it is empty
+	ListSessions(username string) []Session
+	// DeleteUserSessions logs username out everywhere
+	DeleteUserSessions(username string) error
+
+	NewMailToken(token string, t MailToken) error
+	UseMailToken(token, purpose string) (MailToken, error)
+	DeleteExpiredMailTokens() error
+
+	NewToken(username string, catalogs []string, coverOnly bool, expire int64, note string) (Token, error)
+	GetToken(id string) (Token, error)
+	TokenExists(id string) bool
+	ListTokens(username string) []Token
+	RevokeToken(id string) error
+
+	NewGroup(name string) error
+	GroupExists(name string) bool
+	DeleteGroup(name string) error
+	ListGroups() []Group
+	AddGroupMember(group, username string) error
+	RemoveGroupMember(group, username string) error
+	UserGroups(username string) ([]string, error)
+	AddAccessRule(group, backend, pattern string) (int64, error)
+	RemoveAccessRule(id int64) error
+	ListAccessRules(group string) []AccessRule
+	UserAccessRules(username string) ([]AccessRule, error)
+
+	AppendAudit(e AuditEvent) error
+	QueryAudit(f AuditFilter) []AuditEvent
+
+	// RecordDownload counts a track of catalog streamed to username on the day of t
+	RecordDownload(username, catalog string, t time.Time) error
+	// ListDownloads returns the daily counts from the day of the unix time since on
+	ListDownloads(since int64) []DownloadCount
+
+	SetTotpSecret(username, secret string) error
+	GetTotp(username string) (TotpState, error)
+	EnableTotp(username string) error
+	UseTotpStep(username string, step int64) bool
+	DeleteTotp(username string) error
+	SetRecoveryCodes(username string, codes []string) error
+	UseRecoveryCode(username, code string) bool
+	RecoveryCodesLeft(username string) int
+
+	GetSetting(key string) (string, error)
+	SetSetting(key, value string) error
+
+	LinkIdentity(issuer, subject, username string) error
+	IdentityUser(issuer, subject string) (string, error)
+	UserIdentities(username string) []Identity
+	UnlinkIdentity(issuer, subject string) error
+
+	Close() error
+}
+
+var (
+	_ Store = (*SQLiteStore)(nil)
+	_ Store = (*MemoryStore)(nil)
+)
 
-func Init() error {
-	var err error
-	db, err = sql.Open("sqlite3", "./data.db")
+// CreateOwner registers the first owner account.
+// If mustChange is set, the password has to be changed at first login.
+func CreateOwner(s Store, username, password string, mustChange bool) error {
+	err := s.Register(username, password)
 	if err != nil {
 		return err
 	}
-	_, err = db.Exec("CREATE TABLE IF NOT EXISTS Users (\n    `Username` varchar(64) NOT NULL,\n    `AllowShare` int NOT NULL DEFAULT 0,\n    `RegisterTime` datetime NOT NULL DEFAULT (DATETIME('now')),\n    `Password` varchar(64) NOT NULL,\n    `Admin` int NOT NULL DEFAULT 0,\n    PRIMARY KEY (`Username`)\n)")
-	if err != nil {
-		return err
+	err = s.SetRole(username, RoleOwner)
+	if err == nil {
+		err = s.SetMustChangePassword(username, mustChange)
 	}
-	// If there are no users, add a default admin account
-	// Default password is "12345"
-	_, err = db.Exec("INSERT INTO Users(Username, Password, `Admin`) SELECT \"Admin\", \"24326124313024645a41414b316b7045334557356c56587a7549537165754a773271676f555063794e754a49396e6c62566a35385a5142526b654f61\", 1 WHERE NOT EXISTS(SELECT * FROM Users)")
 	if err != nil {
+		// A half created account would count as a user, and keep the owner from being created again
+		if e := s.RevokeUser(username); e != nil {
+			return fmt.Errorf("%v, and failed to remove the account again: %v", err, e)
+		}
 		return err
 	}
-	_, err = db.Exec("CREATE TABLE IF NOT EXISTS InviteCodes(\n    `Code` varchar(64) NOT NULL,\n    `Limit` int NOT NULL DEFAULT 0,\n    PRIMARY KEY(`Code`)\n)")
 	return nil
 }
 
-func Register(username, password string) error {
-	hashed, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+// ProvisionUser creates the account of a user logging in through an external provider, with
+// role if it is not empty, and links it to subject at issuer. The account is removed again if
+// any step fails, so that it does not keep the name from being provisioned later.
+func ProvisionUser(s Store, username, password, role, issuer, subject string) error {
+	err := s.Register(username, password)
 	if err != nil {
 		return err
 	}
-	_, err = db.Exec("INSERT INTO Users(Username,Password) values (?,?)", username, hex.EncodeToString(hashed))
-	if err != nil {
-		log.Printf("Failed to register user %s: %v\n", username, err)
-	}
-	return err
-}
-
-func CheckPassword(username, password string) bool {
-	var hashed string
-	err := db.QueryRow("SELECT `Password` FROM Users WHERE Username=?", username).Scan(&hashed)
-	if err != nil {
-		return false
-	}
-	pwd, err := hex.DecodeString(hashed)
-	if err != nil {
-		return false
-	}
-	err = bcrypt.CompareHashAndPassword(pwd, []byte(password))
-	return err == nil
-}
-
-func ChangePassword(username, password string) error {
-	h, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
-	if err != nil {
-		return err
-	}
-	_, err = db.Exec("UPDATE Users SET Password=? WHERE Username=?", hex.EncodeToString(h), username)
-	return err
-}
-
-func RegisterDate(username string) (time.Time, error) {
-	var t time.Time
-	err := db.QueryRow("SELECT `RegisterTime` FROM Users WHERE Username=?", username).Scan(&t)
-	return t, err
-}
-
-func RevokeUser(username string) (err error) {
-	_, err = db.Exec("DELETE FROM Users WHERE Username=?", username)
-	return
-}
-
-func UserExists(username string) bool {
-	ret := false
-	_ = db.QueryRow("SELECT EXISTS(SELECT * FROM Users WHERE Username=?)", username).Scan(&ret)
-	return ret
-}
-
-func SetAllowShare(username string, allow bool) error {
-	_, err := db.Exec("UPDATE Users SET AllowShare=? WHERE Username=?", allow, username)
-	if err != nil {
-		log.Printf("Failed to set allow share for %s: %v\n", username, err)
+	if role != "" {
+		err = s.SetRole(username, role)
 	}
-	return err
-}
-
-func AllowShare(username string) bool {
-	ret := false
-	_ = db.QueryRow("SELECT AllowShare FROM Users WHERE Username=?", username).Scan(&ret)
-	return ret
-}
-
-func IsAdmin(username string) bool {
-	ret := false
-	_ = db.QueryRow("SELECT `Admin` FROM Users WHERE Username=?", username).Scan(&ret)
-	return ret
-}
-
-func SetAdmin(username string, admin bool) error {
-	_, err := db.Exec("UPDATE Users SET `Admin`=? WHERE Username=?", admin, username)
-	if err != nil {
-		log.Printf("Failed to set allow share for %s: %v\n", username, err)
+	if err == nil {
+		err = s.LinkIdentity(issuer, subject, username)
 	}
-	return err
-}
-
-func ListUsers() []User {
-	ret := make([]User, 0)
-	rows, err := db.Query("SELECT Username,RegisterDate, AllowShare, IsAdmin FROM Users")
 	if err != nil {
-		return ret
-	}
-	for rows.Next() {
-		var u User
-		var t time.Time
-		err = rows.Scan(&u.Username, &t, &u.AllowShare, &u.IsAdmin)
-		if err != nil {
-			return ret
+		if e := s.RevokeUser(username); e != nil {
+			return fmt.Errorf("%v, and failed to remove the account again: %v", err, e)
 		}
-		u.RegisterDate = t.Unix()
-		ret = append(ret, u)
-	}
-	return ret
-}
-
-func NewInviteCode(limit int) (string, error) {
-	if limit == 0 {
-		return "", fmt.Errorf("invalid limit")
-	}
-	code := uuid.NewV4().String()
-	_, err := db.Exec("INSERT INTO InviteCodes(`Code`, `Limit`) VALUES (?,?)", code, limit)
-	if err != nil {
-		return "", err
+		return err
 	}
-	return code, nil
+	return nil
 }
 
-func ListInviteCodes() []InviteCode {
-	ret := make([]InviteCode, 0)
-	rows, err := db.Query("SELECT Code, `Limit` FROM InviteCodes")
-	if err != nil {
-		return ret
-	}
-	for rows.Next() {
-		var r InviteCode
-		err = rows.Scan(&r.Code, &r.Limit)
-		if err != nil {
-			return ret
+// fillPermissions sets the flags derived from the role of each user.
+func fillPermissions(s Store, users []User) {
+	for i := range users {
+		for _, p := range s.RolePermissions(users[i].Role) {
+			switch p {
+			case PermShare:
+				users[i].AllowShare = true
+			case PermManageUsers:
+				users[i].IsAdmin = true
+			}
 		}
-		ret = append(ret, r)
-	}
-	return ret
-}
-
-func ShrinkInviteCode(code string) bool {
-	ok := false
-	err := db.QueryRow("SELECT EXISTS(SELECT * FROM InviteCodes WHERE Code=? AND (`Limit`>0 or `Limit`=-1))", code).Scan(&ok)
-	if err != nil {
-		return false
 	}
-	_, err = db.Exec("UPDATE InviteCodes SET `Limit`=`Limit`-1 WHERE Code=? AND `Limit`>0; DELETE FROM InviteCodes WHERE `Limit`=0", code)
-	if err != nil {
-		log.Printf("Failed to shrink invite code: %v", err)
-	}
-	return ok
-}
-
-func RevokeInviteCode(code string) error {
-	_, err := db.Exec("DELETE FROM InviteCodes WHERE Code=?", code)
-	return err
 }
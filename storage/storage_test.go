@@ -1,53 +1,150 @@
 package storage
 
 import (
-	"os"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sync"
 	"testing"
 	"time"
 )
 
+// forEachStore runs f against every Store implementation.
+func forEachStore(t *testing.T, f func(t *testing.T, s Store)) {
+	t.Run("sqlite", func(t *testing.T) {
+		s, err := OpenSQLite(filepath.Join(t.TempDir(), "data.db"))
+		if err != nil {
+			t.Fatalf("failed to open database: %v", err)
+		}
+		defer s.Close()
+		err = s.Migrate()
+		if err != nil {
+			t.Fatalf("failed to migrate: %v", err)
+		}
+		f(t, s)
+	})
+	t.Run("memory", func(t *testing.T) {
+		f(t, NewMemoryStore())
+	})
+}
+
+func mustGroups(t *testing.T, s Store, username string) []string {
+	g, err := s.UserGroups(username)
+	if err != nil {
+		t.Fatalf("failed to list groups of %s: %v", username, err)
+	}
+	return g
+}
+
+func mustRules(t *testing.T, s Store, username string) []AccessRule {
+	r, err := s.UserAccessRules(username)
+	if err != nil {
+		t.Fatalf("failed to list access rules of %s: %v", username, err)
+	}
+	return r
+}
+
+// brokenRoles fails to assign roles.
+type brokenRoles struct {
+	Store
+}
+
+func (brokenRoles) SetRole(string, string) error {
+	return errors.New("database is locked")
+}
+
+func TestCreateOwnerRollback(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s Store) {
+		if err := CreateOwner(brokenRoles{s}, "Admin", "12345", false); err == nil {
+			t.Errorf("owner created without a role")
+		}
+		if n, _ := s.CountUsers(); n != 0 || s.UserExists("Admin") {
+			t.Errorf("half created owner left behind")
+		}
+	})
+}
+
+func TestProvisionUser(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s Store) {
+		if err := ProvisionUser(s, "alice", "123456", RoleMember, "https://op", "1"); err != nil {
+			t.Fatalf("failed to provision: %v", err)
+		}
+		if name, _ := s.IdentityUser("https://op", "1"); name != "alice" || s.UserRole("alice") != RoleMember {
+			t.Errorf("wrong provisioned user: %s %s", name, s.UserRole("alice"))
+		}
+		// The subject is taken, the account must not stay behind
+		if err := ProvisionUser(s, "bob", "123456", "", "https://op", "1"); err == nil {
+			t.Errorf("provisioned a linked subject")
+		}
+		if s.UserExists("bob") {
+			t.Errorf("account left behind by a failed link")
+		}
+	})
+}
+
 func TestUser(t *testing.T) {
-	err := Init()
+	forEachStore(t, testUser)
+}
+
+func testUser(t *testing.T, s Store) {
+	err := CreateOwner(s, "Admin", "12345", true)
 	if err != nil {
 		t.Errorf("failed to init: %v", err)
 		t.FailNow()
 	}
-	if !UserExists("Admin") {
-		t.Errorf("no default user")
+	if !s.UserExists("Admin") || s.UserRole("Admin") != RoleOwner {
+		t.Errorf("no owner")
+		t.Fail()
+	}
+	if !s.CheckPassword("Admin", "12345") {
+		t.Errorf("owner password incorrect")
+		t.Fail()
+	}
+	if !s.MustChangePassword("Admin") || !s.ListUsers()[0].MustChangePassword {
+		t.Errorf("owner not required to change password")
 		t.Fail()
 	}
-	if !CheckPassword("Admin", "12345") {
-		t.Errorf("default admin password incorrect")
+	if n, err := s.CountUsers(); n != 1 || err != nil {
+		t.Errorf("wrong user count: %d %v", n, err)
+	}
+	err = s.ChangePassword("Admin", "54321")
+	if err != nil || s.MustChangePassword("Admin") {
+		t.Errorf("must change password flag not cleared: %v", err)
+		t.Fail()
+	}
+	err = s.ChangePassword("Admin", "12345")
+	if err != nil {
+		t.Errorf("failed to change password: %v", err)
 		t.Fail()
 	}
 
-	err = Register("TestUser2", "123456")
+	err = s.Register("TestUser2", "123456")
 	if err != nil {
 		t.Errorf("failed to create user: %v", err)
 		t.FailNow()
 	}
-	if !CheckPassword("TestUser2", "123456") {
+	if !s.CheckPassword("TestUser2", "123456") {
 		t.Errorf("failed to check password")
 		t.Fail()
 	}
-	if CheckPassword("TestUser2", "random") {
+	if s.CheckPassword("TestUser2", "random") {
 		t.Errorf("failed to check password")
 		t.Fail()
 	}
-	err = ChangePassword("TestUser2", "1234567")
+	err = s.ChangePassword("TestUser2", "1234567")
 	if err != nil {
 		t.Errorf("failed to change password")
 	}
-	if !CheckPassword("TestUser2", "1234567") {
+	if !s.CheckPassword("TestUser2", "1234567") {
 		t.Errorf("failed to check password")
 		t.Fail()
 	}
-	if CheckPassword("TestUser2", "123456") {
+	if s.CheckPassword("TestUser2", "123456") {
 		t.Errorf("failed to check password")
 		t.Fail()
 	}
 
-	date, err := RegisterDate("TestUser2")
+	date, err := s.RegisterDate("TestUser2")
 	if err != nil {
 		t.Errorf("failed to read register date: %v", err)
 		t.Fail()
@@ -58,93 +155,627 @@ func TestUser(t *testing.T) {
 		t.Fail()
 	}
 
-	if AllowShare("TestUser2") {
-		t.Errorf("wrong default ")
+	if s.UserRole("TestUser2") != RoleGuest || HasPermission(s, "TestUser2", PermShare) {
+		t.Errorf("wrong default role")
 		t.Fail()
 	}
-	err = SetAllowShare("TestUser2", true)
+	err = s.SetRole("TestUser2", RoleMember)
 	if err != nil {
-		t.Errorf("failed to allow share")
+		t.Errorf("failed to set role: %v", err)
 		t.Fail()
 	}
-	if !AllowShare("TestUser2") {
+	if !HasPermission(s, "TestUser2", PermShare) {
 		t.Errorf("wrong allow share")
 		t.Fail()
 	}
-	err = SetAllowShare("TestUser2", false)
+	if HasPermission(s, "TestUser2", PermManageUsers) {
+		t.Errorf("wrong default admin")
+		t.Fail()
+	}
+	err = s.SetRole("TestUser2", RoleAdmin)
 	if err != nil {
-		t.Errorf("failed to allow share")
+		t.Errorf("failed to set role: %v", err)
 		t.Fail()
 	}
-
-	if IsAdmin("TestUser2") {
-		t.Errorf("wrong default admin")
+	if !HasPermission(s, "TestUser2", PermManageUsers) {
+		t.Error("wrong admin")
+		t.Fail()
+	}
+	if s.SetRole("TestUser2", "nonexistent") == nil {
+		t.Error("unknown role accepted")
 		t.Fail()
 	}
 
-	err = SetAdmin("TestUser2", true)
+	err = s.NewRole("uploader", []string{PermShare, PermManageInvites})
 	if err != nil {
-		t.Errorf("failed to set admin: %v", err)
+		t.Errorf("failed to create role: %v", err)
+		t.FailNow()
+	}
+	err = s.SetRole("TestUser2", "uploader")
+	if err != nil {
+		t.Errorf("failed to set role: %v", err)
 		t.Fail()
 	}
-	if !IsAdmin("TestUser2") {
-		t.Error("wrong admin")
+	if !HasPermission(s, "TestUser2", PermManageInvites) || HasPermission(s, "TestUser2", PermManageUsers) {
+		t.Error("wrong custom role permissions")
 		t.Fail()
 	}
-	err = SetAdmin("TestUser2", false)
+	if s.DeleteRole("uploader") == nil {
+		t.Error("deleted role in use")
+		t.Fail()
+	}
+	err = s.SetRolePermissions("uploader", []string{PermShare})
 	if err != nil {
-		t.Errorf("failed to set admin: %v", err)
+		t.Errorf("failed to set role permissions: %v", err)
 		t.Fail()
 	}
-	if IsAdmin("TestUser2") {
-		t.Error("wrong admin")
+	if HasPermission(s, "TestUser2", PermManageInvites) {
+		t.Error("wrong custom role permissions")
+		t.Fail()
+	}
+	users := s.ListUsers()
+	if len(users) != 2 {
+		t.Errorf("wrong user list: %v", users)
+		t.Fail()
+	}
+	for _, u := range users {
+		if u.Username == "Admin" && (u.Role != RoleOwner || !u.IsAdmin) {
+			t.Errorf("wrong default admin: %v", u)
+			t.Fail()
+		}
+	}
+	err = s.SetRole("TestUser2", RoleGuest)
+	if err != nil {
+		t.Errorf("failed to set role: %v", err)
+		t.Fail()
+	}
+	err = s.DeleteRole("uploader")
+	if err != nil {
+		t.Errorf("failed to delete role: %v", err)
+		t.Fail()
+	}
+	if s.RoleExists("uploader") || len(s.ListRoles()) != 4 {
+		t.Error("wrong role exist")
 		t.Fail()
 	}
-	err = RevokeUser("TestUser2")
+	err = s.RevokeUser("TestUser2")
 	if err != nil {
 		t.Errorf("failed tr revoke user: %v", err)
 		t.Fail()
 	}
-	if UserExists("TestUser2") {
+	if s.UserExists("TestUser2") {
 		t.Errorf("wrong user exist")
 		t.Fail()
 	}
-	code, err := NewInviteCode(1)
+	code, err := s.NewInviteCode(InviteCode{Limit: 1})
 	if err != nil {
 		t.Errorf("failed to create invite code: %v", err)
 		t.FailNow()
 	}
-	if !ShrinkInviteCode(code) {
-		t.Errorf("wrong shrink invite code return value")
+	if err = s.RedeemInviteCode(code.Code, "TestUser3", "TestPassword"); err != nil {
+		t.Errorf("failed to redeem invite code: %v", err)
 		t.Fail()
 	}
-	if ShrinkInviteCode(code) {
-		t.Errorf("wrong shrink invite code return value")
+	if err = s.RedeemInviteCode(code.Code, "TestUser4", "TestPassword"); err != ErrInvalidInviteCode {
+		t.Errorf("wrong redeem invite code return value: %v", err)
 		t.Fail()
 	}
 
-	code, err = NewInviteCode(-1)
+	code, err = s.NewInviteCode(InviteCode{Limit: -1})
 	if err != nil {
 		t.Errorf("failed to create invite code: %v", err)
 		t.FailNow()
 	}
-	for i := 0; i < 100; i++ {
-		if !ShrinkInviteCode(code) {
-			t.Errorf("wrong shrink invite code return value")
+	for i := 0; i < 5; i++ {
+		if err = s.RedeemInviteCode(code.Code, fmt.Sprintf("TestUser%d", i+4), "TestPassword"); err != nil {
+			t.Errorf("failed to redeem invite code: %v", err)
 			t.Fail()
 		}
 	}
-	err = RevokeInviteCode(code)
+	err = s.RevokeInviteCode(code.Code)
 	if err != nil {
 		t.Errorf("failed to revoke invite code: %v", err)
 		t.FailNow()
 	}
 	for i := 0; i < 50; i++ {
-		_, _ = NewInviteCode(-1)
+		_, _ = s.NewInviteCode(InviteCode{Limit: -1})
+	}
+	// The used up code is kept for its history
+	if len(s.ListInviteCodes()) != 51 {
+		t.Fail()
+	}
+}
+
+func TestRevokeUserAtomic(t *testing.T) {
+	s, err := OpenSQLite(filepath.Join(t.TempDir(), "data.db"))
+	if err != nil {
+		t.Fatalf("failed to open database: %v", err)
+	}
+	defer s.Close()
+	if err = s.Migrate(); err != nil {
+		t.Fatalf("failed to migrate: %v", err)
+	}
+	_ = s.Register("alice", "123456")
+	if _, err = s.NewToken("alice", nil, false, 0, ""); err != nil {
+		t.Fatalf("failed to create token: %v", err)
+	}
+	// The last statement fails, nothing may be deleted
+	if _, err = s.db.Exec("DROP TABLE MailTokens"); err != nil {
+		t.Fatalf("failed to drop table: %v", err)
+	}
+	if err = s.RevokeUser("alice"); err == nil {
+		t.Fatalf("revoked a user with a broken table")
+	}
+	if !s.UserExists("alice") || len(s.ListTokens("alice")) != 1 {
+		t.Errorf("failed revocation was partially applied")
+	}
+}
+
+func TestInviteCode(t *testing.T) {
+	forEachStore(t, testInviteCode)
+}
+
+func testInviteCode(t *testing.T, s Store) {
+	_ = s.NewGroup("friends")
+	code, err := s.NewInviteCode(InviteCode{
+		Limit:   2,
+		Creator: "Admin",
+		Note:    "for friends",
+		Role:    RoleMember,
+		Groups:  []string{"friends", "missing"},
+	})
+	if err != nil {
+		t.Fatalf("failed to create invite code: %v", err)
+	}
+	if code.CreateTime == 0 || len(code.Code) == 0 {
+		t.Errorf("invite code not filled in: %v", code)
+	}
+	if err = s.RedeemInviteCode(code.Code, "alice", "123456"); err != nil {
+		t.Fatalf("failed to redeem invite code: %v", err)
+	}
+	if g := mustGroups(t, s, "alice"); s.UserRole("alice") != RoleMember || len(g) != 1 {
+		t.Errorf("invite code grants not applied: %s %v", s.UserRole("alice"), g)
+	}
+	if !s.CheckPassword("alice", "123456") {
+		t.Errorf("wrong password after redeeming")
+	}
+	if err = s.RedeemInviteCode(code.Code, "alice", "123456"); err == nil {
+		t.Errorf("registered an existing user")
+	}
+	c, err := s.GetInviteCode(code.Code)
+	if err != nil || c.Limit != 1 || c.Redeemed != 1 || c.Note != "for friends" || c.Creator != "Admin" || len(c.Groups) != 2 {
+		t.Errorf("wrong invite code after redeeming: %v %v", c, err)
+	}
+	r := s.ListRedemptions(code.Code)
+	if len(r) != 1 || r[0].Username != "alice" || r[0].Time == 0 {
+		t.Errorf("wrong redemptions: %v", r)
+	}
+
+	expired, _ := s.NewInviteCode(InviteCode{Limit: -1, Expire: time.Now().Add(-time.Minute).Unix()})
+	if err = s.RedeemInviteCode(expired.Code, "bob", "123456"); err != ErrInvalidInviteCode || s.UserExists("bob") {
+		t.Errorf("redeemed an expired invite code: %v", err)
+	}
+	if err = s.RedeemInviteCode("missing", "bob", "123456"); err != ErrInvalidInviteCode {
+		t.Errorf("redeemed a missing invite code: %v", err)
+	}
+	if err = s.RevokeInviteCode(code.Code); err != nil || len(s.ListRedemptions("")) != 1 {
+		t.Errorf("redemption history lost after revoking: %v", err)
+	}
+
+	// Concurrent registrations must not overspend the code
+	limited, _ := s.NewInviteCode(InviteCode{Limit: 3})
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	redeemed := 0
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if s.RedeemInviteCode(limited.Code, fmt.Sprintf("user%d", i), "123456") == nil {
+				mu.Lock()
+				redeemed++
+				mu.Unlock()
+			}
+		}(i)
+	}
+	wg.Wait()
+	if redeemed != 3 || len(s.ListRedemptions(limited.Code)) != 3 {
+		t.Errorf("invite code with limit 3 redeemed %d times", redeemed)
+	}
+}
+
+func TestToken(t *testing.T) {
+	forEachStore(t, testToken)
+}
+
+func testToken(t *testing.T, s Store) {
+	err := CreateOwner(s, "Admin", "12345", false)
+	if err != nil {
+		t.Errorf("failed to init: %v", err)
+		t.FailNow()
+	}
+	err = s.Register("TokenUser", "123456")
+	if err != nil {
+		t.Errorf("failed to create user: %v", err)
+		t.FailNow()
+	}
+	tok, err := s.NewToken("TokenUser", []string{"LACA-12345"}, true, 0, "kiosk")
+	if err != nil {
+		t.Errorf("failed to create token: %v", err)
+		t.FailNow()
+	}
+	got, err := s.GetToken(tok.Id)
+	if err != nil {
+		t.Errorf("failed to read token: %v", err)
+		t.FailNow()
+	}
+	if got.Username != "TokenUser" || !got.CoverOnly || got.Note != "kiosk" ||
+		len(got.Catalogs) != 1 || got.Catalogs[0] != "LACA-12345" || got.IssueTime != tok.IssueTime {
+		t.Errorf("wrong token: %+v", got)
+		t.Fail()
+	}
+	if len(s.ListTokens("TokenUser")) != 1 {
+		t.Errorf("wrong token list")
+		t.Fail()
+	}
+	err = s.RevokeToken(tok.Id)
+	if err != nil {
+		t.Errorf("failed to revoke token: %v", err)
+		t.Fail()
+	}
+	if s.TokenExists(tok.Id) {
+		t.Errorf("wrong token exist")
+		t.Fail()
+	}
+	_, _ = s.NewToken("TokenUser", nil, false, 0, "")
+	_ = s.RevokeUser("TokenUser")
+	if len(s.ListTokens("TokenUser")) != 0 {
+		t.Errorf("tokens not removed with user")
+		t.Fail()
+	}
+}
+
+func TestGroup(t *testing.T) {
+	forEachStore(t, testGroup)
+}
+
+func testGroup(t *testing.T, s Store) {
+	err := CreateOwner(s, "Admin", "12345", false)
+	if err != nil {
+		t.Errorf("failed to init: %v", err)
+		t.FailNow()
+	}
+	err = s.Register("GroupUser", "123456")
+	if err != nil {
+		t.Errorf("failed to create user: %v", err)
+		t.FailNow()
+	}
+	err = s.NewGroup("guests")
+	if err != nil {
+		t.Errorf("failed to create group: %v", err)
+		t.FailNow()
+	}
+	if !s.GroupExists("guests") {
+		t.Errorf("wrong group exist")
+		t.Fail()
+	}
+	err = s.AddGroupMember("guests", "GroupUser")
+	if err != nil {
+		t.Errorf("failed to add member: %v", err)
+		t.Fail()
+	}
+	if g := mustGroups(t, s, "GroupUser"); len(g) != 1 || g[0] != "guests" {
+		t.Errorf("wrong user groups: %v", g)
+		t.Fail()
+	}
+	id, err := s.AddAccessRule("guests", "friend", "LACA-*")
+	if err != nil {
+		t.Errorf("failed to add access rule: %v", err)
+		t.FailNow()
+	}
+	if r := mustRules(t, s, "GroupUser"); len(r) != 1 || r[0].Id != id || r[0].Backend != "friend" {
+		t.Errorf("wrong user access rules: %v", r)
+		t.Fail()
+	}
+	err = s.RemoveAccessRule(id)
+	if err != nil {
+		t.Errorf("failed to remove access rule: %v", err)
+		t.Fail()
+	}
+	if len(s.ListAccessRules("guests")) != 0 {
+		t.Errorf("wrong access rules")
+		t.Fail()
+	}
+	_, _ = s.AddAccessRule("guests", "", "")
+	err = s.DeleteGroup("guests")
+	if err != nil {
+		t.Errorf("failed to delete group: %v", err)
+		t.Fail()
 	}
-	if len(ListInviteCodes()) != 50 {
+	if len(mustGroups(t, s, "GroupUser")) != 0 || len(s.ListAccessRules("")) != 0 || len(s.ListGroups()) != 0 {
+		t.Errorf("group not fully deleted")
 		t.Fail()
 	}
+	_ = s.RevokeUser("GroupUser")
+}
+
+func TestGroupQueryError(t *testing.T) {
+	s, err := OpenSQLite(filepath.Join(t.TempDir(), "data.db"))
+	if err != nil {
+		t.Fatalf("failed to open database: %v", err)
+	}
+	if err = s.Migrate(); err != nil {
+		t.Fatalf("failed to migrate: %v", err)
+	}
+	_ = s.Close()
+	if _, err = s.UserGroups("alice"); err == nil {
+		t.Errorf("listed groups of a closed database")
+	}
+	if _, err = s.UserAccessRules("alice"); err == nil {
+		t.Errorf("listed access rules of a closed database")
+	}
+}
+
+func TestSession(t *testing.T) {
+	forEachStore(t, testSession)
+}
+
+func testSession(t *testing.T, s Store) {
+	err := s.Register("SessionUser", "123456")
+	if err != nil {
+		t.Fatalf("failed to create user: %v", err)
+	}
+	sid, err := s.NewSession("SessionUser", time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatalf("failed to create session: %v", err)
+	}
+	expired, _ := s.NewSession("SessionUser", time.Now().Add(-time.Hour))
+	if n, err := s.CountSessions(); err != nil || n != 1 {
+		t.Errorf("wrong session count %d: %v", n, err)
+	}
+	_ = s.Register("OtherUser", "123456")
+	other, _ := s.NewSession("OtherUser", time.Now().Add(2*time.Hour))
+	if l := s.ListSessions("SessionUser"); len(l) != 1 || l[0].Id != sid {
+		t.Errorf("wrong sessions of user: %v", l)
+	}
+	if l := s.ListSessions(""); len(l) != 2 || l[1].Id != other {
+		t.Errorf("wrong sessions: %v", l)
+	}
+	ses, err := s.GetSession(sid)
+	if err != nil || ses.Username != "SessionUser" {
+		t.Errorf("wrong session %v: %v", ses, err)
+	}
+	err = s.DeleteExpiredSessions()
+	if err != nil {
+		t.Errorf("failed to delete expired sessions: %v", err)
+	}
+	if _, err = s.GetSession(expired); err == nil {
+		t.Errorf("expired session not deleted")
+	}
+	if _, err = s.GetSession(sid); err != nil {
+		t.Errorf("valid session deleted: %v", err)
+	}
+	err = s.DeleteSession(sid)
+	if err != nil {
+		t.Errorf("failed to delete session: %v", err)
+	}
+	if _, err = s.GetSession(sid); err == nil {
+		t.Errorf("session not deleted")
+	}
+	sid, _ = s.NewSession("SessionUser", time.Now().Add(time.Hour))
+	_ = s.RevokeUser("SessionUser")
+	if _, err = s.GetSession(sid); err == nil {
+		t.Errorf("session not deleted with user")
+	}
+}
 
-	_ = os.Remove("data.db")
+func TestAudit(t *testing.T) {
+	forEachStore(t, testAudit)
+}
+
+func testAudit(t *testing.T, s Store) {
+	events := []AuditEvent{
+		{Time: 100, Actor: "Admin", Action: "login", IP: "127.0.0.1", Status: 200},
+		{Time: 200, Actor: "Admin", Action: "revoke", Target: "alice", Status: 200},
+		{Time: 300, Action: "login", Target: "", Actor: "alice", Status: 401},
+		{Time: 400, Actor: "bob", Action: "changePassword", Target: "bob", Status: 403, Reason: "WRONG_OLD_PASSWORD"},
+	}
+	for _, e := range events {
+		if err := s.AppendAudit(e); err != nil {
+			t.Fatalf("failed to append audit event: %v", err)
+		}
+	}
+	all := s.QueryAudit(AuditFilter{})
+	if len(all) != 4 || all[0].Id >= all[1].Id || all[3].Reason != "WRONG_OLD_PASSWORD" || all[0].IP != "127.0.0.1" {
+		t.Errorf("wrong audit log: %v", all)
+	}
+	for _, c := range []struct {
+		f    AuditFilter
+		want int
+	}{
+		{AuditFilter{User: "alice"}, 2},
+		{AuditFilter{Action: "login"}, 2},
+		{AuditFilter{Since: 200, Until: 300}, 2},
+		{AuditFilter{Action: "login", Since: 200}, 1},
+		{AuditFilter{Limit: 3}, 3},
+	} {
+		if got := s.QueryAudit(c.f); len(got) != c.want {
+			t.Errorf("wrong events for %+v: %v", c.f, got)
+		}
+	}
+	// The latest events are kept
+	if got := s.QueryAudit(AuditFilter{Limit: 1}); len(got) != 1 || got[0].Actor != "bob" {
+		t.Errorf("wrong limited events: %v", got)
+	}
+}
+
+func TestDownloads(t *testing.T) {
+	forEachStore(t, testDownloads)
+}
+
+func testDownloads(t *testing.T, s Store) {
+	day := time.Date(2021, 4, 10, 0, 0, 0, 0, time.UTC)
+	for _, d := range []struct {
+		user, catalog string
+		t             time.Time
+	}{
+		{"alice", "LACA-1", day.Add(time.Hour)},
+		{"alice", "LACA-1", day.Add(23 * time.Hour)},
+		{"bob", "LACA-1", day.Add(2 * time.Hour)},
+		{"alice", "LACA-2", day.Add(25 * time.Hour)},
+		{"alice", "LACA-2", day.Add(-time.Hour)},
+	} {
+		if err := s.RecordDownload(d.user, d.catalog, d.t); err != nil {
+			t.Fatalf("failed to record download: %v", err)
+		}
+	}
+	got := s.ListDownloads(day.Add(time.Hour).Unix())
+	want := []DownloadCount{
+		{day.Unix(), "alice", "LACA-1", 2},
+		{day.Unix(), "bob", "LACA-1", 1},
+		{day.Unix() + 86400, "alice", "LACA-2", 1},
+	}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("wrong downloads %v, expected %v", got, want)
+	}
+}
+
+func TestTotp(t *testing.T) {
+	forEachStore(t, testTotp)
+}
+
+func testTotp(t *testing.T, s Store) {
+	_ = s.Register("alice", "123456")
+	if _, err := s.GetTotp("alice"); err == nil {
+		t.Errorf("totp state of a user who never enrolled")
+	}
+	if err := s.SetTotpSecret("alice", "SECRET"); err != nil {
+		t.Fatalf("failed to set totp secret: %v", err)
+	}
+	if st, err := s.GetTotp("alice"); err != nil || st.Secret != "SECRET" || st.Enabled {
+		t.Errorf("wrong totp state: %v %v", st, err)
+	}
+	_ = s.EnableTotp("alice")
+	if !s.UseTotpStep("alice", 10) || s.UseTotpStep("alice", 10) || s.UseTotpStep("alice", 9) || !s.UseTotpStep("alice", 11) {
+		t.Errorf("wrong totp replay protection")
+	}
+	if st, _ := s.GetTotp("alice"); !st.Enabled || st.LastStep != 11 {
+		t.Errorf("wrong totp state: %v", st)
+	}
+
+	_ = s.SetRecoveryCodes("alice", []string{"abcd-efgh", "ijkl-mnop"})
+	if s.RecoveryCodesLeft("alice") != 2 {
+		t.Errorf("wrong recovery codes left: %d", s.RecoveryCodesLeft("alice"))
+	}
+	if !s.UseRecoveryCode("alice", "ABCDEFGH") || s.UseRecoveryCode("alice", "abcd-efgh") || s.UseRecoveryCode("bob", "ijkl-mnop") {
+		t.Errorf("wrong recovery code behaviour")
+	}
+	if s.RecoveryCodesLeft("alice") != 1 {
+		t.Errorf("recovery code not consumed")
+	}
+
+	_ = s.SetSetting(SettingTotpRequiredRoles, "owner,admin")
+	if required, err := TotpRequired(s, "alice"); required || err != nil {
+		t.Errorf("totp required for a guest: %v", err)
+	}
+	_ = s.SetRole("alice", RoleAdmin)
+	if required, err := TotpRequired(s, "alice"); !required || err != nil {
+		t.Errorf("totp not required for an admin: %v", err)
+	}
+	if _, err := TotpRequired(s, "nobody"); err == nil {
+		t.Errorf("requirement of a user without role checked")
+	}
+
+	_ = s.RevokeUser("alice")
+	if _, err := s.GetTotp("alice"); err == nil || s.RecoveryCodesLeft("alice") != 0 {
+		t.Errorf("totp not deleted with user")
+	}
+}
+
+func TestIdentity(t *testing.T) {
+	forEachStore(t, testIdentity)
+}
+
+func testIdentity(t *testing.T, s Store) {
+	_ = s.Register("alice", "123456")
+	if err := s.LinkIdentity("https://id.example", "1234", "alice"); err != nil {
+		t.Fatalf("failed to link identity: %v", err)
+	}
+	if err := s.LinkIdentity("https://id.example", "1234", "bob"); err == nil {
+		t.Errorf("linked an identity twice")
+	}
+	if u, err := s.IdentityUser("https://id.example", "1234"); err != nil || u != "alice" {
+		t.Errorf("wrong identity user: %s %v", u, err)
+	}
+	if _, err := s.IdentityUser("https://other.example", "1234"); err == nil {
+		t.Errorf("subject matched across issuers")
+	}
+	if ids := s.UserIdentities("alice"); len(ids) != 1 || ids[0].Subject != "1234" {
+		t.Errorf("wrong identities: %v", ids)
+	}
+	if err := s.UnlinkIdentity("https://id.example", "1234"); err != nil || len(s.UserIdentities("alice")) != 0 {
+		t.Errorf("failed to unlink identity: %v", err)
+	}
+	_ = s.LinkIdentity("https://id.example", "1234", "alice")
+	_ = s.RevokeUser("alice")
+	if _, err := s.IdentityUser("https://id.example", "1234"); err == nil {
+		t.Errorf("identity not deleted with user")
+	}
+}
+
+func TestEmail(t *testing.T) {
+	forEachStore(t, testEmail)
+}
+
+func testEmail(t *testing.T, s Store) {
+	_ = s.Register("alice", "123456")
+	if err := s.SetEmail("alice", "alice@example.com"); err != nil {
+		t.Fatalf("failed to set email: %v", err)
+	}
+	if _, err := s.EmailUser("alice@example.com"); err == nil {
+		t.Errorf("found user by unverified email")
+	}
+	if err := s.VerifyEmail("alice", "old@example.com"); err == nil {
+		t.Errorf("verified an address which was changed")
+	}
+	if err := s.VerifyEmail("alice", "alice@example.com"); err != nil {
+		t.Fatalf("failed to verify email: %v", err)
+	}
+	if u, err := s.EmailUser("alice@example.com"); err != nil || u != "alice" {
+		t.Errorf("wrong email user: %s %v", u, err)
+	}
+	if e, v := s.UserEmail("alice"); e != "alice@example.com" || !v {
+		t.Errorf("wrong email: %s %v", e, v)
+	}
+	if users := s.ListUsers(); users[0].Email != "alice@example.com" || !users[0].EmailVerified {
+		t.Errorf("email not listed: %v", users)
+	}
+
+	expire := time.Now().Add(time.Hour).Unix()
+	_ = s.NewMailToken("first", MailToken{Username: "alice", Purpose: MailTokenReset, Email: "alice@example.com", Expire: expire})
+	_ = s.NewMailToken("second", MailToken{Username: "alice", Purpose: MailTokenReset, Email: "alice@example.com", Expire: expire})
+	if _, err := s.UseMailToken("first", MailTokenReset); err == nil {
+		t.Errorf("replaced token still usable")
+	}
+	if _, err := s.UseMailToken("second", MailTokenVerify); err == nil {
+		t.Errorf("token used for another purpose")
+	}
+	if tk, err := s.UseMailToken("second", MailTokenReset); err != nil || tk.Username != "alice" {
+		t.Errorf("failed to use token: %v", err)
+	}
+	if _, err := s.UseMailToken("second", MailTokenReset); err == nil {
+		t.Errorf("token used twice")
+	}
+	_ = s.NewMailToken("expired", MailToken{Username: "alice", Purpose: MailTokenVerify, Expire: time.Now().Add(-time.Minute).Unix()})
+	if _, err := s.UseMailToken("expired", MailTokenVerify); err == nil {
+		t.Errorf("expired token used")
+	}
+
+	a, _ := s.NewSession("alice", time.Now().Add(time.Hour))
+	if err := s.DeleteUserSessions("alice"); err != nil {
+		t.Fatalf("failed to delete sessions: %v", err)
+	}
+	if _, err := s.GetSession(a); err == nil {
+		t.Errorf("session not deleted")
+	}
 }
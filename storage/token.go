@@ -0,0 +1,105 @@
+package storage
+
+import (
+	"encoding/json"
+	uuid "github.com/satori/go.uuid"
+	"time"
+)
+
+// Token is an entry of the user token registry.
+type Token struct {
+	Id        string `json:"id"`
+	Username  string `json:"username"`
+	IssueTime int64  `json:"issueTime"`
+	// 0 indicates the token never expires
+	Expire int64 `json:"expire"`
+	// Empty indicates all catalogs are allowed
+	Catalogs  []string `json:"catalogs"`
+	CoverOnly bool     `json:"coverOnly"`
+	Note      string   `json:"note"`
+}
+
+// NewToken records a token in the registry and returns it with its id and issue time filled in.
+func (s *SQLiteStore) NewToken(username string, catalogs []string, coverOnly bool, expire int64, note string) (Token, error) {
+	if catalogs == nil {
+		catalogs = []string{}
+	}
+	t := Token{
+		Id:        uuid.NewV4().String(),
+		Username:  username,
+		IssueTime: time.Now().Unix(),
+		Expire:    expire,
+		Catalogs:  catalogs,
+		CoverOnly: coverOnly,
+		Note:      note,
+	}
+	c, err := json.Marshal(catalogs)
+	if err != nil {
+		return Token{}, err
+	}
+	_, err = s.db.Exec("INSERT INTO Tokens(`Id`, `Username`, `IssueTime`, `Expire`, `Catalogs`, `CoverOnly`, `Note`) VALUES (?,?,?,?,?,?,?)",
+		t.Id, t.Username, time.Unix(t.IssueTime, 0), t.Expire, string(c), t.CoverOnly, t.Note)
+	if err != nil {
+		return Token{}, err
+	}
+	return t, nil
+}
+
+func (s *SQLiteStore) GetToken(id string) (Token, error) {
+	return scanToken(s.db.QueryRow("SELECT `Id`, `Username`, `IssueTime`, `Expire`, `Catalogs`, `CoverOnly`, `Note` FROM Tokens WHERE Id=?", id))
+}
+
+func (s *SQLiteStore) TokenExists(id string) bool {
+	ret := false
+	_ = s.db.QueryRow("SELECT EXISTS(SELECT * FROM Tokens WHERE Id=?)", id).Scan(&ret)
+	return ret
+}
+
+// ListTokens lists tokens issued to username, or all tokens if username is empty.
+func (s *SQLiteStore) ListTokens(username string) []Token {
+	ret := make([]Token, 0)
+	query := "SELECT `Id`, `Username`, `IssueTime`, `Expire`, `Catalogs`, `CoverOnly`, `Note` FROM Tokens"
+	args := make([]interface{}, 0)
+	if username != "" {
+		query += " WHERE Username=?"
+		args = append(args, username)
+	}
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return ret
+	}
+	defer rows.Close()
+	for rows.Next() {
+		t, err := scanToken(rows)
+		if err != nil {
+			return ret
+		}
+		ret = append(ret, t)
+	}
+	return ret
+}
+
+func (s *SQLiteStore) RevokeToken(id string) error {
+	_, err := s.db.Exec("DELETE FROM Tokens WHERE Id=?", id)
+	return err
+}
+
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanToken(row scanner) (Token, error) {
+	var t Token
+	var issue time.Time
+	var catalogs string
+	err := row.Scan(&t.Id, &t.Username, &issue, &t.Expire, &catalogs, &t.CoverOnly, &t.Note)
+	if err != nil {
+		return Token{}, err
+	}
+	t.IssueTime = issue.Unix()
+	t.Catalogs = make([]string, 0)
+	if catalogs != "" {
+		err = json.Unmarshal([]byte(catalogs), &t.Catalogs)
+	}
+	return t, err
+}
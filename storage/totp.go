@@ -0,0 +1,118 @@
+package storage
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+// Setting holding the comma separated roles which must enroll TOTP
+const SettingTotpRequiredRoles = "totp.requiredRoles"
+
+// TotpState is the TOTP enrollment of a user.
+type TotpState struct {
+	Secret string
+	// Set once the enrollment is confirmed with a valid code
+	Enabled bool
+	// Latest time step a code was accepted for, to reject replays
+	LastStep int64
+}
+
+// TotpRequired reports whether the role of username has to use TOTP.
+// Callers must treat an error as required, so that a failing database doesn't lift the requirement.
+func TotpRequired(s Store, username string) (bool, error) {
+	roles, err := s.GetSetting(SettingTotpRequiredRoles)
+	if err != nil || roles == "" {
+		return false, err
+	}
+	role := s.UserRole(username)
+	if role == "" {
+		return false, fmt.Errorf("failed to read role of %s", username)
+	}
+	for _, r := range strings.Split(roles, ",") {
+		if r == role {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// hashRecoveryCode hashes a recovery code, ignoring case and separators.
+// Recovery codes are random, so a fast hash is enough.
+func hashRecoveryCode(code string) string {
+	code = strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+	h := sha256.Sum256([]byte(code))
+	return hex.EncodeToString(h[:])
+}
+
+// SetTotpSecret starts a new enrollment of username, replacing the previous one.
+func (s *SQLiteStore) SetTotpSecret(username, secret string) error {
+	_, err := s.db.Exec("INSERT OR REPLACE INTO Totp(`Username`, `Secret`, `Enabled`, `LastStep`) VALUES (?,?,0,0)", username, secret)
+	return err
+}
+
+func (s *SQLiteStore) GetTotp(username string) (TotpState, error) {
+	var t TotpState
+	err := s.db.QueryRow("SELECT `Secret`, `Enabled`, `LastStep` FROM Totp WHERE `Username`=?", username).Scan(&t.Secret, &t.Enabled, &t.LastStep)
+	return t, err
+}
+
+func (s *SQLiteStore) EnableTotp(username string) error {
+	_, err := s.db.Exec("UPDATE Totp SET `Enabled`=1 WHERE `Username`=?", username)
+	return err
+}
+
+// UseTotpStep records that a code of step was accepted.
+// It returns false if a code of the same or a later step was accepted before.
+func (s *SQLiteStore) UseTotpStep(username string, step int64) bool {
+	res, err := s.db.Exec("UPDATE Totp SET `LastStep`=? WHERE `Username`=? AND `LastStep`<?", step, username, step)
+	if err != nil {
+		return false
+	}
+	n, err := res.RowsAffected()
+	return err == nil && n == 1
+}
+
+// DeleteTotp removes the enrollment and recovery codes of username.
+func (s *SQLiteStore) DeleteTotp(username string) error {
+	_, err := s.db.Exec("DELETE FROM Totp WHERE `Username`=?", username)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.Exec("DELETE FROM RecoveryCodes WHERE `Username`=?", username)
+	return err
+}
+
+// SetRecoveryCodes replaces the recovery codes of username, only their hashes are stored.
+func (s *SQLiteStore) SetRecoveryCodes(username string, codes []string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("DELETE FROM RecoveryCodes WHERE `Username`=?", username)
+	for i := 0; err == nil && i < len(codes); i++ {
+		_, err = tx.Exec("INSERT OR IGNORE INTO RecoveryCodes(`Username`, `Hash`) VALUES (?,?)", username, hashRecoveryCode(codes[i]))
+	}
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// UseRecoveryCode consumes code, returning false if it isn't an unused recovery code of username.
+func (s *SQLiteStore) UseRecoveryCode(username, code string) bool {
+	res, err := s.db.Exec("DELETE FROM RecoveryCodes WHERE `Username`=? AND `Hash`=?", username, hashRecoveryCode(code))
+	if err != nil {
+		return false
+	}
+	n, err := res.RowsAffected()
+	return err == nil && n == 1
+}
+
+func (s *SQLiteStore) RecoveryCodesLeft(username string) int {
+	ret := 0
+	_ = s.db.QueryRow("SELECT COUNT(*) FROM RecoveryCodes WHERE `Username`=?", username).Scan(&ret)
+	return ret
+}
@@ -0,0 +1,241 @@
+// Package throttle slows down and locks out repeated failed attempts, such as logins.
+package throttle
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Policy describes how failures of a key are throttled.
+type Policy struct {
+	// Failures allowed before further attempts are delayed
+	Free int
+	// Delay after the first delayed failure, doubled for every further failure up to MaxDelay
+	Delay    time.Duration
+	MaxDelay time.Duration
+	// Failures before the key is locked out for LockoutFor, 0 disables lockout
+	Lockout    int
+	LockoutFor time.Duration
+	// Failures are forgotten once none happened for Window, 0 remembers them until Reset
+	Window time.Duration
+}
+
+// Lock describes a locked out key.
+type Lock struct {
+	Key   string `json:"key"`
+	Until int64  `json:"until"`
+}
+
+type entry struct {
+	failures    int
+	last        time.Time
+	next        time.Time
+	lockedUntil time.Time
+}
+
+// Limiter tracks failures per key in memory.
+type Limiter struct {
+	mu      sync.Mutex
+	policy  Policy
+	entries map[string]*entry
+	max     int
+	now     func() time.Time
+}
+
+const (
+	// pruneSize is the number of tracked keys above which stale entries are dropped.
+	pruneSize = 1024
+	// maxSize caps the number of tracked keys, the least recently failed ones are evicted
+	// beyond it so that failures of random keys can't exhaust memory.
+	maxSize = 16384
+)
+
+func New(policy Policy) *Limiter {
+	return &Limiter{
+		policy:  policy,
+		entries: make(map[string]*entry),
+		max:     maxSize,
+		now:     time.Now,
+	}
+}
+
+// Check reports how long key must wait before its next attempt, and whether it is locked out.
+// A zero wait allows the attempt.
+func (l *Limiter) Check(key string) (wait time.Duration, locked bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	e := l.entry(key)
+	if e == nil {
+		return 0, false
+	}
+	return l.check(e, l.now())
+}
+
+// Attempt is Check, except that an allowed attempt is counted as a failure in the same step.
+// Concurrent attempts therefore can't all pass before any of them fails; Refund takes the
+// failure back once the attempt succeeded.
+func (l *Limiter) Attempt(key string) (wait time.Duration, locked bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	e := l.entry(key)
+	if e != nil {
+		if wait, locked = l.check(e, now); wait > 0 {
+			return
+		}
+	} else {
+		e = l.add(key, now)
+	}
+	l.fail(e, now)
+	return 0, false
+}
+
+// Fail records a failed attempt of key.
+func (l *Limiter) Fail(key string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	e := l.entry(key)
+	if e == nil {
+		e = l.add(key, now)
+	}
+	l.fail(e, now)
+}
+
+// Refund takes back a failure counted by Attempt, along with the delay or lockout it caused.
+func (l *Limiter) Refund(key string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	e := l.entry(key)
+	if e == nil || e.failures == 0 {
+		return
+	}
+	if l.policy.Lockout > 0 && e.failures >= l.policy.Lockout {
+		e.lockedUntil = time.Time{}
+	}
+	e.failures--
+	e.next = time.Time{}
+	if d := l.delay(e.failures); d > 0 {
+		e.next = e.last.Add(d)
+	}
+}
+
+// Reset forgets every failure of key and lifts its lockout.
+func (l *Limiter) Reset(key string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.entries, key)
+}
+
+// Locks lists the keys currently locked out.
+func (l *Limiter) Locks() []Lock {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	ret := make([]Lock, 0)
+	for k, e := range l.entries {
+		if now.Before(e.lockedUntil) {
+			ret = append(ret, Lock{Key: k, Until: e.lockedUntil.Unix()})
+		}
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Key < ret[j].Key })
+	return ret
+}
+
+// entry returns the state of key, or nil if it has nothing to remember. l.mu must be held.
+func (l *Limiter) entry(key string) *entry {
+	e, ok := l.entries[key]
+	if !ok {
+		return nil
+	}
+	now := l.now()
+	if l.stale(e, now) {
+		delete(l.entries, key)
+		return nil
+	}
+	// Failures start over once a lockout has ended
+	if l.policy.Lockout > 0 && e.failures >= l.policy.Lockout && !now.Before(e.lockedUntil) {
+		e.failures = 0
+		e.next = time.Time{}
+	}
+	return e
+}
+
+// add starts tracking key, making room for it if needed. l.mu must be held.
+func (l *Limiter) add(key string, now time.Time) *entry {
+	if len(l.entries) >= pruneSize {
+		l.prune(now)
+	}
+	for len(l.entries) >= l.max {
+		l.evictOldest()
+	}
+	e := &entry{}
+	l.entries[key] = e
+	return e
+}
+
+func (l *Limiter) check(e *entry, now time.Time) (wait time.Duration, locked bool) {
+	if now.Before(e.lockedUntil) {
+		return e.lockedUntil.Sub(now), true
+	}
+	if now.Before(e.next) {
+		return e.next.Sub(now), false
+	}
+	return 0, false
+}
+
+func (l *Limiter) fail(e *entry, now time.Time) {
+	e.failures++
+	e.last = now
+	p := l.policy
+	if p.Lockout > 0 && e.failures >= p.Lockout {
+		e.lockedUntil = now.Add(p.LockoutFor)
+		return
+	}
+	if d := l.delay(e.failures); d > 0 {
+		e.next = now.Add(d)
+	}
+}
+
+// delay is how long to wait after the given number of failures.
+func (l *Limiter) delay(failures int) time.Duration {
+	p := l.policy
+	if failures <= p.Free || p.Delay == 0 {
+		return 0
+	}
+	delay := p.Delay
+	for i := p.Free + 1; i < failures && (p.MaxDelay == 0 || delay < p.MaxDelay); i++ {
+		delay *= 2
+	}
+	if p.MaxDelay > 0 && delay > p.MaxDelay {
+		delay = p.MaxDelay
+	}
+	return delay
+}
+
+func (l *Limiter) stale(e *entry, now time.Time) bool {
+	if l.policy.Window == 0 {
+		return false
+	}
+	return !now.Before(e.lockedUntil) && !now.Before(e.next) && now.Sub(e.last) > l.policy.Window
+}
+
+func (l *Limiter) prune(now time.Time) {
+	for k, e := range l.entries {
+		if l.stale(e, now) {
+			delete(l.entries, k)
+		}
+	}
+}
+
+// evictOldest drops the entry whose last failure is the oldest.
+func (l *Limiter) evictOldest() {
+	oldest := ""
+	for k, e := range l.entries {
+		if oldest == "" || e.last.Before(l.entries[oldest].last) {
+			oldest = k
+		}
+	}
+	delete(l.entries, oldest)
+}
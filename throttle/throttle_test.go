@@ -0,0 +1,112 @@
+package throttle
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLimiter(t *testing.T) {
+	now := time.Unix(1000, 0)
+	l := New(Policy{
+		Free:       2,
+		Delay:      time.Second,
+		MaxDelay:   3 * time.Second,
+		Lockout:    6,
+		LockoutFor: time.Minute,
+		Window:     time.Hour,
+	})
+	l.now = func() time.Time { return now }
+
+	for i := 0; i < 2; i++ {
+		l.Fail("alice")
+		if wait, locked := l.Check("alice"); wait != 0 || locked {
+			t.Errorf("free attempt %d throttled: %v %v", i, wait, locked)
+		}
+	}
+	// Delays double up to the maximum
+	for _, want := range []time.Duration{time.Second, 2 * time.Second, 3 * time.Second} {
+		l.Fail("alice")
+		if wait, locked := l.Check("alice"); wait != want || locked {
+			t.Errorf("wrong delay: %v %v, want %v", wait, locked, want)
+		}
+		now = now.Add(want)
+	}
+	if wait, _ := l.Check("bob"); wait != 0 {
+		t.Errorf("unrelated key throttled")
+	}
+
+	l.Fail("alice")
+	if wait, locked := l.Check("alice"); wait != time.Minute || !locked {
+		t.Errorf("not locked out: %v %v", wait, locked)
+	}
+	if locks := l.Locks(); len(locks) != 1 || locks[0].Key != "alice" {
+		t.Errorf("wrong locks: %v", locks)
+	}
+	l.Reset("alice")
+	if wait, locked := l.Check("alice"); wait != 0 || locked {
+		t.Errorf("still locked after reset: %v %v", wait, locked)
+	}
+
+	// Failures are forgotten after the window
+	for i := 0; i < 3; i++ {
+		l.Fail("carol")
+	}
+	now = now.Add(2 * time.Hour)
+	l.Fail("carol")
+	if wait, _ := l.Check("carol"); wait != 0 {
+		t.Errorf("old failures remembered: %v", wait)
+	}
+}
+
+func TestLimiterCap(t *testing.T) {
+	now := time.Unix(1000, 0)
+	l := New(Policy{Lockout: 5, LockoutFor: time.Minute, Window: time.Hour})
+	l.now = func() time.Time { return now }
+	l.max = 3
+	for _, k := range []string{"a", "b", "c", "d"} {
+		l.Fail(k)
+		now = now.Add(time.Second)
+	}
+	if len(l.entries) != 3 {
+		t.Errorf("limiter grew past its cap: %d", len(l.entries))
+	}
+	if _, ok := l.entries["a"]; ok {
+		t.Errorf("oldest entry kept")
+	}
+	if _, ok := l.entries["d"]; !ok {
+		t.Errorf("newest entry evicted")
+	}
+}
+
+func TestLimiterAttempt(t *testing.T) {
+	now := time.Unix(1000, 0)
+	l := New(Policy{Free: 1, Delay: time.Second, Lockout: 3, LockoutFor: time.Minute})
+	l.now = func() time.Time { return now }
+
+	// Attempts count before their outcome is known
+	if wait, locked := l.Attempt("alice"); wait != 0 || locked {
+		t.Errorf("first attempt throttled: %v %v", wait, locked)
+	}
+	if wait, _ := l.Attempt("alice"); wait != 0 {
+		t.Errorf("free attempt throttled: %v", wait)
+	}
+	if wait, _ := l.Attempt("alice"); wait != time.Second {
+		t.Errorf("attempt not delayed: %v", wait)
+	}
+	// A successful attempt takes back its failure and delay
+	l.Refund("alice")
+	if wait, _ := l.Check("alice"); wait != 0 {
+		t.Errorf("refunded attempt still delays: %v", wait)
+	}
+
+	l.Attempt("alice")
+	now = now.Add(time.Second)
+	l.Attempt("alice")
+	if wait, locked := l.Attempt("alice"); wait != time.Minute || !locked {
+		t.Errorf("not locked out: %v %v", wait, locked)
+	}
+	l.Refund("alice")
+	if _, locked := l.Check("alice"); locked {
+		t.Errorf("refunded attempt still locks out")
+	}
+}
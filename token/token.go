@@ -3,26 +3,78 @@ package token
 import (
 	"errors"
 	"fmt"
-	"github.com/SeraphJACK/go-annil/config"
 	"github.com/SeraphJACK/go-annil/storage"
 	"github.com/dgrijalva/jwt-go"
 	"time"
 )
 
-func GenerateUserToken(username string) (string, error) {
+// Manager issues and validates user and share tokens.
+type Manager struct {
+	store  storage.Store
+	secret []byte
+}
+
+func NewManager(store storage.Store, secret string) *Manager {
+	return &Manager{store: store, secret: []byte(secret)}
+}
+
+// Scope limits what a user token may access.
+type Scope struct {
+	// Empty indicates all catalogs are allowed
+	Catalogs []string
+	// Only covers and the album list may be read
+	CoverOnly bool
+}
+
+func (s Scope) AllowCatalog(catalog string) bool {
+	if len(s.Catalogs) == 0 {
+		return true
+	}
+	for _, c := range s.Catalogs {
+		if c == catalog {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *Manager) GenerateUserToken(username string) (string, error) {
+	return m.GenerateScopedUserToken(username, Scope{}, 0, "")
+}
+
+// GenerateScopedUserToken generates a user token limited to scope and records it in the token registry.
+// The token never expires if exp is not positive.
+func (m *Manager) GenerateScopedUserToken(username string, scope Scope, exp time.Duration, note string) (string, error) {
 	token := jwt.New(jwt.SigningMethodHS256)
 	claims := make(jwt.MapClaims)
 
-	claims["iat"] = time.Now().Unix()
+	var expire int64 = 0
+	if exp.Milliseconds() > 0 {
+		expire = time.Now().Add(exp).Unix()
+		claims["exp"] = expire
+	}
+	entry, err := m.store.NewToken(username, scope.Catalogs, scope.CoverOnly, expire, note)
+	if err != nil {
+		return "", err
+	}
+
+	claims["iat"] = entry.IssueTime
+	claims["jti"] = entry.Id
 	claims["type"] = "user"
 	claims["username"] = username
-	claims["allowShare"] = storage.AllowShare(username)
+	claims["allowShare"] = storage.HasPermission(m.store, username, storage.PermShare)
+	if len(scope.Catalogs) > 0 {
+		claims["catalogs"] = scope.Catalogs
+	}
+	if scope.CoverOnly {
+		claims["coverOnly"] = true
+	}
 
 	token.Claims = claims
-	return token.SignedString([]byte(config.Cfg.Secret))
+	return token.SignedString(m.secret)
 }
 
-func GenerateShareToken(username string, audios map[string][]int, exp time.Duration) (string, error) {
+func (m *Manager) GenerateShareToken(username string, audios map[string][]int, exp time.Duration) (string, error) {
 	token := jwt.New(jwt.SigningMethodHS256)
 	claims := make(jwt.MapClaims)
 
@@ -35,96 +87,133 @@ func GenerateShareToken(username string, audios map[string][]int, exp time.Durat
 	claims["type"] = "share"
 
 	token.Claims = claims
-	return token.SignedString([]byte(config.Cfg.Secret))
+	return token.SignedString(m.secret)
+}
+
+func (m *Manager) ValidateUserToken(token string) (string, error) {
+	username, _, err := m.ValidateScopedUserToken(token)
+	return username, err
 }
 
-func ValidateUserToken(token string) (string, error) {
+// ValidateScopedUserToken validates a user token and returns its owner and scope.
+// Tokens issued without a registry entry are granted the full scope.
+func (m *Manager) ValidateScopedUserToken(token string) (string, Scope, error) {
 	t, err := jwt.Parse(token, func(token *jwt.Token) (interface{}, error) {
 		alg, ok := token.Method.(*jwt.SigningMethodHMAC)
 		if !ok || alg != jwt.SigningMethodHS256 {
 			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
 		}
-		return []byte(config.Cfg.Secret), nil
+		return m.secret, nil
 	})
 	if err != nil {
-		return "", err
+		return "", Scope{}, err
 	}
 	claims, ok := t.Claims.(jwt.MapClaims)
 	if !ok {
-		return "", fmt.Errorf("failed to parse claims")
+		return "", Scope{}, fmt.Errorf("failed to parse claims")
 	}
 	username, ok := claims["username"].(string)
 	if !ok {
-		return "", fmt.Errorf("failed to parse claims")
+		return "", Scope{}, fmt.Errorf("failed to parse claims")
 	}
 	iat := int64(claims["iat"].(float64))
-	if !storage.UserExists(username) {
-		return "", errors.New("user not exist")
+	if !m.store.UserExists(username) {
+		return "", Scope{}, errors.New("user not exist")
 	}
-	date, err := storage.RegisterDate(username)
+	date, err := m.store.RegisterDate(username)
 	if err != nil {
-		return "", err
+		return "", Scope{}, err
 	}
 	if claims["type"].(string) != "user" {
-		return "", fmt.Errorf("invalid type")
+		return "", Scope{}, fmt.Errorf("invalid type")
 	}
 	// Token issued before user register
 	if date.After(time.Unix(iat, 0)) {
-		return "", fmt.Errorf("invalid iat")
+		return "", Scope{}, fmt.Errorf("invalid iat")
+	}
+	scope := Scope{}
+	if jti, ok := claims["jti"].(string); ok {
+		// Token revoked from the registry
+		if !m.store.TokenExists(jti) {
+			return "", Scope{}, fmt.Errorf("token revoked")
+		}
+		if catalogs, ok := claims["catalogs"].([]interface{}); ok {
+			for _, c := range catalogs {
+				if cat, ok := c.(string); ok {
+					scope.Catalogs = append(scope.Catalogs, cat)
+				}
+			}
+		}
+		scope.CoverOnly, _ = claims["coverOnly"].(bool)
 	}
-	return username, nil
+	return username, scope, nil
+}
+
+func (m *Manager) ValidateShareToken(token string) (map[string][]int, error) {
+	_, audios, err := m.validateShareToken(token)
+	return audios, err
 }
 
-func ValidateShareToken(token string) (map[string][]int, error) {
+func (m *Manager) validateShareToken(token string) (string, map[string][]int, error) {
 	t, err := jwt.Parse(token, func(token *jwt.Token) (interface{}, error) {
 		alg, ok := token.Method.(*jwt.SigningMethodHMAC)
 		if !ok || alg != jwt.SigningMethodHS256 {
 			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
 		}
-		return []byte(config.Cfg.Secret), nil
+		return m.secret, nil
 	})
 	if err != nil {
-		return nil, err
+		return "", nil, err
 	}
 	claims, ok := t.Claims.(jwt.MapClaims)
 	if !ok {
-		return nil, fmt.Errorf("failed to parse claims")
+		return "", nil, fmt.Errorf("failed to parse claims")
 	}
 
 	iat := int64(claims["iat"].(float64))
 
 	username, ok := claims["username"].(string)
 	if !ok {
-		return nil, fmt.Errorf("failed to parse claims")
+		return "", nil, fmt.Errorf("failed to parse claims")
 	}
 
-	date, err := storage.RegisterDate(username)
+	date, err := m.store.RegisterDate(username)
 	if err != nil {
-		return nil, err
+		return "", nil, err
 	}
 
 	// Token issued before user register
 	if date.After(time.Unix(iat, 0)) {
-		return nil, fmt.Errorf("invalid iat")
+		return "", nil, fmt.Errorf("invalid iat")
 	}
 
 	if claims["type"].(string) != "share" {
-		return nil, fmt.Errorf("invalid type")
+		return "", nil, fmt.Errorf("invalid type")
 	}
 
 	audios, ok := claims["audios"].(map[string]interface{})
 	if !ok {
-		return nil, fmt.Errorf("failed to parse claims")
+		return "", nil, fmt.Errorf("failed to parse claims")
 	}
 
-	return parseAudios(audios), nil
+	return username, parseAudios(audios), nil
+}
+
+// Owner returns the user who issued a valid user or share token.
+func (m *Manager) Owner(token string) (string, error) {
+	username, err := m.ValidateUserToken(token)
+	if err == nil {
+		return username, nil
+	}
+	username, _, err = m.validateShareToken(token)
+	return username, err
 }
 
 // return 0 for ok, 1 for no permission, 2 for authorization invalid
-func CheckCoverPerms(token, catalog string) uint8 {
-	_, err := ValidateUserToken(token)
+func (m *Manager) CheckCoverPerms(token, catalog string) uint8 {
+	_, scope, err := m.ValidateScopedUserToken(token)
 	if err != nil {
-		audios, err := ValidateShareToken(token)
+		audios, err := m.ValidateShareToken(token)
 		if err != nil {
 			return 2
 		} else {
@@ -135,16 +224,18 @@ func CheckCoverPerms(token, catalog string) uint8 {
 				return 1
 			}
 		}
-	} else {
+	} else if scope.AllowCatalog(catalog) {
 		return 0
+	} else {
+		return 1
 	}
 }
 
 // return 0 for ok, 1 for no permission, 2 for authorization invalid
-func CheckAudioPerms(token, catalog string, track int) uint8 {
-	_, err := ValidateUserToken(token)
+func (m *Manager) CheckAudioPerms(token, catalog string, track int) uint8 {
+	_, scope, err := m.ValidateScopedUserToken(token)
 	if err != nil {
-		audios, err := ValidateShareToken(token)
+		audios, err := m.ValidateShareToken(token)
 		if err != nil {
 			return 2
 		} else {
@@ -157,8 +248,10 @@ func CheckAudioPerms(token, catalog string, track int) uint8 {
 			}
 			return 1
 		}
-	} else {
+	} else if !scope.CoverOnly && scope.AllowCatalog(catalog) {
 		return 0
+	} else {
+		return 1
 	}
 }
 
@@ -0,0 +1,56 @@
+package totp
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCode(t *testing.T) {
+	// Test vectors of RFC 6238 for SHA1
+	key := []byte("12345678901234567890")
+	for _, c := range []struct {
+		time int64
+		code string
+	}{
+		{59, "94287082"},
+		{1111111109, "07081804"},
+		{1111111111, "14050471"},
+		{1234567890, "89005924"},
+		{2000000000, "69279037"},
+		{20000000000, "65353130"},
+	} {
+		if got := code(key, c.time/Period, 8); got != c.code {
+			t.Errorf("wrong code at %d: %s, want %s", c.time, got, c.code)
+		}
+	}
+	secret := encoding.EncodeToString(key)
+	if got, _ := Code(secret, 59/Period); got != "287082" {
+		t.Errorf("wrong 6 digit code: %s", got)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	secret, err := NewSecret()
+	if err != nil {
+		t.Fatalf("failed to generate secret: %v", err)
+	}
+	now := time.Unix(1600000000, 0)
+	c, _ := Code(secret, Step(now))
+	if step, ok := Validate(secret, c, now); !ok || step != Step(now) {
+		t.Errorf("current code rejected")
+	}
+	if _, ok := Validate(secret, c, now.Add(Period*time.Second)); !ok {
+		t.Errorf("code of the previous step rejected")
+	}
+	if _, ok := Validate(secret, c, now.Add(3*Period*time.Second)); ok {
+		t.Errorf("stale code accepted")
+	}
+	if _, ok := Validate(secret, "12345", now); ok {
+		t.Errorf("short code accepted")
+	}
+	uri := URI("go-annil", "alice", secret)
+	if !strings.HasPrefix(uri, "otpauth://totp/go-annil:alice?") || !strings.Contains(uri, "secret="+secret) {
+		t.Errorf("wrong uri: %s", uri)
+	}
+}
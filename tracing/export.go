@@ -0,0 +1,296 @@
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// WriterExporter writes every span as a JSON line, for local debugging.
+type WriterExporter struct {
+	mu sync.Mutex
+	w  io.Writer
+	// The file opened by OpenFileExporter
+	f *os.File
+}
+
+func NewWriterExporter(w io.Writer) *WriterExporter {
+	return &WriterExporter{w: w}
+}
+
+// OpenFileExporter appends spans to the file at path.
+func OpenFileExporter(path string) (*WriterExporter, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &WriterExporter{w: f, f: f}, nil
+}
+
+// Record is the JSON form of a span written by WriterExporter.
+type Record struct {
+	Name       string                 `json:"name"`
+	Kind       string                 `json:"kind"`
+	TraceID    string                 `json:"traceId"`
+	SpanID     string                 `json:"spanId"`
+	ParentID   string                 `json:"parentId,omitempty"`
+	Start      time.Time              `json:"start"`
+	DurationMs float64                `json:"durationMs"`
+	Attributes map[string]interface{} `json:"attributes,omitempty"`
+	Error      string                 `json:"error,omitempty"`
+}
+
+func (e *WriterExporter) Export(s *Span) {
+	r := Record{
+		Name:       s.Name(),
+		Kind:       s.Kind.String(),
+		TraceID:    s.Context.TraceID.String(),
+		SpanID:     s.Context.SpanID.String(),
+		Start:      s.Start.UTC(),
+		DurationMs: float64(s.EndTime().Sub(s.Start)) / float64(time.Millisecond),
+		Error:      s.Err(),
+	}
+	if !s.Parent.IsZero() {
+		r.ParentID = s.Parent.String()
+	}
+	if attrs := s.Attrs(); len(attrs) > 0 {
+		r.Attributes = make(map[string]interface{}, len(attrs))
+		for _, a := range attrs {
+			r.Attributes[a.Key] = a.Value
+		}
+	}
+	b, err := json.Marshal(r)
+	if err != nil {
+		return
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	_, _ = e.w.Write(append(b, '\n'))
+}
+
+func (e *WriterExporter) Shutdown(ctx context.Context) error {
+	if e.f == nil {
+		return nil
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.f.Close()
+}
+
+// OTLPExporter sends spans in batches to an OpenTelemetry collector, using OTLP over HTTP with JSON.
+// Spans are dropped if the collector cannot keep up.
+type OTLPExporter struct {
+	url     string
+	service string
+	client  *http.Client
+	// Called with failures to send a batch
+	OnError func(error)
+
+	spans chan *Span
+	flush chan chan struct{}
+	once  sync.Once
+}
+
+const (
+	otlpBatch    = 256
+	otlpInterval = 5 * time.Second
+)
+
+// NewOTLPExporter sends spans of service to the collector at endpoint, e.g. http://localhost:4318.
+func NewOTLPExporter(endpoint, service string) *OTLPExporter {
+	e := &OTLPExporter{
+		url:     strings.TrimSuffix(endpoint, "/") + "/v1/traces",
+		service: service,
+		client:  &http.Client{Timeout: 10 * time.Second},
+		spans:   make(chan *Span, 8*otlpBatch),
+		flush:   make(chan chan struct{}),
+	}
+	go e.run()
+	return e
+}
+
+func (e *OTLPExporter) Export(s *Span) {
+	select {
+	case e.spans <- s:
+	default:
+	}
+}
+
+// Shutdown sends the remaining spans and stops the exporter.
+func (e *OTLPExporter) Shutdown(ctx context.Context) error {
+	done := make(chan struct{})
+	var err error
+	e.once.Do(func() {
+		select {
+		case e.flush <- done:
+		case <-ctx.Done():
+			err = ctx.Err()
+			return
+		}
+		select {
+		case <-done:
+		case <-ctx.Done():
+			err = ctx.Err()
+		}
+	})
+	return err
+}
+
+func (e *OTLPExporter) run() {
+	ticker := time.NewTicker(otlpInterval)
+	defer ticker.Stop()
+	batch := make([]*Span, 0, otlpBatch)
+	send := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if err := e.send(batch); err != nil && e.OnError != nil {
+			e.OnError(err)
+		}
+		batch = batch[:0]
+	}
+	for {
+		select {
+		case s := <-e.spans:
+			batch = append(batch, s)
+			if len(batch) == otlpBatch {
+				send()
+			}
+		case <-ticker.C:
+			send()
+		case done := <-e.flush:
+			for len(e.spans) > 0 {
+				batch = append(batch, <-e.spans)
+			}
+			send()
+			close(done)
+			return
+		}
+	}
+}
+
+func (e *OTLPExporter) send(batch []*Span) error {
+	spans := make([]otlpSpan, len(batch))
+	for i, s := range batch {
+		spans[i] = toOTLP(s)
+	}
+	body := otlpRequest{ResourceSpans: []otlpResourceSpans{{
+		Resource:   otlpResource{Attributes: []otlpAttr{{Key: "service.name", Value: otlpValue{StringValue: &e.service}}}},
+		ScopeSpans: []otlpScopeSpans{{Scope: otlpScope{Name: e.service}, Spans: spans}},
+	}}}
+	b, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	res, err := e.client.Post(e.url, "application/json", bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode/100 != 2 {
+		return errors.New("collector responded with " + res.Status)
+	}
+	return nil
+}
+
+// JSON encoding of OTLP, see https://opentelemetry.io/docs/specs/otlp/#json-protobuf-encoding
+type otlpRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpAttr `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpSpan struct {
+	TraceID      string     `json:"traceId"`
+	SpanID       string     `json:"spanId"`
+	ParentSpanID string     `json:"parentSpanId,omitempty"`
+	TraceState   string     `json:"traceState,omitempty"`
+	Name         string     `json:"name"`
+	Kind         int        `json:"kind"`
+	Start        string     `json:"startTimeUnixNano"`
+	End          string     `json:"endTimeUnixNano"`
+	Attributes   []otlpAttr `json:"attributes,omitempty"`
+	Status       otlpStatus `json:"status"`
+}
+
+type otlpAttr struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpValue struct {
+	StringValue *string  `json:"stringValue,omitempty"`
+	IntValue    *string  `json:"intValue,omitempty"`
+	DoubleValue *float64 `json:"doubleValue,omitempty"`
+	BoolValue   *bool    `json:"boolValue,omitempty"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+func toOTLP(s *Span) otlpSpan {
+	o := otlpSpan{
+		TraceID:    s.Context.TraceID.String(),
+		SpanID:     s.Context.SpanID.String(),
+		TraceState: s.Context.State,
+		Name:       s.Name(),
+		// OTLP counts kinds from 1 for internal spans
+		Kind:  int(s.Kind) + 1,
+		Start: strconv.FormatInt(s.Start.UnixNano(), 10),
+		End:   strconv.FormatInt(s.EndTime().UnixNano(), 10),
+	}
+	if !s.Parent.IsZero() {
+		o.ParentSpanID = s.Parent.String()
+	}
+	for _, a := range s.Attrs() {
+		o.Attributes = append(o.Attributes, otlpAttr{Key: a.Key, Value: otlpValueOf(a.Value)})
+	}
+	if err := s.Err(); err != "" {
+		o.Status = otlpStatus{Code: 2, Message: err}
+	}
+	return o
+}
+
+func otlpValueOf(v interface{}) otlpValue {
+	switch x := v.(type) {
+	case bool:
+		return otlpValue{BoolValue: &x}
+	case int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64:
+		s := fmt.Sprint(x)
+		return otlpValue{IntValue: &s}
+	case float32:
+		f := float64(x)
+		return otlpValue{DoubleValue: &f}
+	case float64:
+		return otlpValue{DoubleValue: &x}
+	}
+	s := fmt.Sprint(v)
+	return otlpValue{StringValue: &s}
+}
@@ -0,0 +1,325 @@
+// Package tracing records spans of work done for a request and hands finished spans to an exporter.
+// Trace context is exchanged with other services in W3C traceparent headers, so spans of relays
+// and their upstreams join the same trace.
+package tracing
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"math"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+type TraceID [16]byte
+
+type SpanID [8]byte
+
+func (t TraceID) String() string { return hex.EncodeToString(t[:]) }
+func (s SpanID) String() string  { return hex.EncodeToString(s[:]) }
+
+func (t TraceID) IsZero() bool { return t == TraceID{} }
+func (s SpanID) IsZero() bool  { return s == SpanID{} }
+
+// SpanContext identifies a span, which may belong to another service.
+type SpanContext struct {
+	TraceID TraceID
+	SpanID  SpanID
+	// Whether the span is recorded, callers pass their decision on
+	Sampled bool
+	// tracestate of the caller, passed on unchanged
+	State string
+}
+
+func (c SpanContext) Valid() bool {
+	return !c.TraceID.IsZero() && !c.SpanID.IsZero()
+}
+
+type Kind int
+
+const (
+	Internal Kind = iota
+	Server
+	Client
+)
+
+func (k Kind) String() string {
+	switch k {
+	case Server:
+		return "server"
+	case Client:
+		return "client"
+	}
+	return "internal"
+}
+
+// Attr is an attribute of a span.
+type Attr struct {
+	Key   string
+	Value interface{}
+}
+
+// Span is an operation within a trace. Methods of a nil span do nothing, so callers
+// need not check whether tracing is enabled.
+type Span struct {
+	tracer  *Tracer
+	Context SpanContext
+	// Zero for the root span of a trace
+	Parent SpanID
+	Kind   Kind
+	Start  time.Time
+
+	mu    sync.Mutex
+	name  string
+	attrs []Attr
+	err   string
+	end   time.Time
+}
+
+// Name returns the name of the span.
+func (s *Span) Name() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.name
+}
+
+// SetName renames the span, e.g. once the route of a request is known.
+func (s *Span) SetName(name string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	s.name = name
+	s.mu.Unlock()
+}
+
+// SetAttr sets the attribute key, replacing an earlier value.
+func (s *Span) SetAttr(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := range s.attrs {
+		if s.attrs[i].Key == key {
+			s.attrs[i].Value = value
+			return
+		}
+	}
+	s.attrs = append(s.attrs, Attr{Key: key, Value: value})
+}
+
+// Attrs returns the attributes of the span in the order they were first set.
+func (s *Span) Attrs() []Attr {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Attr(nil), s.attrs...)
+}
+
+// SetError marks the span as failed, unless err is nil.
+func (s *Span) SetError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.mu.Lock()
+	s.err = err.Error()
+	s.mu.Unlock()
+}
+
+// Err returns the error the span failed with, empty if it did not.
+func (s *Span) Err() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err
+}
+
+// EndTime returns when the span ended, zero while it is running.
+func (s *Span) EndTime() time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.end
+}
+
+// End finishes the span and exports it if it is sampled. Later calls do nothing.
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	if !s.end.IsZero() {
+		s.mu.Unlock()
+		return
+	}
+	s.end = time.Now()
+	s.mu.Unlock()
+	if s.Context.Sampled {
+		s.tracer.exporter.Export(s)
+	}
+}
+
+// Exporter receives finished spans. Export is called by the goroutine ending the span
+// and must not block on slow outputs.
+type Exporter interface {
+	Export(s *Span)
+	// Shutdown writes out buffered spans
+	Shutdown(ctx context.Context) error
+}
+
+// Tracer starts spans and passes them to its exporter once finished.
+type Tracer struct {
+	exporter Exporter
+	ratio    float64
+}
+
+// New creates a tracer recording ratio of the traces started here. Traces continued
+// from a caller are recorded if the caller records them.
+func New(e Exporter, ratio float64) *Tracer {
+	return &Tracer{exporter: e, ratio: ratio}
+}
+
+// Shutdown exports spans which are still buffered.
+func (t *Tracer) Shutdown(ctx context.Context) error {
+	if t == nil {
+		return nil
+	}
+	return t.exporter.Shutdown(ctx)
+}
+
+var (
+	defMu sync.RWMutex
+	// Tracing is disabled unless a tracer is set
+	def *Tracer
+)
+
+// Default returns the tracer starting root spans, nil if tracing is disabled.
+func Default() *Tracer {
+	defMu.RLock()
+	defer defMu.RUnlock()
+	return def
+}
+
+func SetDefault(t *Tracer) {
+	defMu.Lock()
+	def = t
+	defMu.Unlock()
+}
+
+type contextKey int
+
+const (
+	spanKey contextKey = iota
+	remoteKey
+)
+
+// SpanFromContext returns the current span of ctx, nil if there is none.
+func SpanFromContext(ctx context.Context) *Span {
+	s, _ := ctx.Value(spanKey).(*Span)
+	return s
+}
+
+// ContextWithRemote returns a context whose next span continues the trace of a caller.
+func ContextWithRemote(ctx context.Context, sc SpanContext) context.Context {
+	return context.WithValue(ctx, remoteKey, sc)
+}
+
+// current returns the context of the span new spans of ctx are children of.
+func current(ctx context.Context) SpanContext {
+	if s := SpanFromContext(ctx); s != nil {
+		return s.Context
+	}
+	sc, _ := ctx.Value(remoteKey).(SpanContext)
+	return sc
+}
+
+// Start starts a span as a child of the current span of ctx, with attributes from
+// the key value pairs kv. It returns a nil span if tracing is disabled.
+func Start(ctx context.Context, name string, kind Kind, kv ...interface{}) (context.Context, *Span) {
+	t := Default()
+	if parent := SpanFromContext(ctx); parent != nil {
+		t = parent.tracer
+	}
+	if t == nil {
+		return ctx, nil
+	}
+	s := &Span{tracer: t, Kind: kind, Start: time.Now(), name: name}
+	parent := current(ctx)
+	if parent.Valid() {
+		s.Context.TraceID = parent.TraceID
+		s.Context.Sampled = parent.Sampled
+		s.Context.State = parent.State
+		s.Parent = parent.SpanID
+	} else {
+		_, _ = rand.Read(s.Context.TraceID[:])
+		s.Context.Sampled = t.sample()
+	}
+	_, _ = rand.Read(s.Context.SpanID[:])
+	for i := 0; i+1 < len(kv); i += 2 {
+		if k, ok := kv[i].(string); ok {
+			s.attrs = append(s.attrs, Attr{Key: k, Value: kv[i+1]})
+		}
+	}
+	return context.WithValue(ctx, spanKey, s), s
+}
+
+func (t *Tracer) sample() bool {
+	if t.ratio >= 1 {
+		return true
+	}
+	var b [8]byte
+	_, _ = rand.Read(b[:])
+	return float64(binary.BigEndian.Uint64(b[:])>>11)/(1<<53) < math.Max(t.ratio, 0)
+}
+
+const (
+	traceparentHeader = "Traceparent"
+	tracestateHeader  = "Tracestate"
+)
+
+// Inject sets the traceparent header of an outgoing request to the current span of ctx.
+func Inject(ctx context.Context, h http.Header) {
+	sc := current(ctx)
+	if !sc.Valid() {
+		return
+	}
+	flags := "00"
+	if sc.Sampled {
+		flags = "01"
+	}
+	h.Set(traceparentHeader, "00-"+sc.TraceID.String()+"-"+sc.SpanID.String()+"-"+flags)
+	if sc.State != "" {
+		h.Set(tracestateHeader, sc.State)
+	}
+}
+
+// Extract parses the traceparent header of an incoming request.
+func Extract(h http.Header) (SpanContext, bool) {
+	var sc SpanContext
+	parts := strings.Split(strings.TrimSpace(h.Get(traceparentHeader)), "-")
+	// Later versions may append fields, version 00 has exactly four
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || parts[0] == "00" && len(parts) != 4 {
+		return sc, false
+	}
+	if !decodeHex(sc.TraceID[:], parts[1]) || !decodeHex(sc.SpanID[:], parts[2]) || len(parts[3]) != 2 {
+		return sc, false
+	}
+	var flags [1]byte
+	if !decodeHex(flags[:], parts[3]) || !decodeHex(make([]byte, 1), parts[0]) || !sc.Valid() {
+		return sc, false
+	}
+	sc.Sampled = flags[0]&1 == 1
+	sc.State = h.Get(tracestateHeader)
+	return sc, true
+}
+
+// decodeHex decodes lowercase hex s into dst, which it has to fill exactly.
+func decodeHex(dst []byte, s string) bool {
+	if len(s) != 2*len(dst) || strings.ToLower(s) != s {
+		return false
+	}
+	_, err := hex.Decode(dst, []byte(s))
+	return err == nil
+}
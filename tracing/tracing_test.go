@@ -0,0 +1,138 @@
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func records(t *testing.T, b *bytes.Buffer) []Record {
+	var ret []Record
+	for _, line := range strings.Split(strings.TrimSpace(b.String()), "\n") {
+		var r Record
+		if err := json.Unmarshal([]byte(line), &r); err != nil {
+			t.Fatalf("invalid record %s: %v", line, err)
+		}
+		ret = append(ret, r)
+	}
+	return ret
+}
+
+func TestSpans(t *testing.T) {
+	defer SetDefault(Default())
+	SetDefault(nil)
+	if _, s := Start(context.Background(), "off", Internal); s != nil {
+		t.Fatalf("span started while tracing is disabled")
+	}
+
+	var b bytes.Buffer
+	SetDefault(New(NewWriterExporter(&b), 1))
+	ctx, root := Start(context.Background(), "root", Server, "route", "/albums")
+	_, child := Start(ctx, "child", Client)
+	child.SetAttr("status", 200)
+	child.SetError(errors.New("broken"))
+	child.End()
+	root.End()
+	root.End()
+
+	recs := records(t, &b)
+	if len(recs) != 2 {
+		t.Fatalf("wrong number of spans: %v", recs)
+	}
+	c, r := recs[0], recs[1]
+	if c.TraceID != r.TraceID || c.ParentID != r.SpanID || r.ParentID != "" {
+		t.Errorf("child not in the trace of its parent: %+v %+v", c, r)
+	}
+	if c.Kind != "client" || c.Error != "broken" || c.Attributes["status"] != 200.0 || r.Attributes["route"] != "/albums" {
+		t.Errorf("wrong spans: %+v %+v", c, r)
+	}
+}
+
+func TestPropagation(t *testing.T) {
+	defer SetDefault(Default())
+	var b bytes.Buffer
+	SetDefault(New(NewWriterExporter(&b), 0))
+
+	in := http.Header{}
+	in.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	in.Set("tracestate", "vendor=1")
+	sc, ok := Extract(in)
+	if !ok || !sc.Sampled || sc.TraceID.String() != "4bf92f3577b34da6a3ce929d0e0e4736" {
+		t.Fatalf("failed to extract: %+v", sc)
+	}
+	// Sampled by the caller, although the ratio here is 0
+	ctx, s := Start(ContextWithRemote(context.Background(), sc), "handler", Server)
+	out := http.Header{}
+	Inject(ctx, out)
+	want := "00-4bf92f3577b34da6a3ce929d0e0e4736-" + s.Context.SpanID.String() + "-01"
+	if out.Get("traceparent") != want || out.Get("tracestate") != "vendor=1" {
+		t.Errorf("wrong outgoing headers: %v", out)
+	}
+	s.End()
+	if recs := records(t, &b); recs[0].ParentID != "00f067aa0ba902b7" {
+		t.Errorf("wrong parent: %+v", recs[0])
+	}
+
+	b.Reset()
+	_, s = Start(context.Background(), "unsampled", Internal)
+	s.End()
+	if b.Len() != 0 {
+		t.Errorf("unsampled span exported: %s", b.String())
+	}
+
+	for _, h := range []string{
+		"",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01",
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra",
+	} {
+		if _, ok := Extract(http.Header{"Traceparent": {h}}); ok {
+			t.Errorf("accepted invalid traceparent %q", h)
+		}
+	}
+	if _, ok := Extract(http.Header{"Traceparent": {"01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra"}}); !ok {
+		t.Errorf("rejected traceparent of a later version")
+	}
+}
+
+func TestOTLP(t *testing.T) {
+	bodies := make(chan []byte, 1)
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/traces" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		b, _ := ioutil.ReadAll(r.Body)
+		bodies <- b
+	}))
+	defer collector.Close()
+
+	e := NewOTLPExporter(collector.URL, "go-annil")
+	tr := New(e, 1)
+	defer SetDefault(Default())
+	SetDefault(tr)
+	_, s := Start(context.Background(), "GET /albums", Server, "http.status_code", 200)
+	s.End()
+	if err := tr.Shutdown(context.Background()); err != nil {
+		t.Fatalf("failed to shut down: %v", err)
+	}
+	body := string(<-bodies)
+	for _, want := range []string{
+		`"service.name","value":{"stringValue":"go-annil"}`,
+		`"spanId":"` + s.Context.SpanID.String() + `"`,
+		`"name":"GET /albums","kind":2`,
+		`{"key":"http.status_code","value":{"intValue":"200"}}`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("request lacks %s: %s", want, body)
+		}
+	}
+}
@@ -0,0 +1,366 @@
+'use strict';
+
+// Admin console of go-annil. It only uses the HTTP API, see /openapi.json.
+
+const tabs = [
+    {id: 'users', title: 'Users', perm: 'users.manage', render: renderUsers},
+    {id: 'roles', title: 'Roles', perm: 'roles.manage', render: renderRoles},
+    {id: 'invites', title: 'Invite codes', perm: 'invites.manage', render: renderInvites},
+    {id: 'tokens', title: 'Tokens', perm: 'tokens.manage', render: renderTokens},
+    {id: 'sessions', title: 'Sessions', perm: 'users.manage', render: renderSessions},
+    {id: 'backends', title: 'Backends', perm: 'settings.manage', render: renderBackends},
+    {id: 'downloads', title: 'Downloads', perm: 'audit.view', render: renderDownloads},
+];
+
+let me = null;
+
+// h creates an element with attributes, event handlers (on*) and children.
+function h(tag, attrs, ...children) {
+    const el = document.createElement(tag);
+    for (const [k, v] of Object.entries(attrs || {})) {
+        if (k.startsWith('on')) {
+            el.addEventListener(k.slice(2), v);
+        } else if (v === true) {
+            el.setAttribute(k, '');
+        } else if (v !== false && v != null) {
+            el.setAttribute(k, v);
+        }
+    }
+    for (const c of children.flat()) {
+        el.append(c instanceof Node ? c : String(c ?? ''));
+    }
+    return el;
+}
+
+function table(headers, rows) {
+    return h('table', {},
+        h('thead', {}, h('tr', {}, headers.map(t => h('th', {}, t)))),
+        h('tbody', {}, rows.map(r => h('tr', {}, r.map(c => h('td', {}, c))))));
+}
+
+function button(label, action, danger) {
+    return h('button', {type: 'button', class: danger ? 'danger' : null, onclick: () => run(action)}, label);
+}
+
+function time(unix) {
+    return unix ? new Date(unix * 1000).toLocaleString() : 'never';
+}
+
+function csrfToken() {
+    const m = document.cookie.match(/(?:^|;\s*)csrfToken=([^;]*)/);
+    return m ? decodeURIComponent(m[1]) : '';
+}
+
+class ApiError extends Error {
+    constructor(status, code) {
+        super(code || 'HTTP ' + status);
+        this.status = status;
+    }
+}
+
+// api calls an endpoint with form fields for /api/* or a JSON body for /api/v2/*.
+async function api(method, path, body) {
+    const init = {method, headers: {}, credentials: 'same-origin'};
+    if (method !== 'GET') {
+        init.headers['X-CSRF-Token'] = csrfToken();
+    }
+    if (body !== undefined && path.startsWith('/api/v2/')) {
+        init.headers['Content-Type'] = 'application/json';
+        init.body = JSON.stringify(body);
+    } else if (body !== undefined) {
+        init.body = new URLSearchParams(body);
+    }
+    const res = await fetch(path, init);
+    const type = res.headers.get('Content-Type') || '';
+    if (!res.ok) {
+        let code = res.headers.get('X-Status-Reason');
+        if (type.startsWith('application/json')) {
+            code = (await res.json()).error?.code || code;
+        }
+        throw new ApiError(res.status, code);
+    }
+    if (type.startsWith('application/json')) {
+        return res.json();
+    }
+    return res.text();
+}
+
+// run performs an action and reports its error, then renders the current tab again.
+async function run(action) {
+    showError('');
+    try {
+        await action();
+    } catch (e) {
+        if (e instanceof ApiError && e.status === 401) {
+            me = null;
+            return renderLogin();
+        }
+        showError(e.message);
+    }
+    await render();
+}
+
+function showError(msg) {
+    const el = document.getElementById('error');
+    el.textContent = msg;
+    el.hidden = !msg;
+}
+
+function formValues(form) {
+    return Object.fromEntries(new FormData(form).entries());
+}
+
+function renderLogin(ticket) {
+    document.getElementById('tabs').replaceChildren();
+    document.getElementById('me').replaceChildren();
+    const form = ticket
+        ? h('form', {}, h('input', {name: 'code', placeholder: 'TOTP code', autocomplete: 'one-time-code', required: true}),
+            h('button', {}, 'Verify'))
+        : h('form', {}, h('input', {name: 'username', placeholder: 'Username', autocomplete: 'username', required: true}),
+            h('input', {name: 'password', type: 'password', placeholder: 'Password', autocomplete: 'current-password', required: true}),
+            h('button', {}, 'Log in'));
+    form.addEventListener('submit', async e => {
+        e.preventDefault();
+        showError('');
+        try {
+            if (ticket) {
+                await api('POST', '/api/loginTotp', {ticket, ...formValues(form)});
+            } else {
+                // A stale session still needs the CSRF token
+                const res = await fetch('/api/login', {
+                    method: 'POST', headers: {'X-CSRF-Token': csrfToken()}, body: new URLSearchParams(formValues(form)),
+                });
+                if (res.status === 202) {
+                    return renderLogin(await res.text());
+                }
+                if (!res.ok) {
+                    throw new ApiError(res.status, res.headers.get('X-Status-Reason') || 'WRONG_CREDENTIALS');
+                }
+            }
+            await start();
+        } catch (err) {
+            showError(err.message);
+        }
+    });
+    document.getElementById('view').replaceChildren(h('h2', {}, 'Log in'), form);
+}
+
+async function start() {
+    try {
+        me = await api('GET', '/api/v2/me');
+    } catch (e) {
+        return renderLogin();
+    }
+    document.getElementById('me').replaceChildren(`${me.username} (${me.role})`);
+    if (!location.hash) {
+        const first = tabs.find(t => me.permissions.includes(t.perm));
+        location.hash = first ? first.id : 'none';
+    }
+    await render();
+}
+
+async function render() {
+    if (!me) {
+        return;
+    }
+    const allowed = tabs.filter(t => me.permissions.includes(t.perm));
+    const current = allowed.find(t => '#' + t.id === location.hash);
+    document.getElementById('tabs').replaceChildren(...allowed.map(t =>
+        h('a', {href: '#' + t.id, class: t === current ? 'active' : null}, t.title)));
+    const view = document.getElementById('view');
+    if (!current) {
+        view.replaceChildren(h('p', {}, 'Your role has no administrative permissions.'));
+        return;
+    }
+    try {
+        view.replaceChildren(...await current.render());
+    } catch (e) {
+        if (e instanceof ApiError && e.status === 401) {
+            me = null;
+            return renderLogin();
+        }
+        showError(e.message);
+    }
+}
+
+let selectedUser = '';
+
+async function renderUsers() {
+    const [users, roles, locks] = await Promise.all([
+        api('GET', '/api/v2/users'), api('POST', '/api/listRoles'), api('POST', '/api/listLockedUsers')]);
+    const locked = new Set(locks.map(l => l.key));
+    const rows = users.map(u => [
+        h('a', {href: '#users', onclick: () => run(() => selectedUser = u.username)}, u.username),
+        h('select', {onchange: e => run(() => api('POST', '/api/setRole', {username: u.username, role: e.target.value}))},
+            roles.map(r => h('option', {value: r.name, selected: r.name === u.role}, r.name))),
+        shareCell(u),
+        u.email ? u.email + (u.emailVerified ? '' : ' (unverified)') : '',
+        time(u.registerTime),
+        locked.has(u.username) ? button('Unlock', () => api('POST', '/api/unlockUser', {username: u.username})) : '',
+    ]);
+    const ret = [h('h2', {}, 'Users'), table(['Username', 'Role', 'Share', 'Email', 'Registered', 'Lockout'], rows)];
+    if (selectedUser && users.some(u => u.username === selectedUser)) {
+        ret.push(await renderUserDetails(selectedUser));
+    }
+    return ret;
+}
+
+// shareCell toggles sharing of members and guests, which is granted by the member role.
+function shareCell(u) {
+    if (u.role === 'member') {
+        return ['yes ', button('Disallow', () => api('POST', '/api/disallowShare', {username: u.username}))];
+    }
+    if (u.role === 'guest') {
+        return ['no ', button('Allow', () => api('POST', '/api/allowShare', {username: u.username}))];
+    }
+    return u.allowShare ? 'yes' : 'no';
+}
+
+async function renderUserDetails(name) {
+    const d = await api('GET', `/api/v2/users/${encodeURIComponent(name)}/details`);
+    return h('div', {class: 'panel'},
+        h('h3', {}, d.username),
+        table(['', ''], [
+            ['Role', d.role],
+            ['Groups', (d.groups || []).join(', ') || 'none'],
+            ['Invite code', d.inviteCode || 'none'],
+            ['Last login', time(d.lastLogin)],
+            ['Password change required', d.mustChangePassword ? 'yes' : 'no'],
+            ['TOTP', d.totpEnabled ? ['enabled ', button('Reset', () => api('POST', '/api/resetTotp', {username: name}), true)] : 'disabled'],
+            ['Linked identities', (d.identities || []).map(i => `${i.issuer} ${i.subject}`).join(', ') || 'none'],
+        ]),
+        h('h4', {}, 'Tokens'), tokenTable(d.tokens || []),
+        h('h4', {}, 'Sessions'), sessionTable(d.sessions || []),
+        button('Delete user', async () => {
+            if (confirm(`Delete ${name} with all tokens and sessions?`)) {
+                await api('DELETE', `/api/v2/users/${encodeURIComponent(name)}`);
+                selectedUser = '';
+            }
+        }, true));
+}
+
+function tokenTable(tokens) {
+    return table(['Id', 'Issued', 'Expires', 'Catalogs', 'Note', ''], tokens.map(t => [
+        h('code', {}, t.id), time(t.issueTime), time(t.expire),
+        (t.catalogs && t.catalogs.length ? t.catalogs.join(', ') : 'all') + (t.coverOnly ? ' (covers only)' : ''), t.note,
+        button('Revoke', () => api('POST', '/api/revokeToken', {id: t.id}), true),
+    ]));
+}
+
+function sessionTable(sessions) {
+    return table(['User', 'Expires', ''], sessions.map(s => [
+        s.username + (s.current ? ' (this session)' : ''), time(s.expire),
+        button('Log out', () => api('DELETE', `/api/v2/sessions/${s.id}`), true),
+    ]));
+}
+
+async function renderRoles() {
+    const [roles, perms] = await Promise.all([api('POST', '/api/listRoles'), api('POST', '/api/listPermissions')]);
+    const rows = roles.map(r => ({...r, permissions: r.permissions || []})).map(r => [
+        r.name,
+        h('span', {}, perms.map(p => h('label', {},
+            h('input', {
+                type: 'checkbox', checked: r.permissions.includes(p), disabled: r.builtin,
+                onchange: e => run(() => {
+                    const next = e.target.checked ? [...r.permissions, p] : r.permissions.filter(x => x !== p);
+                    return api('POST', '/api/setRolePermissions', {name: r.name, permissions: next.join(',')});
+                }),
+            }), p + ' '))),
+        r.builtin ? 'built-in' : button('Delete', () => api('POST', '/api/deleteRole', {name: r.name}), true),
+    ]);
+    const form = h('form', {}, h('input', {name: 'name', placeholder: 'New role', required: true}), h('button', {}, 'Create'));
+    form.addEventListener('submit', e => {
+        e.preventDefault();
+        run(() => api('POST', '/api/createRole', {name: formValues(form).name, permissions: ''}));
+    });
+    return [h('h2', {}, 'Roles'), table(['Role', 'Permissions', ''], rows), form];
+}
+
+let selectedCode = '';
+
+async function renderInvites() {
+    const [codes, roles] = await Promise.all([api('GET', '/api/v2/invite-codes'), api('POST', '/api/listRoles')]);
+    const rows = codes.map(c => [
+        h('a', {href: '#invites', onclick: () => run(() => selectedCode = c.code)}, h('code', {}, c.code)),
+        `${c.redeemed} / ${c.limit < 0 ? '∞' : c.limit}`, c.role || 'guest', (c.groups || []).join(', '), c.creator,
+        time(c.createTime), time(c.expire), c.note,
+        button('Revoke', () => api('DELETE', `/api/v2/invite-codes/${encodeURIComponent(c.code)}`), true),
+    ]);
+    const form = h('form', {},
+        h('input', {name: 'limit', type: 'number', min: -1, value: 1, title: 'Registrations, -1 for unlimited'}),
+        h('input', {name: 'expireHours', type: 'number', min: 0, value: 0, title: 'Hours until it expires, 0 for never'}),
+        h('select', {name: 'role'}, h('option', {value: ''}, 'guest'), roles.filter(r => r.name !== 'guest').map(r => h('option', {value: r.name}, r.name))),
+        h('input', {name: 'groups', placeholder: 'Groups, comma separated'}),
+        h('input', {name: 'note', placeholder: 'Note'}),
+        h('button', {}, 'Create'));
+    form.addEventListener('submit', e => {
+        e.preventDefault();
+        const v = formValues(form);
+        run(() => api('POST', '/api/v2/invite-codes', {
+            limit: Number(v.limit), expireHours: Number(v.expireHours), role: v.role, note: v.note,
+            groups: v.groups.split(',').map(g => g.trim()).filter(g => g),
+        }));
+    });
+    const ret = [h('h2', {}, 'Invite codes'), form,
+        table(['Code', 'Used', 'Role', 'Groups', 'Creator', 'Created', 'Expires', 'Note', ''], rows)];
+    if (selectedCode && codes.some(c => c.code === selectedCode)) {
+        const used = await api('GET', `/api/v2/invite-codes/${encodeURIComponent(selectedCode)}/redemptions`);
+        ret.push(h('div', {class: 'panel'}, h('h3', {}, 'Registered with ', h('code', {}, selectedCode)),
+            table(['User', 'Registered'], used.map(r => [r.username, time(r.time)]))));
+    }
+    return ret;
+}
+
+let tokenUser = '';
+
+async function renderTokens() {
+    const form = h('form', {}, h('input', {name: 'username', placeholder: 'Username', value: tokenUser, required: true}), h('button', {}, 'Show'));
+    form.addEventListener('submit', e => {
+        e.preventDefault();
+        run(() => tokenUser = formValues(form).username);
+    });
+    const ret = [h('h2', {}, 'Tokens'), form];
+    if (tokenUser) {
+        ret.push(tokenTable(await api('POST', '/api/listTokens', {username: tokenUser})));
+    }
+    return ret;
+}
+
+async function renderSessions() {
+    return [h('h2', {}, 'Active sessions'), sessionTable(await api('GET', '/api/v2/sessions'))];
+}
+
+async function renderBackends() {
+    const backends = await api('GET', '/api/v2/backends');
+    const rows = backends.map(b => [
+        b.name, b.catalogs, b.latencyMs + ' ms', b.calls,
+        h('span', {class: b.errors ? 'bad' : null}, b.errors),
+        b.lastError ? `${time(b.lastErrorTime)}: ${b.lastError}` : '',
+    ]);
+    return [h('h2', {}, 'Backends'),
+        table(['Backend', 'Catalogs', 'Listed in', 'Calls', 'Errors', 'Last error'], rows),
+        button('Reload config', async () => {
+            const res = await api('POST', '/api/reloadConfig');
+            if (res.restartRequired.length) {
+                alert('Restart to apply: ' + res.restartRequired.join(', '));
+            }
+        })];
+}
+
+let downloadDays = 30;
+
+async function renderDownloads() {
+    const stats = await api('GET', `/api/v2/downloads?days=${downloadDays}`);
+    const max = Math.max(1, ...stats.daily.map(d => d.count));
+    const select = h('select', {onchange: e => run(() => downloadDays = Number(e.target.value))},
+        [7, 30, 90, 365].map(n => h('option', {value: n, selected: n === downloadDays}, `Last ${n} days`)));
+    return [h('h2', {}, 'Downloads'), select,
+        h('p', {}, `${stats.total} tracks streamed`),
+        h('div', {class: 'bars'}, stats.daily.map(d =>
+            h('div', {style: `height: ${100 * d.count / max}%`, title: `${d.key}: ${d.count}`}))),
+        h('h3', {}, 'Top users'), table(['User', 'Tracks'], stats.users.map(u => [u.key, u.count])),
+        h('h3', {}, 'Top catalogs'), table(['Catalog', 'Tracks'], stats.catalogs.map(c => [c.key, c.count]))];
+}
+
+window.addEventListener('hashchange', () => run(async () => null));
+start();
@@ -0,0 +1,35 @@
+// Package web bundles the built front-end into the binary.
+package web
+
+import (
+	"embed"
+	"io/fs"
+)
+
+// The front-end build copied into dist, a placeholder page unless it was built before the binary
+//
+//go:embed dist
+var dist embed.FS
+
+// The admin console, which needs no build step
+//
+//go:embed admin
+var admin embed.FS
+
+// FS returns the bundled front-end, with index.html at its root.
+func FS() fs.FS {
+	return sub(dist, "dist")
+}
+
+// Admin returns the admin console, with index.html at its root.
+func Admin() fs.FS {
+	return sub(admin, "admin")
+}
+
+func sub(files embed.FS, dir string) fs.FS {
+	ret, err := fs.Sub(files, dir)
+	if err != nil {
+		panic(err)
+	}
+	return ret
+}